@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+func (e *env) bindAffinity(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.bindAffinity")
+	defer span.Finish()
+
+	var body models.AffinityRequest
+	if c.Request.ContentLength != 0 {
+		err := c.BindJSON(&body)
+		if err != nil {
+			err = httputil.BadRequestError(fmt.Errorf("failed to parse request body. %w", err))
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			c.Error(err)
+			return
+		}
+	}
+
+	application := c.Param("name")
+	affinity, err := e.affinity.Bind(ctx, application, c.Param("key"), body)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditAffinityBind,
+		Application: application,
+		ServiceID:   affinity.Binding.ServiceID,
+	}, nil, affinity.Binding, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, affinity)
+}
+
+func (e *env) lookupAffinity(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.lookupAffinity")
+	defer span.Finish()
+
+	affinity, err := e.affinity.Lookup(ctx, c.Param("name"), c.Param("key"))
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, affinity)
+}
+
+func (e *env) unbindAffinity(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.unbindAffinity")
+	defer span.Finish()
+
+	application := c.Param("name")
+	err := e.affinity.Unbind(ctx, application, c.Param("key"))
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditAffinityUnbind,
+		Application: application,
+	}, nil, nil, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	httputil.SendOK(c)
+}
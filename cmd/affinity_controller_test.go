@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/CzarSimon/httputil/client/rpc"
+	"github.com/CzarSimon/httputil/jwt"
+	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAffinity(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	repo := repository.NewAffinityRepository(e.db)
+	server := newServer(e)
+
+	services := make(map[string]models.Service)
+	for i := 0; i < 3; i++ {
+		req := createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, dto.Service{
+			Application: "signalling",
+			Location:    fmt.Sprintf("ip-%d", i),
+			Port:        8080,
+			Status:      dto.StatusHealty,
+		})
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var svc models.Service
+		err := rpc.DecodeJSON(res.Result(), &svc)
+		assert.NoError(err)
+		services[svc.ID] = svc
+	}
+
+	bind := func(key string, body interface{}) models.Affinity {
+		req := createTestRequest("/v1/applications/signalling/affinity/"+key, http.MethodPut, jwt.SystemRole, body)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var affinity models.Affinity
+		err := rpc.DecodeJSON(res.Result(), &affinity)
+		assert.NoError(err)
+		return affinity
+	}
+	lookup := func(key string) models.Affinity {
+		req := createTestRequest("/v1/applications/signalling/affinity/"+key, http.MethodGet, jwt.SystemRole, nil)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var affinity models.Affinity
+		err := rpc.DecodeJSON(res.Result(), &affinity)
+		assert.NoError(err)
+		return affinity
+	}
+
+	bound := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("room-%d", i)
+		affinity := bind(key, nil)
+		assert.False(affinity.Rebound)
+		assert.Equal(affinity.Binding.ServiceID, affinity.Service.ID)
+		assert.True(affinity.Binding.ExpiresAt.After(time.Now().Add(9 * time.Minute)))
+		bound[key] = affinity.Service.ID
+	}
+	assert.Len(distinct(bound), 3)
+
+	// Lookups and repeated binds stick to the bound instance.
+	affinity := lookup("room-0")
+	assert.Equal(bound["room-0"], affinity.Service.ID)
+	assert.False(affinity.Rebound)
+	affinity = bind("room-0", models.AffinityRequest{TTLSeconds: 60})
+	assert.Equal(bound["room-0"], affinity.Service.ID)
+
+	var other string
+	for id := range services {
+		if id != bound["room-0"] {
+			other = id
+		}
+	}
+	affinity = bind("room-0", models.AffinityRequest{ServiceID: other})
+	assert.Equal(other, affinity.Service.ID)
+	assert.True(affinity.Rebound)
+	bound["room-0"] = other
+
+	invalidBinds := []struct {
+		key            string
+		body           models.AffinityRequest
+		expectedStatus int
+	}{
+		{key: "room-0", body: models.AffinityRequest{ServiceID: "missing-id"}, expectedStatus: http.StatusUnprocessableEntity},
+		{key: "room-0", body: models.AffinityRequest{TTLSeconds: -1}, expectedStatus: http.StatusBadRequest},
+		{key: "room-0", body: models.AffinityRequest{TTLSeconds: 90000}, expectedStatus: http.StatusBadRequest},
+	}
+	for _, tc := range invalidBinds {
+		req := createTestRequest("/v1/applications/signalling/affinity/"+tc.key, http.MethodPut, jwt.SystemRole, tc.body)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(tc.expectedStatus, res.Code)
+	}
+
+	req := createTestRequest("/v1/applications/other-app/affinity/room-0", http.MethodPut, jwt.SystemRole, nil)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusServiceUnavailable, res.Code)
+
+	req = createTestRequest("/v1/applications/signalling/affinity/missing-room", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+
+	// Draining an instance migrates its bindings, other bindings stay where they are.
+	drained := services[bound["room-1"]]
+	route := fmt.Sprintf("/v1/services/%s/status/UNHEALTHY?epoch=%d", drained.ID, drained.Epoch)
+	req = createTestRequest(route, http.MethodPut, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	for key, serviceID := range bound {
+		binding, err := repo.Find(ctx, "signalling", key)
+		assert.NoError(err)
+		if serviceID == drained.ID {
+			assert.NotEqual(drained.ID, binding.ServiceID, key)
+		} else {
+			assert.Equal(serviceID, binding.ServiceID, key)
+		}
+		bound[key] = binding.ServiceID
+	}
+	assert.Len(distinct(bound), 2)
+
+	// Deregistering an instance migrates its bindings to the last available instance.
+	deregistered := bound["room-1"]
+	req = createTestRequest("/v1/services/"+deregistered, http.MethodDelete, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	for key := range bound {
+		affinity = lookup(key)
+		assert.False(affinity.Rebound, key)
+		assert.NotEqual(drained.ID, affinity.Service.ID)
+		assert.NotEqual(deregistered, affinity.Service.ID)
+		bound[key] = affinity.Service.ID
+	}
+	assert.Len(distinct(bound), 1)
+
+	// Bindings to instances that disappeared without notice are rebound on lookup.
+	binding, err := repo.Find(ctx, "signalling", "room-2")
+	assert.NoError(err)
+	binding.ServiceID = "vanished-id"
+	_, err = repo.Save(ctx, binding)
+	assert.NoError(err)
+
+	affinity = lookup("room-2")
+	assert.True(affinity.Rebound)
+	assert.Equal(bound["room-2"], affinity.Service.ID)
+	assert.Equal(binding.ExpiresAt.Unix(), affinity.Binding.ExpiresAt.Unix())
+
+	// Expired bindings are not returned and are removed by the cleanup worker.
+	binding.ExpiresAt = time.Now().Add(-time.Second)
+	_, err = repo.Save(ctx, binding)
+	assert.NoError(err)
+
+	req = createTestRequest("/v1/applications/signalling/affinity/room-2", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+
+	newCleanupWorker(e.allocations, e.affinity, nil, time.Hour).cleanup()
+	_, err = repo.Find(ctx, "signalling", "room-2")
+	assert.Equal(sql.ErrNoRows, err)
+
+	req = createTestRequest("/v1/applications/signalling/affinity/room-3", http.MethodDelete, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	req = createTestRequest("/v1/applications/signalling/affinity/room-3", http.MethodDelete, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+}
+
+func TestAffinity_DrainOnStatusTransition(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+
+	var drained []string
+	e.registry.OnUnavailable(func(ctx context.Context, svc models.Service) {
+		drained = append(drained, svc.ID)
+	})
+
+	svc, err := e.registry.Register(ctx, models.Service{Service: dto.Service{Application: "signalling", Location: "ip-0", Port: 8080}})
+	assert.NoError(err)
+
+	// Repeated reports of an unhealthy status do not drain the instance again.
+	for i := 0; i < 3; i++ {
+		_, err = e.registry.SetStatus(ctx, svc.ID, dto.StatusUnhealthy, svc.Epoch, 0)
+		assert.NoError(err)
+	}
+	assert.Equal([]string{svc.ID}, drained)
+
+	_, err = e.registry.SetStatus(ctx, svc.ID, dto.StatusHealty, svc.Epoch, 0)
+	assert.NoError(err)
+	assert.Len(drained, 1)
+	_, err = e.registry.SetStatus(ctx, svc.ID, dto.StatusUnhealthy, svc.Epoch, 0)
+	assert.NoError(err)
+	assert.Equal([]string{svc.ID, svc.ID}, drained)
+}
+
+func distinct(bound map[string]string) map[string]bool {
+	values := make(map[string]bool)
+	for _, value := range bound {
+		values[value] = true
+	}
+	return values
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+// findAlerts lists the alert of every rule, e.g. ?state=FIRING&application=media-server.
+func (e *env) findAlerts(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.findAlerts")
+	defer span.Finish()
+
+	state := models.AlertState(c.Query("state"))
+	alerts, err := e.alerts.FindAlerts(ctx, c.Query("application"), state)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, alerts)
+}
+
+func (e *env) createAlertRule(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.createAlertRule")
+	defer span.Finish()
+
+	var body models.AlertRule
+	err := c.BindJSON(&body)
+	if err != nil {
+		err = httputil.BadRequestError(fmt.Errorf("failed to parse request body. %w", err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	rule, err := e.alerts.CreateRule(ctx, body)
+	e.recordAudit(ctx, c, models.AuditEntry{Action: auditAlertRuleCreate, Application: body.Application}, nil, rule, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, rule)
+}
+
+func (e *env) findAlertRule(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.findAlertRule")
+	defer span.Finish()
+
+	rule, err := e.alerts.FindRule(ctx, c.Param("id"))
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, rule)
+}
+
+func (e *env) deleteAlertRule(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.deleteAlertRule")
+	defer span.Finish()
+
+	id := c.Param("id")
+	before, _ := e.alerts.FindRule(ctx, id)
+	err := e.alerts.DeleteRule(ctx, id)
+	e.recordAudit(ctx, c, models.AuditEntry{Action: auditAlertRuleDelete, Application: before.Application}, before, nil, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	httputil.SendOK(c)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/CzarSimon/httputil/client/rpc"
+	"github.com/CzarSimon/httputil/jwt"
+	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+	"github.com/rtcheap/service-registry/internal/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlerts(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	server := newServer(e)
+
+	receiver := newTestReceiver(http.StatusOK)
+	defer receiver.server.Close()
+	createTestWebhook(t, server.Handler, models.Webhook{
+		URL:        receiver.server.URL,
+		EventTypes: []models.EventType{models.EventAlertFiring, models.EventAlertResolved},
+	})
+
+	invalid := []models.AlertRule{
+		{Application: "media-server", Condition: models.AlertHealthyBelow, Threshold: 2},
+		{Name: "too-few", Condition: models.AlertHealthyBelow, Threshold: 2},
+		{Name: "too-few", Application: "media-server", Condition: "sometimes", Threshold: 2},
+		{Name: "too-many", Application: "media-server", Condition: models.AlertUnhealthyAbove, Threshold: 150},
+		{Name: "too-few", Application: "media-server", Condition: models.AlertHealthyBelow, Threshold: 2, ForSeconds: -1},
+	}
+	for _, rule := range invalid {
+		req := createTestRequest("/v1/alerts/rules", http.MethodPost, jwt.SystemRole, rule)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusBadRequest, res.Code)
+	}
+
+	tooFew := createTestAlertRule(t, server.Handler, models.AlertRule{
+		Name:        "too-few-healthy",
+		Application: "media-server",
+		Condition:   models.AlertHealthyBelow,
+		Threshold:   2,
+	})
+	assert.NotEmpty(tooFew.ID)
+	tooMany := createTestAlertRule(t, server.Handler, models.AlertRule{
+		Name:        "too-many-unhealthy",
+		Application: "media-server",
+		Condition:   models.AlertUnhealthyAbove,
+		Threshold:   40,
+		ForSeconds:  3600,
+	})
+	silent := createTestAlertRule(t, server.Handler, models.AlertRule{
+		Name:        "silent",
+		Application: "ghost-app",
+		Condition:   models.AlertNoHeartbeat,
+		Threshold:   60,
+	})
+
+	alerts := findTestAlerts(t, server.Handler, "", http.StatusOK)
+	assert.Len(alerts, 3)
+	for _, alert := range alerts {
+		assert.Equal(models.AlertInactive, alert.State)
+	}
+
+	svc, err := e.registry.Register(ctx, models.Service{Service: dto.Service{Application: "media-server", Location: "ip-0", Port: 8080}})
+	assert.NoError(err)
+	_, err = e.registry.Register(ctx, models.Service{Service: dto.Service{Application: "media-server", Location: "ip-1", Port: 8080}})
+	assert.NoError(err)
+
+	// An application without instances has never sent a heartbeat.
+	_, err = e.alerts.Evaluate(ctx)
+	assert.NoError(err)
+	firing := findTestAlerts(t, server.Handler, "?state=FIRING", http.StatusOK)
+	assert.Len(firing, 1)
+	assert.Equal(silent.ID, firing[0].Rule.ID)
+	assert.Nil(firing[0].Value)
+	assert.Equal("no instance of ghost-app has sent a heartbeat", firing[0].Summary)
+
+	// Rules with a duration are pending until the condition has held for it.
+	svc, err = e.registry.SetStatus(ctx, svc.ID, dto.StatusUnhealthy, svc.Epoch, 0)
+	assert.NoError(err)
+	_, err = e.alerts.Evaluate(ctx)
+	assert.NoError(err)
+
+	firing = findTestAlerts(t, server.Handler, "?state=FIRING&application=media-server", http.StatusOK)
+	assert.Len(firing, 1)
+	assert.Equal(tooFew.ID, firing[0].Rule.ID)
+	assert.Equal(1.0, *firing[0].Value)
+	assert.NotNil(firing[0].FiredAt)
+
+	pending := findTestAlerts(t, server.Handler, "?state=PENDING", http.StatusOK)
+	assert.Len(pending, 1)
+	assert.Equal(tooMany.ID, pending[0].Rule.ID)
+	assert.Equal(50.0, *pending[0].Value)
+	assert.NotNil(pending[0].ActiveSince)
+	assert.Nil(pending[0].FiredAt)
+	findTestAlerts(t, server.Handler, "?state=LOUD", http.StatusBadRequest)
+
+	// Alerts are resolved once the condition no longer holds.
+	_, err = e.registry.SetStatus(ctx, svc.ID, dto.StatusHealty, svc.Epoch, 0)
+	assert.NoError(err)
+	_, err = e.alerts.Evaluate(ctx)
+	assert.NoError(err)
+
+	resolved := findTestAlerts(t, server.Handler, "?state=RESOLVED", http.StatusOK)
+	assert.Len(resolved, 1)
+	assert.Equal(tooFew.ID, resolved[0].Rule.ID)
+	assert.NotNil(resolved[0].ResolvedAt)
+	inactive := findTestAlerts(t, server.Handler, "?state=INACTIVE", http.StatusOK)
+	assert.Len(inactive, 1)
+	assert.Equal(tooMany.ID, inactive[0].Rule.ID)
+	assert.Nil(inactive[0].ActiveSince)
+
+	// Alerts are only saved again once their state changes.
+	_, err = e.alerts.Evaluate(ctx)
+	assert.NoError(err)
+	unchanged := findTestAlerts(t, server.Handler, "?state=RESOLVED", http.StatusOK)
+	assert.Len(unchanged, 1)
+	assert.True(resolved[0].EvaluatedAt.Equal(unchanged[0].EvaluatedAt))
+
+	// Fired and resolved alerts are sent to the webhooks subscribed to them.
+	delivered, err := e.webhooks.Deliver(ctx)
+	assert.NoError(err)
+	assert.Equal(3, delivered)
+
+	expected := []struct {
+		eventType models.EventType
+		ruleID    string
+	}{
+		{eventType: models.EventAlertFiring, ruleID: silent.ID},
+		{eventType: models.EventAlertFiring, ruleID: tooFew.ID},
+		{eventType: models.EventAlertResolved, ruleID: tooFew.ID},
+	}
+	received := receiver.received()
+	assert.Len(received, 3)
+	for i, r := range received {
+		var event models.Event
+		err = json.Unmarshal(r.body, &event)
+		assert.NoError(err)
+		assert.Equal(expected[i].eventType, event.Type)
+		assert.Equal(expected[i].ruleID, event.Alert.Rule.ID)
+		assert.Equal(event.Alert.Rule.Application, event.Application)
+		assert.Nil(event.Service)
+	}
+
+	req := createTestRequest("/v1/alerts/rules/"+tooFew.ID, http.MethodGet, jwt.SystemRole, nil)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	var rule models.AlertRule
+	err = rpc.DecodeJSON(res.Result(), &rule)
+	assert.NoError(err)
+	assert.Equal(tooFew.Name, rule.Name)
+	assert.Equal(tooFew.Threshold, rule.Threshold)
+
+	req = createTestRequest("/v1/alerts/rules/"+tooFew.ID, http.MethodDelete, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+	req = createTestRequest("/v1/alerts/rules/"+tooFew.ID, http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+	assert.Len(findTestAlerts(t, server.Handler, "", http.StatusOK), 2)
+
+	actions := make(map[string]int)
+	for _, entry := range findTestAuditEntries(t, server.Handler, "limit=1000") {
+		actions[entry.Action]++
+	}
+	assert.Equal(8, actions[auditAlertRuleCreate])
+	assert.Equal(2, actions[auditAlertRuleDelete])
+}
+
+func TestAlerts_ExpiredInstances(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	server := newServer(e)
+
+	_, err := e.apps.Create(ctx, models.Application{
+		Name:               "media-server",
+		Team:               "platform",
+		Contact:            "platform@example.com",
+		InstanceTTLSeconds: 60,
+	})
+	assert.NoError(err)
+	tooFew := createTestAlertRule(t, server.Handler, models.AlertRule{
+		Name:        "too-few-healthy",
+		Application: "media-server",
+		Condition:   models.AlertHealthyBelow,
+		Threshold:   1,
+	})
+	tooMany := createTestAlertRule(t, server.Handler, models.AlertRule{
+		Name:        "too-many-unhealthy",
+		Application: "media-server",
+		Condition:   models.AlertUnhealthyAbove,
+		Threshold:   50,
+	})
+
+	for _, location := range []string{"ip-0", "ip-1"} {
+		_, err = e.registry.Register(ctx, models.Service{Service: dto.Service{Application: "media-server", Location: location, Port: 8080}})
+		assert.NoError(err)
+	}
+	_, err = e.alerts.Evaluate(ctx)
+	assert.NoError(err)
+	assert.Empty(findTestAlerts(t, server.Handler, "?state=FIRING", http.StatusOK))
+
+	// Instances that stopped sending heartbeats are not healthy, whatever their last reported status.
+	_, err = e.db.Exec("UPDATE service SET heartbeat_at = ? WHERE application = ?", time.Now().UTC().Add(-time.Hour), "media-server")
+	assert.NoError(err)
+	_, err = e.alerts.Evaluate(ctx)
+	assert.NoError(err)
+
+	firing := findTestAlerts(t, server.Handler, "?state=FIRING", http.StatusOK)
+	assert.Len(firing, 2)
+	values := make(map[string]float64)
+	for _, alert := range firing {
+		values[alert.Rule.ID] = *alert.Value
+	}
+	assert.Equal(map[string]float64{tooFew.ID: 0, tooMany.ID: 100}, values)
+}
+
+func TestAlerts_EvaluatedByReplicas(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	server := newServer(e)
+
+	rule := createTestAlertRule(t, server.Handler, models.AlertRule{
+		Name:        "silent",
+		Application: "ghost-app",
+		Condition:   models.AlertNoHeartbeat,
+		Threshold:   60,
+	})
+
+	// Both replicas evaluate the rule from the same state, only the first to save it notifies.
+	repo := repository.NewAlertRepository(e.db)
+	snapshot, err := repo.FindAlerts(ctx)
+	assert.NoError(err)
+	first := &testNotifier{}
+	second := &testNotifier{}
+	replicas := []*service.AlertService{
+		service.NewAlertService(&testAlertRepo{AlertRepository: repo, snapshot: snapshot}, e.registry, first),
+		service.NewAlertService(&testAlertRepo{AlertRepository: repo, snapshot: snapshot}, e.registry, second),
+	}
+	for _, replica := range replicas {
+		_, err = replica.Evaluate(ctx)
+		assert.NoError(err)
+	}
+	assert.Len(first.alerts, 1)
+	assert.Empty(second.alerts)
+
+	firing := findTestAlerts(t, server.Handler, "?state=FIRING", http.StatusOK)
+	assert.Len(firing, 1)
+	assert.Equal(rule.ID, firing[0].Rule.ID)
+
+	saved, err := repo.SaveAlert(ctx, firing[0], models.AlertInactive)
+	assert.NoError(err)
+	assert.False(saved)
+
+	_, err = e.registry.Register(ctx, models.Service{Service: dto.Service{Application: "ghost-app", Location: "ip-0", Port: 8080}})
+	assert.NoError(err)
+	snapshot, err = repo.FindAlerts(ctx)
+	assert.NoError(err)
+	for i, replica := range []*service.AlertService{
+		service.NewAlertService(&testAlertRepo{AlertRepository: repo, snapshot: snapshot}, e.registry, second),
+		service.NewAlertService(&testAlertRepo{AlertRepository: repo, snapshot: snapshot}, e.registry, first),
+	} {
+		alerts, err := replica.Evaluate(ctx)
+		assert.NoError(err)
+		assert.Equal([]models.AlertState{models.AlertResolved, models.AlertFiring}[i], alerts[0].State)
+	}
+	assert.Len(first.alerts, 1)
+	assert.Len(second.alerts, 1)
+	assert.Equal(models.AlertResolved, second.alerts[0].State)
+}
+
+// testAlertRepo alert repository returning a snapshot of the alerts, as if read before another replica saved them.
+type testAlertRepo struct {
+	repository.AlertRepository
+	snapshot []models.Alert
+}
+
+func (r *testAlertRepo) FindAlerts(ctx context.Context) ([]models.Alert, error) {
+	alerts := make([]models.Alert, len(r.snapshot))
+	copy(alerts, r.snapshot)
+	return alerts, nil
+}
+
+type testNotifier struct {
+	alerts []models.Alert
+}
+
+func (n *testNotifier) Notify(ctx context.Context, alert models.Alert) error {
+	n.alerts = append(n.alerts, alert)
+	return nil
+}
+
+func createTestAlertRule(t *testing.T, handler http.Handler, rule models.AlertRule) models.AlertRule {
+	req := createTestRequest("/v1/alerts/rules", http.MethodPost, jwt.SystemRole, rule)
+	res := performTestRequest(handler, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	var created models.AlertRule
+	err := rpc.DecodeJSON(res.Result(), &created)
+	assert.NoError(t, err)
+	return created
+}
+
+func findTestAlerts(t *testing.T, handler http.Handler, query string, expectedStatus int) []models.Alert {
+	req := createTestRequest("/v1/alerts"+query, http.MethodGet, jwt.SystemRole, nil)
+	res := performTestRequest(handler, req)
+	assert.Equal(t, expectedStatus, res.Code)
+
+	var alerts []models.Alert
+	if expectedStatus == http.StatusOK {
+		err := rpc.DecodeJSON(res.Result(), &alerts)
+		assert.NoError(t, err)
+	}
+	return alerts
+}
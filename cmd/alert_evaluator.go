@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rtcheap/service-registry/internal/service"
+	"go.uber.org/zap"
+)
+
+// alertEvaluator periodically evaluates the alert rules.
+type alertEvaluator struct {
+	*periodicWorker
+	alerts *service.AlertService
+}
+
+func newAlertEvaluator(alerts *service.AlertService, interval time.Duration) *alertEvaluator {
+	w := &alertEvaluator{alerts: alerts}
+	w.periodicWorker = newPeriodicWorker(interval, w.evaluate)
+	return w
+}
+
+func (w *alertEvaluator) evaluate() {
+	_, err := w.alerts.Evaluate(context.Background())
+	if err != nil {
+		log.Error("failed to evaluate alert rules", zap.Error(err))
+	}
+}
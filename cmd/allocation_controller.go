@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+)
+
+func (e *env) setCapacity(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.setCapacity")
+	defer span.Finish()
+
+	epoch, err := parseEpoch(c)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	var body models.Capacity
+	err = c.BindJSON(&body)
+	if err != nil {
+		err = httputil.BadRequestError(fmt.Errorf("failed to parse request body. %w", err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	id := c.Param("id")
+	before, _ := e.registry.Find(ctx, id)
+	capacity, err := e.allocations.SetCapacity(ctx, id, epoch, body)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditSetCapacity,
+		Application: before.Application,
+		ServiceID:   id,
+	}, optionalCapacity(before.Capacity), capacity, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, capacity)
+}
+
+func (e *env) allocateSession(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.allocateSession")
+	defer span.Finish()
+
+	var body models.AllocationRequest
+	if c.Request.ContentLength != 0 {
+		err := c.BindJSON(&body)
+		if err != nil {
+			err = httputil.BadRequestError(fmt.Errorf("failed to parse request body. %w", err))
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			c.Error(err)
+			return
+		}
+	}
+
+	application := c.Param("name")
+	allocation, err := e.allocateRouted(ctx, c, application, body)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditAllocate,
+		Application: application,
+		ServiceID:   allocation.Reservation.ServiceID,
+	}, nil, allocation.Reservation, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, allocation)
+}
+
+// allocateRouted allocates a session in the subset the request is routed to, falling back to
+// every instance matching the request if the subset has no remaining capacity.
+func (e *env) allocateRouted(ctx context.Context, c *gin.Context, application string, req models.AllocationRequest) (models.Allocation, error) {
+	subset, routed, err := e.routes.Route(ctx, application, newRouteRequest(c, req.RouteKey))
+	if err != nil {
+		return models.Allocation{}, err
+	}
+
+	if routed {
+		routedReq := req
+		routedReq.ServiceFilter = req.ServiceFilter.WithLabels(subset.Labels)
+		allocation, err := e.allocations.Allocate(ctx, application, routedReq)
+		if !errors.Is(err, repository.ErrNoCapacity) {
+			return allocation, err
+		}
+	}
+
+	return e.allocations.Allocate(ctx, application, req)
+}
+
+func (e *env) releaseReservation(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.releaseReservation")
+	defer span.Finish()
+
+	reservation, err := e.allocations.Release(ctx, c.Param("id"))
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditRelease,
+		Application: reservation.Application,
+		ServiceID:   reservation.ServiceID,
+	}, reservation, nil, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	httputil.SendOK(c)
+}
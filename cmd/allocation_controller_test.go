@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/CzarSimon/httputil/client/rpc"
+	"github.com/CzarSimon/httputil/jwt"
+	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllocateSession(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	repo := repository.NewServiceRepository(e.db)
+	server := newServer(e)
+
+	services := make([]models.Service, 0, 3)
+	for i, status := range []dto.ServiceStatus{dto.StatusHealty, dto.StatusHealty, dto.StatusUnhealthy} {
+		req := createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, dto.Service{
+			Application: "media-server",
+			Location:    fmt.Sprintf("ip-%d", i),
+			Port:        8080,
+			Status:      status,
+		})
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var svc models.Service
+		err := rpc.DecodeJSON(res.Result(), &svc)
+		assert.NoError(err)
+		services = append(services, svc)
+	}
+
+	// Capacity reports require the epoch of the instance.
+	req := createTestRequest("/v1/services/"+services[0].ID+"/capacity", http.MethodPut, jwt.SystemRole, models.Capacity{MaxSessions: 4})
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusPreconditionRequired, res.Code)
+
+	route := fmt.Sprintf("/v1/services/%s/capacity?epoch=%d", services[0].ID, services[0].Epoch+1)
+	req = createTestRequest(route, http.MethodPut, jwt.SystemRole, models.Capacity{MaxSessions: 4})
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusConflict, res.Code)
+
+	req = createTestRequest("/v1/services/missing-id/capacity?epoch=1", http.MethodPut, jwt.SystemRole, models.Capacity{MaxSessions: 4})
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+
+	capacities := []models.Capacity{
+		{MaxSessions: 4, ActiveSessions: 2},
+		{MaxSessions: 2, ActiveSessions: 0},
+		{MaxSessions: 10, ActiveSessions: 0},
+	}
+	for i, capacity := range capacities {
+		route := fmt.Sprintf("/v1/services/%s/capacity?epoch=%d", services[i].ID, services[i].Epoch)
+		req = createTestRequest(route, http.MethodPut, jwt.SystemRole, capacity)
+		res = performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+	}
+
+	// Least utilized healthy instance first, ties broken by the fewest sessions:
+	// ip-1 (0/2), ip-1 (1/2 before 2/4), ip-0 (2/4), ip-0 (3/4).
+	expected := []string{services[1].ID, services[1].ID, services[0].ID, services[0].ID}
+	reservations := make([]models.Reservation, 0, len(expected))
+	for _, serviceID := range expected {
+		req = createTestRequest("/v1/applications/media-server/allocate", http.MethodPost, jwt.SystemRole, models.AllocationRequest{TTLSeconds: 30})
+		res = performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var allocation models.Allocation
+		err := rpc.DecodeJSON(res.Result(), &allocation)
+		assert.NoError(err)
+		assert.Equal(serviceID, allocation.Reservation.ServiceID)
+		assert.Equal(serviceID, allocation.Service.ID)
+		assert.NotEmpty(allocation.Reservation.ID)
+		assert.True(allocation.Reservation.ExpiresAt.After(time.Now().Add(20 * time.Second)))
+		reservations = append(reservations, allocation.Reservation)
+	}
+
+	req = createTestRequest("/v1/applications/media-server/allocate", http.MethodPost, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusServiceUnavailable, res.Code)
+
+	req = createTestRequest("/v1/applications/media-server/allocate", http.MethodPost, jwt.SystemRole, models.AllocationRequest{TTLSeconds: 7200})
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusBadRequest, res.Code)
+
+	// Releasing a reservation frees its slot.
+	req = createTestRequest("/v1/reservations/"+reservations[0].ID, http.MethodDelete, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	req = createTestRequest("/v1/reservations/"+reservations[0].ID, http.MethodDelete, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+
+	stored, err := repo.Find(ctx, services[1].ID)
+	assert.NoError(err)
+	assert.Equal(1, stored.Capacity.ReservedSessions)
+
+	req = createTestRequest("/v1/applications/media-server/allocate", http.MethodPost, jwt.SystemRole, models.AllocationRequest{
+		ServiceFilter: models.ServiceFilter{Location: "ip-1"},
+	})
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	// Reports from the instance keep the reserved slots.
+	route = fmt.Sprintf("/v1/services/%s/capacity?epoch=%d", services[1].ID, services[1].Epoch)
+	req = createTestRequest(route, http.MethodPut, jwt.SystemRole, models.Capacity{MaxSessions: 2, ActiveSessions: 1})
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	var capacity models.Capacity
+	err = rpc.DecodeJSON(res.Result(), &capacity)
+	assert.NoError(err)
+	assert.Equal(2, capacity.ReservedSessions)
+	assert.False(capacity.Available())
+
+	entries := findTestAuditEntries(t, server.Handler, "application=media-server&limit=1000")
+	actions := make(map[string]int)
+	for _, entry := range entries {
+		actions[entry.Action]++
+	}
+	assert.Equal(7, actions[auditAllocate])
+	assert.Equal(1, actions[auditRelease])
+
+	// Capacity reports are audited with the capacity before and after the report.
+	var report models.AuditEntry
+	for _, entry := range findTestAuditEntries(t, server.Handler, "service-id="+services[1].ID) {
+		if entry.Action == auditSetCapacity && entry.Outcome == models.OutcomeSuccess {
+			report = entry
+			break
+		}
+	}
+	var before, after models.Capacity
+	assert.NoError(json.Unmarshal(report.Before, &before))
+	assert.NoError(json.Unmarshal(report.After, &after))
+	assert.Equal(2, before.ReservedSessions)
+	assert.Equal(0, before.ActiveSessions)
+	assert.Equal(1, after.ActiveSessions)
+	assert.Equal(2, after.ReservedSessions)
+}
+
+func TestReclaimExpiredReservations(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	repo := repository.NewServiceRepository(e.db)
+	allocations := repository.NewAllocationRepository(e.db)
+
+	svc, _, err := repo.Save(ctx, models.Service{
+		Service: dto.Service{Application: "media-server", Location: "ip-1", Port: 8080, Status: dto.StatusHealty},
+	}, repository.TakeOver)
+	assert.NoError(err)
+
+	_, err = allocations.SetCapacity(ctx, svc.ID, svc.Epoch, models.Capacity{MaxSessions: 1})
+	assert.NoError(err)
+
+	expired, err := allocations.Allocate(ctx, "media-server", func(models.Service) bool { return true }, time.Now().Add(-time.Second))
+	assert.NoError(err)
+
+	w := newCleanupWorker(e.allocations, e.affinity, nil, time.Hour)
+	w.cleanup()
+
+	stored, err := repo.Find(ctx, svc.ID)
+	assert.NoError(err)
+	assert.Equal(0, stored.Capacity.ReservedSessions)
+
+	_, err = e.allocations.Release(ctx, expired.Reservation.ID)
+	assert.Error(err)
+
+	// Allocation reclaims expired reservations of the application without waiting for the reclaimer.
+	_, err = allocations.Allocate(ctx, "media-server", func(models.Service) bool { return true }, time.Now().Add(-time.Second))
+	assert.NoError(err)
+
+	allocation, err := e.allocations.Allocate(ctx, "media-server", models.AllocationRequest{})
+	assert.NoError(err)
+	assert.Equal(svc.ID, allocation.Service.ID)
+}
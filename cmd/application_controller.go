@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+func (e *env) createApplication(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.createApplication")
+	defer span.Finish()
+
+	var body models.Application
+	err := c.BindJSON(&body)
+	if err != nil {
+		err = httputil.BadRequestError(fmt.Errorf("failed to parse request body. %w", err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	app, err := e.apps.Create(ctx, body)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditApplicationCreate,
+		Application: body.Name,
+	}, nil, app, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, app)
+}
+
+func (e *env) findApplications(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.findApplications")
+	defer span.Finish()
+
+	summaries, err := e.apps.FindAll(ctx)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, summaries)
+}
+
+func (e *env) findApplication(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.findApplication")
+	defer span.Finish()
+
+	summary, err := e.apps.Summarize(ctx, c.Param("name"))
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, summary)
+}
+
+func (e *env) updateApplication(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.updateApplication")
+	defer span.Finish()
+
+	var body models.Application
+	err := c.BindJSON(&body)
+	if err != nil {
+		err = httputil.BadRequestError(fmt.Errorf("failed to parse request body. %w", err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	name := c.Param("name")
+	if body.Name != "" && body.Name != name {
+		err = httputil.BadRequestError(fmt.Errorf("name %s in body does not match %s", body.Name, name))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+	body.Name = name
+
+	before, _ := e.apps.Find(ctx, name)
+	app, err := e.apps.Update(ctx, body)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditApplicationUpdate,
+		Application: name,
+	}, optionalApplication(before), app, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, app)
+}
+
+func (e *env) deleteApplication(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.deleteApplication")
+	defer span.Finish()
+
+	name := c.Param("name")
+	app, err := e.apps.Delete(ctx, name)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditApplicationDelete,
+		Application: name,
+	}, optionalApplication(app), nil, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	httputil.SendOK(c)
+}
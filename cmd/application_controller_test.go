@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/CzarSimon/httputil/client/rpc"
+	"github.com/CzarSimon/httputil/id"
+	"github.com/CzarSimon/httputil/jwt"
+	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplicationCatalog(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	repo := repository.NewServiceRepository(e.db)
+	server := newServer(e)
+
+	app := models.Application{
+		Name:                "test-app",
+		Description:         "Test application",
+		Team:                "platform",
+		Contact:             "platform@rtcheap.com",
+		MinHealthyInstances: 2,
+		ConflictPolicy:      models.ConflictReject,
+	}
+	req := createTestRequest("/v1/applications", http.MethodPost, jwt.SystemRole, app)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	req = createTestRequest("/v1/applications", http.MethodPost, jwt.SystemRole, app)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusConflict, res.Code)
+
+	for _, invalid := range []models.Application{
+		{Name: ""},
+		{Name: "invalid-app", MinHealthyInstances: -1},
+		{Name: "invalid-app", ConflictPolicy: "ignore"},
+	} {
+		req = createTestRequest("/v1/applications", http.MethodPost, jwt.SystemRole, invalid)
+		res = performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusBadRequest, res.Code)
+	}
+
+	services := []dto.Service{
+		{ID: id.New(), Application: "test-app", Location: "ip-1", Port: 8080, Status: dto.StatusHealty},
+		{ID: id.New(), Application: "test-app", Location: "ip-2", Port: 8080, Status: dto.StatusUnhealthy},
+		{ID: id.New(), Application: "other-app", Location: "ip-3", Port: 8080, Status: dto.StatusHealty},
+	}
+	for _, svc := range services {
+		req = createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, svc)
+		res = performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+	}
+
+	// Conflict policy declared in the catalog overrides the deployment default.
+	conflicting := dto.Service{ID: id.New(), Application: "test-app", Location: "ip-1", Port: 8080}
+	req = createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, conflicting)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusConflict, res.Code)
+
+	req = createTestRequest("/v1/applications", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	var summaries []models.ApplicationSummary
+	err := rpc.DecodeJSON(res.Result(), &summaries)
+	assert.NoError(err)
+	assert.Len(summaries, 2)
+
+	assert.Equal("other-app", summaries[0].Name)
+	assert.False(summaries[0].Declared)
+	assert.Equal(1, summaries[0].Instances[dto.StatusHealty])
+
+	assert.Equal("test-app", summaries[1].Name)
+	assert.True(summaries[1].Declared)
+	assert.Equal("platform", summaries[1].Team)
+	assert.Equal(1, summaries[1].Instances[dto.StatusHealty])
+	assert.Equal(1, summaries[1].Instances[dto.StatusUnhealthy])
+	assert.True(summaries[1].BelowMinimum)
+
+	app.Team = "media"
+	app.MinHealthyInstances = 1
+	app.Name = ""
+	req = createTestRequest("/v1/applications/test-app", http.MethodPut, jwt.SystemRole, app)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	req = createTestRequest("/v1/applications/test-app", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	var summary models.ApplicationSummary
+	err = rpc.DecodeJSON(res.Result(), &summary)
+	assert.NoError(err)
+	assert.Equal("media", summary.Team)
+	assert.Equal("Test application", summary.Description)
+	assert.False(summary.BelowMinimum)
+
+	app.Name = "other-name"
+	req = createTestRequest("/v1/applications/test-app", http.MethodPut, jwt.SystemRole, app)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusBadRequest, res.Code)
+
+	app.Name = ""
+	req = createTestRequest("/v1/applications/missing-app", http.MethodPut, jwt.SystemRole, app)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+
+	req = createTestRequest("/v1/applications/missing-app", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+
+	req = createTestRequest("/v1/applications/test-app", http.MethodDelete, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	req = createTestRequest("/v1/applications/test-app", http.MethodDelete, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+
+	// Instances are kept when the declaration is removed.
+	instances, err := repo.FindByApplication(ctx, "test-app")
+	assert.NoError(err)
+	assert.Len(instances, 2)
+
+	entries := findTestAuditEntries(t, server.Handler, "")
+	actions := make([]string, 0)
+	for _, entry := range entries {
+		if entry.Application == "test-app" && strings.HasPrefix(entry.Action, "application.") {
+			actions = append(actions, entry.Action)
+		}
+	}
+	assert.Equal([]string{auditApplicationDelete, auditApplicationDelete, auditApplicationUpdate, auditApplicationCreate, auditApplicationCreate}, actions)
+}
+
+func TestRegister_RequireDeclaredApplications(t *testing.T) {
+	assert := assert.New(t)
+	e, _ := createTestEnv()
+	server := newServer(e)
+	e.registry.SetPolicy(models.RegistrationPolicy{
+		ConflictPolicy:              models.ConflictTakeover,
+		RequireDeclaredApplications: true,
+	})
+
+	svc := dto.Service{Application: "test-app", Location: "ip-1", Port: 8080}
+	req := createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, svc)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusUnprocessableEntity, res.Code)
+
+	req = createTestRequest("/v1/applications", http.MethodPost, jwt.SystemRole, models.Application{Name: "test-app"})
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	req = createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, svc)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	batch := []dto.Service{
+		{Application: "other-app", Location: "ip-2", Port: 8080},
+		{Application: "test-app", Location: "ip-3", Port: 8080},
+		{Application: "other-app", Location: "ip-4", Port: 8080},
+	}
+	req = createTestRequest("/v1/services:batch", http.MethodPost, jwt.SystemRole, batch)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	var body models.BatchResponse
+	err := rpc.DecodeJSON(res.Result(), &body)
+	assert.NoError(err)
+	assert.Equal(1, body.Succeeded)
+	assert.Equal(2, body.Failed)
+	assert.Equal(http.StatusUnprocessableEntity, body.Results[0].Status)
+	assert.Equal(http.StatusOK, body.Results[1].Status)
+	assert.Equal("ip-3", body.Results[1].Service.Location)
+	assert.Equal(http.StatusUnprocessableEntity, body.Results[2].Status)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/CzarSimon/httputil/jwt"
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+	jaeger "github.com/uber/jaeger-client-go"
+	"go.uber.org/zap"
+)
+
+// Audited actions.
+const (
+	auditRegister    = "service.register"
+	auditSetStatus   = "service.setStatus"
+	auditSetCapacity = "service.setCapacity"
+	auditDeregister  = "service.deregister"
+
+	auditApplicationCreate = "application.create"
+	auditApplicationUpdate = "application.update"
+	auditApplicationDelete = "application.delete"
+
+	auditAllocate = "reservation.allocate"
+	auditRelease  = "reservation.release"
+
+	auditAffinityBind   = "affinity.bind"
+	auditAffinityUnbind = "affinity.unbind"
+
+	auditRoutesUpdate   = "routes.update"
+	auditRoutesRollback = "routes.rollback"
+	auditRoutesDelete   = "routes.delete"
+
+	auditWebhookCreate    = "webhook.create"
+	auditWebhookDelete    = "webhook.delete"
+	auditWebhookRedeliver = "webhook.redeliver"
+
+	auditAlertRuleCreate = "alertRule.create"
+	auditAlertRuleDelete = "alertRule.delete"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+func (e *env) findAuditEntries(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.findAuditEntries")
+	defer span.Finish()
+
+	filter, err := parseAuditFilter(c)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	entries, err := e.audit.Find(ctx, filter)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, entries)
+}
+
+// recordAudit completes an audit entry with information about the caller and the
+// outcome of the operation and stores it.
+func (e *env) recordAudit(ctx context.Context, c *gin.Context, entry models.AuditEntry, before, after interface{}, err error) {
+	user := currentUser(c)
+	entry.ActorID = user.ID
+	entry.ActorRoles = user.Roles
+	entry.SourceIP = c.ClientIP()
+	entry.TraceID = traceID(ctx)
+	entry.Before = marshalAuditState(before)
+	entry.Outcome = models.OutcomeSuccess
+	if err != nil {
+		entry.Outcome = models.OutcomeFailure
+		entry.Error = err.Error()
+	} else {
+		entry.After = marshalAuditState(after)
+	}
+
+	e.audit.Record(ctx, entry)
+}
+
+// currentUser returns the authenticated caller of a request.
+func currentUser(c *gin.Context) jwt.User {
+	value, ok := c.Get(userKey)
+	if !ok {
+		return jwt.User{}
+	}
+
+	user, _ := value.(jwt.User)
+	return user
+}
+
+func traceID(ctx context.Context) string {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return ""
+	}
+
+	spanCtx, ok := span.Context().(jaeger.SpanContext)
+	if !ok {
+		return ""
+	}
+
+	return spanCtx.TraceID().String()
+}
+
+// optionalService returns nil for services that do not exist so that they are omitted from the audit log.
+func optionalService(svc models.Service) interface{} {
+	if svc.ID == "" {
+		return nil
+	}
+
+	return svc
+}
+
+// optionalCapacity returns nil for services that have not reported a capacity so that it is omitted from the audit log.
+func optionalCapacity(capacity *models.Capacity) interface{} {
+	if capacity == nil {
+		return nil
+	}
+
+	return capacity
+}
+
+// optionalApplication returns nil for applications that are not declared so that they are omitted from the audit log.
+func optionalApplication(app models.Application) interface{} {
+	if app.Name == "" {
+		return nil
+	}
+
+	return app
+}
+
+func marshalAuditState(state interface{}) json.RawMessage {
+	if state == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		log.Error("failed to marshal audit state", zap.Error(err))
+		return nil
+	}
+
+	return b
+}
+
+func parseAuditFilter(c *gin.Context) (models.AuditFilter, error) {
+	filter := models.AuditFilter{
+		ActorID:     c.Query("actor"),
+		Application: c.Query("application"),
+		ServiceID:   c.Query("service-id"),
+		Limit:       defaultAuditLimit,
+	}
+
+	var err error
+	filter.From, err = parseTimeQuery(c, "from")
+	if err != nil {
+		return models.AuditFilter{}, err
+	}
+
+	filter.To, err = parseTimeQuery(c, "to")
+	if err != nil {
+		return models.AuditFilter{}, err
+	}
+
+	limit, ok := c.GetQuery("limit")
+	if !ok {
+		return filter, nil
+	}
+
+	filter.Limit, err = strconv.Atoi(limit)
+	if err != nil || filter.Limit < 1 || filter.Limit > maxAuditLimit {
+		err = fmt.Errorf("limit must be an integer between 1 and %d, got %s", maxAuditLimit, limit)
+		return models.AuditFilter{}, httputil.BadRequestError(err)
+	}
+
+	return filter, nil
+}
+
+func parseTimeQuery(c *gin.Context, name string) (time.Time, error) {
+	value, ok := c.GetQuery(name)
+	if !ok {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		err = fmt.Errorf("failed to parse %s as an RFC3339 timestamp. %w", name, err)
+		return time.Time{}, httputil.BadRequestError(err)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/CzarSimon/httputil/client/rpc"
+	"github.com/CzarSimon/httputil/jwt"
+	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	assert := assert.New(t)
+	e, _ := createTestEnv()
+	server := newServer(e)
+	start := time.Now().UTC().Add(-time.Second)
+
+	svc := dto.Service{
+		Application: "test-app",
+		Location:    "ip-1",
+		Port:        8080,
+	}
+	req := createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, svc)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	var registered models.Service
+	err := rpc.DecodeJSON(res.Result(), &registered)
+	assert.NoError(err)
+
+	path := fmt.Sprintf("/v1/services/%s/status/%s?epoch=%d", registered.ID, dto.StatusUnhealthy, registered.Epoch)
+	req = createTestRequest(path, http.MethodPut, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	req = createTestRequest("/v1/services/missing-id/status/HEALTHY", http.MethodPut, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusPreconditionRequired, res.Code)
+
+	req = createTestRequest("/v1/services/"+registered.ID, http.MethodDelete, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	entries := findTestAuditEntries(t, server.Handler, "")
+	assert.Len(entries, 4)
+
+	deregistered := entries[0]
+	assert.Equal(auditDeregister, deregistered.Action)
+	assert.Equal(models.OutcomeSuccess, deregistered.Outcome)
+	assert.Equal("service-registry-user", deregistered.ActorID)
+	assert.Equal([]string{jwt.SystemRole}, deregistered.ActorRoles)
+	assert.Equal("test-app", deregistered.Application)
+	assert.Equal(registered.ID, deregistered.ServiceID)
+	assert.Nil(deregistered.After)
+	var before dto.Service
+	assert.NoError(json.Unmarshal(deregistered.Before, &before))
+	assert.Equal(dto.StatusUnhealthy, before.Status)
+
+	failed := entries[1]
+	assert.Equal(auditSetStatus, failed.Action)
+	assert.Equal(models.OutcomeFailure, failed.Outcome)
+	assert.Equal("missing-id", failed.ServiceID)
+	assert.NotEqual("", failed.Error)
+	assert.Nil(failed.Before)
+	assert.Nil(failed.After)
+
+	statusChange := entries[2]
+	assert.Equal(auditSetStatus, statusChange.Action)
+	assert.Equal(models.OutcomeSuccess, statusChange.Outcome)
+	var after dto.Service
+	assert.NoError(json.Unmarshal(statusChange.Before, &before))
+	assert.NoError(json.Unmarshal(statusChange.After, &after))
+	assert.Equal(dto.StatusHealty, before.Status)
+	assert.Equal(dto.StatusUnhealthy, after.Status)
+
+	registration := entries[3]
+	assert.Equal(auditRegister, registration.Action)
+	assert.Nil(registration.Before)
+	assert.NoError(json.Unmarshal(registration.After, &after))
+	assert.Equal(registered.Service, after)
+
+	assert.Len(findTestAuditEntries(t, server.Handler, "service-id=missing-id"), 1)
+	assert.Len(findTestAuditEntries(t, server.Handler, "application=test-app"), 3)
+	assert.Len(findTestAuditEntries(t, server.Handler, "actor=service-registry-user&limit=2"), 2)
+	assert.Len(findTestAuditEntries(t, server.Handler, "actor=other-user"), 0)
+
+	from := url.QueryEscape(start.Format(time.RFC3339))
+	to := url.QueryEscape(start.Add(time.Hour).Format(time.RFC3339))
+	assert.Len(findTestAuditEntries(t, server.Handler, "from="+from+"&to="+to), 4)
+	assert.Len(findTestAuditEntries(t, server.Handler, "from="+to), 0)
+
+	req = createTestRequest("/v1/admin/audit?from=yesterday", http.MethodGet, jwt.AdminRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusBadRequest, res.Code)
+
+	req = createTestRequest("/v1/admin/audit?limit=0", http.MethodGet, jwt.AdminRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusBadRequest, res.Code)
+
+	req = createTestRequest("/v1/admin/audit", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusForbidden, res.Code)
+}
+
+func findTestAuditEntries(t *testing.T, handler http.Handler, query string) []models.AuditEntry {
+	req := createTestRequest("/v1/admin/audit?"+query, http.MethodGet, jwt.AdminRole, nil)
+	res := performTestRequest(handler, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	entries := make([]models.AuditEntry, 0)
+	err := rpc.DecodeJSON(res.Result(), &entries)
+	assert.NoError(t, err)
+	return entries
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+// maxBatchSize maximum number of services that can be registered in one request.
+const maxBatchSize = 500
+
+// serviceAction routes custom methods on the services collection, e.g. POST /v1/services:batch.
+// The router treats the text after "/services" as a path parameter, including the colon.
+func (e *env) serviceAction(c *gin.Context) {
+	switch c.Param("action") {
+	case ":batch":
+		e.registerServices(c)
+	default:
+		c.Error(httputil.NotFoundError(fmt.Errorf("no such route %s", c.Request.URL.Path)))
+	}
+}
+
+func (e *env) registerServices(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.registerServices")
+	defer span.Finish()
+
+	var body []models.Service
+	err := c.BindJSON(&body)
+	if err != nil {
+		err = httputil.BadRequestError(fmt.Errorf("failed to parse request body. %w", err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+	if len(body) == 0 || len(body) > maxBatchSize {
+		err = httputil.BadRequestError(fmt.Errorf("batch must contain between 1 and %d services, got %d", maxBatchSize, len(body)))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	before := make([]models.Service, len(body))
+	for i, svc := range body {
+		before[i], err = e.registry.FindExisting(ctx, svc)
+		if err != nil {
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			c.Error(err)
+			return
+		}
+	}
+
+	results, err := e.registry.RegisterAll(ctx, body)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	for i, result := range results {
+		after := batchService(result)
+		serviceID := after.ID
+		if serviceID == "" {
+			serviceID = body[i].ID
+		}
+		e.recordAudit(ctx, c, models.AuditEntry{
+			Action:      auditRegister,
+			Application: body[i].Application,
+			ServiceID:   serviceID,
+		}, optionalService(before[i]), after, batchError(result))
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, newBatchResponse(results))
+}
+
+func (e *env) setApplicationStatus(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.setApplicationStatus")
+	defer span.Finish()
+
+	var body models.ApplicationStatusUpdate
+	err := c.BindJSON(&body)
+	if err != nil {
+		err = httputil.BadRequestError(fmt.Errorf("failed to parse request body. %w", err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	application := c.Param("name")
+	services, err := e.registry.FindApplicationServices(ctx, application, models.ServiceQuery{})
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	before := make(map[string]models.Service, len(services))
+	for _, svc := range services {
+		before[svc.ID] = svc
+	}
+
+	results, err := e.registry.SetApplicationStatus(ctx, application, body)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	for _, result := range results {
+		after := batchService(result)
+		e.recordAudit(ctx, c, models.AuditEntry{
+			Action:      auditSetStatus,
+			Application: application,
+			ServiceID:   after.ID,
+		}, optionalService(before[after.ID]), after, batchError(result))
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, newBatchResponse(results))
+}
+
+func newBatchResponse(results []models.BatchResult) models.BatchResponse {
+	res := models.BatchResponse{
+		Results: results,
+	}
+
+	for _, result := range results {
+		if result.Status == http.StatusOK {
+			res.Succeeded++
+		} else {
+			res.Failed++
+		}
+	}
+
+	return res
+}
+
+func batchService(result models.BatchResult) models.Service {
+	if result.Service == nil {
+		return models.Service{}
+	}
+
+	return *result.Service
+}
+
+func batchError(result models.BatchResult) error {
+	if result.Status == http.StatusOK {
+		return nil
+	}
+
+	return errors.New(result.Error)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/CzarSimon/httputil/client/rpc"
+	"github.com/CzarSimon/httputil/id"
+	"github.com/CzarSimon/httputil/jwt"
+	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterServices(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	repo := repository.NewServiceRepository(e.db)
+	server := newServer(e)
+	e.registry.SetPolicy(models.RegistrationPolicy{ConflictPolicy: models.ConflictReject})
+
+	holder, _, err := repo.Save(ctx, models.Service{
+		Service: dto.Service{ID: id.New(), Application: "other-app", Location: "ip-1", Port: 8080, Status: dto.StatusHealty},
+	}, repository.TakeOver)
+	assert.NoError(err)
+
+	batch := []models.Service{
+		{
+			Service: dto.Service{Application: "test-app", Location: "ip-2", Port: 8080},
+			Labels:  map[string]string{"zone": "a"},
+		},
+		{
+			Service: dto.Service{ID: id.New(), Application: "test-app", Location: "ip-1", Port: 8080},
+		},
+		{
+			Service: dto.Service{Application: "test-app", Location: "ip-3", Port: 8080},
+			Labels:  map[string]string{"zone": "b"},
+		},
+	}
+	req := createTestRequest("/v1/services:batch", http.MethodPost, jwt.SystemRole, batch)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	var body models.BatchResponse
+	err = rpc.DecodeJSON(res.Result(), &body)
+	assert.NoError(err)
+	assert.Equal(2, body.Succeeded)
+	assert.Equal(1, body.Failed)
+	assert.Len(body.Results, 3)
+
+	assert.Equal(http.StatusConflict, body.Results[1].Status)
+	assert.Nil(body.Results[1].Service)
+	assert.Contains(body.Results[1].Error, holder.ID)
+
+	for _, i := range []int{0, 2} {
+		result := body.Results[i]
+		assert.Equal(i, result.Index)
+		assert.Equal(http.StatusOK, result.Status)
+		assert.NotEmpty(result.Service.ID)
+
+		stored, err := repo.Find(ctx, result.Service.ID)
+		assert.NoError(err)
+		assert.Equal(batch[i].Location, stored.Location)
+		assert.Equal(batch[i].Labels, stored.Labels)
+		assert.Equal(dto.StatusHealty, stored.Status)
+	}
+
+	stored, err := repo.FindByLocation(ctx, "ip-1", 8080)
+	assert.NoError(err)
+	assert.Equal(holder.ID, stored.ID)
+
+	entries := findTestAuditEntries(t, server.Handler, "")
+	assert.Len(entries, 3)
+
+	req = createTestRequest("/v1/services:batch", http.MethodPost, jwt.SystemRole, []models.Service{})
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusBadRequest, res.Code)
+
+	req = createTestRequest("/v1/services:purge", http.MethodPost, jwt.SystemRole, batch)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+}
+
+func TestSetApplicationStatus(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	repo := repository.NewServiceRepository(e.db)
+	server := newServer(e)
+
+	services := []models.Service{
+		{Service: dto.Service{ID: "svc-1", Application: "test-app", Location: "ip-1", Port: 8080}, Labels: map[string]string{"zone": "a"}},
+		{Service: dto.Service{ID: "svc-2", Application: "test-app", Location: "ip-2", Port: 8080}, Labels: map[string]string{"zone": "a", "canary": "true"}},
+		{Service: dto.Service{ID: "svc-3", Application: "test-app", Location: "ip-3", Port: 8080}, Labels: map[string]string{"zone": "b"}},
+		{Service: dto.Service{ID: "svc-4", Application: "other-app", Location: "ip-1", Port: 9090}, Labels: map[string]string{"zone": "a"}},
+	}
+	for _, svc := range services {
+		svc.Status = dto.StatusHealty
+		_, _, err := repo.Save(ctx, svc, repository.TakeOver)
+		assert.NoError(err)
+	}
+
+	update := models.ApplicationStatusUpdate{
+		Status: dto.StatusUnhealthy,
+		ServiceFilter: models.ServiceFilter{
+			Labels: map[string]string{"zone": "a"},
+		},
+	}
+	req := createTestRequest("/v1/applications/test-app/status", http.MethodPut, jwt.SystemRole, update)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	var body models.BatchResponse
+	err := rpc.DecodeJSON(res.Result(), &body)
+	assert.NoError(err)
+	assert.Equal(2, body.Succeeded)
+	assert.Equal(0, body.Failed)
+
+	expectedStatus := map[string]dto.ServiceStatus{
+		"svc-1": dto.StatusUnhealthy,
+		"svc-2": dto.StatusUnhealthy,
+		"svc-3": dto.StatusHealty,
+		"svc-4": dto.StatusHealty,
+	}
+	for serviceID, status := range expectedStatus {
+		stored, err := repo.Find(ctx, serviceID)
+		assert.NoError(err)
+		assert.Equal(status, stored.Status, serviceID)
+		assert.Equal(int64(1), stored.Epoch, serviceID)
+		if status == dto.StatusUnhealthy {
+			assert.Equal(int64(2), stored.Version, serviceID)
+		}
+	}
+
+	// Evacuate a location.
+	update = models.ApplicationStatusUpdate{
+		Status: dto.StatusUnhealthy,
+		ServiceFilter: models.ServiceFilter{
+			Location: "ip-3",
+		},
+	}
+	req = createTestRequest("/v1/applications/test-app/status", http.MethodPut, jwt.SystemRole, update)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	body = models.BatchResponse{}
+	err = rpc.DecodeJSON(res.Result(), &body)
+	assert.NoError(err)
+	assert.Equal(1, body.Succeeded)
+	assert.Equal("svc-3", body.Results[0].Service.ID)
+	assert.Equal(dto.StatusUnhealthy, body.Results[0].Service.Status)
+
+	update.Status = "SLEEPING"
+	req = createTestRequest("/v1/applications/test-app/status", http.MethodPut, jwt.SystemRole, update)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusBadRequest, res.Code)
+
+	req = createTestRequest("/v1/applications/missing-app/status", http.MethodPut, jwt.SystemRole, models.ApplicationStatusUpdate{Status: dto.StatusHealty})
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rtcheap/service-registry/internal/service"
+	"go.uber.org/zap"
+)
+
+// catalogPoller periodically checks the catalog index for changes made through other replicas.
+type catalogPoller struct {
+	*periodicWorker
+	catalog *service.CatalogIndex
+}
+
+func newCatalogPoller(catalog *service.CatalogIndex, interval time.Duration) *catalogPoller {
+	w := &catalogPoller{catalog: catalog}
+	w.periodicWorker = newPeriodicWorker(interval, w.poll)
+	return w
+}
+
+func (w *catalogPoller) poll() {
+	err := w.catalog.Refresh(context.Background())
+	if err != nil {
+		log.Error("failed to refresh catalog index", zap.Error(err))
+	}
+}
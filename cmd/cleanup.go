@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rtcheap/service-registry/internal/service"
+	"go.uber.org/zap"
+)
+
+// cleanupWorker periodically reclaims expired session reservations, removes expired affinity bindings
+// and, if the catalog index is set, advances it when instances expire.
+type cleanupWorker struct {
+	*periodicWorker
+	allocations *service.AllocationService
+	affinity    *service.AffinityService
+	catalog     *service.CatalogIndex
+}
+
+func newCleanupWorker(allocations *service.AllocationService, affinity *service.AffinityService, catalog *service.CatalogIndex, interval time.Duration) *cleanupWorker {
+	w := &cleanupWorker{
+		allocations: allocations,
+		affinity:    affinity,
+		catalog:     catalog,
+	}
+	w.periodicWorker = newPeriodicWorker(interval, w.cleanup)
+	return w
+}
+
+func (w *cleanupWorker) cleanup() {
+	ctx := context.Background()
+	_, err := w.allocations.ReclaimExpired(ctx)
+	if err != nil {
+		log.Error("failed to reclaim expired reservations", zap.Error(err))
+	}
+
+	_, err = w.affinity.DeleteExpired(ctx)
+	if err != nil {
+		log.Error("failed to delete expired affinity bindings", zap.Error(err))
+	}
+
+	if w.catalog == nil {
+		return
+	}
+	err = w.catalog.AdvanceExpired(ctx)
+	if err != nil {
+		log.Error("failed to check for expired instances", zap.Error(err))
+	}
+}
@@ -1,9 +1,22 @@
 package main
 
 import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/CzarSimon/httputil/dbutil"
 	"github.com/CzarSimon/httputil/environ"
 	"github.com/CzarSimon/httputil/jwt"
+	"github.com/rtcheap/service-registry/internal/models"
+	jaegercfg "github.com/uber/jaeger-client-go/config"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v2"
 )
 
 type config struct {
@@ -11,27 +24,742 @@ type config struct {
 	port           string
 	migrationsPath string
 	jwtCredentials jwt.Credentials
+	tracing        jaegercfg.Configuration
+	tls            tlsConfig
+	runtime        runtimeConfig
+	file           string
+	reloadInterval time.Duration
+	// reclaimInterval how often expired session reservations and affinity bindings are removed.
+	reclaimInterval time.Duration
+	// webhookInterval how often due webhook deliveries are attempted.
+	webhookInterval time.Duration
+	webhooks        models.DeliveryPolicy
+	// alertInterval how often alert rules are evaluated.
+	alertInterval  time.Duration
+	alertNotifiers []string
+	// templatesPath directory config templates are loaded from in addition to the built-in templates.
+	templatesPath string
+	proxy         proxyConfig
+	consul        consulConfig
+	// eurekaEnabled serves the Eureka compatible API under /eureka.
+	eurekaEnabled bool
+	kubernetes    kubernetesConfig
+}
+
+// runtimeConfig settings that can be changed without restarting the service.
+type runtimeConfig struct {
+	logLevel        zapcore.Level
+	requestTimeout  time.Duration
+	shutdownDelay   time.Duration
+	shutdownTimeout time.Duration
+	registration    models.RegistrationPolicy
+	// localityFailoverThreshold healthy instances required in the caller's zone to not fail over to other zones.
+	localityFailoverThreshold int
+	outliers                  models.OutlierPolicy
+}
+
+// proxyConfig settings of the reverse proxy forwarding /proxy/<application>/ requests to instances.
+type proxyConfig struct {
+	enabled bool
+	// timeout how long to wait for the response headers of an instance.
+	timeout     time.Duration
+	dialTimeout time.Duration
+	// retries other instances tried when connecting to an instance fails.
+	retries int
+}
+
+// consulConfig settings of the Consul compatible catalog and health API served under /consul/v1.
+type consulConfig struct {
+	enabled bool
+	// datacenter reported for instances without a region.
+	datacenter string
+	// pollInterval how often changes made through other replicas are checked for.
+	pollInterval time.Duration
+}
+
+// kubernetesConfig settings of the sync mirroring annotated Kubernetes services into the registry.
+type kubernetesConfig struct {
+	enabled bool
+	// kubeconfig path to a kubeconfig file, the in-cluster config is used if empty.
+	kubeconfig string
+	// namespace services are mirrored from, every namespace if empty.
+	namespace string
+	// cluster name of the cluster, set as a label on mirrored instances.
+	cluster string
+	// resyncInterval how often a full sync is done in addition to syncing on changes.
+	resyncInterval time.Duration
+}
+
+// tlsConfig settings for serving HTTPS and verifying client certificates.
+type tlsConfig struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	clientAuth   tls.ClientAuthType
+	subjectRoles map[string][]string
+}
+
+func (cfg tlsConfig) enabled() bool {
+	return cfg.certFile != ""
+}
+
+// fileConfig layout of the optional YAML configuration file.
+type fileConfig struct {
+	DB struct {
+		Host             string `yaml:"host"`
+		Port             string `yaml:"port"`
+		Database         string `yaml:"database"`
+		Username         string `yaml:"username"`
+		Password         string `yaml:"password"`
+		ConnectionParams string `yaml:"connectionParams"`
+	} `yaml:"db"`
+	Port           string `yaml:"port"`
+	MigrationsPath string `yaml:"migrationsPath"`
+	JWT            struct {
+		Issuer string `yaml:"issuer"`
+		Secret string `yaml:"secret"`
+	} `yaml:"jwt"`
+	TLS struct {
+		CertFile     string              `yaml:"certFile"`
+		KeyFile      string              `yaml:"keyFile"`
+		ClientCAFile string              `yaml:"clientCAFile"`
+		ClientAuth   string              `yaml:"clientAuth"`
+		SubjectRoles map[string][]string `yaml:"subjectRoles"`
+	} `yaml:"tls"`
+	Tracing         jaegercfg.Configuration `yaml:"tracing"`
+	LogLevel        string                  `yaml:"logLevel"`
+	RequestTimeout  string                  `yaml:"requestTimeout"`
+	ShutdownDelay   string                  `yaml:"shutdownDelay"`
+	ShutdownTimeout string                  `yaml:"shutdownTimeout"`
+	ReloadInterval  string                  `yaml:"reloadInterval"`
+	ReclaimInterval string                  `yaml:"reclaimInterval"`
+	ConflictPolicy  string                  `yaml:"conflictPolicy"`
+	InstanceTTL     string                  `yaml:"instanceTTL"`
+	LoadReportTTL   string                  `yaml:"loadReportTTL"`
+	// ApplicationConflictPolicies overrides the conflict policy for specific applications.
+	ApplicationConflictPolicies map[string]string `yaml:"applicationConflictPolicies"`
+	RequireDeclaredApplications bool              `yaml:"requireDeclaredApplications"`
+	LocalityFailoverThreshold   string            `yaml:"localityFailoverThreshold"`
+	OutlierDetection            struct {
+		Window             string `yaml:"window"`
+		ErrorThreshold     string `yaml:"errorThreshold"`
+		MinRequests        string `yaml:"minRequests"`
+		BaseEjectionTime   string `yaml:"baseEjectionTime"`
+		MaxEjectionTime    string `yaml:"maxEjectionTime"`
+		MaxEjectionPercent string `yaml:"maxEjectionPercent"`
+	} `yaml:"outlierDetection"`
+	Webhooks struct {
+		DeliveryInterval string `yaml:"deliveryInterval"`
+		Timeout          string `yaml:"timeout"`
+		MaxAttempts      string `yaml:"maxAttempts"`
+		RetryBackoff     string `yaml:"retryBackoff"`
+		MaxRetryBackoff  string `yaml:"maxRetryBackoff"`
+	} `yaml:"webhooks"`
+	Alerting struct {
+		EvaluationInterval string `yaml:"evaluationInterval"`
+		// Notifiers is a comma separated list of the notifiers alerts are sent to.
+		Notifiers string `yaml:"notifiers"`
+	} `yaml:"alerting"`
+	Render struct {
+		TemplatesPath string `yaml:"templatesPath"`
+	} `yaml:"render"`
+	Proxy struct {
+		Enabled     bool   `yaml:"enabled"`
+		Timeout     string `yaml:"timeout"`
+		DialTimeout string `yaml:"dialTimeout"`
+		Retries     string `yaml:"retries"`
+	} `yaml:"proxy"`
+	Consul struct {
+		Enabled      bool   `yaml:"enabled"`
+		Datacenter   string `yaml:"datacenter"`
+		PollInterval string `yaml:"pollInterval"`
+	} `yaml:"consul"`
+	Eureka struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"eureka"`
+	Kubernetes struct {
+		Enabled        bool   `yaml:"enabled"`
+		Kubeconfig     string `yaml:"kubeconfig"`
+		Namespace      string `yaml:"namespace"`
+		Cluster        string `yaml:"cluster"`
+		ResyncInterval string `yaml:"resyncInterval"`
+	} `yaml:"kubernetes"`
+}
+
+func getConfig() (config, error) {
+	return loadConfig(environ.Get("CONFIG_FILE", ""))
+}
+
+// loadConfig reads the configuration file at the given path, if any, lets environment
+// variables override its values and validates the result, reporting every problem found.
+func loadConfig(path string) (config, error) {
+	fc := fileConfig{
+		Port:            "8080",
+		MigrationsPath:  "/etc/service-registry/migrations",
+		LogLevel:        "debug",
+		RequestTimeout:  "0s",
+		ShutdownDelay:   "5s",
+		ShutdownTimeout: "30s",
+		ReloadInterval:  "10s",
+		ReclaimInterval: "10s",
+		ConflictPolicy:  string(models.ConflictTakeover),
+		InstanceTTL:     "0s",
+		LoadReportTTL:   "30s",
+
+		LocalityFailoverThreshold: "1",
+	}
+	fc.DB.ConnectionParams = "parseTime=true"
+	fc.TLS.ClientAuth = "none"
+	fc.OutlierDetection.Window = "1m"
+	fc.OutlierDetection.ErrorThreshold = "0.5"
+	fc.OutlierDetection.MinRequests = "10"
+	fc.OutlierDetection.BaseEjectionTime = "30s"
+	fc.OutlierDetection.MaxEjectionTime = "5m"
+	fc.OutlierDetection.MaxEjectionPercent = "50"
+	fc.Webhooks.DeliveryInterval = "1s"
+	fc.Webhooks.Timeout = "5s"
+	fc.Webhooks.MaxAttempts = "8"
+	fc.Webhooks.RetryBackoff = "1s"
+	fc.Webhooks.MaxRetryBackoff = "5m"
+	fc.Alerting.EvaluationInterval = "15s"
+	fc.Alerting.Notifiers = "log,webhook"
+	fc.Proxy.Timeout = "30s"
+	fc.Proxy.DialTimeout = "2s"
+	fc.Proxy.Retries = "2"
+	fc.Consul.Datacenter = "dc1"
+	fc.Consul.PollInterval = "1s"
+	fc.Kubernetes.Cluster = "default"
+	fc.Kubernetes.ResyncInterval = "30s"
+
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return config{}, fmt.Errorf("failed to read config file %s. %w", path, err)
+		}
+
+		err = yaml.UnmarshalStrict(content, &fc)
+		if err != nil {
+			return config{}, fmt.Errorf("failed to parse config file %s. %w", path, err)
+		}
+	}
+
+	fc.applyEnv()
+	return fc.toConfig(path)
 }
 
-func getConfig() config {
+func (fc *fileConfig) applyEnv() {
+	overrides := map[string]*string{
+		"DB_HOST":          &fc.DB.Host,
+		"DB_PORT":          &fc.DB.Port,
+		"DB_DATABASE":      &fc.DB.Database,
+		"DB_USERNAME":      &fc.DB.Username,
+		"DB_PASSWORD":      &fc.DB.Password,
+		"SERVICE_PORT":     &fc.Port,
+		"MIGRATIONS_PATH":  &fc.MigrationsPath,
+		"JWT_ISSUER":       &fc.JWT.Issuer,
+		"JWT_SECRET":       &fc.JWT.Secret,
+		"LOG_LEVEL":        &fc.LogLevel,
+		"REQUEST_TIMEOUT":  &fc.RequestTimeout,
+		"SHUTDOWN_DELAY":   &fc.ShutdownDelay,
+		"SHUTDOWN_TIMEOUT": &fc.ShutdownTimeout,
+		"RELOAD_INTERVAL":  &fc.ReloadInterval,
+		"RECLAIM_INTERVAL": &fc.ReclaimInterval,
+		"CONFLICT_POLICY":  &fc.ConflictPolicy,
+		"INSTANCE_TTL":     &fc.InstanceTTL,
+		"LOAD_REPORT_TTL":  &fc.LoadReportTTL,
+
+		"LOCALITY_FAILOVER_THRESHOLD": &fc.LocalityFailoverThreshold,
+
+		"TLS_CERT_FILE":      &fc.TLS.CertFile,
+		"TLS_KEY_FILE":       &fc.TLS.KeyFile,
+		"TLS_CLIENT_AUTH":    &fc.TLS.ClientAuth,
+		"TLS_CLIENT_CA_FILE": &fc.TLS.ClientCAFile,
+
+		"OUTLIER_WINDOW":               &fc.OutlierDetection.Window,
+		"OUTLIER_ERROR_THRESHOLD":      &fc.OutlierDetection.ErrorThreshold,
+		"OUTLIER_MIN_REQUESTS":         &fc.OutlierDetection.MinRequests,
+		"OUTLIER_BASE_EJECTION_TIME":   &fc.OutlierDetection.BaseEjectionTime,
+		"OUTLIER_MAX_EJECTION_TIME":    &fc.OutlierDetection.MaxEjectionTime,
+		"OUTLIER_MAX_EJECTION_PERCENT": &fc.OutlierDetection.MaxEjectionPercent,
+
+		"WEBHOOK_DELIVERY_INTERVAL": &fc.Webhooks.DeliveryInterval,
+		"WEBHOOK_TIMEOUT":           &fc.Webhooks.Timeout,
+		"WEBHOOK_MAX_ATTEMPTS":      &fc.Webhooks.MaxAttempts,
+		"WEBHOOK_RETRY_BACKOFF":     &fc.Webhooks.RetryBackoff,
+		"WEBHOOK_MAX_RETRY_BACKOFF": &fc.Webhooks.MaxRetryBackoff,
+
+		"ALERT_EVALUATION_INTERVAL": &fc.Alerting.EvaluationInterval,
+		"ALERT_NOTIFIERS":           &fc.Alerting.Notifiers,
+
+		"RENDER_TEMPLATES_PATH": &fc.Render.TemplatesPath,
+
+		"PROXY_TIMEOUT":      &fc.Proxy.Timeout,
+		"PROXY_DIAL_TIMEOUT": &fc.Proxy.DialTimeout,
+		"PROXY_RETRIES":      &fc.Proxy.Retries,
+
+		"CONSUL_DATACENTER":    &fc.Consul.Datacenter,
+		"CONSUL_POLL_INTERVAL": &fc.Consul.PollInterval,
+
+		"K8S_SYNC_KUBECONFIG": &fc.Kubernetes.Kubeconfig,
+		"K8S_SYNC_NAMESPACE":  &fc.Kubernetes.Namespace,
+		"K8S_SYNC_CLUSTER":    &fc.Kubernetes.Cluster,
+		"K8S_SYNC_INTERVAL":   &fc.Kubernetes.ResyncInterval,
+	}
+
+	for name, field := range overrides {
+		*field = environ.Get(name, *field)
+	}
+
+	value, ok := os.LookupEnv("REQUIRE_DECLARED_APPLICATIONS")
+	if ok {
+		fc.RequireDeclaredApplications = parseFlag(value)
+	}
+
+	value, ok = os.LookupEnv("PROXY_ENABLED")
+	if ok {
+		fc.Proxy.Enabled = parseFlag(value)
+	}
+
+	value, ok = os.LookupEnv("CONSUL_ENABLED")
+	if ok {
+		fc.Consul.Enabled = parseFlag(value)
+	}
+
+	value, ok = os.LookupEnv("EUREKA_ENABLED")
+	if ok {
+		fc.Eureka.Enabled = parseFlag(value)
+	}
+
+	value, ok = os.LookupEnv("K8S_SYNC_ENABLED")
+	if ok {
+		fc.Kubernetes.Enabled = parseFlag(value)
+	}
+}
+
+func (fc fileConfig) toConfig(path string) (config, error) {
+	errs := make(validationErrors, 0)
+	required := []struct {
+		name  string
+		value string
+	}{
+		{name: "db.host (DB_HOST)", value: fc.DB.Host},
+		{name: "db.port (DB_PORT)", value: fc.DB.Port},
+		{name: "db.database (DB_DATABASE)", value: fc.DB.Database},
+		{name: "db.username (DB_USERNAME)", value: fc.DB.Username},
+		{name: "db.password (DB_PASSWORD)", value: fc.DB.Password},
+		{name: "jwt.issuer (JWT_ISSUER)", value: fc.JWT.Issuer},
+		{name: "jwt.secret (JWT_SECRET)", value: fc.JWT.Secret},
+		{name: "port (SERVICE_PORT)", value: fc.Port},
+		{name: "migrationsPath (MIGRATIONS_PATH)", value: fc.MigrationsPath},
+	}
+	for _, field := range required {
+		if field.value == "" {
+			errs = append(errs, fmt.Sprintf("%s is required", field.name))
+		}
+	}
+
+	tlsCfg, tlsErrs := fc.tlsConfig()
+	errs = append(errs, tlsErrs...)
+
+	runtime, runtimeErrs := fc.runtimeConfig()
+	errs = append(errs, runtimeErrs...)
+
+	reloadInterval, err := time.ParseDuration(fc.ReloadInterval)
+	if err != nil || reloadInterval <= 0 {
+		errs = append(errs, fmt.Sprintf("reloadInterval (RELOAD_INTERVAL) must be a positive duration, got %q", fc.ReloadInterval))
+	}
+
+	reclaimInterval, err := time.ParseDuration(fc.ReclaimInterval)
+	if err != nil || reclaimInterval <= 0 {
+		errs = append(errs, fmt.Sprintf("reclaimInterval (RECLAIM_INTERVAL) must be a positive duration, got %q", fc.ReclaimInterval))
+	}
+
+	webhookInterval, err := time.ParseDuration(fc.Webhooks.DeliveryInterval)
+	if err != nil || webhookInterval <= 0 {
+		errs = append(errs, fmt.Sprintf("webhooks.deliveryInterval (WEBHOOK_DELIVERY_INTERVAL) must be a positive duration, got %q", fc.Webhooks.DeliveryInterval))
+	}
+
+	webhooks, webhookErrs := fc.deliveryPolicy()
+	errs = append(errs, webhookErrs...)
+
+	alertInterval, err := time.ParseDuration(fc.Alerting.EvaluationInterval)
+	if err != nil || alertInterval <= 0 {
+		errs = append(errs, fmt.Sprintf("alerting.evaluationInterval (ALERT_EVALUATION_INTERVAL) must be a positive duration, got %q", fc.Alerting.EvaluationInterval))
+	}
+
+	alertNotifiers, notifierErrs := fc.alertNotifiers()
+	errs = append(errs, notifierErrs...)
+
+	proxy, proxyErrs := fc.proxyConfig()
+	errs = append(errs, proxyErrs...)
+
+	consul, consulErrs := fc.consulConfig()
+	errs = append(errs, consulErrs...)
+
+	kubernetes, kubernetesErrs := fc.kubernetesConfig()
+	errs = append(errs, kubernetesErrs...)
+
+	tracing, err := fc.Tracing.FromEnv()
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("invalid tracing configuration: %v", err))
+		tracing = &fc.Tracing
+	}
+
+	if len(errs) > 0 {
+		return config{}, errs
+	}
+
 	return config{
 		db: dbutil.MysqlConfig{
-			Host:             environ.MustGet("DB_HOST"),
-			Port:             environ.MustGet("DB_PORT"),
-			Database:         environ.MustGet("DB_DATABASE"),
-			User:             environ.MustGet("DB_USERNAME"),
-			Password:         environ.MustGet("DB_PASSWORD"),
-			ConnectionParams: "parseTime=true",
+			Host:             fc.DB.Host,
+			Port:             fc.DB.Port,
+			Database:         fc.DB.Database,
+			User:             fc.DB.Username,
+			Password:         fc.DB.Password,
+			ConnectionParams: fc.DB.ConnectionParams,
+		},
+		port:           fc.Port,
+		migrationsPath: fc.MigrationsPath,
+		jwtCredentials: jwt.Credentials{
+			Issuer: fc.JWT.Issuer,
+			Secret: fc.JWT.Secret,
 		},
-		port:           environ.Get("SERVICE_PORT", "8080"),
-		migrationsPath: environ.Get("MIGRATIONS_PATH", "/etc/service-registry/migrations"),
-		jwtCredentials: getJwtCredentials(),
+		tracing:         *tracing,
+		tls:             tlsCfg,
+		runtime:         runtime,
+		file:            path,
+		reloadInterval:  reloadInterval,
+		reclaimInterval: reclaimInterval,
+		webhookInterval: webhookInterval,
+		webhooks:        webhooks,
+		alertInterval:   alertInterval,
+		alertNotifiers:  alertNotifiers,
+		templatesPath:   fc.Render.TemplatesPath,
+		proxy:           proxy,
+		consul:          consul,
+		eurekaEnabled:   fc.Eureka.Enabled,
+		kubernetes:      kubernetes,
+	}, nil
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+func (fc fileConfig) tlsConfig() (tlsConfig, validationErrors) {
+	errs := make(validationErrors, 0)
+	if (fc.TLS.CertFile == "") != (fc.TLS.KeyFile == "") {
+		errs = append(errs, "tls.certFile (TLS_CERT_FILE) and tls.keyFile (TLS_KEY_FILE) must be set together")
+	}
+
+	clientAuth, ok := clientAuthTypes[fc.TLS.ClientAuth]
+	if !ok {
+		errs = append(errs, fmt.Sprintf("tls.clientAuth (TLS_CLIENT_AUTH) must be one of none, request or require, got %q", fc.TLS.ClientAuth))
+	}
+	if clientAuth != tls.NoClientCert && fc.TLS.ClientCAFile == "" {
+		errs = append(errs, "tls.clientCAFile (TLS_CLIENT_CA_FILE) is required to verify client certificates")
+	}
+	if fc.TLS.CertFile == "" && (fc.TLS.ClientCAFile != "" || clientAuth != tls.NoClientCert) {
+		errs = append(errs, "tls.certFile (TLS_CERT_FILE) is required to verify client certificates")
+	}
+
+	return tlsConfig{
+		certFile:     fc.TLS.CertFile,
+		keyFile:      fc.TLS.KeyFile,
+		clientCAFile: fc.TLS.ClientCAFile,
+		clientAuth:   clientAuth,
+		subjectRoles: fc.TLS.SubjectRoles,
+	}, errs
+}
+
+func (fc fileConfig) runtimeConfig() (runtimeConfig, validationErrors) {
+	errs := make(validationErrors, 0)
+
+	var level zapcore.Level
+	err := level.UnmarshalText([]byte(fc.LogLevel))
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("logLevel (LOG_LEVEL) is invalid, got %q", fc.LogLevel))
+	}
+
+	timeout, err := time.ParseDuration(fc.RequestTimeout)
+	if err != nil || timeout < 0 {
+		errs = append(errs, fmt.Sprintf("requestTimeout (REQUEST_TIMEOUT) must be a non negative duration, got %q", fc.RequestTimeout))
 	}
+
+	shutdownDelay, err := time.ParseDuration(fc.ShutdownDelay)
+	if err != nil || shutdownDelay < 0 {
+		errs = append(errs, fmt.Sprintf("shutdownDelay (SHUTDOWN_DELAY) must be a non negative duration, got %q", fc.ShutdownDelay))
+	}
+
+	shutdownTimeout, err := time.ParseDuration(fc.ShutdownTimeout)
+	if err != nil || shutdownTimeout <= 0 {
+		errs = append(errs, fmt.Sprintf("shutdownTimeout (SHUTDOWN_TIMEOUT) must be a positive duration, got %q", fc.ShutdownTimeout))
+	}
+
+	registration, registrationErrs := fc.registrationPolicy()
+	errs = append(errs, registrationErrs...)
+
+	failoverThreshold, err := strconv.Atoi(fc.LocalityFailoverThreshold)
+	if err != nil || failoverThreshold < 0 {
+		errs = append(errs, fmt.Sprintf("localityFailoverThreshold (LOCALITY_FAILOVER_THRESHOLD) must be a non negative integer, got %q", fc.LocalityFailoverThreshold))
+	}
+
+	outliers, outlierErrs := fc.outlierPolicy()
+	errs = append(errs, outlierErrs...)
+
+	return runtimeConfig{
+		logLevel:        level,
+		requestTimeout:  timeout,
+		shutdownDelay:   shutdownDelay,
+		shutdownTimeout: shutdownTimeout,
+		registration:    registration,
+
+		localityFailoverThreshold: failoverThreshold,
+		outliers:                  outliers,
+	}, errs
+}
+
+func (fc fileConfig) registrationPolicy() (models.RegistrationPolicy, validationErrors) {
+	errs := make(validationErrors, 0)
+	const validPolicies = "reject, takeover or takeover-if-unhealthy"
+
+	policy := models.ConflictPolicy(fc.ConflictPolicy)
+	if !policy.Valid() {
+		errs = append(errs, fmt.Sprintf("conflictPolicy (CONFLICT_POLICY) must be one of %s, got %q", validPolicies, fc.ConflictPolicy))
+	}
+
+	applicationPolicies := make(map[string]models.ConflictPolicy, len(fc.ApplicationConflictPolicies))
+	for application, value := range fc.ApplicationConflictPolicies {
+		applicationPolicy := models.ConflictPolicy(value)
+		if !applicationPolicy.Valid() {
+			errs = append(errs, fmt.Sprintf("applicationConflictPolicies.%s must be one of %s, got %q", application, validPolicies, value))
+		}
+		applicationPolicies[application] = applicationPolicy
+	}
+
+	ttl, err := time.ParseDuration(fc.InstanceTTL)
+	if err != nil || ttl < 0 {
+		errs = append(errs, fmt.Sprintf("instanceTTL (INSTANCE_TTL) must be a non negative duration, got %q", fc.InstanceTTL))
+	}
+
+	loadReportTTL, err := time.ParseDuration(fc.LoadReportTTL)
+	if err != nil || loadReportTTL <= 0 {
+		errs = append(errs, fmt.Sprintf("loadReportTTL (LOAD_REPORT_TTL) must be a positive duration, got %q", fc.LoadReportTTL))
+	}
+
+	return models.RegistrationPolicy{
+		ConflictPolicy:              policy,
+		ApplicationPolicies:         applicationPolicies,
+		InstanceTTL:                 ttl,
+		LoadReportTTL:               loadReportTTL,
+		RequireDeclaredApplications: fc.RequireDeclaredApplications,
+	}, errs
+}
+
+func (fc fileConfig) outlierPolicy() (models.OutlierPolicy, validationErrors) {
+	errs := make(validationErrors, 0)
+	cfg := fc.OutlierDetection
+
+	window, err := time.ParseDuration(cfg.Window)
+	if err != nil || window <= 0 {
+		errs = append(errs, fmt.Sprintf("outlierDetection.window (OUTLIER_WINDOW) must be a positive duration, got %q", cfg.Window))
+	}
+
+	threshold, err := strconv.ParseFloat(cfg.ErrorThreshold, 64)
+	if err != nil || threshold < 0 || threshold > 1 {
+		errs = append(errs, fmt.Sprintf("outlierDetection.errorThreshold (OUTLIER_ERROR_THRESHOLD) must be between 0 and 1, got %q", cfg.ErrorThreshold))
+	}
+
+	minRequests, err := strconv.Atoi(cfg.MinRequests)
+	if err != nil || minRequests < 0 {
+		errs = append(errs, fmt.Sprintf("outlierDetection.minRequests (OUTLIER_MIN_REQUESTS) must be a non negative integer, got %q", cfg.MinRequests))
+	}
+
+	baseEjection, err := time.ParseDuration(cfg.BaseEjectionTime)
+	if err != nil || baseEjection <= 0 {
+		errs = append(errs, fmt.Sprintf("outlierDetection.baseEjectionTime (OUTLIER_BASE_EJECTION_TIME) must be a positive duration, got %q", cfg.BaseEjectionTime))
+	}
+
+	maxEjection, err := time.ParseDuration(cfg.MaxEjectionTime)
+	if err != nil || maxEjection < baseEjection {
+		errs = append(errs, fmt.Sprintf("outlierDetection.maxEjectionTime (OUTLIER_MAX_EJECTION_TIME) must be a duration of at least the base ejection time, got %q", cfg.MaxEjectionTime))
+	}
+
+	maxPercent, err := strconv.Atoi(cfg.MaxEjectionPercent)
+	if err != nil || maxPercent < 0 || maxPercent > 100 {
+		errs = append(errs, fmt.Sprintf("outlierDetection.maxEjectionPercent (OUTLIER_MAX_EJECTION_PERCENT) must be an integer between 0 and 100, got %q", cfg.MaxEjectionPercent))
+	}
+
+	return models.OutlierPolicy{
+		Window:             window,
+		ErrorThreshold:     threshold,
+		MinRequests:        minRequests,
+		BaseEjectionTime:   baseEjection,
+		MaxEjectionTime:    maxEjection,
+		MaxEjectionPercent: maxPercent,
+	}, errs
 }
 
-func getJwtCredentials() jwt.Credentials {
-	return jwt.Credentials{
-		Issuer: environ.MustGet("JWT_ISSUER"),
-		Secret: environ.MustGet("JWT_SECRET"),
+func (fc fileConfig) deliveryPolicy() (models.DeliveryPolicy, validationErrors) {
+	errs := make(validationErrors, 0)
+	cfg := fc.Webhooks
+
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil || timeout <= 0 {
+		errs = append(errs, fmt.Sprintf("webhooks.timeout (WEBHOOK_TIMEOUT) must be a positive duration, got %q", cfg.Timeout))
+	}
+
+	maxAttempts, err := strconv.Atoi(cfg.MaxAttempts)
+	if err != nil || maxAttempts < 1 {
+		errs = append(errs, fmt.Sprintf("webhooks.maxAttempts (WEBHOOK_MAX_ATTEMPTS) must be a positive integer, got %q", cfg.MaxAttempts))
 	}
+
+	backoff, err := time.ParseDuration(cfg.RetryBackoff)
+	if err != nil || backoff <= 0 {
+		errs = append(errs, fmt.Sprintf("webhooks.retryBackoff (WEBHOOK_RETRY_BACKOFF) must be a positive duration, got %q", cfg.RetryBackoff))
+	}
+
+	maxBackoff, err := time.ParseDuration(cfg.MaxRetryBackoff)
+	if err != nil || maxBackoff < backoff {
+		errs = append(errs, fmt.Sprintf("webhooks.maxRetryBackoff (WEBHOOK_MAX_RETRY_BACKOFF) must be a duration of at least the retry backoff, got %q", cfg.MaxRetryBackoff))
+	}
+
+	policy := models.DefaultDeliveryPolicy()
+	policy.Timeout = timeout
+	policy.MaxAttempts = maxAttempts
+	policy.RetryBackoff = backoff
+	policy.MaxRetryBackoff = maxBackoff
+	return policy, errs
+}
+
+// Notifiers alerts can be sent to.
+const (
+	logNotifier     = "log"
+	webhookNotifier = "webhook"
+)
+
+func (fc fileConfig) alertNotifiers() ([]string, validationErrors) {
+	errs := make(validationErrors, 0)
+	notifiers := make([]string, 0)
+	for _, name := range strings.Split(fc.Alerting.Notifiers, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name != logNotifier && name != webhookNotifier {
+			errs = append(errs, fmt.Sprintf("alerting.notifiers (ALERT_NOTIFIERS) must only contain %s or %s, got %q", logNotifier, webhookNotifier, name))
+			continue
+		}
+
+		notifiers = append(notifiers, name)
+	}
+
+	return notifiers, errs
+}
+
+func (fc fileConfig) proxyConfig() (proxyConfig, validationErrors) {
+	errs := make(validationErrors, 0)
+	cfg := fc.Proxy
+
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil || timeout <= 0 {
+		errs = append(errs, fmt.Sprintf("proxy.timeout (PROXY_TIMEOUT) must be a positive duration, got %q", cfg.Timeout))
+	}
+
+	dialTimeout, err := time.ParseDuration(cfg.DialTimeout)
+	if err != nil || dialTimeout <= 0 {
+		errs = append(errs, fmt.Sprintf("proxy.dialTimeout (PROXY_DIAL_TIMEOUT) must be a positive duration, got %q", cfg.DialTimeout))
+	}
+
+	retries, err := strconv.Atoi(cfg.Retries)
+	if err != nil || retries < 0 {
+		errs = append(errs, fmt.Sprintf("proxy.retries (PROXY_RETRIES) must be a non negative integer, got %q", cfg.Retries))
+	}
+
+	return proxyConfig{
+		enabled:     cfg.Enabled,
+		timeout:     timeout,
+		dialTimeout: dialTimeout,
+		retries:     retries,
+	}, errs
+}
+
+func (fc fileConfig) consulConfig() (consulConfig, validationErrors) {
+	errs := make(validationErrors, 0)
+	cfg := fc.Consul
+
+	if cfg.Datacenter == "" {
+		errs = append(errs, "consul.datacenter (CONSUL_DATACENTER) must not be empty")
+	}
+
+	pollInterval, err := time.ParseDuration(cfg.PollInterval)
+	if err != nil || pollInterval <= 0 {
+		errs = append(errs, fmt.Sprintf("consul.pollInterval (CONSUL_POLL_INTERVAL) must be a positive duration, got %q", cfg.PollInterval))
+	}
+
+	return consulConfig{
+		enabled:      cfg.Enabled,
+		datacenter:   cfg.Datacenter,
+		pollInterval: pollInterval,
+	}, errs
+}
+
+func (fc fileConfig) kubernetesConfig() (kubernetesConfig, validationErrors) {
+	errs := make(validationErrors, 0)
+	cfg := fc.Kubernetes
+
+	resyncInterval, err := time.ParseDuration(cfg.ResyncInterval)
+	if err != nil || resyncInterval <= 0 {
+		errs = append(errs, fmt.Sprintf("kubernetes.resyncInterval (K8S_SYNC_INTERVAL) must be a positive duration, got %q", cfg.ResyncInterval))
+	}
+
+	if cfg.Cluster == "" {
+		errs = append(errs, "kubernetes.cluster (K8S_SYNC_CLUSTER) must not be empty")
+	}
+
+	return kubernetesConfig{
+		enabled:        cfg.Enabled,
+		kubeconfig:     cfg.Kubeconfig,
+		namespace:      cfg.Namespace,
+		cluster:        cfg.Cluster,
+		resyncInterval: resyncInterval,
+	}, errs
+}
+
+// requiresRestart lists the settings that differ between two configs but can only be applied on restart.
+func (cfg config) requiresRestart(other config) []string {
+	changed := make([]string, 0)
+	if cfg.db != other.db {
+		changed = append(changed, "db")
+	}
+	if cfg.port != other.port {
+		changed = append(changed, "port")
+	}
+	if cfg.migrationsPath != other.migrationsPath {
+		changed = append(changed, "migrationsPath")
+	}
+	if cfg.jwtCredentials != other.jwtCredentials {
+		changed = append(changed, "jwt")
+	}
+	if cfg.tls.certFile != other.tls.certFile || cfg.tls.keyFile != other.tls.keyFile ||
+		cfg.tls.clientCAFile != other.tls.clientCAFile || cfg.tls.clientAuth != other.tls.clientAuth ||
+		!reflect.DeepEqual(cfg.tls.subjectRoles, other.tls.subjectRoles) {
+		changed = append(changed, "tls")
+	}
+
+	return changed
+}
+
+func parseFlag(value string) bool {
+	value = strings.ToLower(strings.TrimSpace(value))
+	return value == "true" || value == "1"
+}
+
+// validationErrors list of problems found when validating a config.
+type validationErrors []string
+
+func (errs validationErrors) Error() string {
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(errs, "; "))
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CzarSimon/httputil/dbutil"
+	"github.com/rtcheap/service-registry/internal/logging"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/service"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+const testConfigFile = `
+db:
+  host: db-host
+  port: "3306"
+  database: serviceregistry
+  username: serviceregistry
+  password: password
+port: "9090"
+jwt:
+  issuer: rtcheap
+  secret: file-secret
+tracing:
+  serviceName: service-registry
+logLevel: warn
+requestTimeout: 5s
+conflictPolicy: reject
+applicationConflictPolicies:
+  media-server: takeover-if-unhealthy
+instanceTTL: 30s
+`
+
+func TestLoadConfig(t *testing.T) {
+	assert := assert.New(t)
+	path := writeTestConfig(t, testConfigFile)
+	defer os.Remove(path)
+
+	os.Setenv("JWT_SECRET", "env-secret")
+	os.Setenv("REQUIRE_DECLARED_APPLICATIONS", "true")
+	defer os.Unsetenv("JWT_SECRET")
+	defer os.Unsetenv("REQUIRE_DECLARED_APPLICATIONS")
+
+	cfg, err := loadConfig(path)
+	assert.NoError(err)
+
+	db, ok := cfg.db.(dbutil.MysqlConfig)
+	assert.True(ok)
+	assert.Equal("db-host", db.Host)
+	assert.Equal("parseTime=true", db.ConnectionParams)
+	assert.Equal("9090", cfg.port)
+	assert.Equal("/etc/service-registry/migrations", cfg.migrationsPath)
+	assert.Equal("rtcheap", cfg.jwtCredentials.Issuer)
+	assert.Equal("env-secret", cfg.jwtCredentials.Secret)
+	assert.Equal("service-registry", cfg.tracing.ServiceName)
+	assert.Equal(zap.WarnLevel, cfg.runtime.logLevel)
+	assert.Equal(5*time.Second, cfg.runtime.requestTimeout)
+	assert.Equal(5*time.Second, cfg.runtime.shutdownDelay)
+	assert.Equal(30*time.Second, cfg.runtime.shutdownTimeout)
+	assert.Equal(10*time.Second, cfg.reloadInterval)
+	assert.Equal(10*time.Second, cfg.reclaimInterval)
+	assert.Equal(models.ConflictReject, cfg.runtime.registration.ConflictPolicyFor("test-app"))
+	assert.Equal(models.ConflictTakeoverUnhealthy, cfg.runtime.registration.ConflictPolicyFor("media-server"))
+	assert.Equal(30*time.Second, cfg.runtime.registration.InstanceTTL)
+	assert.Equal(models.DefaultLoadReportTTL, cfg.runtime.registration.LoadReportTTL)
+	assert.Equal(1, cfg.runtime.localityFailoverThreshold)
+	assert.Equal(models.DefaultOutlierPolicy(), cfg.runtime.outliers)
+	assert.Equal(time.Second, cfg.webhookInterval)
+	assert.Equal(models.DefaultDeliveryPolicy(), cfg.webhooks)
+	assert.Equal(15*time.Second, cfg.alertInterval)
+	assert.Equal([]string{"log", "webhook"}, cfg.alertNotifiers)
+	assert.Equal(proxyConfig{timeout: 30 * time.Second, dialTimeout: 2 * time.Second, retries: 2}, cfg.proxy)
+	assert.Equal(consulConfig{datacenter: "dc1", pollInterval: time.Second}, cfg.consul)
+	assert.False(cfg.eurekaEnabled)
+	assert.Equal(kubernetesConfig{cluster: "default", resyncInterval: 30 * time.Second}, cfg.kubernetes)
+	assert.True(cfg.runtime.registration.RequireDeclaredApplications)
+}
+
+func TestLoadConfig_ReportsAllErrors(t *testing.T) {
+	assert := assert.New(t)
+	path := writeTestConfig(t, "port: \"9090\"\nlogLevel: loud\nrequestTimeout: soon\nconflictPolicy: ignore\nalerting:\n  notifiers: log,pager\n")
+	defer os.Remove(path)
+
+	_, err := loadConfig(path)
+	assert.Error(err)
+
+	errs, ok := err.(validationErrors)
+	assert.True(ok)
+	assert.Len(errs, 11)
+	assert.Contains(errs, "db.host (DB_HOST) is required")
+	assert.Contains(errs, "jwt.secret (JWT_SECRET) is required")
+	assert.Contains(errs, `logLevel (LOG_LEVEL) is invalid, got "loud"`)
+	assert.Contains(errs, `requestTimeout (REQUEST_TIMEOUT) must be a non negative duration, got "soon"`)
+	assert.Contains(errs, `conflictPolicy (CONFLICT_POLICY) must be one of reject, takeover or takeover-if-unhealthy, got "ignore"`)
+	assert.Contains(errs, `alerting.notifiers (ALERT_NOTIFIERS) must only contain log or webhook, got "pager"`)
+
+	path = writeTestConfig(t, "unknownKey: true\n")
+	defer os.Remove(path)
+
+	_, err = loadConfig(path)
+	assert.Error(err)
+
+	_, err = loadConfig("/missing/service-registry.yml")
+	assert.Error(err)
+}
+
+func TestConfigWatcher_Reload(t *testing.T) {
+	assert := assert.New(t)
+	path := writeTestConfig(t, testConfigFile)
+	defer os.Remove(path)
+
+	cfg, err := loadConfig(path)
+	assert.NoError(err)
+
+	e := &env{
+		cfg:      cfg,
+		registry: service.NewRegistryService(nil, nil),
+		settings: newRuntimeSettings(cfg.runtime),
+	}
+	defer logging.SetLevel(zap.DebugLevel)
+	assert.Equal(zap.WarnLevel, logging.Level())
+
+	w := newConfigWatcher(e, func() (config, error) {
+		return loadConfig(path)
+	})
+
+	updated := strings.Replace(testConfigFile, "logLevel: warn\nrequestTimeout: 5s\nconflictPolicy: reject", "logLevel: error\nrequestTimeout: 1s\nconflictPolicy: takeover", 1)
+	err = ioutil.WriteFile(path, []byte(updated), 0644)
+	assert.NoError(err)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+
+	assert.True(w.fileChanged())
+	assert.False(w.fileChanged())
+	w.reload()
+	assert.Equal(zap.ErrorLevel, e.settings.get().logLevel)
+	assert.Equal(time.Second, e.settings.get().requestTimeout)
+	assert.Equal(zap.ErrorLevel, logging.Level())
+	assert.Equal(models.ConflictTakeover, e.registry.Policy().ConflictPolicy)
+
+	// Invalid config should be rejected and the current settings kept.
+	err = ioutil.WriteFile(path, []byte("logLevel: loud\n"), 0644)
+	assert.NoError(err)
+	w.reload()
+	assert.Equal(zap.ErrorLevel, e.settings.get().logLevel)
+	assert.Equal(time.Second, e.settings.get().requestTimeout)
+}
+
+func writeTestConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "service-registry-*.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+// Headers of the Consul API.
+const (
+	consulIndexHeader = "X-Consul-Index"
+	consulTokenHeader = "X-Consul-Token"
+)
+
+// Bounds of how long blocking queries wait for the catalog to change, as in Consul.
+const (
+	defaultConsulWait = 5 * time.Minute
+	maxConsulWait     = 10 * time.Minute
+)
+
+// consulToken lets Consul clients authenticate with their token, sent in the X-Consul-Token
+// header or the token query parameter, by using it as the bearer token of the request.
+func consulToken(c *gin.Context) {
+	if c.GetHeader("Authorization") != "" {
+		return
+	}
+
+	token := c.GetHeader(consulTokenHeader)
+	if token == "" {
+		token = c.Query("token")
+	}
+	if token != "" {
+		c.Request.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// consulCatalogServices lists the registered applications along with the tags of their instances.
+func (e *env) consulCatalogServices(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.consulCatalogServices")
+	defer span.Finish()
+
+	_, err := e.consulBlock(c)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	services, err := e.registry.FindAll(ctx, models.ServiceFilter{})
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	catalog := make(map[string][]string)
+	for _, svc := range services {
+		tags := catalog[svc.Application]
+		if tags == nil {
+			tags = make([]string, 0)
+		}
+		for _, tag := range models.ConsulTags(svc) {
+			if !containsString(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		catalog[svc.Application] = tags
+	}
+	for _, tags := range catalog {
+		sort.Strings(tags)
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, catalog)
+}
+
+// consulCatalogService lists the instances of an application, e.g. ?tag=version=v2.
+func (e *env) consulCatalogService(c *gin.Context) {
+	span, _ := opentracing.StartSpanFromContext(c.Request.Context(), "controller.consulCatalogService")
+	defer span.Finish()
+
+	index, err := e.consulBlock(c)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	services, err := e.findConsulServices(c, false)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	catalog := make([]models.ConsulCatalogService, 0, len(services))
+	for _, svc := range services {
+		catalog = append(catalog, models.NewConsulCatalogService(svc, e.cfg.consul.datacenter, index))
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, catalog)
+}
+
+// consulHealthService lists the instances of an application along with their health,
+// only the healthy ones with ?passing.
+func (e *env) consulHealthService(c *gin.Context) {
+	span, _ := opentracing.StartSpanFromContext(c.Request.Context(), "controller.consulHealthService")
+	defer span.Finish()
+
+	index, err := e.consulBlock(c)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	value, passing := c.GetQuery("passing")
+	services, err := e.findConsulServices(c, passing && value != "false" && value != "0")
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	policy, err := e.registry.ApplicationPolicy(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	now := time.Now()
+	entries := make([]models.ConsulServiceEntry, 0, len(services))
+	for _, svc := range services {
+		entries = append(entries, models.NewConsulServiceEntry(svc, policy, now, e.cfg.consul.datacenter, index))
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, entries)
+}
+
+// findConsulServices looks up the instances of the application named in the path having every tag in the query.
+func (e *env) findConsulServices(c *gin.Context, onlyHealthy bool) ([]models.Service, error) {
+	services, err := e.registry.FindApplicationServices(c.Request.Context(), c.Param("name"), models.ServiceQuery{OnlyHealthy: onlyHealthy})
+	if err != nil {
+		return nil, err
+	}
+
+	tags := c.QueryArray("tag")
+	matching := make([]models.Service, 0, len(services))
+	for _, svc := range services {
+		if models.HasConsulTags(svc, tags) {
+			matching = append(matching, svc)
+		}
+	}
+
+	return matching, nil
+}
+
+// consulBlock handles blocking queries, ?index=<index>&wait=<duration>, by waiting for the catalog to
+// change past the index. Returns the current index, which is also sent in the X-Consul-Index header.
+func (e *env) consulBlock(c *gin.Context) (uint64, error) {
+	index, err := e.catalog.Current(c.Request.Context())
+	if err != nil {
+		return 0, httputil.InternalServerError(err)
+	}
+
+	value, ok := c.GetQuery("index")
+	if ok {
+		after, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, httputil.BadRequestError(fmt.Errorf("invalid index %s", value))
+		}
+
+		wait := defaultConsulWait
+		if value := c.Query("wait"); value != "" {
+			wait, err = time.ParseDuration(value)
+			if err != nil || wait <= 0 {
+				return 0, httputil.BadRequestError(fmt.Errorf("invalid wait %s", value))
+			}
+			if wait > maxConsulWait {
+				wait = maxConsulWait
+			}
+		}
+
+		// An index ahead of the catalog was handed out before the database was reset, so
+		// the client is answered at once and resets its index.
+		if after <= index {
+			index, err = e.catalog.Wait(c.Request.Context(), after, wait)
+			if err != nil {
+				return 0, httputil.InternalServerError(err)
+			}
+		}
+	}
+
+	c.Header(consulIndexHeader, strconv.FormatUint(index, 10))
+	c.Header("X-Consul-KnownLeader", "true")
+	c.Header("X-Consul-LastContact", "0")
+	return index, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/CzarSimon/httputil/client/rpc"
+	"github.com/CzarSimon/httputil/jwt"
+	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+	"github.com/rtcheap/service-registry/internal/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsulCatalog(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	e.cfg.consul = consulConfig{enabled: true, datacenter: "dc1"}
+	e.catalog = service.NewCatalogIndex(repository.NewCatalogRepository(e.db), e.registry)
+	server := newServer(e)
+
+	v1, err := e.registry.Register(ctx, models.Service{
+		Service: dto.Service{Application: "media-server", Location: "ip-0", Port: 8080},
+		Region:  "eu-north-1",
+		Zone:    "eu-north-1a",
+		Labels:  map[string]string{"version": "v1"},
+	})
+	assert.NoError(err)
+	v2, err := e.registry.Register(ctx, models.Service{
+		Service: dto.Service{Application: "media-server", Location: "ip-1", Port: 8080},
+		Labels:  map[string]string{"version": "v2"},
+	})
+	assert.NoError(err)
+	_, err = e.registry.Register(ctx, models.Service{Service: dto.Service{Application: "api", Location: "ip-2", Port: 80}})
+	assert.NoError(err)
+
+	req := createTestRequest("/consul/v1/catalog/services", http.MethodGet, jwt.SystemRole, nil)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	assert.Equal("4", res.Header().Get(consulIndexHeader))
+	var names map[string][]string
+	assert.NoError(rpc.DecodeJSON(res.Result(), &names))
+	assert.Equal(map[string][]string{"api": {}, "media-server": {"version=v1", "version=v2"}}, names)
+
+	// Consul clients authenticate with the X-Consul-Token header.
+	req = createTestRequest("/consul/v1/catalog/service/media-server?tag=version=v1", http.MethodGet, jwt.SystemRole, nil)
+	req.Header.Set(consulTokenHeader, req.Header.Get("Authorization")[len("Bearer "):])
+	req.Header.Del("Authorization")
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	var catalog []models.ConsulCatalogService
+	assert.NoError(rpc.DecodeJSON(res.Result(), &catalog))
+	assert.Len(catalog, 1)
+	assert.Equal(v1.ID, catalog[0].ServiceID)
+	assert.Equal("media-server", catalog[0].ServiceName)
+	assert.Equal("ip-0", catalog[0].Node)
+	assert.Equal("eu-north-1", catalog[0].Datacenter)
+	assert.Equal(8080, catalog[0].ServicePort)
+	assert.Equal([]string{"version=v1"}, catalog[0].ServiceTags)
+
+	_, err = e.registry.SetStatus(ctx, v2.ID, dto.StatusUnhealthy, v2.Epoch, 0)
+	assert.NoError(err)
+
+	entries := findTestConsulHealth(t, server.Handler, "media-server", "")
+	assert.Len(entries, 2)
+	statuses := map[string]string{}
+	for _, entry := range entries {
+		assert.Len(entry.Checks, 1)
+		statuses[entry.Service.ID] = entry.Checks[0].Status
+	}
+	assert.Equal(map[string]string{v1.ID: models.ConsulPassing, v2.ID: models.ConsulCritical}, statuses)
+
+	entries = findTestConsulHealth(t, server.Handler, "media-server", "?passing")
+	assert.Len(entries, 1)
+	assert.Equal(v1.ID, entries[0].Service.ID)
+	assert.Equal("dc1", findTestConsulHealth(t, server.Handler, "api", "?passing=true")[0].Node.Datacenter)
+	assert.Empty(findTestConsulHealth(t, server.Handler, "missing", ""))
+
+	// Instances past the TTL of their application are critical.
+	_, err = e.apps.Create(ctx, models.Application{
+		Name:               "api",
+		Team:               "platform",
+		Contact:            "platform@example.com",
+		InstanceTTLSeconds: 60,
+	})
+	assert.NoError(err)
+	_, err = e.db.Exec("UPDATE service SET heartbeat_at = ? WHERE application = ?", time.Now().UTC().Add(-time.Hour), "api")
+	assert.NoError(err)
+	entries = findTestConsulHealth(t, server.Handler, "api", "")
+	assert.Len(entries, 1)
+	assert.Equal(models.ConsulCritical, entries[0].Checks[0].Status)
+	assert.Empty(findTestConsulHealth(t, server.Handler, "api", "?passing"))
+
+	req = createTestRequest("/consul/v1/health/service/media-server?index=soon", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusBadRequest, res.Code)
+}
+
+func TestConsulBlockingQuery(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	e.cfg.consul = consulConfig{enabled: true, datacenter: "dc1"}
+	e.catalog = service.NewCatalogIndex(repository.NewCatalogRepository(e.db), e.registry)
+	server := newServer(e)
+
+	current, err := e.catalog.Current(ctx)
+	assert.NoError(err)
+	index := strconv.FormatUint(current, 10)
+	start := time.Now()
+	req := createTestRequest("/consul/v1/health/service/api?index="+index+"&wait=50ms", http.MethodGet, jwt.SystemRole, nil)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	assert.True(time.Since(start) >= 50*time.Millisecond)
+	assert.Equal(index, res.Header().Get(consulIndexHeader))
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_, err := e.registry.Register(ctx, models.Service{Service: dto.Service{Application: "api", Location: "ip-0", Port: 80}})
+		assert.NoError(err)
+	}()
+
+	req = createTestRequest("/consul/v1/health/service/api?index="+index+"&wait=5s", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	assert.Equal("2", res.Header().Get(consulIndexHeader))
+	var entries []models.ConsulServiceEntry
+	assert.NoError(rpc.DecodeJSON(res.Result(), &entries))
+	assert.Len(entries, 1)
+
+	// An index the registry has not reached yet is answered at once.
+	start = time.Now()
+	req = createTestRequest("/consul/v1/health/service/api?index=100&wait=5s", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	assert.True(time.Since(start) < time.Second)
+
+	// Changes made through other replicas are noticed by polling the shared index.
+	other := service.NewCatalogIndex(repository.NewCatalogRepository(e.db), service.NewRegistryService(repository.NewServiceRepository(e.db), repository.NewApplicationRepository(e.db)))
+	otherIndex, err := other.Current(ctx)
+	assert.NoError(err)
+	assert.Equal(uint64(2), otherIndex)
+
+	poller := newCatalogPoller(e.catalog, 5*time.Millisecond)
+	poller.start()
+	defer poller.stop()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_, err := e.db.Exec("UPDATE catalog_index SET value = value + 1")
+		assert.NoError(err)
+	}()
+
+	req = createTestRequest("/consul/v1/health/service/api?index=2&wait=5s", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	assert.Equal("3", res.Header().Get(consulIndexHeader))
+
+	// Instances expiring advance the index once.
+	_, err = e.apps.Create(ctx, models.Application{
+		Name:               "api",
+		Team:               "platform",
+		Contact:            "platform@example.com",
+		InstanceTTLSeconds: 60,
+	})
+	assert.NoError(err)
+	_, err = e.db.Exec("UPDATE service SET heartbeat_at = ? WHERE application = ?", time.Now().UTC().Add(20*time.Millisecond-time.Minute), "api")
+	assert.NoError(err)
+	assert.NoError(e.catalog.AdvanceExpired(ctx))
+	current, err = e.catalog.Current(ctx)
+	assert.NoError(err)
+	assert.Equal(uint64(3), current)
+
+	time.Sleep(50 * time.Millisecond)
+	newCleanupWorker(e.allocations, e.affinity, e.catalog, time.Hour).cleanup()
+	assert.NoError(e.catalog.AdvanceExpired(ctx))
+	current, err = e.catalog.Current(ctx)
+	assert.NoError(err)
+	assert.Equal(uint64(4), current)
+}
+
+func findTestConsulHealth(t *testing.T, handler http.Handler, name, query string) []models.ConsulServiceEntry {
+	req := createTestRequest("/consul/v1/health/service/"+name+query, http.MethodGet, jwt.SystemRole, nil)
+	res := performTestRequest(handler, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	var entries []models.ConsulServiceEntry
+	err := rpc.DecodeJSON(res.Result(), &entries)
+	assert.NoError(t, err)
+	return entries
+}
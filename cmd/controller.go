@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/CzarSimon/httputil"
@@ -10,13 +11,14 @@ import (
 	"github.com/opentracing/opentracing-go"
 	tracelog "github.com/opentracing/opentracing-go/log"
 	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
 )
 
 func (e *env) registerService(c *gin.Context) {
 	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.registerService")
 	defer span.Finish()
 
-	var body dto.Service
+	var body models.Service
 	err := c.BindJSON(&body)
 	if err != nil {
 		err = httputil.BadRequestError(fmt.Errorf("failed to parse request body. %w", err))
@@ -25,7 +27,23 @@ func (e *env) registerService(c *gin.Context) {
 		return
 	}
 
+	before, err := e.registry.FindExisting(ctx, body)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
 	svc, err := e.registry.Register(ctx, body)
+	serviceID := svc.ID
+	if serviceID == "" {
+		serviceID = body.ID
+	}
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditRegister,
+		Application: body.Application,
+		ServiceID:   serviceID,
+	}, optionalService(before), svc, err)
 	if err != nil {
 		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
 		c.Error(err)
@@ -33,6 +51,7 @@ func (e *env) registerService(c *gin.Context) {
 	}
 
 	span.LogFields(tracelog.Bool("success", true))
+	setETag(c, svc)
 	c.JSON(http.StatusOK, svc)
 }
 
@@ -48,6 +67,7 @@ func (e *env) findService(c *gin.Context) {
 	}
 
 	span.LogFields(tracelog.Bool("success", true))
+	setETag(c, svc)
 	c.JSON(http.StatusOK, svc)
 }
 
@@ -55,8 +75,150 @@ func (e *env) setServiceStatus(c *gin.Context) {
 	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.setServiceStatus")
 	defer span.Finish()
 
+	version, err := parseIfMatch(c)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	epoch, err := parseEpoch(c)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	id := c.Param("id")
 	status := dto.ServiceStatus(c.Param("status"))
-	err := e.registry.SetStatus(ctx, c.Param("id"), status)
+	before, _ := e.registry.Find(ctx, id)
+	after, err := e.registry.SetStatus(ctx, id, status, epoch, version)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditSetStatus,
+		Application: before.Application,
+		ServiceID:   id,
+	}, optionalService(before), after, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	setETag(c, after)
+	httputil.SendOK(c)
+}
+
+func (e *env) heartbeat(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.heartbeat")
+	defer span.Finish()
+
+	epoch, err := parseEpoch(c)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	err = e.registry.Heartbeat(ctx, c.Param("id"), epoch)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	httputil.SendOK(c)
+}
+
+func (e *env) reportLoad(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.reportLoad")
+	defer span.Finish()
+
+	epoch, err := parseEpoch(c)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	var body models.LoadReport
+	err = c.BindJSON(&body)
+	if err != nil {
+		err = httputil.BadRequestError(fmt.Errorf("failed to parse request body. %w", err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	report, err := e.registry.ReportLoad(ctx, c.Param("id"), epoch, body)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, report)
+}
+
+func (e *env) reportCalls(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.reportCalls")
+	defer span.Finish()
+
+	var body models.CallReport
+	err := c.BindJSON(&body)
+	if err != nil {
+		err = httputil.BadRequestError(fmt.Errorf("failed to parse request body. %w", err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	status, err := e.registry.ReportCalls(ctx, body)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, status)
+}
+
+func (e *env) findOutlierStatus(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.findOutlierStatus")
+	defer span.Finish()
+
+	status, err := e.registry.FindOutlierStatus(ctx, c.Param("id"))
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, status)
+}
+
+func (e *env) deregisterService(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.deregisterService")
+	defer span.Finish()
+
+	version, err := parseIfMatch(c)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	id := c.Param("id")
+	svc, err := e.registry.Deregister(ctx, id, version)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditDeregister,
+		Application: svc.Application,
+		ServiceID:   id,
+	}, optionalService(svc), nil, err)
 	if err != nil {
 		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
 		c.Error(err)
@@ -79,13 +241,42 @@ func (e *env) findApplicationServices(c *gin.Context) {
 		return
 	}
 
-	services, err := e.registry.FindApplicationServices(ctx, application, onlyHealthy)
+	filter, err := parsePortFilter(c)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	order, err := parseLoadOrder(c)
 	if err != nil {
 		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
 		c.Error(err)
 		return
 	}
 
+	locality, err := parseLocality(c, e.settings.get().localityFailoverThreshold)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	services, subset, err := e.findRoutedServices(ctx, application, newRouteRequest(c, c.Query("route-key")), models.ServiceQuery{
+		OnlyHealthy: onlyHealthy,
+		Filter:      filter,
+		Order:       order,
+		Locality:    locality,
+	})
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	if subset != "" {
+		c.Header(routeSubsetHeader, subset)
+	}
 	span.LogFields(tracelog.Bool("success", true))
 	c.JSON(http.StatusOK, services)
 }
@@ -98,3 +289,105 @@ func parseQueryFlag(c *gin.Context, name string, defaultValue bool) bool {
 
 	return strings.ToLower(flag) == "true" || flag == "1"
 }
+
+// parsePortFilter parses the optional port-name and protocol query parameters used to select instances by named port.
+func parsePortFilter(c *gin.Context) (models.ServiceFilter, error) {
+	filter := models.ServiceFilter{
+		PortName: c.Query("port-name"),
+		Protocol: models.Protocol(strings.ToLower(c.Query("protocol"))),
+	}
+
+	if filter.Protocol != "" && !filter.Protocol.Valid() {
+		err := fmt.Errorf("invalid protocol %s", filter.Protocol)
+		return models.ServiceFilter{}, httputil.BadRequestError(err)
+	}
+
+	return filter, nil
+}
+
+// leastLoadedOrder value of the order query parameter that sorts services least loaded first.
+const leastLoadedOrder = "least-loaded"
+
+// parseLoadOrder parses how services are ranked by load, e.g. ?order=least-loaded&load-metric=connections.
+func parseLoadOrder(c *gin.Context) (models.LoadOrder, error) {
+	order := models.LoadOrder{
+		Metric: models.LoadMetric(strings.ToLower(c.Query("load-metric"))),
+	}
+	if order.Metric != "" && !order.Metric.Valid() {
+		err := fmt.Errorf("invalid load-metric %s", order.Metric)
+		return models.LoadOrder{}, httputil.BadRequestError(err)
+	}
+
+	switch value := c.Query("order"); value {
+	case "":
+	case leastLoadedOrder:
+		order.LeastLoadedFirst = true
+	default:
+		err := fmt.Errorf("invalid order %s", value)
+		return models.LoadOrder{}, httputil.BadRequestError(err)
+	}
+
+	return order, nil
+}
+
+// parseLocality parses the zone and region of the caller, e.g. ?zone=eu-west-1a&region=eu-west-1.
+// The failover threshold defaults to the configured threshold.
+func parseLocality(c *gin.Context, defaultThreshold int) (models.Locality, error) {
+	locality := models.Locality{
+		Zone:              c.Query("zone"),
+		Region:            c.Query("region"),
+		FailoverThreshold: defaultThreshold,
+	}
+
+	value, ok := c.GetQuery("failover-threshold")
+	if !ok {
+		return locality, nil
+	}
+
+	threshold, err := strconv.Atoi(value)
+	if err != nil || threshold < 0 {
+		err = fmt.Errorf("invalid failover-threshold %s", value)
+		return models.Locality{}, httputil.BadRequestError(err)
+	}
+
+	locality.FailoverThreshold = threshold
+	return locality, nil
+}
+
+// parseIfMatch parses the expected service version from the If-Match header,
+// returns zero if any version is acceptable.
+func parseIfMatch(c *gin.Context) (int64, error) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+
+	tag := strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || version < 1 {
+		err = fmt.Errorf("invalid If-Match header %s", header)
+		return 0, httputil.BadRequestError(err)
+	}
+
+	return version, nil
+}
+
+// parseEpoch parses the epoch (fencing token) of the caller, returns zero if not present.
+func parseEpoch(c *gin.Context) (int64, error) {
+	value, ok := c.GetQuery("epoch")
+	if !ok {
+		return 0, nil
+	}
+
+	epoch, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || epoch < 1 {
+		err = fmt.Errorf("invalid epoch %s", value)
+		return 0, httputil.BadRequestError(err)
+	}
+
+	return epoch, nil
+}
+
+func setETag(c *gin.Context, svc models.Service) {
+	c.Header("ETag", fmt.Sprintf(`"%d"`, svc.Version))
+}
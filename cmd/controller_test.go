@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
@@ -17,6 +19,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/opentracing/opentracing-go"
 	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
 	"github.com/rtcheap/service-registry/internal/repository"
 	"github.com/rtcheap/service-registry/internal/service"
 	"github.com/stretchr/testify/assert"
@@ -103,7 +106,7 @@ func TestRegister_ExistingService(t *testing.T) {
 		Port:        8080,
 		Status:      dto.StatusHealty,
 	}
-	_, err := repo.Save(ctx, existingSvc)
+	_, _, err := repo.Save(ctx, models.Service{Service: existingSvc}, repository.TakeOver)
 	assert.NoError(err)
 
 	services, err := repo.FindByApplication(ctx, "test-app")
@@ -183,7 +186,7 @@ func TestFindService(t *testing.T) {
 		Port:        8080,
 		Status:      dto.StatusHealty,
 	}
-	_, err := repo.Save(ctx, svc)
+	_, _, err := repo.Save(ctx, models.Service{Service: svc}, repository.TakeOver)
 	assert.NoError(err)
 	req := createTestRequest("/v1/services/"+svcID, http.MethodGet, jwt.SystemRole, nil)
 	res := performTestRequest(server.Handler, req)
@@ -217,11 +220,11 @@ func TestSetServiceServiceStatus(t *testing.T) {
 		Port:        8080,
 		Status:      dto.StatusHealty,
 	}
-	_, err := repo.Save(ctx, svc)
+	_, _, err := repo.Save(ctx, models.Service{Service: svc}, repository.TakeOver)
 	assert.NoError(err)
 
 	var newStatus dto.ServiceStatus = dto.StatusUnhealthy
-	path := fmt.Sprintf("/v1/services/%s/status/%s", svcID, newStatus)
+	path := fmt.Sprintf("/v1/services/%s/status/%s?epoch=1", svcID, newStatus)
 	req := createTestRequest(path, http.MethodPut, jwt.SystemRole, nil)
 	res := performTestRequest(server.Handler, req)
 	assert.Equal(http.StatusOK, res.Code)
@@ -246,6 +249,493 @@ func TestSetServiceServiceStatus(t *testing.T) {
 	assert.Nil(httpErr.Err)
 }
 
+func TestDeregisterService(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	repo := repository.NewServiceRepository(e.db)
+	server := newServer(e)
+
+	svcID := id.New()
+	svc := dto.Service{
+		ID:          svcID,
+		Application: "test-app",
+		Location:    "ip-1",
+		Port:        8080,
+		Status:      dto.StatusHealty,
+	}
+	_, _, err := repo.Save(ctx, models.Service{Service: svc}, repository.TakeOver)
+	assert.NoError(err)
+
+	req := createTestRequest("/v1/services/"+svcID, http.MethodDelete, jwt.SystemRole, nil)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	services, err := repo.FindByApplication(ctx, "test-app")
+	assert.NoError(err)
+	assert.Len(services, 0)
+
+	req = createTestRequest("/v1/services/"+svcID, http.MethodDelete, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+}
+
+func TestOptimisticConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	repo := repository.NewServiceRepository(e.db)
+	server := newServer(e)
+
+	svc := dto.Service{
+		Application: "test-app",
+		Location:    "ip-1",
+		Port:        8080,
+	}
+	req := createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, svc)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	assert.Equal(`"1"`, res.Header().Get("ETag"))
+
+	var registered models.Service
+	err := rpc.DecodeJSON(res.Result(), &registered)
+	assert.NoError(err)
+	assert.Equal(int64(1), registered.Version)
+
+	req = createTestRequest("/v1/services/"+registered.ID, http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	assert.Equal(`"1"`, res.Header().Get("ETag"))
+
+	path := fmt.Sprintf("/v1/services/%s/status/%s?epoch=%d", registered.ID, dto.StatusUnhealthy, registered.Epoch)
+	req = createTestRequest(path, http.MethodPut, jwt.SystemRole, nil)
+	req.Header.Set("If-Match", `"1"`)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	assert.Equal(`"2"`, res.Header().Get("ETag"))
+
+	// Stale writes should be rejected.
+	path = fmt.Sprintf("/v1/services/%s/status/%s?epoch=%d", registered.ID, dto.StatusHealty, registered.Epoch)
+	req = createTestRequest(path, http.MethodPut, jwt.SystemRole, nil)
+	req.Header.Set("If-Match", `"1"`)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusPreconditionFailed, res.Code)
+
+	req = createTestRequest("/v1/services/"+registered.ID, http.MethodDelete, jwt.SystemRole, nil)
+	req.Header.Set("If-Match", `"1"`)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusPreconditionFailed, res.Code)
+
+	req = createTestRequest("/v1/services/"+registered.ID, http.MethodDelete, jwt.SystemRole, nil)
+	req.Header.Set("If-Match", "two")
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusBadRequest, res.Code)
+
+	stored, err := repo.Find(ctx, registered.ID)
+	assert.NoError(err)
+	assert.Equal(dto.StatusUnhealthy, stored.Status)
+	assert.Equal(int64(2), stored.Version)
+
+	// Compare-and-set in the repository.
+	stale := stored
+	stale.Version = 1
+	_, _, err = repo.Save(ctx, stale, repository.TakeOver)
+	assert.Equal(repository.ErrVersionConflict, err)
+
+	saved, _, err := repo.Save(ctx, stored, repository.TakeOver)
+	assert.NoError(err)
+	assert.Equal(int64(3), saved.Version)
+
+	err = repo.Delete(ctx, registered.ID, 2)
+	assert.Equal(repository.ErrVersionConflict, err)
+
+	req = createTestRequest("/v1/services/"+registered.ID, http.MethodDelete, jwt.SystemRole, nil)
+	req.Header.Set("If-Match", `W/"3"`)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	_, err = repo.Find(ctx, registered.ID)
+	assert.Equal(sql.ErrNoRows, err)
+}
+
+func TestEpochFencing(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	repo := repository.NewServiceRepository(e.db)
+	server := newServer(e)
+
+	svc := dto.Service{
+		Application: "test-app",
+		Location:    "ip-1",
+		Port:        8080,
+	}
+	req := createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, svc)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	var oldInstance models.Service
+	err := rpc.DecodeJSON(res.Result(), &oldInstance)
+	assert.NoError(err)
+	assert.Equal(int64(1), oldInstance.Epoch)
+	assert.False(oldInstance.HeartbeatAt.IsZero())
+
+	req = createTestRequest("/v1/services/"+oldInstance.ID+"/heartbeat?epoch=1", http.MethodPut, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	stored, err := repo.Find(ctx, oldInstance.ID)
+	assert.NoError(err)
+	assert.True(stored.HeartbeatAt.After(oldInstance.HeartbeatAt))
+	assert.Equal(oldInstance.Version, stored.Version)
+
+	// Instance restarts on the same location and port.
+	req = createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, svc)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	var newInstance models.Service
+	err = rpc.DecodeJSON(res.Result(), &newInstance)
+	assert.NoError(err)
+	assert.Equal(oldInstance.ID, newInstance.ID)
+	assert.Equal(int64(2), newInstance.Epoch)
+
+	// Late updates from the old process should be rejected.
+	req = createTestRequest("/v1/services/"+oldInstance.ID+"/heartbeat?epoch=1", http.MethodPut, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusConflict, res.Code)
+
+	path := fmt.Sprintf("/v1/services/%s/status/%s?epoch=1", oldInstance.ID, dto.StatusUnhealthy)
+	req = createTestRequest(path, http.MethodPut, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusConflict, res.Code)
+
+	stored, err = repo.Find(ctx, oldInstance.ID)
+	assert.NoError(err)
+	assert.Equal(dto.StatusHealty, stored.Status)
+
+	path = fmt.Sprintf("/v1/services/%s/status/%s?epoch=2", oldInstance.ID, dto.StatusUnhealthy)
+	req = createTestRequest(path, http.MethodPut, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	stored, err = repo.Find(ctx, oldInstance.ID)
+	assert.NoError(err)
+	assert.Equal(dto.StatusUnhealthy, stored.Status)
+	assert.Equal(int64(2), stored.Epoch)
+
+	req = createTestRequest("/v1/services/"+oldInstance.ID+"/heartbeat?epoch=2", http.MethodPut, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	// Epoch is required and must be valid.
+	req = createTestRequest("/v1/services/"+oldInstance.ID+"/heartbeat", http.MethodPut, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusPreconditionRequired, res.Code)
+
+	req = createTestRequest("/v1/services/"+oldInstance.ID+"/heartbeat?epoch=latest", http.MethodPut, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusBadRequest, res.Code)
+
+	req = createTestRequest("/v1/services/"+id.New()+"/heartbeat?epoch=1", http.MethodPut, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+}
+
+func TestRegister_ConflictPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		name           string
+		policy         models.RegistrationPolicy
+		holderStatus   dto.ServiceStatus
+		holderAge      time.Duration
+		expectedStatus int
+	}{
+		{
+			name:           "reject",
+			policy:         models.RegistrationPolicy{ConflictPolicy: models.ConflictReject},
+			holderStatus:   dto.StatusUnhealthy,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "takeover",
+			policy:         models.RegistrationPolicy{ConflictPolicy: models.ConflictTakeover},
+			holderStatus:   dto.StatusHealty,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "takeover-if-unhealthy with healthy holder",
+			policy:         models.RegistrationPolicy{ConflictPolicy: models.ConflictTakeoverUnhealthy, InstanceTTL: time.Minute},
+			holderStatus:   dto.StatusHealty,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "takeover-if-unhealthy with unhealthy holder",
+			policy:         models.RegistrationPolicy{ConflictPolicy: models.ConflictTakeoverUnhealthy, InstanceTTL: time.Minute},
+			holderStatus:   dto.StatusUnhealthy,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "takeover-if-unhealthy with expired holder",
+			policy:         models.RegistrationPolicy{ConflictPolicy: models.ConflictTakeoverUnhealthy, InstanceTTL: time.Minute},
+			holderStatus:   dto.StatusHealty,
+			holderAge:      time.Hour,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "application override",
+			policy: models.RegistrationPolicy{
+				ConflictPolicy:      models.ConflictReject,
+				ApplicationPolicies: map[string]models.ConflictPolicy{"test-app": models.ConflictTakeover},
+			},
+			holderStatus:   dto.StatusHealty,
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		e, ctx := createTestEnv()
+		repo := repository.NewServiceRepository(e.db)
+		server := newServer(e)
+		e.registry.SetPolicy(tc.policy)
+
+		holder, _, err := repo.Save(ctx, models.Service{
+			Service: dto.Service{
+				ID:          id.New(),
+				Application: "other-app",
+				Location:    "ip-1",
+				Port:        8080,
+				Status:      tc.holderStatus,
+			},
+		}, repository.TakeOver)
+		assert.NoError(err, tc.name)
+		_, err = e.db.Exec("UPDATE service SET heartbeat_at = ? WHERE id = ?", time.Now().UTC().Add(-tc.holderAge), holder.ID)
+		assert.NoError(err, tc.name)
+
+		svc := dto.Service{
+			ID:          id.New(),
+			Application: "test-app",
+			Location:    "ip-1",
+			Port:        8080,
+		}
+		req := createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, svc)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(tc.expectedStatus, res.Code, tc.name)
+
+		stored, err := repo.FindByLocation(ctx, "ip-1", 8080)
+		assert.NoError(err, tc.name)
+		if tc.expectedStatus == http.StatusOK {
+			assert.Equal(svc.ID, stored.ID, tc.name)
+			_, err = repo.Find(ctx, holder.ID)
+			assert.Equal(sql.ErrNoRows, err, tc.name)
+		} else {
+			assert.Equal(holder.ID, stored.ID, tc.name)
+		}
+
+		// Registrations without an id update the service holding the location regardless of policy.
+		svc.ID = ""
+		req = createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, svc)
+		res = performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code, tc.name)
+
+		var reregistered models.Service
+		err = rpc.DecodeJSON(res.Result(), &reregistered)
+		assert.NoError(err, tc.name)
+		assert.Equal(stored.ID, reregistered.ID, tc.name)
+		assert.Equal(stored.Epoch+1, reregistered.Epoch, tc.name)
+	}
+}
+
+func TestRegister_ConflictPolicy_MovedService(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	repo := repository.NewServiceRepository(e.db)
+	server := newServer(e)
+
+	// The registering service already exists on another location and its
+	// new location is held by another service, matching two rows.
+	moved, _, err := repo.Save(ctx, models.Service{
+		Service: dto.Service{ID: id.New(), Application: "test-app", Location: "ip-2", Port: 8080, Status: dto.StatusHealty},
+	}, repository.TakeOver)
+	assert.NoError(err)
+	holder, _, err := repo.Save(ctx, models.Service{
+		Service: dto.Service{ID: id.New(), Application: "test-app", Location: "ip-1", Port: 8080, Status: dto.StatusHealty},
+	}, repository.TakeOver)
+	assert.NoError(err)
+
+	svc := dto.Service{
+		ID:          moved.ID,
+		Application: "test-app",
+		Location:    "ip-1",
+		Port:        8080,
+	}
+
+	e.registry.SetPolicy(models.RegistrationPolicy{ConflictPolicy: models.ConflictReject})
+	req := createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, svc)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusConflict, res.Code)
+
+	stored, err := repo.Find(ctx, moved.ID)
+	assert.NoError(err)
+	assert.Equal("ip-2", stored.Location)
+	assert.Equal(int64(1), stored.Epoch)
+	stored, err = repo.Find(ctx, holder.ID)
+	assert.NoError(err)
+	assert.Equal("ip-1", stored.Location)
+
+	e.registry.SetPolicy(models.RegistrationPolicy{ConflictPolicy: models.ConflictTakeover})
+	req = createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, svc)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	var registered models.Service
+	err = rpc.DecodeJSON(res.Result(), &registered)
+	assert.NoError(err)
+	assert.Equal(moved.ID, registered.ID)
+	assert.Equal("ip-1", registered.Location)
+	assert.Equal(int64(2), registered.Epoch)
+
+	_, err = repo.Find(ctx, holder.ID)
+	assert.Equal(sql.ErrNoRows, err)
+	services, err := repo.FindByApplication(ctx, "test-app")
+	assert.NoError(err)
+	assert.Len(services, 1)
+}
+
+func TestRegister_TakeoverDeregistersHolder(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	e.registry.SetPolicy(models.RegistrationPolicy{ConflictPolicy: models.ConflictTakeover})
+
+	var events []models.Event
+	e.registry.OnEvent(func(ctx context.Context, event models.Event) error {
+		events = append(events, event)
+		return nil
+	})
+	var unavailable []string
+	e.registry.OnUnavailable(func(ctx context.Context, svc models.Service) {
+		unavailable = append(unavailable, svc.ID)
+	})
+
+	holder, err := e.registry.Register(ctx, models.Service{
+		Service: dto.Service{ID: id.New(), Application: "test-app", Location: "ip-1", Port: 8080},
+		Labels:  map[string]string{"version": "v1"},
+	})
+	assert.NoError(err)
+	svc, err := e.registry.Register(ctx, models.Service{
+		Service: dto.Service{ID: id.New(), Application: "test-app", Location: "ip-1", Port: 8080},
+	})
+	assert.NoError(err)
+
+	assert.Len(events, 3)
+	assert.Equal(models.EventServiceDeregistered, events[1].Type)
+	assert.Equal(holder.ID, events[1].Service.ID)
+	assert.Equal("v1", events[1].Service.Labels["version"])
+	assert.Equal(models.EventServiceRegistered, events[2].Type)
+	assert.Equal(svc.ID, events[2].Service.ID)
+	assert.Equal([]string{holder.ID}, unavailable)
+
+	// Batch registrations taking over a location deregister the holder in the same way.
+	results, err := e.registry.RegisterAll(ctx, []models.Service{{
+		Service: dto.Service{ID: id.New(), Application: "test-app", Location: "ip-1", Port: 8080},
+	}})
+	assert.NoError(err)
+	assert.Len(results, 1)
+	assert.Len(events, 5)
+	assert.Equal(models.EventServiceDeregistered, events[3].Type)
+	assert.Equal(svc.ID, events[3].Service.ID)
+	assert.Equal(models.EventServiceRegistered, events[4].Type)
+	assert.Equal([]string{holder.ID, svc.ID}, unavailable)
+}
+
+func TestNamedPorts(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	repo := repository.NewServiceRepository(e.db)
+	server := newServer(e)
+
+	mediaServer := models.Service{
+		Service: dto.Service{Application: "media-server", Location: "ip-1"},
+		Ports: []models.ServicePort{
+			{Name: "signalling", Port: 8443, Protocol: models.ProtocolWS},
+			{Name: "rtp", Port: 10000, EndPort: 20000, Protocol: models.ProtocolUDP},
+			{Name: "metrics", Port: 9100, Protocol: models.ProtocolHTTP},
+		},
+	}
+	req := createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, mediaServer)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	var registered models.Service
+	err := rpc.DecodeJSON(res.Result(), &registered)
+	assert.NoError(err)
+	assert.Equal(8443, registered.Port)
+
+	stored, err := repo.Find(ctx, registered.ID)
+	assert.NoError(err)
+	assert.Len(stored.Ports, 3)
+	assert.Equal(models.ServicePort{Name: "metrics", Port: 9100, Protocol: models.ProtocolHTTP}, stored.Ports[1])
+
+	legacy := dto.Service{Application: "media-server", Location: "ip-2", Port: 8080}
+	req = createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, legacy)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	cases := []struct {
+		query        string
+		expectedPort []int
+	}{
+		{query: "", expectedPort: []int{8443, 8080}},
+		{query: "&port-name=rtp", expectedPort: []int{10000}},
+		{query: "&protocol=HTTP", expectedPort: []int{9100}},
+		{query: "&port-name=signalling&protocol=ws", expectedPort: []int{8443}},
+		{query: "&port-name=signalling&protocol=udp", expectedPort: []int{}},
+	}
+	for _, tc := range cases {
+		req = createTestRequest("/v1/services?application=media-server"+tc.query, http.MethodGet, jwt.SystemRole, nil)
+		res = performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var services []models.Service
+		err = rpc.DecodeJSON(res.Result(), &services)
+		assert.NoError(err)
+		ports := make([]int, 0, len(services))
+		for _, svc := range services {
+			ports = append(ports, svc.Port)
+		}
+		assert.ElementsMatch(tc.expectedPort, ports, tc.query)
+	}
+
+	req = createTestRequest("/v1/services?application=media-server&protocol=smtp", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusBadRequest, res.Code)
+
+	invalidPorts := [][]models.ServicePort{
+		{{Name: "", Port: 8080, Protocol: models.ProtocolHTTP}},
+		{{Name: "http", Port: 8080, Protocol: models.ProtocolHTTP}, {Name: "http", Port: 8081, Protocol: models.ProtocolHTTP}},
+		{{Name: "smtp", Port: 25, Protocol: "smtp"}},
+		{{Name: "http", Port: 70000, Protocol: models.ProtocolHTTP}},
+		{{Name: "rtp", Port: 10000, EndPort: 9000, Protocol: models.ProtocolUDP}},
+	}
+	for _, ports := range invalidPorts {
+		invalid := mediaServer
+		invalid.Location = "ip-3"
+		invalid.Ports = ports
+		req = createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, invalid)
+		res = performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusBadRequest, res.Code)
+	}
+
+	// Re-registration replaces the named ports.
+	mediaServer.ID = registered.ID
+	mediaServer.Ports = mediaServer.Ports[:1]
+	req = createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, mediaServer)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	stored, err = repo.Find(ctx, registered.ID)
+	assert.NoError(err)
+	assert.Equal(mediaServer.Ports, stored.Ports)
+}
+
 func TestFindApplicationServices(t *testing.T) {
 	assert := assert.New(t)
 	e, ctx := createTestEnv()
@@ -286,7 +776,7 @@ func TestFindApplicationServices(t *testing.T) {
 	}
 	for i, svc := range storedServices {
 		svc.ID = strconv.Itoa(i + 1)
-		_, err := repo.Save(ctx, svc)
+		_, _, err := repo.Save(ctx, models.Service{Service: svc}, repository.TakeOver)
 		assert.NoError(err)
 	}
 
@@ -348,6 +838,435 @@ func TestFindApplicationServices(t *testing.T) {
 	assert.Equal(http.StatusBadRequest, res.Code)
 }
 
+func TestFindApplicationServices_ExpiredInstances(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	repo := repository.NewServiceRepository(e.db)
+	server := newServer(e)
+
+	_, err := e.apps.Create(ctx, models.Application{
+		Name:               "test-app",
+		Team:               "platform",
+		Contact:            "platform@example.com",
+		InstanceTTLSeconds: 60,
+	})
+	assert.NoError(err)
+
+	for i, location := range []string{"ip-1", "ip-2"} {
+		_, _, err := repo.Save(ctx, models.Service{
+			Service: dto.Service{ID: strconv.Itoa(i + 1), Application: "test-app", Location: location, Port: 8080, Status: dto.StatusHealty},
+		}, repository.TakeOver)
+		assert.NoError(err)
+	}
+	_, err = e.db.Exec("UPDATE service SET heartbeat_at = ? WHERE id = ?", time.Now().UTC().Add(-time.Hour), "2")
+	assert.NoError(err)
+
+	// Instances past the TTL of their application are left out of healthy results.
+	req := createTestRequest("/v1/services?application=test-app", http.MethodGet, jwt.SystemRole, nil)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	var services []dto.Service
+	err = rpc.DecodeJSON(res.Result(), &services)
+	assert.NoError(err)
+	assert.Len(services, 1)
+	assert.Equal("1", services[0].ID)
+
+	req = createTestRequest("/v1/services?application=test-app&only-healthy=false", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	services = nil
+	err = rpc.DecodeJSON(res.Result(), &services)
+	assert.NoError(err)
+	assert.Len(services, 2)
+}
+
+func TestFindApplicationServices_ManyInstances(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+
+	// Details are loaded in batches of 500 instances, every instance must get its own.
+	services := make([]models.Service, 1001)
+	for i := range services {
+		services[i] = models.Service{
+			Service: dto.Service{Application: "test-app", Location: fmt.Sprintf("ip-%d", i), Port: 8080},
+			Zone:    fmt.Sprintf("zone-%d", i%3),
+			Labels:  map[string]string{"index": strconv.Itoa(i)},
+			Ports:   []models.ServicePort{{Name: "http", Port: 8080, Protocol: models.ProtocolHTTP}, {Name: "metrics", Port: 9000 + i, Protocol: models.ProtocolHTTP}},
+		}
+	}
+	results, err := e.registry.RegisterAll(ctx, services)
+	assert.NoError(err)
+	assert.Len(results, len(services))
+
+	found, err := e.registry.FindApplicationServices(ctx, "test-app", models.ServiceQuery{})
+	assert.NoError(err)
+	assert.Len(found, len(services))
+	for _, svc := range found {
+		i, err := strconv.Atoi(svc.Labels["index"])
+		assert.NoError(err)
+		assert.Equal(fmt.Sprintf("ip-%d", i), svc.Location)
+		assert.Equal(fmt.Sprintf("zone-%d", i%3), svc.Zone)
+		assert.Len(svc.Ports, 2)
+		assert.Equal(9000+i, svc.Ports[1].Port)
+	}
+}
+
+func TestReportLoad(t *testing.T) {
+	assert := assert.New(t)
+	e, _ := createTestEnv()
+	server := newServer(e)
+
+	services := make([]models.Service, 0, 3)
+	for i := 0; i < 3; i++ {
+		req := createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, dto.Service{
+			Application: "media-server",
+			Location:    fmt.Sprintf("ip-%d", i),
+			Port:        8080,
+			Status:      dto.StatusHealty,
+		})
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var svc models.Service
+		err := rpc.DecodeJSON(res.Result(), &svc)
+		assert.NoError(err)
+		services = append(services, svc)
+	}
+
+	invalidReports := []struct {
+		route          string
+		report         models.LoadReport
+		expectedStatus int
+	}{
+		{route: "/v1/services/" + services[0].ID + "/load", report: models.LoadReport{CPU: 0.5}, expectedStatus: http.StatusPreconditionRequired},
+		{route: fmt.Sprintf("/v1/services/%s/load?epoch=%d", services[0].ID, services[0].Epoch+1), report: models.LoadReport{CPU: 0.5}, expectedStatus: http.StatusConflict},
+		{route: fmt.Sprintf("/v1/services/%s/load?epoch=%d", services[0].ID, services[0].Epoch), report: models.LoadReport{CPU: 1.5}, expectedStatus: http.StatusBadRequest},
+		{route: fmt.Sprintf("/v1/services/%s/load?epoch=%d", services[0].ID, services[0].Epoch), report: models.LoadReport{ActiveConnections: -1}, expectedStatus: http.StatusBadRequest},
+		{route: "/v1/services/missing-id/load?epoch=1", report: models.LoadReport{CPU: 0.5}, expectedStatus: http.StatusNotFound},
+	}
+	for _, tc := range invalidReports {
+		req := createTestRequest(tc.route, http.MethodPut, jwt.SystemRole, tc.report)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(tc.expectedStatus, res.Code, tc.route)
+	}
+
+	reports := []models.LoadReport{
+		{CPU: 0.8, ActiveConnections: 10},
+		{CPU: 0.2, ActiveConnections: 40},
+	}
+	for i, report := range reports {
+		route := fmt.Sprintf("/v1/services/%s/load?epoch=%d", services[i].ID, services[i].Epoch)
+		req := createTestRequest(route, http.MethodPut, jwt.SystemRole, report)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var stored models.LoadReport
+		err := rpc.DecodeJSON(res.Result(), &stored)
+		assert.NoError(err)
+		assert.False(stored.ReportedAt.IsZero())
+	}
+
+	// Services without a fresh report get the mean weight and are ordered last.
+	cases := []struct {
+		query           string
+		expectedIDs     []string
+		expectedWeights []int
+	}{
+		{
+			query:           "&order=least-loaded",
+			expectedIDs:     []string{services[1].ID, services[0].ID, services[2].ID},
+			expectedWeights: []int{80, 21, 51},
+		},
+		{
+			query:           "&order=least-loaded&load-metric=connections",
+			expectedIDs:     []string{services[0].ID, services[1].ID, services[2].ID},
+			expectedWeights: []int{75, 1, 38},
+		},
+	}
+	for _, tc := range cases {
+		req := createTestRequest("/v1/services?application=media-server"+tc.query, http.MethodGet, jwt.SystemRole, nil)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var found []models.Service
+		err := rpc.DecodeJSON(res.Result(), &found)
+		assert.NoError(err)
+		assert.Len(found, 3)
+		for i, svc := range found {
+			assert.Equal(tc.expectedIDs[i], svc.ID, tc.query)
+			assert.Equal(tc.expectedWeights[i], svc.Weight, tc.query)
+		}
+		assert.NotNil(found[0].Load)
+		assert.Nil(found[2].Load)
+	}
+
+	for _, query := range []string{"&order=most-loaded", "&load-metric=memory"} {
+		req := createTestRequest("/v1/services?application=media-server"+query, http.MethodGet, jwt.SystemRole, nil)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusBadRequest, res.Code)
+	}
+
+	// Stale reports are ignored.
+	e.registry.SetPolicy(models.RegistrationPolicy{ConflictPolicy: models.ConflictTakeover, LoadReportTTL: time.Nanosecond})
+	req := createTestRequest("/v1/services?application=media-server&order=least-loaded", http.MethodGet, jwt.SystemRole, nil)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	var found []models.Service
+	err := rpc.DecodeJSON(res.Result(), &found)
+	assert.NoError(err)
+	assert.Len(found, 3)
+	for _, svc := range found {
+		assert.Nil(svc.Load)
+		assert.Equal(models.MaxWeight, svc.Weight)
+	}
+}
+
+func TestLocalityAwareOrdering(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	repo := repository.NewServiceRepository(e.db)
+	server := newServer(e)
+
+	registrations := []models.Service{
+		{Service: dto.Service{Application: "media-server", Location: "ip-1", Port: 8080}, Region: "eu-1", Zone: "eu-1a"},
+		{Service: dto.Service{Application: "media-server", Location: "ip-2", Port: 8080}, Region: "eu-1", Zone: "eu-1b"},
+		{Service: dto.Service{Application: "media-server", Location: "ip-3", Port: 8080}, Region: "us-1", Zone: "us-1a"},
+		{Service: dto.Service{Application: "media-server", Location: "ip-4", Port: 8080}, Region: "eu-1", Zone: "eu-1a"},
+	}
+	services := make([]models.Service, 0, len(registrations))
+	for _, svc := range registrations {
+		req := createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, svc)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var registered models.Service
+		err := rpc.DecodeJSON(res.Result(), &registered)
+		assert.NoError(err)
+		services = append(services, registered)
+	}
+
+	stored, err := repo.Find(ctx, services[1].ID)
+	assert.NoError(err)
+	assert.Equal("eu-1", stored.Region)
+	assert.Equal("eu-1b", stored.Zone)
+
+	findLocations := func(query string) []string {
+		req := createTestRequest("/v1/services?application=media-server"+query, http.MethodGet, jwt.SystemRole, nil)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var found []models.Service
+		err := rpc.DecodeJSON(res.Result(), &found)
+		assert.NoError(err)
+		locations := make([]string, 0, len(found))
+		for _, svc := range found {
+			locations = append(locations, svc.Location)
+		}
+		return locations
+	}
+
+	assert.ElementsMatch([]string{"ip-1", "ip-2", "ip-3", "ip-4"}, findLocations(""))
+	assert.Equal([]string{"ip-1", "ip-4", "ip-2", "ip-3"}, findLocations("&zone=eu-1a&region=eu-1&failover-threshold=0"))
+	assert.Equal([]string{"ip-1", "ip-4"}, findLocations("&zone=eu-1a&region=eu-1&failover-threshold=2"))
+	assert.Equal([]string{"ip-1", "ip-4", "ip-2", "ip-3"}, findLocations("&zone=eu-1a&region=eu-1&failover-threshold=3"))
+	assert.Equal([]string{"ip-3"}, findLocations("&region=us-1&failover-threshold=1"))
+
+	// The configured threshold applies unless the caller overrides it.
+	e.settings.set(runtimeConfig{localityFailoverThreshold: 1})
+	assert.Equal([]string{"ip-1", "ip-4"}, findLocations("&zone=eu-1a&region=eu-1"))
+
+	// Fail over to the region and then other regions when the zone has no healthy instances.
+	for _, svc := range []models.Service{services[0], services[3]} {
+		route := fmt.Sprintf("/v1/services/%s/status/UNHEALTHY?epoch=%d", svc.ID, svc.Epoch)
+		req := createTestRequest(route, http.MethodPut, jwt.SystemRole, nil)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+	}
+	assert.Equal([]string{"ip-2", "ip-3"}, findLocations("&zone=eu-1a&region=eu-1"))
+	assert.Equal([]string{"ip-1", "ip-4", "ip-2", "ip-3"}, findLocations("&zone=eu-1a&region=eu-1&only-healthy=false"))
+
+	req := createTestRequest("/v1/services?application=media-server&zone=eu-1a&failover-threshold=-1", http.MethodGet, jwt.SystemRole, nil)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusBadRequest, res.Code)
+}
+
+func TestOutlierEjection(t *testing.T) {
+	assert := assert.New(t)
+	e, _ := createTestEnv()
+	server := newServer(e)
+
+	services := make([]models.Service, 0, 4)
+	for i := 0; i < 4; i++ {
+		req := createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, dto.Service{
+			Application: "media-server",
+			Location:    fmt.Sprintf("ip-%d", i),
+			Port:        8080,
+		})
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var svc models.Service
+		err := rpc.DecodeJSON(res.Result(), &svc)
+		assert.NoError(err)
+		services = append(services, svc)
+	}
+
+	reportCalls := func(svc models.Service, report models.CallReport) models.OutlierStatus {
+		report.ServiceID = svc.ID
+		req := createTestRequest("/v1/call-reports", http.MethodPost, jwt.SystemRole, report)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var status models.OutlierStatus
+		err := rpc.DecodeJSON(res.Result(), &status)
+		assert.NoError(err)
+		return status
+	}
+
+	findServices := func(query string) []models.Service {
+		req := createTestRequest("/v1/services?application=media-server"+query, http.MethodGet, jwt.SystemRole, nil)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var found []models.Service
+		err := rpc.DecodeJSON(res.Result(), &found)
+		assert.NoError(err)
+		return found
+	}
+
+	for _, report := range []models.CallReport{{ServiceID: services[0].ID}, {ServiceID: services[0].ID, Successes: -1, Failures: 2}} {
+		req := createTestRequest("/v1/call-reports", http.MethodPost, jwt.SystemRole, report)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusBadRequest, res.Code)
+	}
+
+	req := createTestRequest("/v1/call-reports", http.MethodPost, jwt.SystemRole, models.CallReport{ServiceID: "missing-id", Failures: 1})
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+
+	// Too few calls to judge the instance.
+	status := reportCalls(services[0], models.CallReport{Successes: 2, Failures: 3})
+	assert.Equal(models.CallReport{Successes: 2, Failures: 3}, status.Calls)
+	assert.Nil(status.EjectedUntil)
+	assert.Len(findServices(""), 4)
+
+	status = reportCalls(services[0], models.CallReport{Failures: 6})
+	assert.Equal(1, status.Ejections)
+	assert.NotNil(status.EjectedUntil)
+	assert.WithinDuration(time.Now().Add(30*time.Second), *status.EjectedUntil, 5*time.Second)
+
+	found := findServices("")
+	assert.Len(found, 3)
+	for _, svc := range found {
+		assert.NotEqual(services[0].ID, svc.ID)
+	}
+
+	found = findServices("&only-healthy=false")
+	assert.Len(found, 4)
+	for _, svc := range found {
+		assert.Equal(svc.ID == services[0].ID, svc.EjectedUntil != nil)
+	}
+
+	// Mostly successful calls do not eject the instance.
+	status = reportCalls(services[1], models.CallReport{Successes: 20, Failures: 5})
+	assert.Nil(status.EjectedUntil)
+
+	status = reportCalls(services[2], models.CallReport{Successes: 1, Failures: 19})
+	assert.NotNil(status.EjectedUntil)
+	assert.Len(findServices(""), 2)
+
+	// At most half of the instances are ejected.
+	status = reportCalls(services[3], models.CallReport{Failures: 20})
+	assert.Nil(status.EjectedUntil)
+	assert.Len(findServices(""), 2)
+
+	req = createTestRequest("/v1/services/"+services[3].ID+"/outlier", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	err := rpc.DecodeJSON(res.Result(), &status)
+	assert.NoError(err)
+	assert.Equal(1.0, status.ErrorRatio)
+	assert.Equal(0, status.Ejections)
+
+	// Deregistered instances are no longer tracked.
+	req = createTestRequest("/v1/services/"+services[0].ID, http.MethodDelete, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	req = createTestRequest("/v1/services/"+services[0].ID+"/outlier", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+	assert.Len(findServices(""), 2)
+
+	// Consecutive ejections back off exponentially until the instance has stayed in
+	// rotation for the max ejection time.
+	policy := models.OutlierPolicy{
+		Window:             time.Minute,
+		ErrorThreshold:     0.5,
+		MinRequests:        1,
+		BaseEjectionTime:   10 * time.Millisecond,
+		MaxEjectionTime:    200 * time.Millisecond,
+		MaxEjectionPercent: 50,
+	}
+	assert.Equal(10*time.Millisecond, policy.EjectionTime(1))
+	assert.Equal(80*time.Millisecond, policy.EjectionTime(4))
+	assert.Equal(200*time.Millisecond, policy.EjectionTime(20))
+	assert.Equal(3, policy.MaxEjected(7))
+	e.registry.SetOutlierPolicy(policy)
+
+	proxies := make([]models.Service, 0, 2)
+	for i := 0; i < 2; i++ {
+		svc, err := e.registry.Register(context.Background(), models.Service{
+			Service: dto.Service{Application: "media-proxy", Location: fmt.Sprintf("proxy-%d", i), Port: 8080},
+		})
+		assert.NoError(err)
+		proxies = append(proxies, svc)
+	}
+
+	status = reportCalls(proxies[0], models.CallReport{Failures: 1})
+	assert.Equal(1, status.Ejections)
+	time.Sleep(20 * time.Millisecond)
+	status = reportCalls(proxies[0], models.CallReport{Failures: 1})
+	assert.Equal(2, status.Ejections)
+	time.Sleep(30 * time.Millisecond)
+	status = reportCalls(proxies[0], models.CallReport{Failures: 1})
+	assert.Equal(3, status.Ejections)
+	assert.NotNil(status.EjectedUntil)
+
+	// Only one of the two instances may be ejected.
+	status = reportCalls(proxies[1], models.CallReport{Failures: 1})
+	assert.Nil(status.EjectedUntil)
+
+	time.Sleep(300 * time.Millisecond)
+	status = reportCalls(proxies[0], models.CallReport{Failures: 1})
+	assert.Equal(1, status.Ejections)
+}
+
+func TestOutlierPolicy_MaxEjected(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		instances int
+		percent   int
+		expected  int
+	}{
+		{instances: 0, percent: 50, expected: 0},
+		{instances: 1, percent: 50, expected: 0},
+		{instances: 1, percent: 100, expected: 1},
+		{instances: 2, percent: 10, expected: 1},
+		{instances: 4, percent: 20, expected: 1},
+		{instances: 4, percent: 0, expected: 0},
+		{instances: 7, percent: 50, expected: 3},
+		{instances: 10, percent: 20, expected: 2},
+	}
+	for _, tc := range cases {
+		policy := models.OutlierPolicy{MaxEjectionPercent: tc.percent}
+		assert.Equal(tc.expected, policy.MaxEjected(tc.instances), "instances=%d percent=%d", tc.instances, tc.percent)
+	}
+}
+
 func TestHealthCheck(t *testing.T) {
 	assert := assert.New(t)
 	e, _ := createTestEnv()
@@ -369,6 +1288,8 @@ func TestHealthCheck(t *testing.T) {
 func TestPermissions(t *testing.T) {
 	assert := assert.New(t)
 	e, _ := createTestEnv()
+	e.catalog = service.NewCatalogIndex(repository.NewCatalogRepository(e.db), e.registry)
+	e.eureka = service.NewEurekaService(e.registry)
 	server := newServer(e)
 
 	cases := []struct {
@@ -379,6 +1300,52 @@ func TestPermissions(t *testing.T) {
 		{method: http.MethodGet, route: "/v1/services/some-id"},
 		{method: http.MethodGet, route: "/v1/services?application=some-app"},
 		{method: http.MethodPut, route: "/v1/services/some-id/status/HEALTHY"},
+		{method: http.MethodDelete, route: "/v1/services/some-id"},
+		{method: http.MethodPut, route: "/v1/services/some-id/heartbeat?epoch=1"},
+		{method: http.MethodPost, route: "/v1/services:batch"},
+		{method: http.MethodPut, route: "/v1/applications/some-app/status"},
+		{method: http.MethodPost, route: "/v1/applications"},
+		{method: http.MethodGet, route: "/v1/applications"},
+		{method: http.MethodGet, route: "/v1/applications/some-app"},
+		{method: http.MethodPut, route: "/v1/applications/some-app"},
+		{method: http.MethodDelete, route: "/v1/applications/some-app"},
+		{method: http.MethodPut, route: "/v1/services/some-id/capacity?epoch=1"},
+		{method: http.MethodPut, route: "/v1/services/some-id/load?epoch=1"},
+		{method: http.MethodGet, route: "/v1/services/some-id/outlier"},
+		{method: http.MethodPost, route: "/v1/call-reports"},
+		{method: http.MethodPost, route: "/v1/applications/some-app/allocate"},
+		{method: http.MethodDelete, route: "/v1/reservations/some-id"},
+		{method: http.MethodPut, route: "/v1/applications/some-app/affinity/some-key"},
+		{method: http.MethodGet, route: "/v1/applications/some-app/affinity/some-key"},
+		{method: http.MethodDelete, route: "/v1/applications/some-app/affinity/some-key"},
+		{method: http.MethodGet, route: "/v1/applications/some-app/routes"},
+		{method: http.MethodPut, route: "/v1/applications/some-app/routes"},
+		{method: http.MethodPut, route: "/v1/applications/some-app/routes/weights"},
+		{method: http.MethodPost, route: "/v1/applications/some-app/routes/rollback"},
+		{method: http.MethodDelete, route: "/v1/applications/some-app/routes"},
+		{method: http.MethodPost, route: "/v1/webhooks"},
+		{method: http.MethodGet, route: "/v1/webhooks"},
+		{method: http.MethodGet, route: "/v1/webhooks/some-id"},
+		{method: http.MethodDelete, route: "/v1/webhooks/some-id"},
+		{method: http.MethodGet, route: "/v1/webhooks/some-id/deliveries"},
+		{method: http.MethodPost, route: "/v1/webhooks/some-id/deliveries/other-id/redeliver"},
+		{method: http.MethodGet, route: "/v1/alerts"},
+		{method: http.MethodPost, route: "/v1/alerts/rules"},
+		{method: http.MethodGet, route: "/v1/alerts/rules/some-id"},
+		{method: http.MethodDelete, route: "/v1/alerts/rules/some-id"},
+		{method: http.MethodGet, route: "/v1/sd/prometheus"},
+		{method: http.MethodGet, route: "/v1/render/nginx"},
+		{method: http.MethodGet, route: "/consul/v1/catalog/services"},
+		{method: http.MethodGet, route: "/consul/v1/catalog/service/some-app"},
+		{method: http.MethodGet, route: "/consul/v1/health/service/some-app"},
+		{method: http.MethodGet, route: "/eureka/apps"},
+		{method: http.MethodPost, route: "/eureka/apps/SOME-APP"},
+		{method: http.MethodGet, route: "/eureka/apps/SOME-APP"},
+		{method: http.MethodGet, route: "/eureka/apps/SOME-APP/some-id"},
+		{method: http.MethodPut, route: "/eureka/apps/SOME-APP/some-id"},
+		{method: http.MethodDelete, route: "/eureka/apps/SOME-APP/some-id"},
+		{method: http.MethodPut, route: "/eureka/apps/SOME-APP/some-id/status?value=UP"},
+		{method: http.MethodDelete, route: "/eureka/apps/SOME-APP/some-id/status"},
 	}
 
 	badRoles := []string{jwt.AnonymousRole, jwt.AdminRole, ""}
@@ -394,6 +1361,11 @@ func TestPermissions(t *testing.T) {
 			}
 			assert.Equal(expectedStatus, res.Code)
 		}
+
+		req := createTestRequest(tc.route, tc.method, "", nil)
+		req.Header.Set("Authorization", "Bearer invalid-token")
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusUnauthorized, res.Code)
 	}
 }
 
@@ -404,9 +1376,18 @@ func createTestEnv() (*env, context.Context) {
 		db:             dbutil.SqliteConfig{},
 		migrationsPath: "../resources/db/sqlite",
 		jwtCredentials: getTestJWTCredentials(),
+		webhooks: models.DeliveryPolicy{
+			MaxAttempts:     3,
+			RetryBackoff:    time.Millisecond,
+			MaxRetryBackoff: 4 * time.Millisecond,
+			Timeout:         time.Second,
+			BatchSize:       100,
+		},
 	}
 
 	db := dbutil.MustConnect(cfg.db)
+	// Every connection to an in-memory database opens a new, empty database.
+	db.SetMaxOpenConns(1)
 
 	err := dbutil.Downgrade(cfg.migrationsPath, cfg.db.Driver(), db)
 	if err != nil {
@@ -419,11 +1400,26 @@ func createTestEnv() (*env, context.Context) {
 	}
 
 	repo := repository.NewServiceRepository(db)
+	appRepo := repository.NewApplicationRepository(db)
+	registry := service.NewRegistryService(repo, appRepo)
 
 	e := &env{
-		cfg:      cfg,
-		db:       db,
-		registry: service.NewRegistryService(repo),
+		cfg:         cfg,
+		db:          db,
+		registry:    registry,
+		apps:        service.NewApplicationService(appRepo, repo),
+		routes:      service.NewRoutingService(repository.NewRoutingRepository(db)),
+		allocations: service.NewAllocationService(repository.NewAllocationRepository(db), registry),
+		affinity:    service.NewAffinityService(repository.NewAffinityRepository(db), registry),
+		webhooks:    service.NewWebhookService(repository.NewWebhookRepository(db), registry, cfg.webhooks),
+		audit:       service.NewAuditService(repository.NewAuditRepository(db)),
+		settings:    newRuntimeSettings(cfg.runtime),
+		traceCloser: ioutil.NopCloser(nil),
+	}
+	e.alerts = service.NewAlertService(repository.NewAlertRepository(db), e.registry, service.LogNotifier{}, e.webhooks)
+	e.renderer, err = service.NewRenderService(registry, "")
+	if err != nil {
+		log.Panic("Failed to load config templates", zap.Error(err))
 	}
 
 	return e, context.Background()
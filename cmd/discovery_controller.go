@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+// findPrometheusTargets lists every registered instance in the format of the Prometheus
+// http_sd_config, one target group per instance. With ?metrics-port=true only instances
+// declaring a metrics port are listed.
+func (e *env) findPrometheusTargets(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.findPrometheusTargets")
+	defer span.Finish()
+
+	filter := models.ServiceFilter{}
+	if parseQueryFlag(c, "metrics-port", false) {
+		filter.PortName = models.MetricsPortName
+	}
+
+	services, err := e.registry.FindAll(ctx, filter)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, models.NewPrometheusTargetGroups(services))
+}
+
+// renderTemplate renders a config template, e.g. nginx upstreams, from the current registry contents.
+func (e *env) renderTemplate(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.renderTemplate")
+	defer span.Finish()
+
+	out, err := e.renderer.Render(ctx, c.Param("template"))
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.String(http.StatusOK, out)
+}
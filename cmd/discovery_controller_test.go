@@ -0,0 +1,173 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CzarSimon/httputil/client/rpc"
+	"github.com/CzarSimon/httputil/jwt"
+	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusServiceDiscovery(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	server := newServer(e)
+
+	assert.Empty(findTestPrometheusTargets(t, server.Handler, ""))
+
+	scraped, err := e.registry.Register(ctx, models.Service{
+		Service: dto.Service{Application: "media-server", Location: "ip-0"},
+		Zone:    "eu-north-1a",
+		Labels:  map[string]string{"version": "v1", "app.kubernetes.io/name": "media"},
+		Ports: []models.ServicePort{
+			{Name: "signalling", Port: 8443, Protocol: models.ProtocolWS},
+			{Name: "metrics", Port: 9100, Protocol: models.ProtocolHTTP},
+		},
+	})
+	assert.NoError(err)
+	legacy, err := e.registry.Register(ctx, models.Service{Service: dto.Service{Application: "media-server", Location: "ip-1", Port: 8080}})
+	assert.NoError(err)
+	_, err = e.registry.SetStatus(ctx, legacy.ID, dto.StatusUnhealthy, legacy.Epoch, 0)
+	assert.NoError(err)
+	api, err := e.registry.Register(ctx, models.Service{Service: dto.Service{Application: "api", Location: "10.0.0.2", Port: 80}})
+	assert.NoError(err)
+	replica, err := e.registry.Register(ctx, models.Service{Service: dto.Service{Application: "api", Location: "10.0.0.3", Port: 80}})
+	assert.NoError(err)
+
+	// The service ID label differs between instances, so every instance is its own group,
+	// even when instances of an application share all other labels.
+	groups := findTestPrometheusTargets(t, server.Handler, "")
+	assert.Len(groups, 4)
+	assert.Equal([]string{"10.0.0.2:80"}, groups[0].Targets)
+	assert.Equal(map[string]string{
+		models.PrometheusApplicationLabel: "api",
+		models.PrometheusStatusLabel:      string(dto.StatusHealty),
+		models.PrometheusServiceIDLabel:   api.ID,
+	}, groups[0].Labels)
+	assert.Equal([]string{"10.0.0.3:80"}, groups[1].Targets)
+	assert.Equal(map[string]string{
+		models.PrometheusApplicationLabel: "api",
+		models.PrometheusStatusLabel:      string(dto.StatusHealty),
+		models.PrometheusServiceIDLabel:   replica.ID,
+	}, groups[1].Labels)
+
+	assert.Equal([]string{"ip-0:9100"}, groups[2].Targets)
+	assert.Equal(map[string]string{
+		models.PrometheusApplicationLabel:                         "media-server",
+		models.PrometheusStatusLabel:                              string(dto.StatusHealty),
+		models.PrometheusServiceIDLabel:                           scraped.ID,
+		models.PrometheusZoneLabel:                                "eu-north-1a",
+		models.PrometheusPortNameLabel:                            "metrics",
+		models.PrometheusInstanceLabel + "version":                "v1",
+		models.PrometheusInstanceLabel + "app_kubernetes_io_name": "media",
+	}, groups[2].Labels)
+
+	assert.Equal([]string{"ip-1:8080"}, groups[3].Targets)
+	assert.Equal(string(dto.StatusUnhealthy), groups[3].Labels[models.PrometheusStatusLabel])
+	assert.Equal(legacy.ID, groups[3].Labels[models.PrometheusServiceIDLabel])
+
+	groups = findTestPrometheusTargets(t, server.Handler, "?metrics-port=true")
+	assert.Len(groups, 1)
+	assert.Equal([]string{"ip-0:9100"}, groups[0].Targets)
+	assert.Equal(scraped.ID, groups[0].Labels[models.PrometheusServiceIDLabel])
+}
+
+func findTestPrometheusTargets(t *testing.T, handler http.Handler, query string) []models.PrometheusTargetGroup {
+	req := createTestRequest("/v1/sd/prometheus"+query, http.MethodGet, jwt.SystemRole, nil)
+	res := performTestRequest(handler, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	var groups []models.PrometheusTargetGroup
+	err := rpc.DecodeJSON(res.Result(), &groups)
+	assert.NoError(t, err)
+	return groups
+}
+
+func TestRenderTemplates(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	server := newServer(e)
+
+	_, err := e.registry.Register(ctx, models.Service{Service: dto.Service{ID: "media-0", Application: "media-server", Location: "10.0.0.1", Port: 8080}})
+	assert.NoError(err)
+	unhealthy, err := e.registry.Register(ctx, models.Service{Service: dto.Service{ID: "media-1", Application: "media-server", Location: "10.0.0.2", Port: 8080}})
+	assert.NoError(err)
+	_, err = e.registry.SetStatus(ctx, unhealthy.ID, dto.StatusUnhealthy, unhealthy.Epoch, 0)
+	assert.NoError(err)
+	down, err := e.registry.Register(ctx, models.Service{Service: dto.Service{ID: "api-0", Application: "api.v2", Location: "10.0.0.3", Port: 80}})
+	assert.NoError(err)
+	_, err = e.registry.SetStatus(ctx, down.ID, dto.StatusUnhealthy, down.Epoch, 0)
+	assert.NoError(err)
+
+	// Instances past the TTL of their application are left out.
+	_, err = e.apps.Create(ctx, models.Application{
+		Name:               "media-server",
+		Team:               "platform",
+		Contact:            "platform@example.com",
+		InstanceTTLSeconds: 60,
+	})
+	assert.NoError(err)
+	_, err = e.registry.Register(ctx, models.Service{Service: dto.Service{ID: "media-2", Application: "media-server", Location: "10.0.0.4", Port: 8080}})
+	assert.NoError(err)
+	_, err = e.db.Exec("UPDATE service SET heartbeat_at = ? WHERE id = ?", time.Now().UTC().Add(-time.Hour), "media-2")
+	assert.NoError(err)
+
+	expectedNginx := `# Generated by service-registry, do not edit.
+
+upstream media_server {
+    server 10.0.0.1:8080;
+}
+`
+	assert.Equal(expectedNginx, renderTestTemplate(t, server.Handler, "nginx", http.StatusOK))
+
+	expectedHAProxy := `# Generated by service-registry, do not edit.
+
+backend api_v2
+    balance roundrobin
+    server api-0 10.0.0.3:80 check disabled
+
+backend media_server
+    balance roundrobin
+    server media-0 10.0.0.1:8080 check
+    server media-1 10.0.0.2:8080 check disabled
+`
+	assert.Equal(expectedHAProxy, renderTestTemplate(t, server.Handler, "haproxy", http.StatusOK))
+	renderTestTemplate(t, server.Handler, "envoy", http.StatusNotFound)
+
+	// Templates are loaded from the templates directory and may replace the built-in ones.
+	dir, err := ioutil.TempDir("", "templates")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "hosts.tmpl"), []byte("{{ range .Applications }}{{ .Name }}={{ len .Healthy }}/{{ len .Instances }}\n{{ end }}"), 0644)
+	assert.NoError(err)
+	err = ioutil.WriteFile(filepath.Join(dir, "nginx.tmpl"), []byte("{{ len .Applications }} applications\n"), 0644)
+	assert.NoError(err)
+	err = ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("{{ not a template"), 0644)
+	assert.NoError(err)
+
+	e.renderer, err = service.NewRenderService(e.registry, dir)
+	assert.NoError(err)
+	assert.Equal("api.v2=0/1\nmedia-server=1/2\n", renderTestTemplate(t, server.Handler, "hosts", http.StatusOK))
+	assert.Equal("2 applications\n", renderTestTemplate(t, server.Handler, "nginx", http.StatusOK))
+	assert.Equal(expectedHAProxy, renderTestTemplate(t, server.Handler, "haproxy", http.StatusOK))
+
+	err = ioutil.WriteFile(filepath.Join(dir, "broken.tmpl"), []byte("{{ range .Applications }}"), 0644)
+	assert.NoError(err)
+	_, err = service.NewRenderService(e.registry, dir)
+	assert.Error(err)
+}
+
+func renderTestTemplate(t *testing.T, handler http.Handler, template string, expectedStatus int) string {
+	req := createTestRequest("/v1/render/"+template, http.MethodGet, jwt.SystemRole, nil)
+	res := performTestRequest(handler, req)
+	assert.Equal(t, expectedStatus, res.Code)
+	return res.Body.String()
+}
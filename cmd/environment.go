@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/tls"
 	"database/sql"
+	"errors"
 	"io"
+	"sync/atomic"
 
 	"github.com/CzarSimon/httputil"
 	"github.com/CzarSimon/httputil/dbutil"
@@ -10,7 +13,6 @@ import (
 	"github.com/opentracing/opentracing-go"
 	"github.com/rtcheap/service-registry/internal/repository"
 	"github.com/rtcheap/service-registry/internal/service"
-	jaegercfg "github.com/uber/jaeger-client-go/config"
 	"go.uber.org/zap"
 )
 
@@ -18,10 +20,35 @@ type env struct {
 	cfg         config
 	db          *sql.DB
 	registry    *service.RegistryService
+	apps        *service.ApplicationService
+	allocations *service.AllocationService
+	affinity    *service.AffinityService
+	routes      *service.RoutingService
+	webhooks    *service.WebhookService
+	alerts      *service.AlertService
+	renderer    *service.RenderService
+	gateway     *gateway
+	catalog     *service.CatalogIndex
+	eureka      *service.EurekaService
+	audit       *service.AuditService
+	settings    *runtimeSettings
+	tlsConfig   *tls.Config
+	workers     []worker
 	traceCloser io.Closer
+	notReady    int32
+}
+
+// worker background process that must be stopped before the service shuts down.
+type worker interface {
+	start()
+	stop()
 }
 
 func (e *env) checkHealth() error {
+	if !e.ready() {
+		return httputil.ServiceUnavailableError(errors.New("service is shutting down"))
+	}
+
 	err := dbutil.Connected(e.db)
 	if err != nil {
 		return httputil.ServiceUnavailableError(err)
@@ -30,7 +57,30 @@ func (e *env) checkHealth() error {
 	return nil
 }
 
+func (e *env) ready() bool {
+	return atomic.LoadInt32(&e.notReady) == 0
+}
+
+func (e *env) setNotReady() {
+	atomic.StoreInt32(&e.notReady, 1)
+}
+
+func (e *env) startWorkers() {
+	for _, w := range e.workers {
+		w.start()
+	}
+}
+
+// stopWorkers stops background workers in the reverse order that they were started.
+func (e *env) stopWorkers() {
+	for i := len(e.workers) - 1; i >= 0; i-- {
+		e.workers[i].stop()
+	}
+}
+
 func (e *env) close() {
+	e.stopWorkers()
+
 	err := e.db.Close()
 	if err != nil {
 		log.Error("failed to close database connection", zap.Error(err))
@@ -43,35 +93,111 @@ func (e *env) close() {
 }
 
 func setupEnv() *env {
-	jcfg, err := jaegercfg.FromEnv()
+	cfg, err := getConfig()
 	if err != nil {
-		log.Fatal("failed to create jaeger configuration", zap.Error(err))
+		log.Fatal("failed to load configuration", zap.Error(err))
 	}
 
-	tracer, closer, err := jcfg.NewTracer()
+	tracer, closer, err := cfg.tracing.NewTracer()
 	if err != nil {
 		log.Fatal("failed to create tracer", zap.Error(err))
 	}
 
 	opentracing.SetGlobalTracer(tracer)
 
-	cfg := getConfig()
 	db := dbutil.MustConnect(cfg.db)
 	err = dbutil.Upgrade(cfg.migrationsPath, cfg.db.Driver(), db)
 	if err != nil {
 		log.Fatal("failed to apply database migrations", zap.Error(err))
 	}
 	repo := repository.NewServiceRepository(db)
+	appRepo := repository.NewApplicationRepository(db)
 
-	return &env{
+	e := &env{
 		cfg:         cfg,
 		db:          db,
-		registry:    service.NewRegistryService(repo),
+		registry:    service.NewRegistryService(repo, appRepo),
+		apps:        service.NewApplicationService(appRepo, repo),
+		routes:      service.NewRoutingService(repository.NewRoutingRepository(db)),
+		audit:       service.NewAuditService(repository.NewAuditRepository(db)),
+		settings:    newRuntimeSettings(cfg.runtime),
 		traceCloser: closer,
 	}
+	e.registry.SetPolicy(cfg.runtime.registration)
+	e.registry.SetOutlierPolicy(cfg.runtime.outliers)
+	e.allocations = service.NewAllocationService(repository.NewAllocationRepository(db), e.registry)
+	e.affinity = service.NewAffinityService(repository.NewAffinityRepository(db), e.registry)
+	e.webhooks = service.NewWebhookService(repository.NewWebhookRepository(db), e.registry, cfg.webhooks)
+	e.alerts = service.NewAlertService(repository.NewAlertRepository(db), e.registry, e.alertNotifiers()...)
+	e.renderer, err = service.NewRenderService(e.registry, cfg.templatesPath)
+	if err != nil {
+		log.Fatal("failed to load config templates", zap.Error(err))
+	}
+
+	if cfg.proxy.enabled {
+		e.gateway = newGateway(cfg.proxy)
+	}
+
+	if cfg.consul.enabled {
+		e.catalog = service.NewCatalogIndex(repository.NewCatalogRepository(db), e.registry)
+	}
+
+	if cfg.eurekaEnabled {
+		e.eureka = service.NewEurekaService(e.registry)
+	}
+
+	e.workers = []worker{
+		newConfigWatcher(e, getConfig),
+		newCleanupWorker(e.allocations, e.affinity, e.catalog, cfg.reclaimInterval),
+		newWebhookDispatcher(e.webhooks, cfg.webhookInterval),
+		newAlertEvaluator(e.alerts, cfg.alertInterval),
+	}
+
+	if e.catalog != nil {
+		e.workers = append(e.workers, newCatalogPoller(e.catalog, cfg.consul.pollInterval))
+	}
+
+	if cfg.kubernetes.enabled {
+		client, err := newKubernetesClient(cfg.kubernetes)
+		if err != nil {
+			log.Fatal("failed to create kubernetes client", zap.Error(err))
+		}
+		e.workers = append(e.workers, newKubernetesSyncWorker(client, e.registry, cfg.kubernetes))
+	}
+
+	if cfg.tls.enabled() {
+		certs, err := newCertReloader(cfg.tls.certFile, cfg.tls.keyFile, cfg.reloadInterval)
+		if err != nil {
+			log.Fatal("failed to load TLS certificate", zap.Error(err))
+		}
+
+		e.tlsConfig, err = newTLSConfig(cfg.tls, certs)
+		if err != nil {
+			log.Fatal("failed to create TLS configuration", zap.Error(err))
+		}
+		e.workers = append(e.workers, certs)
+	}
+
+	e.startWorkers()
+	return e
 }
 
 func notImplemented(c *gin.Context) {
 	err := httputil.NotImplementedError(nil)
 	c.Error(err)
 }
+
+// alertNotifiers creates the configured notifiers alerts are sent to.
+func (e *env) alertNotifiers() []service.Notifier {
+	notifiers := make([]service.Notifier, 0, len(e.cfg.alertNotifiers))
+	for _, name := range e.cfg.alertNotifiers {
+		switch name {
+		case logNotifier:
+			notifiers = append(notifiers, service.LogNotifier{})
+		case webhookNotifier:
+			notifiers = append(notifiers, e.webhooks)
+		}
+	}
+
+	return notifiers
+}
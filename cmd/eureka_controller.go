@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+// eurekaDeltaApp app name under which Eureka clients fetch deltas, /eureka/apps/delta.
+const eurekaDeltaApp = "delta"
+
+// eurekaToken lets Eureka clients, which only support basic auth, authenticate
+// by sending a token as the password. The user name is ignored.
+func eurekaToken(c *gin.Context) {
+	_, token, ok := c.Request.BasicAuth()
+	if ok && token != "" {
+		c.Request.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func (e *env) eurekaApplications(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.eurekaApplications")
+	defer span.Finish()
+
+	apps, err := e.eureka.Applications(ctx)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	sendEureka(c, "applications", apps)
+}
+
+// eurekaApplication lists the instances of an app, or the recently changed instances of every app for /eureka/apps/delta.
+func (e *env) eurekaApplication(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.eurekaApplication")
+	defer span.Finish()
+
+	if c.Param("app") == eurekaDeltaApp {
+		delta, err := e.eureka.Delta(ctx)
+		if err != nil {
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			c.Error(err)
+			return
+		}
+
+		span.LogFields(tracelog.Bool("success", true))
+		sendEureka(c, "applications", delta)
+		return
+	}
+
+	app, err := e.eureka.Application(ctx, c.Param("app"))
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	sendEureka(c, "application", app)
+}
+
+func (e *env) eurekaInstance(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.eurekaInstance")
+	defer span.Finish()
+
+	instance, err := e.eureka.Instance(ctx, c.Param("app"), c.Param("instance"))
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	sendEureka(c, "instance", instance)
+}
+
+func (e *env) eurekaRegister(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.eurekaRegister")
+	defer span.Finish()
+
+	instance, err := parseEurekaInstance(c)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	id := instance.InstanceID
+	if id == "" {
+		id = instance.HostName
+	}
+	before, _ := e.registry.Find(ctx, id)
+	svc, err := e.eureka.Register(ctx, c.Param("app"), instance)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditRegister,
+		Application: models.EurekaApplicationName(c.Param("app")),
+		ServiceID:   id,
+	}, optionalService(before), svc, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.Status(http.StatusNoContent)
+}
+
+func (e *env) eurekaRenew(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.eurekaRenew")
+	defer span.Finish()
+
+	err := e.eureka.Renew(ctx, c.Param("app"), c.Param("instance"))
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	httputil.SendOK(c)
+}
+
+func (e *env) eurekaCancel(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.eurekaCancel")
+	defer span.Finish()
+
+	id := c.Param("instance")
+	svc, err := e.eureka.Cancel(ctx, c.Param("app"), id)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditDeregister,
+		Application: models.EurekaApplicationName(c.Param("app")),
+		ServiceID:   id,
+	}, optionalService(svc), nil, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	httputil.SendOK(c)
+}
+
+// eurekaOverrideStatus overrides the status of an instance, ?value=OUT_OF_SERVICE.
+func (e *env) eurekaOverrideStatus(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.eurekaOverrideStatus")
+	defer span.Finish()
+
+	id := c.Param("instance")
+	status := models.EurekaStatus(c.Query("value"))
+	before, _ := e.registry.Find(ctx, id)
+	after, err := e.eureka.OverrideStatus(ctx, c.Param("app"), id, status)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditSetStatus,
+		Application: models.EurekaApplicationName(c.Param("app")),
+		ServiceID:   id,
+	}, optionalService(before), after, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	httputil.SendOK(c)
+}
+
+// eurekaRemoveStatusOverride removes the overridden status of an instance, setting its status to ?value=UP if given.
+func (e *env) eurekaRemoveStatusOverride(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.eurekaRemoveStatusOverride")
+	defer span.Finish()
+
+	id := c.Param("instance")
+	status := models.EurekaStatus(c.Query("value"))
+	before, _ := e.registry.Find(ctx, id)
+	after, err := e.eureka.RemoveStatusOverride(ctx, c.Param("app"), id, status)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditSetStatus,
+		Application: models.EurekaApplicationName(c.Param("app")),
+		ServiceID:   id,
+	}, optionalService(before), after, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	httputil.SendOK(c)
+}
+
+// parseEurekaInstance reads an instance sent as XML, <instance>...</instance>,
+// or as JSON, {"instance": {...}}, depending on the content type.
+func parseEurekaInstance(c *gin.Context) (models.EurekaInstance, error) {
+	var err error
+	var instance models.EurekaInstance
+	if strings.Contains(c.ContentType(), "xml") {
+		err = xml.NewDecoder(c.Request.Body).Decode(&instance)
+	} else {
+		var body struct {
+			Instance models.EurekaInstance `json:"instance"`
+		}
+		err = json.NewDecoder(c.Request.Body).Decode(&body)
+		instance = body.Instance
+	}
+	if err != nil {
+		return models.EurekaInstance{}, httputil.BadRequestError(fmt.Errorf("failed to parse request body. %w", err))
+	}
+
+	return instance, nil
+}
+
+// sendEureka responds with JSON wrapped in an object named after the value if the client
+// accepts JSON, and with XML otherwise, as Eureka does.
+func sendEureka(c *gin.Context, name string, value interface{}) {
+	if strings.Contains(c.GetHeader("Accept"), "json") {
+		c.JSON(http.StatusOK, gin.H{name: value})
+		return
+	}
+
+	c.XML(http.StatusOK, value)
+}
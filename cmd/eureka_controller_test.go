@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/CzarSimon/httputil/jwt"
+	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/service"
+	"github.com/stretchr/testify/assert"
+)
+
+// Registration as sent by Spring Cloud Netflix Eureka clients.
+const testEurekaJSONInstance = `{
+  "instance": {
+    "instanceId": "ip-0:media-server:8080",
+    "app": "MEDIA-SERVER",
+    "hostName": "ip-0",
+    "ipAddr": "10.0.0.1",
+    "status": "UP",
+    "overriddenStatus": "UNKNOWN",
+    "port": {"$": 8080, "@enabled": "true"},
+    "securePort": {"$": 443, "@enabled": "false"},
+    "countryId": 1,
+    "dataCenterInfo": {"@class": "com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo", "name": "MyOwn"},
+    "leaseInfo": {"renewalIntervalInSecs": 30, "durationInSecs": 90},
+    "metadata": {"version": "v1"},
+    "vipAddress": "media-server",
+    "isCoordinatingDiscoveryServer": "false",
+    "lastUpdatedTimestamp": "1581000000000",
+    "lastDirtyTimestamp": "1581000000000"
+  }
+}`
+
+const testEurekaXMLInstance = `<instance>
+  <instanceId>ip-1:api:8443</instanceId>
+  <hostName>ip-1</hostName>
+  <app>API</app>
+  <ipAddr>10.0.0.2</ipAddr>
+  <status>UP</status>
+  <port enabled="false">8080</port>
+  <securePort enabled="true">8443</securePort>
+  <dataCenterInfo class="com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo"><name>MyOwn</name></dataCenterInfo>
+  <metadata><zone>eu-north-1a</zone></metadata>
+</instance>`
+
+func TestEurekaRegistration(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	e.eureka = service.NewEurekaService(e.registry)
+	server := newServer(e)
+
+	req := createTestEurekaRequest("/eureka/apps/MEDIA-SERVER", http.MethodPost, "application/json", testEurekaJSONInstance)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNoContent, res.Code)
+
+	svc, err := e.registry.Find(ctx, "ip-0:media-server:8080")
+	assert.NoError(err)
+	assert.Equal("media-server", svc.Application)
+	assert.Equal("ip-0", svc.Location)
+	assert.Equal(8080, svc.Port)
+	assert.Equal(dto.StatusHealty, svc.Status)
+	assert.Equal(map[string]string{"version": "v1"}, svc.Labels)
+
+	req = createTestEurekaRequest("/eureka/apps/API", http.MethodPost, "application/xml", testEurekaXMLInstance)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNoContent, res.Code)
+
+	req = createTestEurekaRequest("/eureka/apps/API", http.MethodPost, "application/json", `{"instance": {"app": "API"}}`)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusBadRequest, res.Code)
+
+	// Eureka clients fetch XML unless they accept JSON.
+	req = createTestEurekaRequest("/eureka/apps/", http.MethodGet, "", "")
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	var apps models.EurekaApplications
+	assert.NoError(xml.Unmarshal(res.Body.Bytes(), &apps))
+	assert.Equal("UP_2_", apps.HashCode)
+	assert.Len(apps.Applications, 2)
+	assert.Equal("API", apps.Applications[0].Name)
+	api := apps.Applications[0].Instances[0]
+	assert.Equal("ip-1:api:8443", api.InstanceID)
+	assert.False(api.Port.On())
+	assert.Equal(models.EurekaPort{Port: 8443, Enabled: "true"}, api.SecurePort)
+	assert.Equal(models.EurekaMetadata{"zone": "eu-north-1a"}, api.Metadata)
+	assert.Equal("MEDIA-SERVER", apps.Applications[1].Name)
+
+	app := findTestEurekaApplication(t, server.Handler, "MEDIA-SERVER")
+	assert.Len(app.Instances, 1)
+	instance := app.Instances[0]
+	assert.Equal("ip-0", instance.HostName)
+	assert.Equal("MEDIA-SERVER", instance.App)
+	assert.Equal(models.EurekaUp, instance.Status)
+	assert.Equal(models.EurekaPort{Port: 8080, Enabled: "true"}, instance.Port)
+	assert.Equal(models.EurekaMetadata{"version": "v1"}, instance.Metadata)
+	assert.Equal("media-server", instance.VIPAddress)
+
+	req = createTestEurekaRequest("/eureka/apps/MEDIA-SERVER/ip-0:media-server:8080?status=UP", http.MethodPut, "", "")
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	// Renewals of unknown instances make clients register again.
+	req = createTestEurekaRequest("/eureka/apps/MEDIA-SERVER/ip-9:media-server:8080", http.MethodPut, "", "")
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+	req = createTestEurekaRequest("/eureka/apps/API/ip-0:media-server:8080", http.MethodPut, "", "")
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+
+	req = createTestEurekaRequest("/eureka/apps/MEDIA-SERVER/ip-0:media-server:8080", http.MethodDelete, "", "")
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	_, err = e.registry.Find(ctx, "ip-0:media-server:8080")
+	assert.Error(err)
+
+	req = createTestEurekaRequest("/eureka/apps/MEDIA-SERVER", http.MethodGet, "", "")
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+
+	entries := findTestAuditEntries(t, server.Handler, "limit=1000")
+	actions := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	assert.Contains(actions, auditRegister)
+	assert.Contains(actions, auditDeregister)
+}
+
+func TestEurekaStatusOverrideAndDelta(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	e.eureka = service.NewEurekaService(e.registry)
+	server := newServer(e)
+
+	req := createTestEurekaRequest("/eureka/apps/MEDIA-SERVER", http.MethodPost, "application/json", testEurekaJSONInstance)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNoContent, res.Code)
+
+	req = createTestEurekaRequest("/eureka/apps/MEDIA-SERVER/ip-0:media-server:8080/status?value=OUT_OF_SERVICE", http.MethodPut, "", "")
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	svc, err := e.registry.Find(ctx, "ip-0:media-server:8080")
+	assert.NoError(err)
+	assert.Equal(dto.StatusUnhealthy, svc.Status)
+
+	// The override outlives registrations reporting the instance as UP.
+	req = createTestEurekaRequest("/eureka/apps/MEDIA-SERVER", http.MethodPost, "application/json", testEurekaJSONInstance)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNoContent, res.Code)
+
+	instance := findTestEurekaApplication(t, server.Handler, "MEDIA-SERVER").Instances[0]
+	assert.Equal(models.EurekaOutOfService, instance.Status)
+	assert.Equal(models.EurekaOutOfService, instance.OverriddenStatus)
+
+	req = createTestEurekaRequest("/eureka/apps/MEDIA-SERVER/ip-0:media-server:8080/status?value=GONE", http.MethodPut, "", "")
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusBadRequest, res.Code)
+
+	req = createTestEurekaRequest("/eureka/apps/delta", http.MethodGet, "", "")
+	req.Header.Set("Accept", "application/json")
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	var body struct {
+		Applications models.EurekaApplications `json:"applications"`
+	}
+	assert.NoError(json.Unmarshal(res.Body.Bytes(), &body))
+	delta := body.Applications
+	assert.Equal("OUT_OF_SERVICE_1_", delta.HashCode)
+	assert.Len(delta.Applications, 1)
+	assert.Len(delta.Applications[0].Instances, 1)
+	assert.Equal(models.EurekaAdded, delta.Applications[0].Instances[0].ActionType)
+	assert.Equal(models.EurekaOutOfService, delta.Applications[0].Instances[0].Status)
+
+	req = createTestEurekaRequest("/eureka/apps/MEDIA-SERVER/ip-0:media-server:8080/status?value=UP", http.MethodDelete, "", "")
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	instance = findTestEurekaApplication(t, server.Handler, "MEDIA-SERVER").Instances[0]
+	assert.Equal(models.EurekaUp, instance.Status)
+	assert.Equal(models.EurekaUnknown, instance.OverriddenStatus)
+
+	_, err = e.registry.Deregister(ctx, "ip-0:media-server:8080", 0)
+	assert.NoError(err)
+
+	req = createTestEurekaRequest("/eureka/apps/delta", http.MethodGet, "", "")
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	delta = models.EurekaApplications{}
+	assert.NoError(xml.Unmarshal(res.Body.Bytes(), &delta))
+	assert.Equal("", delta.HashCode)
+	assert.Len(delta.Applications, 1)
+	assert.Equal(models.EurekaDeleted, delta.Applications[0].Instances[0].ActionType)
+}
+
+func findTestEurekaApplication(t *testing.T, handler http.Handler, name string) models.EurekaApplication {
+	req := createTestEurekaRequest("/eureka/apps/"+name, http.MethodGet, "", "")
+	req.Header.Set("Accept", "application/json")
+	res := performTestRequest(handler, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	var body struct {
+		Application models.EurekaApplication `json:"application"`
+	}
+	err := json.Unmarshal(res.Body.Bytes(), &body)
+	assert.NoError(t, err)
+	return body.Application
+}
+
+// createTestEurekaRequest creates a request authenticated with basic auth like Eureka clients.
+func createTestEurekaRequest(route, method, contentType, body string) *http.Request {
+	req := createTestRequest(route, method, jwt.SystemRole, nil)
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	req.Header.Del("Authorization")
+	req.SetBasicAuth("eureka", token)
+
+	req.Header.Del("Content-Type")
+	if body != "" {
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	return req
+}
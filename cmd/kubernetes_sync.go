@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+
+	"github.com/rtcheap/service-registry/internal/service"
+	"go.uber.org/zap"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// kubernetesSyncWorker keeps the registry in sync with Kubernetes, syncing whenever services or
+// endpoint slices change and every resync interval.
+type kubernetesSyncWorker struct {
+	*periodicWorker
+	sync      *service.KubernetesSync
+	informers informers.SharedInformerFactory
+}
+
+func newKubernetesSyncWorker(client kubernetes.Interface, registry *service.RegistryService, cfg kubernetesConfig) *kubernetesSyncWorker {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace(cfg.namespace))
+	services := factory.Core().V1().Services().Lister()
+	slices := factory.Discovery().V1().EndpointSlices().Lister()
+
+	w := &kubernetesSyncWorker{
+		sync:      service.NewKubernetesSync(services, slices, registry, cfg.namespace, cfg.cluster),
+		informers: factory,
+	}
+	w.periodicWorker = newPeriodicWorker(cfg.resyncInterval, w.syncEndpoints)
+	return w
+}
+
+// newKubernetesClient creates a client from the kubeconfig file, or the in-cluster config if no file is given.
+func newKubernetesClient(cfg kubernetesConfig) (kubernetes.Interface, error) {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", cfg.kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(restConfig)
+}
+
+// start waits for the informer caches to fill before syncing, as syncing from a cold
+// cache would deregister every mirrored instance.
+func (w *kubernetesSyncWorker) start() {
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { w.notify() },
+		UpdateFunc: func(oldObj, newObj interface{}) { w.notify() },
+		DeleteFunc: func(obj interface{}) { w.notify() },
+	}
+	w.informers.Core().V1().Services().Informer().AddEventHandler(handler)
+	w.informers.Discovery().V1().EndpointSlices().Informer().AddEventHandler(handler)
+	w.informers.Start(w.done)
+	if !w.waitForCacheSync() {
+		return
+	}
+
+	w.notify()
+	w.periodicWorker.start()
+}
+
+// waitForCacheSync waits until the informer caches are filled, returns false if stopped before.
+func (w *kubernetesSyncWorker) waitForCacheSync() bool {
+	for informer, synced := range w.informers.WaitForCacheSync(w.done) {
+		if !synced {
+			log.Warn("stopped before kubernetes cache synced", zap.Stringer("type", informer))
+			return false
+		}
+	}
+
+	return true
+}
+
+func (w *kubernetesSyncWorker) syncEndpoints() {
+	err := w.sync.Sync(context.Background())
+	if err != nil {
+		log.Error("failed to sync kubernetes endpoints", zap.Error(err))
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/service"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestKubernetesSync(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+
+	// The sync reads from the informer caches, which are filled directly instead of by watches.
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	services := factory.Core().V1().Services()
+	slices := factory.Discovery().V1().EndpointSlices()
+	for _, svc := range []*corev1.Service{
+		newTestKubernetesService("media", "media-server", ""),
+		newTestKubernetesService("media", "media-server-canary", "media-server"),
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "media", Name: "unannotated"}},
+	} {
+		assert.NoError(services.Informer().GetIndexer().Add(svc))
+	}
+	for _, slice := range []*discoveryv1.EndpointSlice{
+		newTestEndpointSlice("media", "media-server", "media-server-abc", newTestEndpoint("10.1.0.1", "media-server-0", true), newTestEndpoint("10.1.0.2", "media-server-1", false)),
+		newTestEndpointSlice("media", "unannotated", "unannotated-abc", newTestEndpoint("10.1.0.3", "unannotated-0", true)),
+	} {
+		assert.NoError(slices.Informer().GetIndexer().Add(slice))
+	}
+	sync := service.NewKubernetesSync(services.Lister(), slices.Lister(), e.registry, "", "test")
+
+	manual, err := e.registry.Register(ctx, models.Service{Service: dto.Service{Application: "media-server", Location: "ip-0", Port: 8080}})
+	assert.NoError(err)
+
+	assert.NoError(sync.Sync(ctx))
+	registered, err := e.registry.FindApplicationServices(ctx, "media-server", models.ServiceQuery{})
+	assert.NoError(err)
+	assert.Len(registered, 3)
+
+	mirrored := findTestMirroredServices(t, e)
+	assert.Len(mirrored, 2)
+	ready := mirrored[0]
+	assert.Equal("media-server", ready.Application)
+	assert.Equal("10.1.0.1", ready.Location)
+	assert.Equal(8080, ready.Port)
+	assert.Equal(dto.StatusHealty, ready.Status)
+	assert.Equal("eu-north-1a", ready.Zone)
+	assert.Equal([]models.ServicePort{
+		{Name: "http", Port: 8080, Protocol: models.ProtocolHTTP},
+		{Name: "port-9100", Port: 9100, Protocol: models.ProtocolTCP},
+	}, ready.Ports)
+	assert.Equal(map[string]string{
+		models.SourceLabel:              models.SourceKubernetes,
+		models.KubernetesClusterLabel:   "test",
+		models.KubernetesNamespaceLabel: "media",
+		models.KubernetesServiceLabel:   "media-server",
+		models.KubernetesPodLabel:       "media-server-0",
+		models.KubernetesNodeLabel:      "node-0",
+	}, ready.Labels)
+	assert.Equal("10.1.0.2", mirrored[1].Location)
+	assert.Equal(dto.StatusUnhealthy, mirrored[1].Status)
+
+	// Unchanged endpoints are kept alive without being registered again.
+	assert.NoError(sync.Sync(ctx))
+	unchanged, err := e.registry.Find(ctx, ready.ID)
+	assert.NoError(err)
+	assert.Equal(ready.Version, unchanged.Version)
+
+	slice := newTestEndpointSlice("media", "media-server", "media-server-abc", newTestEndpoint("10.1.0.2", "media-server-1", true))
+	assert.NoError(slices.Informer().GetIndexer().Update(slice))
+
+	assert.NoError(sync.Sync(ctx))
+	mirrored = findTestMirroredServices(t, e)
+	assert.Len(mirrored, 1)
+	assert.Equal("10.1.0.2", mirrored[0].Location)
+	assert.Equal(dto.StatusHealty, mirrored[0].Status)
+
+	// Instances registered by other means or mirrored from other clusters are left alone.
+	_, err = e.registry.Find(ctx, manual.ID)
+	assert.NoError(err)
+	other := models.NewKubernetesServices("other", "media-server", *newTestKubernetesService("media", "media-server", ""),
+		[]discoveryv1.EndpointSlice{*newTestEndpointSlice("media", "media-server", "media-server-xyz", newTestEndpoint("10.2.0.1", "media-server-0", true))})
+	_, err = e.registry.Register(ctx, other[0])
+	assert.NoError(err)
+
+	assert.NoError(slices.Informer().GetIndexer().Delete(slice))
+	assert.NoError(sync.Sync(ctx))
+	assert.Empty(findTestMirroredServices(t, e))
+	_, err = e.registry.Find(ctx, other[0].ID)
+	assert.NoError(err)
+}
+
+func TestKubernetesSyncWorker(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+
+	client := fake.NewSimpleClientset(newTestKubernetesService("media", "media-server", ""))
+	w := newKubernetesSyncWorker(client, e.registry, kubernetesConfig{cluster: "test", resyncInterval: time.Hour})
+	w.start()
+	defer w.stop()
+
+	slice := newTestEndpointSlice("media", "media-server", "media-server-abc", newTestEndpoint("10.1.0.1", "media-server-0", true))
+	_, err := client.DiscoveryV1().EndpointSlices("media").Create(ctx, slice, metav1.CreateOptions{})
+	assert.NoError(err)
+	assert.Eventually(func() bool {
+		return len(findTestMirroredServices(t, e)) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	err = client.CoreV1().Services("media").Delete(ctx, "media-server", metav1.DeleteOptions{})
+	assert.NoError(err)
+	assert.Eventually(func() bool {
+		return len(findTestMirroredServices(t, e)) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestKubernetesSyncWorker_WaitsForCacheSync(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+
+	svc := newTestKubernetesService("media", "media-server", "")
+	slice := newTestEndpointSlice("media", "media-server", "media-server-abc", newTestEndpoint("10.1.0.1", "media-server-0", true))
+	mirrored := models.NewKubernetesServices("test", "media-server", *svc, []discoveryv1.EndpointSlice{*slice})
+	_, err := e.registry.Register(ctx, mirrored[0])
+	assert.NoError(err)
+
+	var deregistered []string
+	e.registry.OnEvent(func(ctx context.Context, event models.Event) error {
+		if event.Type == models.EventServiceDeregistered {
+			deregistered = append(deregistered, event.Service.ID)
+		}
+		return nil
+	})
+
+	other := newTestKubernetesService("media", "signalling", "")
+	otherSlice := newTestEndpointSlice("media", "signalling", "signalling-abc", newTestEndpoint("10.1.0.2", "signalling-0", true))
+	client := fake.NewSimpleClientset(svc, slice, other, otherSlice)
+	w := newKubernetesSyncWorker(client, e.registry, kubernetesConfig{cluster: "test", resyncInterval: time.Hour})
+	w.start()
+
+	// Instances that still exist are not deregistered by a sync from an empty cache.
+	assert.Eventually(func() bool {
+		return len(findTestMirroredServices(t, e)) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	w.stop()
+	assert.Empty(deregistered)
+}
+
+func findTestMirroredServices(t *testing.T, e *env) []models.Service {
+	services, err := e.registry.FindAll(context.Background(), models.ServiceFilter{
+		Labels: map[string]string{models.KubernetesClusterLabel: "test"},
+	})
+	assert.NoError(t, err)
+	return services
+}
+
+func newTestKubernetesService(namespace, name, application string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        name,
+			Annotations: map[string]string{models.KubernetesApplicationAnnotation: application},
+		},
+	}
+}
+
+func newTestEndpointSlice(namespace, service, name string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	portName := "http"
+	appProtocol := "http"
+	port := int32(8080)
+	metricsPort := int32(9100)
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports: []discoveryv1.EndpointPort{
+			{Name: &portName, Port: &port, AppProtocol: &appProtocol},
+			{Port: &metricsPort},
+		},
+	}
+}
+
+func newTestEndpoint(address, pod string, ready bool) discoveryv1.Endpoint {
+	node := "node-0"
+	zone := "eu-north-1a"
+	return discoveryv1.Endpoint{
+		Addresses:  []string{address},
+		Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		TargetRef:  &corev1.ObjectReference{Kind: "Pod", Namespace: "media", Name: pod},
+		NodeName:   &node,
+		Zone:       &zone,
+	}
+}
@@ -1,29 +1,69 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/CzarSimon/httputil"
 	"github.com/CzarSimon/httputil/jwt"
-	"github.com/CzarSimon/httputil/logger"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/rtcheap/service-registry/internal/logging"
 	"go.uber.org/zap"
 )
 
-var log = logger.GetDefaultLogger("service-registry/main")
+var log = logging.GetLogger("service-registry/main")
 
 func main() {
 	e := setupEnv()
-	defer e.close()
-
 	server := newServer(e)
-	log.Info("Started service-registry listening on port: " + e.cfg.port)
 
-	err := server.ListenAndServe()
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Info("Started service-registry listening on port: " + e.cfg.port)
+		if server.TLSConfig != nil {
+			serverErr <- server.ListenAndServeTLS("", "")
+			return
+		}
+		serverErr <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case sig := <-signals:
+		log.Info("Received signal, shutting down.", zap.Stringer("signal", sig))
+	case err := <-serverErr:
+		// The server is not serving, so there is nothing to drain.
+		log.Error("Unexpected error stopped server.", zap.Error(err))
+		e.close()
+		os.Exit(1)
+	}
+
+	shutdown(e, server)
+}
+
+// shutdown marks the service as not ready, waits for in-flight requests to complete
+// and then stops background workers and closes the database and tracer connections.
+func shutdown(e *env, server *http.Server) {
+	cfg := e.settings.get()
+	e.setNotReady()
+	time.Sleep(cfg.shutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
 	if err != nil {
-		log.Error("Unexpected error stoped server.", zap.Error(err))
+		log.Error("Failed to drain in-flight requests before shutdown deadline.", zap.Error(err))
 	}
+
+	e.close()
+	log.Info("Stopped service-registry")
 }
 
 func newServer(e *env) *http.Server {
@@ -32,15 +72,80 @@ func newServer(e *env) *http.Server {
 	rbac := httputil.RBAC{
 		Verifier: jwt.NewVerifier(e.cfg.jwtCredentials, time.Minute),
 	}
-	v1 := r.Group("/v1", rbac.Secure(jwt.SystemRole))
+	v1 := r.Group("/v1", e.secure(rbac, jwt.SystemRole), e.withTimeout())
 
 	v1.POST("/services", e.registerService)
+	v1.POST("/services:action", e.serviceAction)
 	v1.GET("/services", e.findApplicationServices)
 	v1.GET("/services/:id", e.findService)
 	v1.PUT("/services/:id/status/:status", e.setServiceStatus)
+	v1.PUT("/services/:id/heartbeat", e.heartbeat)
+	v1.DELETE("/services/:id", e.deregisterService)
+	v1.PUT("/services/:id/capacity", e.setCapacity)
+	v1.PUT("/services/:id/load", e.reportLoad)
+	v1.GET("/services/:id/outlier", e.findOutlierStatus)
+	v1.POST("/call-reports", e.reportCalls)
+	v1.POST("/applications", e.createApplication)
+	v1.GET("/applications", e.findApplications)
+	v1.GET("/applications/:name", e.findApplication)
+	v1.PUT("/applications/:name", e.updateApplication)
+	v1.DELETE("/applications/:name", e.deleteApplication)
+	v1.PUT("/applications/:name/status", e.setApplicationStatus)
+	v1.POST("/applications/:name/allocate", e.allocateSession)
+	v1.PUT("/applications/:name/affinity/:key", e.bindAffinity)
+	v1.GET("/applications/:name/affinity/:key", e.lookupAffinity)
+	v1.DELETE("/applications/:name/affinity/:key", e.unbindAffinity)
+	v1.GET("/applications/:name/routes", e.findRoutes)
+	v1.PUT("/applications/:name/routes", e.saveRoutes)
+	v1.PUT("/applications/:name/routes/weights", e.shiftRouteWeights)
+	v1.POST("/applications/:name/routes/rollback", e.rollbackRoutes)
+	v1.DELETE("/applications/:name/routes", e.deleteRoutes)
+	v1.DELETE("/reservations/:id", e.releaseReservation)
+	v1.POST("/webhooks", e.createWebhook)
+	v1.GET("/webhooks", e.findWebhooks)
+	v1.GET("/webhooks/:id", e.findWebhook)
+	v1.DELETE("/webhooks/:id", e.deleteWebhook)
+	v1.GET("/webhooks/:id/deliveries", e.findWebhookDeliveries)
+	v1.POST("/webhooks/:id/deliveries/:deliveryId/redeliver", e.redeliverWebhook)
+	v1.GET("/alerts", e.findAlerts)
+	v1.POST("/alerts/rules", e.createAlertRule)
+	v1.GET("/alerts/rules/:id", e.findAlertRule)
+	v1.DELETE("/alerts/rules/:id", e.deleteAlertRule)
+	v1.GET("/sd/prometheus", e.findPrometheusTargets)
+	v1.GET("/render/:template", e.renderTemplate)
+
+	if e.gateway != nil {
+		r.Any(proxyPrefix+":application/*path", e.secure(rbac, jwt.SystemRole), e.proxy)
+	}
+
+	// Blocking queries wait for up to 10 minutes, so the request timeout does not apply.
+	if e.catalog != nil {
+		consul := r.Group("/consul/v1", consulToken, e.secure(rbac, jwt.SystemRole))
+		consul.GET("/catalog/services", e.consulCatalogServices)
+		consul.GET("/catalog/service/:name", e.consulCatalogService)
+		consul.GET("/health/service/:name", e.consulHealthService)
+	}
+
+	if e.eureka != nil {
+		eureka := r.Group("/eureka/apps", eurekaToken, e.secure(rbac, jwt.SystemRole), e.withTimeout())
+		// Spring Cloud clients fetch apps/ with a trailing slash.
+		eureka.GET("", e.eurekaApplications)
+		eureka.GET("/", e.eurekaApplications)
+		eureka.POST("/:app", e.eurekaRegister)
+		eureka.GET("/:app", e.eurekaApplication)
+		eureka.GET("/:app/:instance", e.eurekaInstance)
+		eureka.PUT("/:app/:instance", e.eurekaRenew)
+		eureka.DELETE("/:app/:instance", e.eurekaCancel)
+		eureka.PUT("/:app/:instance/status", e.eurekaOverrideStatus)
+		eureka.DELETE("/:app/:instance/status", e.eurekaRemoveStatusOverride)
+	}
+
+	admin := r.Group("/v1/admin", e.secure(rbac, jwt.AdminRole), e.withTimeout())
+	admin.GET("/audit", e.findAuditEntries)
 
 	return &http.Server{
-		Addr:    ":" + e.cfg.port,
-		Handler: r,
+		Addr:      ":" + e.cfg.port,
+		Handler:   r,
+		TLSConfig: e.tlsConfig,
 	}
 }
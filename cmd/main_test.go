@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	assert := assert.New(t)
+	e, _ := createTestEnv()
+	e.settings.set(runtimeConfig{shutdownTimeout: time.Second})
+	w := &testWorker{}
+	e.workers = []worker{w}
+	e.startWorkers()
+	server := newServer(e)
+
+	started := make(chan struct{})
+	server.Handler.(*gin.Engine).GET("/slow", func(c *gin.Context) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		httputil.SendOK(c)
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	go server.Serve(ln)
+
+	status := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + ln.Addr().String() + "/slow")
+		if err != nil {
+			status <- 0
+			return
+		}
+		res.Body.Close()
+		status <- res.StatusCode
+	}()
+
+	<-started
+	shutdown(e, server)
+
+	assert.Equal(http.StatusOK, <-status)
+	assert.False(e.ready())
+	assert.True(w.started)
+	assert.True(w.stopped)
+	assert.Error(e.db.Ping())
+
+	_, err = http.Get("http://" + ln.Addr().String() + "/health")
+	assert.Error(err)
+}
+
+func TestHealthCheck_NotReady(t *testing.T) {
+	assert := assert.New(t)
+	e, _ := createTestEnv()
+	server := newServer(e)
+
+	e.setNotReady()
+	req := createTestRequest("/health", http.MethodGet, "", nil)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusServiceUnavailable, res.Code)
+}
+
+type testWorker struct {
+	started bool
+	stopped bool
+}
+
+func (w *testWorker) start() {
+	w.started = true
+}
+
+func (w *testWorker) stop() {
+	w.stopped = true
+}
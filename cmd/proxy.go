@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	reverseproxy "net/http/httputil"
+	"strings"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+	"go.uber.org/zap"
+)
+
+// Headers of proxied requests and responses.
+const (
+	// proxyRouteKeyHeader routes requests with the same key to the same subset of instances.
+	proxyRouteKeyHeader = "X-Route-Key"
+	// proxyInstanceHeader id of the instance that served a proxied request.
+	proxyInstanceHeader = "X-Registry-Instance"
+)
+
+const proxyPrefix = "/proxy/"
+
+// proxyTargetsKey context key of the instances a proxied request may be sent to.
+type proxyTargetsKey struct{}
+
+// proxyTargets instances a proxied request may be sent to in order of preference,
+// along with the id of the instance connected to.
+type proxyTargets struct {
+	candidates []models.Service
+	connected  string
+}
+
+// gateway forwards requests through a transport that connects to the instances picked for each
+// request, moving on to the next instance when a connection fails.
+type gateway struct {
+	cfg       proxyConfig
+	dialer    *net.Dialer
+	transport *http.Transport
+}
+
+func newGateway(cfg proxyConfig) *gateway {
+	g := &gateway{
+		cfg:    cfg,
+		dialer: &net.Dialer{Timeout: cfg.dialTimeout},
+	}
+	g.transport = &http.Transport{
+		DialContext:           g.dial,
+		ResponseHeaderTimeout: cfg.timeout,
+		// Connections are not reused as every request dials the instances picked for it.
+		DisableKeepAlives: true,
+	}
+
+	return g
+}
+
+// dial connects to the first reachable instance picked for the request, trying at most
+// cfg.retries other instances. Nothing has been sent when dialing fails, so retrying is
+// safe for any request.
+func (g *gateway) dial(ctx context.Context, network, _ string) (net.Conn, error) {
+	targets, ok := ctx.Value(proxyTargetsKey{}).(*proxyTargets)
+	if !ok {
+		return nil, errors.New("no instances picked for proxied request")
+	}
+
+	failures := make([]string, 0)
+	for i, svc := range targets.candidates {
+		if i > g.cfg.retries {
+			break
+		}
+
+		conn, err := g.dialer.DialContext(ctx, network, svc.Address())
+		if err == nil {
+			targets.connected = svc.ID
+			return conn, nil
+		}
+
+		log.Warn("failed to connect to instance",
+			zap.String("application", svc.Application),
+			zap.String("serviceId", svc.ID),
+			zap.Error(err))
+		failures = append(failures, fmt.Sprintf("%s: %v", svc.Address(), err))
+	}
+
+	return nil, fmt.Errorf("failed to connect to any instance. %s", strings.Join(failures, "; "))
+}
+
+// proxy forwards requests to /proxy/<application>/<path> to <path> on a healthy instance of the
+// application, picked by its routing rules and weighted by load. WebSocket upgrades are supported.
+func (e *env) proxy(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.proxy")
+	defer span.Finish()
+
+	application := c.Param("application")
+	app, err := e.apps.Find(ctx, application)
+	if err == nil && !app.ProxyEnabled {
+		err = httputil.ForbiddenError(fmt.Errorf("proxying to application %s is disabled", application))
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	routeReq := newRouteRequest(c, c.GetHeader(proxyRouteKeyHeader))
+	services, _, err := e.findRoutedServices(ctx, application, routeReq, models.ServiceQuery{OnlyHealthy: true})
+	if err == nil && len(services) == 0 {
+		err = httputil.ServiceUnavailableError(fmt.Errorf("application %s has no healthy instances", application))
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+	models.ShuffleByWeight(services)
+
+	targets := &proxyTargets{candidates: services}
+	req := c.Request.WithContext(context.WithValue(ctx, proxyTargetsKey{}, targets))
+	prefix := proxyPrefix + application
+	target := *req.URL
+	target.Path = strings.TrimPrefix(target.Path, prefix)
+	target.RawPath = strings.TrimPrefix(target.RawPath, prefix)
+	req.URL = &target
+
+	var proxyErr error
+	proxy := &reverseproxy.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL.Scheme = "http"
+			out.URL.Host = application
+			out.Header.Set("X-Forwarded-Host", c.Request.Host)
+			out.Header.Set("X-Forwarded-Prefix", prefix)
+		},
+		Transport: e.gateway.transport,
+		ModifyResponse: func(res *http.Response) error {
+			res.Header.Set(proxyInstanceHeader, targets.connected)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			proxyErr = err
+		},
+	}
+	proxy.ServeHTTP(c.Writer, req)
+
+	if proxyErr != nil {
+		err = proxyError(application, proxyErr)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+}
+
+// proxyError reports instances that did not respond in time as a gateway timeout and other failures as a bad gateway.
+func proxyError(application string, err error) error {
+	err = fmt.Errorf("failed to proxy request to application %s. %w", application, err)
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return httputil.NewError(http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout, err)
+	}
+
+	return httputil.BadGatewayError(err)
+}
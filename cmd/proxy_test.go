@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CzarSimon/httputil/jwt"
+	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type proxiedRequest struct {
+	Instance string `json:"instance"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Query    string `json:"query"`
+	Body     string `json:"body"`
+	Prefix   string `json:"prefix"`
+}
+
+func newTestBackend(name string, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") == "websocket" {
+			echoUpgraded(w)
+			return
+		}
+
+		time.Sleep(delay)
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(proxiedRequest{
+			Instance: name,
+			Method:   req.Method,
+			Path:     req.URL.Path,
+			Query:    req.URL.RawQuery,
+			Body:     string(body),
+			Prefix:   req.Header.Get("X-Forwarded-Prefix"),
+		})
+	}))
+}
+
+// echoUpgraded switches protocols and echoes everything sent on the connection.
+func echoUpgraded(w http.ResponseWriter) {
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	buf.Flush()
+	line, err := buf.ReadString('\n')
+	if err == nil {
+		buf.WriteString("echo: " + line)
+		buf.Flush()
+	}
+}
+
+func registerTestBackend(t *testing.T, e *env, application string, backend *httptest.Server, labels map[string]string) models.Service {
+	addr := backend.Listener.Addr().(*net.TCPAddr)
+	svc, err := e.registry.Register(context.Background(), models.Service{
+		Service: dto.Service{Application: application, Location: addr.IP.String(), Port: addr.Port},
+		Labels:  labels,
+	})
+	assert.NoError(t, err)
+	return svc
+}
+
+func TestReverseProxy(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	e.gateway = newGateway(proxyConfig{enabled: true, timeout: 200 * time.Millisecond, dialTimeout: 100 * time.Millisecond, retries: 2})
+	server := httptest.NewServer(newServer(e).Handler)
+	defer server.Close()
+
+	for _, app := range []models.Application{
+		{Name: "tools", Team: "platform", Contact: "platform@example.com", ProxyEnabled: true},
+		{Name: "slow-tools", Team: "platform", Contact: "platform@example.com", ProxyEnabled: true},
+		{Name: "admin-ui", Team: "platform", Contact: "platform@example.com"},
+	} {
+		_, err := e.apps.Create(ctx, app)
+		assert.NoError(err)
+	}
+
+	// The gateway requires the same credentials as the rest of the API.
+	res, err := http.Post(server.URL+"/proxy/tools/", "text/plain", strings.NewReader("payload"))
+	assert.NoError(err)
+	res.Body.Close()
+	assert.Equal(http.StatusUnauthorized, res.StatusCode)
+
+	assert.Equal(http.StatusNotFound, proxyTestRequest(t, server.URL+"/proxy/undeclared/", "", nil).StatusCode)
+	assert.Equal(http.StatusForbidden, proxyTestRequest(t, server.URL+"/proxy/admin-ui/", "", nil).StatusCode)
+	assert.Equal(http.StatusServiceUnavailable, proxyTestRequest(t, server.URL+"/proxy/tools/", "", nil).StatusCode)
+
+	// Instances that refuse connections are skipped.
+	dead := newTestBackend("dead", 0)
+	dead.Close()
+	deadSvc := registerTestBackend(t, e, "tools", dead, nil)
+	assert.Equal(http.StatusBadGateway, proxyTestRequest(t, server.URL+"/proxy/tools/", "", nil).StatusCode)
+
+	first := newTestBackend("first", 0)
+	defer first.Close()
+	second := newTestBackend("second", 0)
+	defer second.Close()
+	firstSvc := registerTestBackend(t, e, "tools", first, map[string]string{"version": "v1"})
+	secondSvc := registerTestBackend(t, e, "tools", second, map[string]string{"version": "v2"})
+
+	instances := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		res := proxyTestRequest(t, server.URL+"/proxy/tools/api/items?page=2", "payload", nil)
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.NotEqual(deadSvc.ID, res.Header.Get(proxyInstanceHeader))
+		instances[res.Header.Get(proxyInstanceHeader)]++
+
+		var proxied proxiedRequest
+		err := json.NewDecoder(res.Body).Decode(&proxied)
+		res.Body.Close()
+		assert.NoError(err)
+		assert.Equal(http.MethodPost, proxied.Method)
+		assert.Equal("/api/items", proxied.Path)
+		assert.Equal("page=2", proxied.Query)
+		assert.Equal("payload", proxied.Body)
+		assert.Equal("/proxy/tools", proxied.Prefix)
+	}
+	assert.Len(instances, 2)
+	assert.True(instances[firstSvc.ID] > 0)
+	assert.True(instances[secondSvc.ID] > 0)
+
+	// Requests are routed by the routing rules of the application.
+	_, err = e.routes.Save(ctx, models.RoutingRules{
+		Application: "tools",
+		Subsets: []models.RouteSubset{
+			{Name: "stable", Labels: map[string]string{"version": "v1"}, Weight: 100},
+			{Name: "canary", Labels: map[string]string{"version": "v2"}, Weight: 0},
+		},
+		Matches: []models.RouteMatch{{Header: "X-Canary", Value: "true", Subset: "canary"}},
+	})
+	assert.NoError(err)
+	for i := 0; i < 5; i++ {
+		res := proxyTestRequest(t, server.URL+"/proxy/tools/", "", map[string]string{"X-Canary": "true"})
+		assert.Equal(http.StatusOK, res.StatusCode)
+		assert.Equal(secondSvc.ID, res.Header.Get(proxyInstanceHeader))
+		res = proxyTestRequest(t, server.URL+"/proxy/tools/", "", nil)
+		assert.Equal(firstSvc.ID, res.Header.Get(proxyInstanceHeader))
+	}
+
+	// Unhealthy instances are not proxied to.
+	_, err = e.registry.SetStatus(ctx, secondSvc.ID, dto.StatusUnhealthy, secondSvc.Epoch, 0)
+	assert.NoError(err)
+	res = proxyTestRequest(t, server.URL+"/proxy/tools/", "", map[string]string{"X-Canary": "true"})
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal(firstSvc.ID, res.Header.Get(proxyInstanceHeader))
+
+	// Instances must respond within the timeout.
+	slow := newTestBackend("slow", time.Second)
+	defer slow.Close()
+	registerTestBackend(t, e, "slow-tools", slow, nil)
+	assert.Equal(http.StatusGatewayTimeout, proxyTestRequest(t, server.URL+"/proxy/slow-tools/", "", nil).StatusCode)
+
+	// WebSocket upgrades are tunneled to the instance.
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	assert.NoError(err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET /proxy/tools/ws HTTP/1.1\r\nHost: registry\r\nAuthorization: " + proxyTestAuthorization() + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	assert.NoError(err)
+
+	reader := bufio.NewReader(conn)
+	upgraded, err := http.ReadResponse(reader, nil)
+	assert.NoError(err)
+	assert.Equal(http.StatusSwitchingProtocols, upgraded.StatusCode)
+	assert.Equal(firstSvc.ID, upgraded.Header.Get(proxyInstanceHeader))
+
+	_, err = conn.Write([]byte("ping\n"))
+	assert.NoError(err)
+	line, err := reader.ReadString('\n')
+	assert.NoError(err)
+	assert.Equal("echo: ping\n", line)
+}
+
+func proxyTestRequest(t *testing.T, url, body string, headers map[string]string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", proxyTestAuthorization())
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	return res
+}
+
+func proxyTestAuthorization() string {
+	return createTestRequest("/proxy", http.MethodGet, jwt.SystemRole, nil).Header.Get("Authorization")
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/CzarSimon/httputil/client/rpc"
+	"github.com/CzarSimon/httputil/environ"
+	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
+	"go.uber.org/zap"
+)
+
+// What the docker agent does with the instance of a container that stops.
+const (
+	onStopDeregister = "deregister"
+	onStopDown       = "down"
+)
+
+// dockerOptions settings of the docker command.
+type dockerOptions struct {
+	url        string
+	token      string
+	dockerHost string
+	network    string
+	onStop     string
+	heartbeat  time.Duration
+	retry      time.Duration
+	timeout    time.Duration
+}
+
+func parseDockerOptions(args []string) (dockerOptions, error) {
+	opts := dockerOptions{}
+	flags := flag.NewFlagSet("docker", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: registryctl docker [flags]")
+		fmt.Fprintf(flags.Output(), "\nRegisters running containers labeled %s=<application> and keeps them in sync with\n", models.DockerApplicationLabel)
+		fmt.Fprintln(flags.Output(), "the events of the Docker engine until stopped.")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&opts.url, "url", environ.Get("REGISTRY_URL", "http://localhost:8080"), "base URL of the service registry (REGISTRY_URL)")
+	flags.StringVar(&opts.token, "token", environ.Get("REGISTRY_TOKEN", ""), "bearer token used to authenticate (REGISTRY_TOKEN)")
+	flags.StringVar(&opts.dockerHost, "docker-host", environ.Get("DOCKER_HOST", "unix:///var/run/docker.sock"), "address of the Docker engine API (DOCKER_HOST)")
+	flags.StringVar(&opts.network, "network", environ.Get("DOCKER_NETWORK", ""), "network whose container IP addresses are registered, e.g. rtcheap, the first network of each container if not set (DOCKER_NETWORK)")
+	flags.StringVar(&opts.onStop, "on-stop", onStopDeregister, "what to do when a container stops, deregister or mark it down")
+	flags.DurationVar(&opts.heartbeat, "heartbeat", 10*time.Second, "how often heartbeats are sent for registered containers, 0 to send none")
+	flags.DurationVar(&opts.retry, "retry", 5*time.Second, "how long to wait before reconnecting to the Docker engine")
+	flags.DurationVar(&opts.timeout, "timeout", 10*time.Second, "timeout of requests to the service registry and the Docker engine")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return dockerOptions{}, err
+	}
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return dockerOptions{}, errors.New("the docker command takes no arguments")
+	}
+	if opts.onStop != onStopDeregister && opts.onStop != onStopDown {
+		return dockerOptions{}, fmt.Errorf("-on-stop must be %s or %s, got %q", onStopDeregister, onStopDown, opts.onStop)
+	}
+	if opts.heartbeat < 0 || opts.retry <= 0 {
+		return dockerOptions{}, errors.New("-heartbeat must not be negative and -retry must be positive")
+	}
+
+	return opts, nil
+}
+
+func docker(args []string) error {
+	opts, err := parseDockerOptions(args)
+	if err != nil {
+		return err
+	}
+
+	agent, err := newDockerAgent(opts)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Info("Received signal, stopping.", zap.Stringer("signal", sig))
+		close(done)
+	}()
+
+	agent.run(done)
+	return nil
+}
+
+// dockerAgent registers containers in the service registry as they start and stop.
+type dockerAgent struct {
+	opts       dockerOptions
+	dockerURL  string
+	docker     *http.Client
+	client     rpc.Client
+	mu         sync.Mutex
+	registered map[string]models.Service
+}
+
+func newDockerAgent(opts dockerOptions) (*dockerAgent, error) {
+	dockerURL, transport, err := dockerTransport(opts.dockerHost)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dockerAgent{
+		opts:       opts,
+		dockerURL:  dockerURL,
+		docker:     &http.Client{Transport: transport},
+		client:     rpc.NewClient(opts.timeout),
+		registered: make(map[string]models.Service),
+	}, nil
+}
+
+// dockerTransport connects to the Docker engine on a unix socket, unix:///var/run/docker.sock,
+// or over TCP, tcp://host:2375.
+func dockerTransport(host string) (string, http.RoundTripper, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid docker host %s. %w", host, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", u.Path)
+			},
+		}
+		return "http://docker", transport, nil
+	case "tcp", "http":
+		return "http://" + u.Host, http.DefaultTransport, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported docker host %s, must be unix:// or tcp://", host)
+	}
+}
+
+// run watches the Docker engine until done is closed, reconnecting after failures. Heartbeats are
+// sent for registered containers meanwhile.
+func (a *dockerAgent) run(done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	var wg sync.WaitGroup
+	if a.opts.heartbeat > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.sendHeartbeats(ctx)
+		}()
+	}
+
+	for {
+		err := a.watch(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		log.Error("Lost connection to the Docker engine, reconnecting.", zap.Error(err))
+
+		select {
+		case <-time.After(a.opts.retry):
+		case <-ctx.Done():
+		}
+	}
+
+	wg.Wait()
+}
+
+// watch subscribes to container events, syncs the running containers and then handles events
+// until the stream ends. Subscribing first ensures no event is missed while syncing.
+func (a *dockerAgent) watch(ctx context.Context) error {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"label": {models.DockerApplicationLabel},
+	})
+	req, err := http.NewRequest(http.MethodGet, a.dockerURL+"/events?filters="+url.QueryEscape(string(filters)), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := a.docker.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to docker events. %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to subscribe to docker events, status: %s", res.Status)
+	}
+
+	err = a.syncContainers(ctx)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(res.Body)
+	for {
+		var event models.DockerEvent
+		err = decoder.Decode(&event)
+		if err != nil {
+			return fmt.Errorf("failed to read docker events. %w", err)
+		}
+
+		a.handle(ctx, event)
+	}
+}
+
+// syncContainers registers the running containers and handles the containers registered
+// before that are no longer running as stopped.
+func (a *dockerAgent) syncContainers(ctx context.Context) error {
+	filters, _ := json.Marshal(map[string][]string{"label": {models.DockerApplicationLabel}})
+	var containers []struct {
+		ID string `json:"Id"`
+	}
+	err := a.dockerGet(ctx, "/containers/json?filters="+url.QueryEscape(string(filters)), &containers)
+	if err != nil {
+		return fmt.Errorf("failed to list containers. %w", err)
+	}
+
+	running := make(map[string]bool, len(containers))
+	for _, container := range containers {
+		running[container.ID] = true
+		a.register(ctx, container.ID)
+	}
+
+	for _, id := range a.registeredContainers() {
+		if !running[id] {
+			a.stopped(ctx, id, a.opts.onStop == onStopDeregister)
+		}
+	}
+
+	return nil
+}
+
+func (a *dockerAgent) handle(ctx context.Context, event models.DockerEvent) {
+	if event.Type != "container" {
+		return
+	}
+
+	id := event.Actor.ID
+	switch {
+	case event.Action == "start":
+		a.register(ctx, id)
+	case strings.HasPrefix(event.Action, "health_status"):
+		a.updateHealth(ctx, id)
+	case event.Action == "die" || event.Action == "stop":
+		a.stopped(ctx, id, a.opts.onStop == onStopDeregister)
+	case event.Action == "destroy":
+		a.stopped(ctx, id, true)
+	}
+}
+
+// register inspects a container and registers it. Failures are logged, as the container
+// is registered again when it restarts or the agent reconnects.
+func (a *dockerAgent) register(ctx context.Context, id string) {
+	svc, err := a.inspect(ctx, id)
+	if err == nil {
+		svc, err = a.registerService(svc)
+	}
+	if err != nil {
+		log.Error("Failed to register container.", zap.String("containerId", id), zap.Error(err))
+		return
+	}
+
+	a.mu.Lock()
+	a.registered[id] = svc
+	a.mu.Unlock()
+	log.Info("Registered container.", zap.String("containerId", id), zap.String("serviceId", svc.ID), zap.String("application", svc.Application))
+}
+
+// updateHealth sets the status of a registered container to the health reported by Docker.
+func (a *dockerAgent) updateHealth(ctx context.Context, id string) {
+	registered, ok := a.find(id)
+	if !ok {
+		a.register(ctx, id)
+		return
+	}
+
+	svc, err := a.inspect(ctx, id)
+	if err == nil && svc.Status != registered.Status {
+		err = a.setStatus(registered, svc.Status)
+	}
+	if err != nil {
+		log.Error("Failed to update status of container.", zap.String("containerId", id), zap.Error(err))
+		return
+	}
+
+	a.mu.Lock()
+	registered.Status = svc.Status
+	a.registered[id] = registered
+	a.mu.Unlock()
+}
+
+// stopped deregisters the instance of a stopped container or marks it as down.
+func (a *dockerAgent) stopped(ctx context.Context, id string, deregister bool) {
+	svc, ok := a.find(id)
+	if !ok {
+		return
+	}
+
+	var err error
+	if deregister {
+		err = a.deregister(svc)
+	} else if svc.Status != dto.StatusUnhealthy {
+		err = a.setStatus(svc, dto.StatusUnhealthy)
+	}
+	if err != nil && !rpc.HasStatus(err, http.StatusNotFound) {
+		log.Error("Failed to update stopped container.", zap.String("containerId", id), zap.Error(err))
+		return
+	}
+
+	a.mu.Lock()
+	if deregister {
+		delete(a.registered, id)
+	} else {
+		svc.Status = dto.StatusUnhealthy
+		a.registered[id] = svc
+	}
+	a.mu.Unlock()
+	log.Info("Container stopped.", zap.String("containerId", id), zap.String("serviceId", svc.ID), zap.Bool("deregistered", deregister))
+}
+
+// sendHeartbeats sends heartbeats for the registered containers every heartbeat interval,
+// registering containers again if the registry no longer knows of them.
+func (a *dockerAgent) sendHeartbeats(ctx context.Context) {
+	ticker := time.NewTicker(a.opts.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		for _, id := range a.registeredContainers() {
+			svc, ok := a.find(id)
+			if !ok {
+				continue
+			}
+
+			err := a.heartbeat(svc)
+			if rpc.HasStatus(err, http.StatusNotFound) {
+				a.register(ctx, id)
+			} else if err != nil {
+				log.Error("Failed to send heartbeat.", zap.String("containerId", id), zap.Error(err))
+			}
+		}
+	}
+}
+
+func (a *dockerAgent) find(id string) (models.Service, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	svc, ok := a.registered[id]
+	return svc, ok
+}
+
+func (a *dockerAgent) registeredContainers() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ids := make([]string, 0, len(a.registered))
+	for id := range a.registered {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (a *dockerAgent) inspect(ctx context.Context, id string) (models.Service, error) {
+	var container models.DockerContainer
+	err := a.dockerGet(ctx, "/containers/"+url.PathEscape(id)+"/json", &container)
+	if err != nil {
+		return models.Service{}, fmt.Errorf("failed to inspect container. %w", err)
+	}
+
+	return models.NewDockerService(container, a.opts.network)
+}
+
+func (a *dockerAgent) dockerGet(ctx context.Context, path string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, a.opts.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, a.dockerURL+path, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := a.docker.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("request to the docker engine failed, status: %s", res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (a *dockerAgent) registerService(svc models.Service) (models.Service, error) {
+	var registered models.Service
+	err := a.call(http.MethodPost, "/v1/services", svc, &registered)
+	return registered, err
+}
+
+func (a *dockerAgent) setStatus(svc models.Service, status dto.ServiceStatus) error {
+	return a.call(http.MethodPut, fmt.Sprintf("/v1/services/%s/status/%s?epoch=%d", svc.ID, status, svc.Epoch), nil, nil)
+}
+
+func (a *dockerAgent) heartbeat(svc models.Service) error {
+	return a.call(http.MethodPut, fmt.Sprintf("/v1/services/%s/heartbeat?epoch=%d", svc.ID, svc.Epoch), nil, nil)
+}
+
+func (a *dockerAgent) deregister(svc models.Service) error {
+	return a.call(http.MethodDelete, "/v1/services/"+svc.ID, nil, nil)
+}
+
+// call sends a request to the service registry, decoding the response into v if not nil.
+func (a *dockerAgent) call(method, path string, body, v interface{}) error {
+	req, err := a.client.CreateRequest(method, strings.TrimSuffix(a.opts.url, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if a.opts.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.opts.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if v == nil {
+		return nil
+	}
+	return rpc.DecodeJSON(res, v)
+}
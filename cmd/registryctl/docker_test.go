@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDockerEngine fake Docker engine API serving containers and streaming events.
+type testDockerEngine struct {
+	server     *httptest.Server
+	mu         sync.Mutex
+	containers map[string]models.DockerContainer
+	events     chan models.DockerEvent
+	filters    string
+}
+
+func newTestDockerEngine() *testDockerEngine {
+	d := &testDockerEngine{
+		containers: make(map[string]models.DockerContainer),
+		events:     make(chan models.DockerEvent, 10),
+	}
+	d.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/events":
+			d.streamEvents(w, req)
+		case req.URL.Path == "/containers/json":
+			d.listContainers(w)
+		case strings.HasPrefix(req.URL.Path, "/containers/"):
+			d.inspectContainer(w, strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/containers/"), "/json"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return d
+}
+
+func (d *testDockerEngine) streamEvents(w http.ResponseWriter, req *http.Request) {
+	d.mu.Lock()
+	d.filters = req.URL.Query().Get("filters")
+	d.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case event := <-d.events:
+			json.NewEncoder(w).Encode(event)
+			w.(http.Flusher).Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func (d *testDockerEngine) listContainers(w http.ResponseWriter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	containers := make([]map[string]string, 0)
+	for id, container := range d.containers {
+		if container.State.Running && container.Config.Labels[models.DockerApplicationLabel] != "" {
+			containers = append(containers, map[string]string{"Id": id})
+		}
+	}
+	json.NewEncoder(w).Encode(containers)
+}
+
+func (d *testDockerEngine) inspectContainer(w http.ResponseWriter, id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	container, ok := d.containers[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(container)
+}
+
+func (d *testDockerEngine) run(id, application, health string) {
+	var container models.DockerContainer
+	container.ID = id
+	container.Name = "/" + application + "-" + id[:4]
+	container.Config.Image = "rtcheap/" + application + ":1.0.0"
+	container.Config.Labels = map[string]string{models.DockerApplicationLabel: application}
+	container.Config.ExposedPorts = map[string]struct{}{"9100/tcp": {}, "8080/tcp": {}}
+	container.State.Running = true
+	if health != "" {
+		container.State.Health = &struct {
+			Status string `json:"Status"`
+		}{Status: health}
+	}
+	container.NetworkSettings.Networks = map[string]struct {
+		IPAddress string `json:"IPAddress"`
+	}{"bridge": {IPAddress: "172.17.0.9"}, "rtcheap": {IPAddress: "172.18.0." + id[:1]}}
+
+	d.mu.Lock()
+	d.containers[id] = container
+	d.mu.Unlock()
+}
+
+func (d *testDockerEngine) eventFilters() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.filters
+}
+
+func (d *testDockerEngine) send(id, action string) {
+	var event models.DockerEvent
+	event.Type = "container"
+	event.Action = action
+	event.Actor.ID = id
+	d.events <- event
+}
+
+// testAgentRegistry fake service registry recording the requests of the agent.
+type testAgentRegistry struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	requests []string
+	services map[string]models.Service
+}
+
+func newTestAgentRegistry() *testAgentRegistry {
+	r := &testAgentRegistry{services: make(map[string]models.Service)}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if req.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.requests = append(r.requests, req.Method+" "+req.URL.RequestURI())
+
+		if req.Method == http.MethodPost && req.URL.Path == "/v1/services" {
+			var svc models.Service
+			json.NewDecoder(req.Body).Decode(&svc)
+			svc.Epoch = r.services[svc.ID].Epoch + 1
+			r.services[svc.ID] = svc
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(svc)
+		}
+	}))
+	return r
+}
+
+func (r *testAgentRegistry) received(request string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, req := range r.requests {
+		if req == request {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *testAgentRegistry) service(id string) models.Service {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.services[id]
+}
+
+func TestDockerAgent(t *testing.T) {
+	assert := assert.New(t)
+	engine := newTestDockerEngine()
+	defer engine.server.Close()
+	registry := newTestAgentRegistry()
+	defer registry.server.Close()
+
+	engine.run("1aaaaaaaaaaaaaaa", "media-server", "")
+	opts, err := parseDockerOptions([]string{
+		"-url", registry.server.URL,
+		"-token", "test-token",
+		"-docker-host", strings.Replace(engine.server.URL, "http://", "tcp://", 1),
+		"-network", "rtcheap",
+		"-heartbeat", "20ms",
+	})
+	assert.NoError(err)
+	agent, err := newDockerAgent(opts)
+	assert.NoError(err)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		agent.run(done)
+		close(stopped)
+	}()
+
+	// Running containers are registered on start.
+	assert.Eventually(func() bool { return registry.received("POST /v1/services") }, 5*time.Second, 10*time.Millisecond)
+	svc := registry.service("docker-1aaaaaaaaaaa")
+	assert.Equal("media-server", svc.Application)
+	assert.Equal("172.18.0.1", svc.Location)
+	assert.Equal(8080, svc.Port)
+	assert.Equal(dto.StatusHealty, svc.Status)
+	assert.Equal(map[string]string{
+		models.SourceLabel:          models.SourceDocker,
+		models.DockerContainerLabel: "media-server-1aaa",
+		models.DockerImageLabel:     "rtcheap/media-server:1.0.0",
+	}, svc.Labels)
+	assert.Contains(engine.eventFilters(), models.DockerApplicationLabel)
+	assert.Eventually(func() bool {
+		return registry.received("PUT /v1/services/docker-1aaaaaaaaaaa/heartbeat?epoch=1")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Containers with a health check are registered as unhealthy until Docker reports them healthy.
+	engine.run("2bbbbbbbbbbbbbbb", "api", models.DockerStarting)
+	engine.send("2bbbbbbbbbbbbbbb", "start")
+	assert.Eventually(func() bool { return registry.service("docker-2bbbbbbbbbbb").ID != "" }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(dto.StatusUnhealthy, registry.service("docker-2bbbbbbbbbbb").Status)
+
+	engine.run("2bbbbbbbbbbbbbbb", "api", models.DockerHealthy)
+	engine.send("2bbbbbbbbbbbbbbb", "health_status: healthy")
+	assert.Eventually(func() bool {
+		return registry.received("PUT /v1/services/docker-2bbbbbbbbbbb/status/HEALTHY?epoch=1")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	engine.send("1aaaaaaaaaaaaaaa", "die")
+	assert.Eventually(func() bool {
+		return registry.received("DELETE /v1/services/docker-1aaaaaaaaaaa")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+}
+
+func TestDockerAgentMarksStoppedContainersDown(t *testing.T) {
+	assert := assert.New(t)
+	engine := newTestDockerEngine()
+	defer engine.server.Close()
+	registry := newTestAgentRegistry()
+	defer registry.server.Close()
+
+	engine.run("3ccccccccccccccc", "media-server", "")
+	opts, err := parseDockerOptions([]string{
+		"-url", registry.server.URL,
+		"-token", "test-token",
+		"-docker-host", strings.Replace(engine.server.URL, "http://", "tcp://", 1),
+		"-on-stop", "down",
+		"-heartbeat", "0",
+	})
+	assert.NoError(err)
+	agent, err := newDockerAgent(opts)
+	assert.NoError(err)
+
+	done := make(chan struct{})
+	defer close(done)
+	go agent.run(done)
+
+	assert.Eventually(func() bool { return registry.service("docker-3ccccccccccc").ID != "" }, 5*time.Second, 10*time.Millisecond)
+	// Without a network the first network of the container is used.
+	assert.Equal("172.17.0.9", registry.service("docker-3ccccccccccc").Location)
+
+	engine.send("3ccccccccccccccc", "die")
+	engine.send("3ccccccccccccccc", "stop")
+	assert.Eventually(func() bool {
+		return registry.received("PUT /v1/services/docker-3ccccccccccc/status/UNHEALTHY?epoch=1")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	engine.send("3ccccccccccccccc", "start")
+	assert.Eventually(func() bool { return registry.service("docker-3ccccccccccc").Epoch == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.False(registry.received("DELETE /v1/services/docker-3ccccccccccc"))
+
+	_, err = parseDockerOptions([]string{"-on-stop", "pause"})
+	assert.Error(err)
+}
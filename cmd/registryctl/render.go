@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/CzarSimon/httputil/client/rpc"
+	"github.com/CzarSimon/httputil/environ"
+	"go.uber.org/zap"
+)
+
+// renderOptions settings of the render command.
+type renderOptions struct {
+	url      string
+	token    string
+	template string
+	out      string
+	reload   string
+	watch    bool
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func parseRenderOptions(args []string) (renderOptions, error) {
+	opts := renderOptions{}
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: registryctl render [flags] <template>")
+		fmt.Fprintln(flags.Output(), "\nRenders a template, e.g. nginx or haproxy, from the current contents of the registry.")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&opts.url, "url", environ.Get("REGISTRY_URL", "http://localhost:8080"), "base URL of the service registry (REGISTRY_URL)")
+	flags.StringVar(&opts.token, "token", environ.Get("REGISTRY_TOKEN", ""), "bearer token used to authenticate (REGISTRY_TOKEN)")
+	flags.StringVar(&opts.out, "out", "", "file to write the rendered template to, written to stdout if not set")
+	flags.StringVar(&opts.reload, "reload", "", "shell command run after the file has changed, e.g. \"nginx -s reload\"")
+	flags.BoolVar(&opts.watch, "watch", false, "keep rendering the template and rewrite the file when it changes")
+	flags.DurationVar(&opts.interval, "interval", 10*time.Second, "how often the template is rendered in watch mode")
+	flags.DurationVar(&opts.timeout, "timeout", 10*time.Second, "timeout of requests to the service registry")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return renderOptions{}, err
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return renderOptions{}, errors.New("exactly one template must be given")
+	}
+	opts.template = flags.Arg(0)
+
+	if opts.out == "" && (opts.watch || opts.reload != "") {
+		return renderOptions{}, errors.New("-out is required with -watch or -reload")
+	}
+	if opts.interval <= 0 {
+		return renderOptions{}, fmt.Errorf("-interval must be a positive duration, got %s", opts.interval)
+	}
+
+	return opts, nil
+}
+
+func render(args []string) error {
+	opts, err := parseRenderOptions(args)
+	if err != nil {
+		return err
+	}
+
+	r := newRenderer(opts)
+	if opts.out == "" {
+		content, err := r.fetch()
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprint(os.Stdout, content)
+		return err
+	}
+
+	if !opts.watch {
+		_, err = r.sync()
+		return err
+	}
+
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Info("Received signal, stopping.", zap.Stringer("signal", sig))
+		close(done)
+	}()
+
+	r.watch(done)
+	return nil
+}
+
+// renderer renders a template through the service registry into a file.
+type renderer struct {
+	opts   renderOptions
+	client rpc.Client
+	// reloadPending is set while the file has changed without a successful reload.
+	reloadPending bool
+}
+
+func newRenderer(opts renderOptions) *renderer {
+	return &renderer{
+		opts:   opts,
+		client: rpc.NewClient(opts.timeout),
+	}
+}
+
+// fetch renders the template with the current contents of the registry.
+func (r *renderer) fetch() (string, error) {
+	route := strings.TrimSuffix(r.opts.url, "/") + "/v1/render/" + url.PathEscape(r.opts.template)
+	req, err := r.client.CreateRequest(http.MethodGet, route, nil)
+	if err != nil {
+		return "", err
+	}
+	if r.opts.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.opts.token)
+	}
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to render template %s. %w", r.opts.template, err)
+	}
+	defer res.Body.Close()
+
+	return rpc.DecodeText(res)
+}
+
+// sync renders the template and, if the output differs from the file, rewrites the
+// file and runs the reload command. A failed reload is retried by the next sync even
+// if the file is unchanged. Returns true if the file was changed.
+func (r *renderer) sync() (bool, error) {
+	content, err := r.fetch()
+	if err != nil {
+		return false, err
+	}
+
+	current, err := ioutil.ReadFile(r.opts.out)
+	changed := err != nil || !bytes.Equal(current, []byte(content))
+	if changed {
+		err = writeFileAtomic(r.opts.out, []byte(content))
+		if err != nil {
+			return false, err
+		}
+		log.Info("Rendered template.", zap.String("template", r.opts.template), zap.String("file", r.opts.out))
+		r.reloadPending = r.opts.reload != ""
+	}
+
+	if !r.reloadPending {
+		return changed, nil
+	}
+
+	out, err := exec.Command("sh", "-c", r.opts.reload).CombinedOutput()
+	if err != nil {
+		return changed, fmt.Errorf("reload command %q failed: %s. %w", r.opts.reload, strings.TrimSpace(string(out)), err)
+	}
+	r.reloadPending = false
+
+	return changed, nil
+}
+
+// watch syncs the file every interval until done is closed. Failures are
+// logged and retried on the next interval.
+func (r *renderer) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(r.opts.interval)
+	defer ticker.Stop()
+	for {
+		_, err := r.sync()
+		if err != nil {
+			log.Error("Failed to render template.", zap.String("template", r.opts.template), zap.Error(err))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// writeFileAtomic writes the file by renaming a temporary file in the same directory
+// over it, so readers never see a partially written file.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s. %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write temporary file for %s. %w", path, err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("failed to replace %s. %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testRegistry struct {
+	server  *httptest.Server
+	mu      sync.Mutex
+	content string
+	status  int
+}
+
+func newTestRegistry(content string) *testRegistry {
+	r := &testRegistry{content: content, status: http.StatusOK}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if req.URL.Path != "/v1/render/nginx" || req.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(r.status)
+		w.Write([]byte(r.content))
+	}))
+	return r
+}
+
+func (r *testRegistry) set(content string, status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.content = content
+	r.status = status
+}
+
+func TestRenderSync(t *testing.T) {
+	assert := assert.New(t)
+	registry := newTestRegistry("upstream a {}\n")
+	defer registry.server.Close()
+
+	dir, err := ioutil.TempDir("", "registryctl")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "upstreams.conf")
+	reloads := filepath.Join(dir, "reloads")
+
+	opts, err := parseRenderOptions([]string{
+		"-url", registry.server.URL + "/",
+		"-token", "test-token",
+		"-out", out,
+		"-reload", "echo reloaded >> " + reloads,
+		"nginx",
+	})
+	assert.NoError(err)
+	r := newRenderer(opts)
+
+	changed, err := r.sync()
+	assert.NoError(err)
+	assert.True(changed)
+	assertFileContent(t, out, "upstream a {}\n")
+	assertFileContent(t, reloads, "reloaded\n")
+
+	// Unchanged membership does not rewrite the file or reload.
+	changed, err = r.sync()
+	assert.NoError(err)
+	assert.False(changed)
+	assertFileContent(t, reloads, "reloaded\n")
+
+	registry.set("upstream b {}\n", http.StatusOK)
+	changed, err = r.sync()
+	assert.NoError(err)
+	assert.True(changed)
+	assertFileContent(t, out, "upstream b {}\n")
+	assertFileContent(t, reloads, "reloaded\nreloaded\n")
+
+	// Failed renders leave the file as is.
+	registry.set("", http.StatusInternalServerError)
+	_, err = r.sync()
+	assert.Error(err)
+	assertFileContent(t, out, "upstream b {}\n")
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(err)
+	assert.Len(files, 2)
+
+	// A failing reload command is reported after the file has been written.
+	registry.set("upstream c {}\n", http.StatusOK)
+	r.opts.reload = "echo bad config >&2; exit 1"
+	changed, err = r.sync()
+	assert.True(changed)
+	assert.Error(err)
+	assert.Contains(err.Error(), "bad config")
+	assertFileContent(t, out, "upstream c {}\n")
+
+	// The reload is retried until it succeeds, even though the file is unchanged.
+	changed, err = r.sync()
+	assert.False(changed)
+	assert.Error(err)
+
+	r.opts.reload = "echo reloaded >> " + reloads
+	changed, err = r.sync()
+	assert.NoError(err)
+	assert.False(changed)
+	assertFileContent(t, reloads, "reloaded\nreloaded\nreloaded\n")
+
+	changed, err = r.sync()
+	assert.NoError(err)
+	assert.False(changed)
+	assertFileContent(t, reloads, "reloaded\nreloaded\nreloaded\n")
+
+	// Watch mode keeps the file up to date until stopped.
+	r.opts.reload = ""
+	r.opts.interval = 5 * time.Millisecond
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		r.watch(done)
+		close(stopped)
+	}()
+
+	registry.set("upstream d {}\n", http.StatusOK)
+	time.Sleep(50 * time.Millisecond)
+	close(done)
+	<-stopped
+	assertFileContent(t, out, "upstream d {}\n")
+}
+
+func TestParseRenderOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	opts, err := parseRenderOptions([]string{"-url", "http://registry:8080", "haproxy"})
+	assert.NoError(err)
+	assert.Equal("haproxy", opts.template)
+	assert.Equal("http://registry:8080", opts.url)
+	assert.Equal(10*time.Second, opts.interval)
+	assert.False(opts.watch)
+
+	invalid := [][]string{
+		{},
+		{"nginx", "haproxy"},
+		{"-watch", "nginx"},
+		{"-reload", "nginx -s reload", "nginx"},
+		{"-out", "upstreams.conf", "-interval", "0s", "nginx"},
+		{"-unknown", "nginx"},
+	}
+	for _, args := range invalid {
+		_, err = parseRenderOptions(args)
+		assert.Error(err, strings.Join(args, " "))
+	}
+}
+
+func assertFileContent(t *testing.T, path, expected string) {
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(content))
+}
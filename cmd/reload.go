@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rtcheap/service-registry/internal/logging"
+	"go.uber.org/zap"
+)
+
+// runtimeSettings holds the runtime config and allows it to be swapped while serving requests.
+type runtimeSettings struct {
+	mu  sync.RWMutex
+	cfg runtimeConfig
+}
+
+func newRuntimeSettings(cfg runtimeConfig) *runtimeSettings {
+	s := &runtimeSettings{}
+	s.set(cfg)
+	return s
+}
+
+func (s *runtimeSettings) get() runtimeConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg
+}
+
+func (s *runtimeSettings) set(cfg runtimeConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+	logging.SetLevel(cfg.logLevel)
+}
+
+// applyRuntimeConfig swaps the runtime settings and the policies used by the registry.
+func (e *env) applyRuntimeConfig(cfg runtimeConfig) {
+	e.settings.set(cfg)
+	e.registry.SetPolicy(cfg.registration)
+	e.registry.SetOutlierPolicy(cfg.outliers)
+}
+
+// withTimeout applies the currently configured request timeout to the request context.
+func (e *env) withTimeout() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timeout := e.settings.get().requestTimeout
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// configWatcher reloads the config on SIGHUP or when the config file is modified.
+type configWatcher struct {
+	*periodicWorker
+	e       *env
+	load    func() (config, error)
+	modTime time.Time
+	signals chan os.Signal
+	// requested is set when a reload is requested by SIGHUP.
+	requested int32
+}
+
+func newConfigWatcher(e *env, load func() (config, error)) *configWatcher {
+	w := &configWatcher{
+		e:       e,
+		load:    load,
+		modTime: fileModTime(e.cfg.file),
+		signals: make(chan os.Signal, 1),
+	}
+	w.periodicWorker = newPeriodicWorker(e.cfg.reloadInterval, w.poll)
+	return w
+}
+
+func (w *configWatcher) start() {
+	signal.Notify(w.signals, syscall.SIGHUP)
+	go func() {
+		for range w.signals {
+			atomic.StoreInt32(&w.requested, 1)
+			w.notify()
+		}
+	}()
+
+	w.periodicWorker.start()
+}
+
+func (w *configWatcher) stop() {
+	signal.Stop(w.signals)
+	close(w.signals)
+	w.periodicWorker.stop()
+}
+
+// poll reloads the config if requested by SIGHUP or if the config file has changed.
+func (w *configWatcher) poll() {
+	if atomic.CompareAndSwapInt32(&w.requested, 1, 0) {
+		log.Info("received SIGHUP, reloading config")
+		w.reload()
+	} else if w.fileChanged() {
+		log.Info("config file changed, reloading config", zap.String("file", w.e.cfg.file))
+		w.reload()
+	}
+}
+
+func (w *configWatcher) fileChanged() bool {
+	if w.e.cfg.file == "" {
+		return false
+	}
+
+	modTime := fileModTime(w.e.cfg.file)
+	if modTime.Equal(w.modTime) {
+		return false
+	}
+
+	w.modTime = modTime
+	return true
+}
+
+// reload loads and validates the config, applying the runtime subset if it is valid.
+func (w *configWatcher) reload() {
+	cfg, err := w.load()
+	if err != nil {
+		log.Error("failed to reload config, keeping current config", zap.Error(err))
+		return
+	}
+
+	changed := w.e.cfg.requiresRestart(cfg)
+	if len(changed) > 0 {
+		log.Warn("config changes will not be applied until restart", zap.Strings("settings", changed))
+	}
+
+	w.e.applyRuntimeConfig(cfg.runtime)
+	log.Info("reloaded runtime config",
+		zap.Stringer("logLevel", cfg.runtime.logLevel),
+		zap.Duration("requestTimeout", cfg.runtime.requestTimeout),
+		zap.String("conflictPolicy", string(cfg.runtime.registration.ConflictPolicy)))
+}
+
+func fileModTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+// routeSubsetHeader response header naming the subset a discovery request was routed to.
+const routeSubsetHeader = "X-Route-Subset"
+
+func (e *env) findRoutes(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.findRoutes")
+	defer span.Finish()
+
+	rules, err := e.routes.Find(ctx, c.Param("name"))
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, rules)
+}
+
+func (e *env) saveRoutes(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.saveRoutes")
+	defer span.Finish()
+
+	var body models.RoutingRules
+	err := c.BindJSON(&body)
+	if err != nil {
+		err = httputil.BadRequestError(fmt.Errorf("failed to parse request body. %w", err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	body.Application = c.Param("name")
+	before := e.currentRoutes(ctx, body.Application)
+	rules, err := e.routes.Save(ctx, body)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditRoutesUpdate,
+		Application: body.Application,
+	}, before, rules, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, rules)
+}
+
+func (e *env) shiftRouteWeights(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.shiftRouteWeights")
+	defer span.Finish()
+
+	var weights map[string]int
+	err := c.BindJSON(&weights)
+	if err != nil {
+		err = httputil.BadRequestError(fmt.Errorf("failed to parse request body. %w", err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	application := c.Param("name")
+	before := e.currentRoutes(ctx, application)
+	rules, err := e.routes.ShiftWeights(ctx, application, weights)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditRoutesUpdate,
+		Application: application,
+	}, before, rules, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, rules)
+}
+
+func (e *env) rollbackRoutes(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.rollbackRoutes")
+	defer span.Finish()
+
+	application := c.Param("name")
+	before := e.currentRoutes(ctx, application)
+	rules, err := e.routes.Rollback(ctx, application)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditRoutesRollback,
+		Application: application,
+	}, before, rules, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, rules)
+}
+
+func (e *env) deleteRoutes(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.deleteRoutes")
+	defer span.Finish()
+
+	application := c.Param("name")
+	before := e.currentRoutes(ctx, application)
+	err := e.routes.Delete(ctx, application)
+	e.recordAudit(ctx, c, models.AuditEntry{
+		Action:      auditRoutesDelete,
+		Application: application,
+	}, before, nil, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	httputil.SendOK(c)
+}
+
+// currentRoutes returns the routing rules of an application for the audit log, nil if there are none.
+func (e *env) currentRoutes(ctx context.Context, application string) interface{} {
+	rules, err := e.routes.Find(ctx, application)
+	if err != nil {
+		return nil
+	}
+
+	return rules
+}
+
+// findRoutedServices looks up the services in the subset a discovery request is routed to, falling back
+// to every service matching the query if the subset has none. Returns the subset used, if any.
+func (e *env) findRoutedServices(ctx context.Context, application string, req models.RouteRequest, query models.ServiceQuery) ([]models.Service, string, error) {
+	subset, routed, err := e.routes.Route(ctx, application, req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if routed {
+		routedQuery := query
+		routedQuery.Filter = query.Filter.WithLabels(subset.Labels)
+		services, err := e.registry.FindApplicationServices(ctx, application, routedQuery)
+		if err != nil || len(services) > 0 {
+			return services, subset.Name, err
+		}
+	}
+
+	services, err := e.registry.FindApplicationServices(ctx, application, query)
+	return services, "", err
+}
+
+func newRouteRequest(c *gin.Context, key string) models.RouteRequest {
+	return models.RouteRequest{
+		Key:     key,
+		Headers: c.Request.Header,
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/CzarSimon/httputil/client/rpc"
+	"github.com/CzarSimon/httputil/jwt"
+	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutingRules(t *testing.T) {
+	assert := assert.New(t)
+	e, _ := createTestEnv()
+	server := newServer(e)
+
+	services := make([]models.Service, 0, 4)
+	for i, version := range []string{"v1", "v1", "v1", "v2"} {
+		req := createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, models.Service{
+			Service: dto.Service{Application: "media-server", Location: fmt.Sprintf("ip-%d", i), Port: 8080},
+			Labels:  map[string]string{"version": version},
+		})
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var svc models.Service
+		err := rpc.DecodeJSON(res.Result(), &svc)
+		assert.NoError(err)
+		services = append(services, svc)
+	}
+
+	req := createTestRequest("/v1/applications/media-server/routes", http.MethodGet, jwt.SystemRole, nil)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+
+	rules := models.RoutingRules{
+		Subsets: []models.RouteSubset{
+			{Name: "stable", Labels: map[string]string{"version": "v1"}, Weight: 90},
+			{Name: "canary", Labels: map[string]string{"version": "v2"}, Weight: 10},
+		},
+		Matches: []models.RouteMatch{
+			{Header: "X-Canary", Value: "true", Subset: "canary"},
+			{Value: "tester", Subset: "canary"},
+		},
+	}
+
+	invalidRules := []models.RoutingRules{
+		{},
+		{Subsets: []models.RouteSubset{{Name: "stable", Weight: 90}}},
+		{Subsets: []models.RouteSubset{{Name: "stable", Weight: 50}, {Name: "stable", Weight: 50}}},
+		{Subsets: []models.RouteSubset{{Name: "stable", Weight: 110}, {Name: "canary", Weight: -10}}},
+		{Subsets: rules.Subsets, Matches: []models.RouteMatch{{Value: "tester", Subset: "missing"}}},
+	}
+	for _, invalid := range invalidRules {
+		req = createTestRequest("/v1/applications/media-server/routes", http.MethodPut, jwt.SystemRole, invalid)
+		res = performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusBadRequest, res.Code)
+	}
+
+	saved := putRoutes(t, server.Handler, "/v1/applications/media-server/routes", rules)
+	assert.Equal("media-server", saved.Application)
+	assert.Equal(int64(1), saved.Revision)
+
+	findVersions := func(query string, headers map[string]string) ([]string, string) {
+		req := createTestRequest("/v1/services?application=media-server"+query, http.MethodGet, jwt.SystemRole, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+
+		var services []models.Service
+		err := rpc.DecodeJSON(res.Result(), &services)
+		assert.NoError(err)
+		versions := make([]string, 0, len(services))
+		for _, svc := range services {
+			versions = append(versions, svc.Labels["version"])
+		}
+		return versions, res.Header().Get(routeSubsetHeader)
+	}
+
+	versions, subset := findVersions("", map[string]string{"X-Canary": "true"})
+	assert.Equal([]string{"v2"}, versions)
+	assert.Equal("canary", subset)
+
+	versions, subset = findVersions("&route-key=tester", nil)
+	assert.Equal([]string{"v2"}, versions)
+	assert.Equal("canary", subset)
+
+	split := func() map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("user-%d", i)
+			_, first := findVersions("&route-key="+key, nil)
+			_, second := findVersions("&route-key="+key, nil)
+			assert.Equal(first, second, key)
+			counts[first]++
+		}
+		return counts
+	}
+	counts := split()
+	assert.Equal(200, counts["stable"]+counts["canary"])
+	assert.True(counts["canary"] > 0 && counts["canary"] < 50, counts)
+
+	// Weights are shifted gradually and each step can be rolled back.
+	shifted := putRoutes(t, server.Handler, "/v1/applications/media-server/routes/weights", map[string]int{"stable": 50, "canary": 50})
+	assert.Equal(int64(2), shifted.Revision)
+	assert.Equal(50, shifted.Subsets[1].Weight)
+	assert.Len(shifted.Matches, 2)
+	counts = split()
+	assert.True(counts["canary"] > 60 && counts["stable"] > 60, counts)
+
+	for _, weights := range []map[string]int{{"stable": 60}, {"stable": 50, "beta": 50}} {
+		req = createTestRequest("/v1/applications/media-server/routes/weights", http.MethodPut, jwt.SystemRole, weights)
+		res = performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusBadRequest, res.Code)
+	}
+
+	rolledBack := postRollback(t, server.Handler, http.StatusOK)
+	assert.Equal(int64(3), rolledBack.Revision)
+	assert.Equal(10, rolledBack.Subsets[1].Weight)
+
+	rolledBack = postRollback(t, server.Handler, http.StatusOK)
+	assert.Equal(50, rolledBack.Subsets[1].Weight)
+
+	// Requests routed to a subset without instances fall back to every instance.
+	rules.Subsets[1].Labels = map[string]string{"version": "v3"}
+	putRoutes(t, server.Handler, "/v1/applications/media-server/routes", rules)
+	versions, subset = findVersions("&route-key=tester", nil)
+	assert.Len(versions, 4)
+	assert.Equal("", subset)
+
+	// Allocations are routed as well.
+	rules.Subsets[1].Labels = map[string]string{"version": "v2"}
+	putRoutes(t, server.Handler, "/v1/applications/media-server/routes", rules)
+	for _, svc := range services {
+		route := fmt.Sprintf("/v1/services/%s/capacity?epoch=%d", svc.ID, svc.Epoch)
+		req = createTestRequest(route, http.MethodPut, jwt.SystemRole, models.Capacity{MaxSessions: 1})
+		res = performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusOK, res.Code)
+	}
+
+	req = createTestRequest("/v1/applications/media-server/allocate", http.MethodPost, jwt.SystemRole, models.AllocationRequest{RouteKey: "tester"})
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	var allocation models.Allocation
+	err := rpc.DecodeJSON(res.Result(), &allocation)
+	assert.NoError(err)
+	assert.Equal(services[3].ID, allocation.Service.ID)
+
+	// The canary is full, so the next routed allocation falls back to any instance.
+	req = createTestRequest("/v1/applications/media-server/allocate", http.MethodPost, jwt.SystemRole, models.AllocationRequest{RouteKey: "tester"})
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	err = rpc.DecodeJSON(res.Result(), &allocation)
+	assert.NoError(err)
+	assert.Equal("v1", allocation.Service.Labels["version"])
+
+	req = createTestRequest("/v1/applications/media-server/routes", http.MethodDelete, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	req = createTestRequest("/v1/applications/media-server/routes", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+	postRollback(t, server.Handler, http.StatusNotFound)
+
+	versions, subset = findVersions("&route-key=tester", map[string]string{"X-Canary": "true"})
+	assert.Len(versions, 4)
+	assert.Equal("", subset)
+
+	entries := findTestAuditEntries(t, server.Handler, "application=media-server")
+	actions := make(map[string]int)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Action, "routes.") {
+			actions[entry.Action]++
+		}
+	}
+	assert.Equal(map[string]int{auditRoutesUpdate: 11, auditRoutesRollback: 3, auditRoutesDelete: 1}, actions)
+}
+
+func putRoutes(t *testing.T, handler http.Handler, route string, body interface{}) models.RoutingRules {
+	req := createTestRequest(route, http.MethodPut, jwt.SystemRole, body)
+	res := performTestRequest(handler, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	var rules models.RoutingRules
+	err := rpc.DecodeJSON(res.Result(), &rules)
+	assert.NoError(t, err)
+	return rules
+}
+
+func postRollback(t *testing.T, handler http.Handler, expectedStatus int) models.RoutingRules {
+	req := createTestRequest("/v1/applications/media-server/routes/rollback", http.MethodPost, jwt.SystemRole, nil)
+	res := performTestRequest(handler, req)
+	assert.Equal(t, expectedStatus, res.Code)
+
+	var rules models.RoutingRules
+	if expectedStatus == http.StatusOK {
+		err := rpc.DecodeJSON(res.Result(), &rules)
+		assert.NoError(t, err)
+	}
+	return rules
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/CzarSimon/httputil/jwt"
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	"go.uber.org/zap"
+)
+
+const userKey = "service-registry/user"
+
+// newTLSConfig creates the server TLS config, serving certificates from the reloader
+// and verifying client certificates against the configured CA bundle.
+func newTLSConfig(cfg tlsConfig, certs *certReloader) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.getCertificate,
+		ClientAuth:     cfg.clientAuth,
+	}
+
+	if cfg.clientCAFile == "" {
+		return tlsCfg, nil
+	}
+
+	bundle, err := ioutil.ReadFile(cfg.clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA bundle %s. %w", cfg.clientCAFile, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle %s", cfg.clientCAFile)
+	}
+
+	tlsCfg.ClientCAs = pool
+	return tlsCfg, nil
+}
+
+// certReloader serves the server certificate and reloads it when it is rotated on disk.
+type certReloader struct {
+	*periodicWorker
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string, interval time.Duration) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	r.periodicWorker = newPeriodicWorker(interval, r.reloadIfChanged)
+
+	err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) reloadIfChanged() {
+	if !r.changed() {
+		return
+	}
+
+	err := r.reload()
+	if err != nil {
+		log.Error("failed to reload TLS certificate, keeping current certificate", zap.Error(err))
+		return
+	}
+
+	log.Info("reloaded TLS certificate", zap.String("certFile", r.certFile))
+}
+
+func (r *certReloader) changed() bool {
+	modTime := latest(fileModTime(r.certFile), fileModTime(r.keyFile))
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !modTime.Equal(r.modTime)
+}
+
+func (r *certReloader) reload() error {
+	modTime := latest(fileModTime(r.certFile), fileModTime(r.keyFile))
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate %s. %w", r.certFile, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
+
+// secure checks that the caller has one of the given roles, either through a verified
+// client certificate with a mapped subject or through a JWT. The caller is stored under userKey.
+func (e *env) secure(rbac httputil.RBAC, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := e.certificateUser(c.Request)
+		if !ok {
+			var err *httputil.Error
+			user, err = verifyToken(rbac.Verifier, c.GetHeader("Authorization"))
+			if err != nil {
+				c.AbortWithStatusJSON(err.Status, err)
+				return
+			}
+		}
+
+		span := opentracing.SpanFromContext(c.Request.Context())
+		if span != nil {
+			span.SetBaggageItem("user-id", user.ID)
+		}
+
+		for _, role := range roles {
+			if user.HasRole(role) {
+				c.Set(userKey, user)
+				c.Next()
+				return
+			}
+		}
+
+		msg := fmt.Sprintf("%s %s access denied for %s", c.Request.Method, c.Request.URL.Path, user)
+		err := httputil.ForbiddenError(errors.New(msg))
+		c.AbortWithStatusJSON(err.Status, err)
+	}
+}
+
+// verifyToken verifies the bearer token of an Authorization header.
+func verifyToken(verifier jwt.Verifier, header string) (jwt.User, *httputil.Error) {
+	if header == "" {
+		return jwt.User{}, httputil.UnauthorizedError(errors.New("no authorization header provided"))
+	}
+
+	user, err := verifier.Verify(strings.TrimPrefix(header, "Bearer "))
+	if err != nil {
+		return jwt.User{}, httputil.UnauthorizedError(err)
+	}
+
+	return user, nil
+}
+
+// certificateUser maps the subject of a verified client certificate to a user.
+// Mappings are looked up by the full subject first and then by common name.
+func (e *env) certificateUser(req *http.Request) (jwt.User, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return jwt.User{}, false
+	}
+
+	subject := req.TLS.VerifiedChains[0][0].Subject
+	for _, name := range []string{subject.String(), subject.CommonName} {
+		roles, ok := e.cfg.tls.subjectRoles[name]
+		if ok && name != "" {
+			return jwt.User{
+				ID:    subject.CommonName,
+				Roles: roles,
+			}, true
+		}
+	}
+
+	return jwt.User{}, false
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CzarSimon/httputil/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMutualTLS(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "service-registry-tls")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	ca, caKey := createTestCA(t)
+	writeTestCert(t, dir, "ca", ca, caKey)
+	for name, commonName := range map[string]string{
+		"server":       "localhost",
+		"media-server": "media-server",
+		"unmapped":     "unmapped",
+		"web-client":   "web-client",
+	} {
+		cert, key := createTestCert(t, commonName, ca, caKey)
+		writeTestCert(t, dir, name, cert, key)
+	}
+
+	e, _ := createTestEnv()
+	e.cfg.tls = tlsConfig{
+		certFile:     filepath.Join(dir, "server.crt"),
+		keyFile:      filepath.Join(dir, "server.key"),
+		clientCAFile: filepath.Join(dir, "ca.crt"),
+		clientAuth:   tls.VerifyClientCertIfGiven,
+		subjectRoles: map[string][]string{
+			"media-server":  {jwt.SystemRole},
+			"CN=web-client": {jwt.AnonymousRole},
+		},
+	}
+	certs, err := newCertReloader(e.cfg.tls.certFile, e.cfg.tls.keyFile, time.Minute)
+	assert.NoError(err)
+	e.tlsConfig, err = newTLSConfig(e.cfg.tls, certs)
+	assert.NoError(err)
+	server := newServer(e)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	url := "https://" + ln.Addr().String() + "/v1/services?application=test-app"
+	cases := []struct {
+		clientCert     string
+		role           string
+		expectedStatus int
+	}{
+		{clientCert: "media-server", role: "", expectedStatus: http.StatusOK},
+		{clientCert: "web-client", role: "", expectedStatus: http.StatusForbidden},
+		{clientCert: "unmapped", role: "", expectedStatus: http.StatusUnauthorized},
+		{clientCert: "unmapped", role: jwt.SystemRole, expectedStatus: http.StatusOK},
+		{clientCert: "", role: "", expectedStatus: http.StatusUnauthorized},
+		{clientCert: "", role: jwt.SystemRole, expectedStatus: http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		client := createTestTLSClient(t, dir, tc.clientCert)
+		req := createTestRequest(url, http.MethodGet, tc.role, nil)
+		res, err := client.Do(req)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.Equal(tc.expectedStatus, res.StatusCode, "clientCert=%s role=%s", tc.clientCert, tc.role)
+	}
+
+	// Rotated certificate should be picked up from disk.
+	cert, err := certs.getCertificate(nil)
+	assert.NoError(err)
+	serverCert, serverKey := createTestCert(t, "localhost", ca, caKey)
+	writeTestCert(t, dir, "server", serverCert, serverKey)
+	os.Chtimes(e.cfg.tls.certFile, time.Now(), time.Now().Add(time.Minute))
+	assert.True(certs.changed())
+	certs.reloadIfChanged()
+	assert.False(certs.changed())
+
+	rotated, err := certs.getCertificate(nil)
+	assert.NoError(err)
+	assert.NotEqual(cert.Certificate[0], rotated.Certificate[0])
+}
+
+func TestLoadConfig_TLS(t *testing.T) {
+	assert := assert.New(t)
+	path := writeTestConfig(t, testConfigFile+"tls:\n  certFile: server.crt\n  clientAuth: require\n")
+	defer os.Remove(path)
+
+	_, err := loadConfig(path)
+	assert.Error(err)
+
+	errs, ok := err.(validationErrors)
+	assert.True(ok)
+	assert.Len(errs, 2)
+	assert.Contains(errs, "tls.certFile (TLS_CERT_FILE) and tls.keyFile (TLS_KEY_FILE) must be set together")
+	assert.Contains(errs, "tls.clientCAFile (TLS_CLIENT_CA_FILE) is required to verify client certificates")
+
+	// TLS can be configured through the environment alone.
+	os.Setenv("TLS_CERT_FILE", "/etc/tls/server.crt")
+	os.Setenv("TLS_KEY_FILE", "/etc/tls/server.key")
+	os.Setenv("TLS_CLIENT_AUTH", "request")
+	os.Setenv("TLS_CLIENT_CA_FILE", "/etc/tls/ca.crt")
+	defer os.Unsetenv("TLS_CERT_FILE")
+	defer os.Unsetenv("TLS_KEY_FILE")
+	defer os.Unsetenv("TLS_CLIENT_AUTH")
+	defer os.Unsetenv("TLS_CLIENT_CA_FILE")
+
+	envPath := writeTestConfig(t, testConfigFile)
+	defer os.Remove(envPath)
+	cfg, err := loadConfig(envPath)
+	assert.NoError(err)
+	assert.Equal("/etc/tls/server.crt", cfg.tls.certFile)
+	assert.Equal("/etc/tls/server.key", cfg.tls.keyFile)
+	assert.Equal("/etc/tls/ca.crt", cfg.tls.clientCAFile)
+	assert.Equal(tls.VerifyClientCertIfGiven, cfg.tls.clientAuth)
+
+	os.Setenv("TLS_CLIENT_AUTH", "always")
+	_, err = loadConfig(envPath)
+	assert.Error(err)
+	errs, ok = err.(validationErrors)
+	assert.True(ok)
+	assert.Equal(validationErrors{`tls.clientAuth (TLS_CLIENT_AUTH) must be one of none, request or require, got "always"`}, errs)
+}
+
+func createTestTLSClient(t *testing.T, dir, clientCert string) *http.Client {
+	bundle, err := ioutil.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(bundle)
+
+	tlsCfg := &tls.Config{RootCAs: pool}
+	if clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(filepath.Join(dir, clientCert+".crt"), filepath.Join(dir, clientCert+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{
+		Timeout:   time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+	}
+}
+
+func createTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "service-registry-test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ca, key
+}
+
+func createTestCert(t *testing.T, commonName string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func writeTestCert(t *testing.T, dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	err = ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+const (
+	defaultDeliveryLimit = 100
+	maxDeliveryLimit     = 1000
+)
+
+func (e *env) createWebhook(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.createWebhook")
+	defer span.Finish()
+
+	var body models.Webhook
+	err := c.BindJSON(&body)
+	if err != nil {
+		err = httputil.BadRequestError(fmt.Errorf("failed to parse request body. %w", err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	webhook, err := e.webhooks.Create(ctx, body)
+	audited := webhook
+	audited.Secret = ""
+	e.recordAudit(ctx, c, models.AuditEntry{Action: auditWebhookCreate}, nil, audited, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, webhook)
+}
+
+func (e *env) findWebhooks(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.findWebhooks")
+	defer span.Finish()
+
+	webhooks, err := e.webhooks.FindAll(ctx)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, webhooks)
+}
+
+func (e *env) findWebhook(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.findWebhook")
+	defer span.Finish()
+
+	webhook, err := e.webhooks.Find(ctx, c.Param("id"))
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, webhook)
+}
+
+func (e *env) deleteWebhook(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.deleteWebhook")
+	defer span.Finish()
+
+	id := c.Param("id")
+	before, _ := e.webhooks.Find(ctx, id)
+	err := e.webhooks.Delete(ctx, id)
+	e.recordAudit(ctx, c, models.AuditEntry{Action: auditWebhookDelete}, before, nil, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	httputil.SendOK(c)
+}
+
+// findWebhookDeliveries lists the latest deliveries of a webhook, e.g. ?status=DEAD&limit=10.
+func (e *env) findWebhookDeliveries(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.findWebhookDeliveries")
+	defer span.Finish()
+
+	limit := defaultDeliveryLimit
+	value, ok := c.GetQuery("limit")
+	if ok {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxDeliveryLimit {
+			err = httputil.BadRequestError(fmt.Errorf("limit must be an integer between 1 and %d, got %s", maxDeliveryLimit, value))
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			c.Error(err)
+			return
+		}
+	}
+
+	status := models.DeliveryStatus(c.Query("status"))
+	deliveries, err := e.webhooks.FindDeliveries(ctx, c.Param("id"), status, limit)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, deliveries)
+}
+
+func (e *env) redeliverWebhook(c *gin.Context) {
+	span, ctx := opentracing.StartSpanFromContext(c.Request.Context(), "controller.redeliverWebhook")
+	defer span.Finish()
+
+	delivery, err := e.webhooks.Redeliver(ctx, c.Param("id"), c.Param("deliveryId"))
+	e.recordAudit(ctx, c, models.AuditEntry{Action: auditWebhookRedeliver}, nil, delivery, err)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		c.Error(err)
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	c.JSON(http.StatusOK, delivery)
+}
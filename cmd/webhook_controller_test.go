@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CzarSimon/httputil/client/rpc"
+	"github.com/CzarSimon/httputil/jwt"
+	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+type testReceiver struct {
+	server   *httptest.Server
+	status   int32
+	mu       sync.Mutex
+	requests []receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func newTestReceiver(status int) *testReceiver {
+	r := &testReceiver{status: int32(status)}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		r.requests = append(r.requests, receivedWebhook{header: req.Header, body: body})
+		r.mu.Unlock()
+
+		w.WriteHeader(int(atomic.LoadInt32(&r.status)))
+		w.Write([]byte("receiver says no"))
+	}))
+	return r
+}
+
+func (r *testReceiver) received() []receivedWebhook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedWebhook{}, r.requests...)
+}
+
+func TestWebhooks(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	server := newServer(e)
+
+	receiver := newTestReceiver(http.StatusOK)
+	defer receiver.server.Close()
+	failing := newTestReceiver(http.StatusInternalServerError)
+	defer failing.server.Close()
+
+	invalid := []models.Webhook{
+		{URL: "not-a-url"},
+		{URL: "ftp://example.com/hook"},
+		{URL: receiver.server.URL, EventTypes: []models.EventType{"service.exploded"}},
+	}
+	for _, webhook := range invalid {
+		req := createTestRequest("/v1/webhooks", http.MethodPost, jwt.SystemRole, webhook)
+		res := performTestRequest(server.Handler, req)
+		assert.Equal(http.StatusBadRequest, res.Code)
+	}
+
+	subscribed := createTestWebhook(t, server.Handler, models.Webhook{
+		URL:          receiver.server.URL,
+		Secret:       "s3cret",
+		Applications: []string{"media-server"},
+		EventTypes:   []models.EventType{models.EventServiceRegistered, models.EventServiceDeregistered},
+	})
+	assert.NotEmpty(subscribed.ID)
+	assert.Equal("s3cret", subscribed.Secret)
+
+	unreachable := createTestWebhook(t, server.Handler, models.Webhook{URL: failing.server.URL})
+	assert.Len(unreachable.Secret, 64)
+
+	req := createTestRequest("/v1/webhooks", http.MethodGet, jwt.SystemRole, nil)
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	var webhooks []models.Webhook
+	err := rpc.DecodeJSON(res.Result(), &webhooks)
+	assert.NoError(err)
+	assert.Len(webhooks, 2)
+	for _, webhook := range webhooks {
+		assert.Empty(webhook.Secret)
+	}
+
+	req = createTestRequest("/v1/webhooks/"+subscribed.ID, http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	var found models.Webhook
+	err = rpc.DecodeJSON(res.Result(), &found)
+	assert.NoError(err)
+	assert.Equal(subscribed.URL, found.URL)
+	assert.Equal(subscribed.EventTypes, found.EventTypes)
+	assert.Empty(found.Secret)
+
+	req = createTestRequest("/v1/webhooks/missing-id", http.MethodGet, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+
+	// Registry changes are queued and delivered by the dispatcher.
+	svc, err := e.registry.Register(ctx, models.Service{Service: dto.Service{Application: "media-server", Location: "ip-0", Port: 8080}})
+	assert.NoError(err)
+	_, err = e.registry.Register(ctx, models.Service{Service: dto.Service{Application: "other-app", Location: "ip-1", Port: 8080}})
+	assert.NoError(err)
+	_, err = e.registry.SetStatus(ctx, svc.ID, dto.StatusUnhealthy, svc.Epoch, 0)
+	assert.NoError(err)
+	_, err = e.registry.Deregister(ctx, svc.ID, 0)
+	assert.NoError(err)
+	assert.Empty(receiver.received())
+
+	delivered, err := e.webhooks.Deliver(ctx)
+	assert.NoError(err)
+	assert.Equal(2, delivered)
+
+	received := receiver.received()
+	assert.Len(received, 2)
+	expectedTypes := []models.EventType{models.EventServiceRegistered, models.EventServiceDeregistered}
+	for i, r := range received {
+		assert.Equal(models.SignWebhookPayload("s3cret", r.body), r.header.Get(models.WebhookSignatureHeader))
+		assert.Equal(string(expectedTypes[i]), r.header.Get(models.WebhookEventHeader))
+		assert.NotEmpty(r.header.Get(models.WebhookDeliveryHeader))
+
+		var event models.Event
+		err = json.Unmarshal(r.body, &event)
+		assert.NoError(err)
+		assert.Equal(expectedTypes[i], event.Type)
+		assert.Equal("media-server", event.Application)
+		assert.Equal(svc.ID, event.Service.ID)
+	}
+
+	// Failed deliveries are retried with back-off and dead-lettered after the max attempts.
+	for i := 0; i < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, err = e.webhooks.Deliver(ctx)
+		assert.NoError(err)
+	}
+	assert.Len(failing.received(), 12)
+	assert.Len(receiver.received(), 2)
+
+	dead := findTestDeliveries(t, server.Handler, unreachable.ID, "?status=DEAD", http.StatusOK)
+	assert.Len(dead, 4)
+	for _, delivery := range dead {
+		assert.Equal(3, delivery.Attempts)
+		assert.Equal(http.StatusInternalServerError, delivery.ResponseStatus)
+		assert.Contains(delivery.LastError, "receiver says no")
+	}
+
+	deliveries := findTestDeliveries(t, server.Handler, subscribed.ID, "", http.StatusOK)
+	assert.Len(deliveries, 2)
+	for _, delivery := range deliveries {
+		assert.Equal(models.DeliveryDelivered, delivery.Status)
+		assert.Equal(1, delivery.Attempts)
+	}
+	assert.Len(findTestDeliveries(t, server.Handler, subscribed.ID, "?limit=1", http.StatusOK), 1)
+	findTestDeliveries(t, server.Handler, subscribed.ID, "?status=LOST", http.StatusBadRequest)
+	findTestDeliveries(t, server.Handler, subscribed.ID, "?limit=0", http.StatusBadRequest)
+	findTestDeliveries(t, server.Handler, "missing-id", "", http.StatusNotFound)
+
+	// Dead letters can be redelivered once the receiver has recovered.
+	atomic.StoreInt32(&failing.status, http.StatusNoContent)
+	route := "/v1/webhooks/" + unreachable.ID + "/deliveries/" + dead[0].ID + "/redeliver"
+	req = createTestRequest(route, http.MethodPost, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+	var redelivery models.WebhookDelivery
+	err = rpc.DecodeJSON(res.Result(), &redelivery)
+	assert.NoError(err)
+	assert.Equal(models.DeliveryPending, redelivery.Status)
+	assert.Equal(0, redelivery.Attempts)
+
+	res = performTestRequest(server.Handler, createTestRequest(route, http.MethodPost, jwt.SystemRole, nil))
+	assert.Equal(http.StatusConflict, res.Code)
+
+	route = "/v1/webhooks/" + subscribed.ID + "/deliveries/" + dead[1].ID + "/redeliver"
+	res = performTestRequest(server.Handler, createTestRequest(route, http.MethodPost, jwt.SystemRole, nil))
+	assert.Equal(http.StatusNotFound, res.Code)
+
+	delivered, err = e.webhooks.Deliver(ctx)
+	assert.NoError(err)
+	assert.Equal(1, delivered)
+	assert.Len(findTestDeliveries(t, server.Handler, unreachable.ID, "?status=DEAD", http.StatusOK), 3)
+
+	// Deleted webhooks no longer receive events.
+	req = createTestRequest("/v1/webhooks/"+subscribed.ID, http.MethodDelete, jwt.SystemRole, nil)
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusOK, res.Code)
+
+	res = performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusNotFound, res.Code)
+	findTestDeliveries(t, server.Handler, subscribed.ID, "", http.StatusNotFound)
+
+	_, err = e.registry.Register(ctx, models.Service{Service: dto.Service{Application: "media-server", Location: "ip-2", Port: 8080}})
+	assert.NoError(err)
+	delivered, err = e.webhooks.Deliver(ctx)
+	assert.NoError(err)
+	assert.Equal(1, delivered)
+	assert.Len(receiver.received(), 2)
+
+	actions := make(map[string]int)
+	for _, entry := range findTestAuditEntries(t, server.Handler, "limit=1000") {
+		actions[entry.Action]++
+	}
+	assert.Equal(5, actions[auditWebhookCreate])
+	assert.Equal(2, actions[auditWebhookDelete])
+	assert.Equal(3, actions[auditWebhookRedeliver])
+}
+
+func createTestWebhook(t *testing.T, handler http.Handler, webhook models.Webhook) models.Webhook {
+	req := createTestRequest("/v1/webhooks", http.MethodPost, jwt.SystemRole, webhook)
+	res := performTestRequest(handler, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	var created models.Webhook
+	err := rpc.DecodeJSON(res.Result(), &created)
+	assert.NoError(t, err)
+	return created
+}
+
+func TestWebhookDeliveryClaims(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	server := newServer(e)
+	repo := repository.NewWebhookRepository(e.db)
+
+	receiver := newTestReceiver(http.StatusOK)
+	defer receiver.server.Close()
+	createTestWebhook(t, server.Handler, models.Webhook{URL: receiver.server.URL})
+
+	_, err := e.registry.Register(ctx, models.Service{Service: dto.Service{Application: "media-server", Location: "ip-0", Port: 8080}})
+	assert.NoError(err)
+	now := time.Now()
+	due, err := repo.FindDue(ctx, now, 10)
+	assert.NoError(err)
+	assert.Len(due, 1)
+
+	// Deliveries claimed by another replica are left to it.
+	claimed, err := repo.Claim(ctx, due[0].ID, now, now.Add(time.Hour))
+	assert.NoError(err)
+	assert.True(claimed)
+	claimed, err = repo.Claim(ctx, due[0].ID, now, now.Add(time.Hour))
+	assert.NoError(err)
+	assert.False(claimed)
+
+	delivered, err := e.webhooks.Deliver(ctx)
+	assert.NoError(err)
+	assert.Equal(0, delivered)
+	assert.Empty(receiver.received())
+
+	// Deliveries are due again if the replica holding the claim did not attempt them in time.
+	_, err = e.db.Exec("UPDATE webhook_delivery SET next_attempt_at = ? WHERE id = ?", now.UTC().Add(-time.Second), due[0].ID)
+	assert.NoError(err)
+	delivered, err = e.webhooks.Deliver(ctx)
+	assert.NoError(err)
+	assert.Equal(1, delivered)
+	assert.Len(receiver.received(), 1)
+}
+
+func TestWebhookEnqueueFailure(t *testing.T) {
+	assert := assert.New(t)
+	e, ctx := createTestEnv()
+	server := newServer(e)
+
+	receiver := newTestReceiver(http.StatusOK)
+	defer receiver.server.Close()
+	createTestWebhook(t, server.Handler, models.Webhook{URL: receiver.server.URL})
+
+	// Changes whose deliveries cannot be queued fail so that the client retries them.
+	_, err := e.db.Exec("DROP TABLE webhook_delivery")
+	assert.NoError(err)
+	req := createTestRequest("/v1/services", http.MethodPost, jwt.SystemRole, dto.Service{
+		Application: "media-server",
+		Location:    "ip-0",
+		Port:        8080,
+	})
+	res := performTestRequest(server.Handler, req)
+	assert.Equal(http.StatusInternalServerError, res.Code)
+
+	services, err := e.registry.FindAll(ctx, models.ServiceFilter{Location: "ip-0"})
+	assert.NoError(err)
+	assert.Len(services, 1)
+}
+
+func findTestDeliveries(t *testing.T, handler http.Handler, webhookID, query string, expectedStatus int) []models.WebhookDelivery {
+	req := createTestRequest("/v1/webhooks/"+webhookID+"/deliveries"+query, http.MethodGet, jwt.SystemRole, nil)
+	res := performTestRequest(handler, req)
+	assert.Equal(t, expectedStatus, res.Code)
+
+	var deliveries []models.WebhookDelivery
+	if expectedStatus == http.StatusOK {
+		err := rpc.DecodeJSON(res.Result(), &deliveries)
+		assert.NoError(t, err)
+	}
+	return deliveries
+}
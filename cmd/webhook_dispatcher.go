@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rtcheap/service-registry/internal/service"
+	"go.uber.org/zap"
+)
+
+// webhookDispatcher periodically attempts the webhook deliveries that are due.
+type webhookDispatcher struct {
+	*periodicWorker
+	webhooks *service.WebhookService
+}
+
+func newWebhookDispatcher(webhooks *service.WebhookService, interval time.Duration) *webhookDispatcher {
+	w := &webhookDispatcher{webhooks: webhooks}
+	w.periodicWorker = newPeriodicWorker(interval, w.dispatch)
+	return w
+}
+
+func (w *webhookDispatcher) dispatch() {
+	_, err := w.webhooks.Deliver(context.Background())
+	if err != nil {
+		log.Error("failed to deliver webhooks", zap.Error(err))
+	}
+}
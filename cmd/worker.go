@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// periodicWorker runs a function every interval until stopped, or earlier when notified.
+type periodicWorker struct {
+	interval time.Duration
+	run      func()
+	wake     chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newPeriodicWorker(interval time.Duration, run func()) *periodicWorker {
+	return &periodicWorker{
+		interval: interval,
+		run:      run,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func (w *periodicWorker) start() {
+	ticker := time.NewTicker(w.interval)
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.run()
+			case <-w.wake:
+				w.run()
+			case <-w.done:
+				return
+			}
+		}
+	}()
+}
+
+func (w *periodicWorker) stop() {
+	close(w.done)
+	w.wg.Wait()
+}
+
+// notify schedules a run without waiting for the next tick, notifications
+// received while a run is pending are handled by that run.
+func (w *periodicWorker) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
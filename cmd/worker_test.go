@@ -0,0 +1,40 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeriodicWorker(t *testing.T) {
+	assert := assert.New(t)
+
+	var runs int32
+	w := newPeriodicWorker(10*time.Millisecond, func() {
+		atomic.AddInt32(&runs, 1)
+	})
+	w.start()
+	assert.Eventually(func() bool {
+		return atomic.LoadInt32(&runs) >= 2
+	}, time.Second, time.Millisecond)
+	w.stop()
+
+	// Stopped workers no longer run.
+	stopped := atomic.LoadInt32(&runs)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(stopped, atomic.LoadInt32(&runs))
+
+	// Notified workers run without waiting for the next tick.
+	runs = 0
+	w = newPeriodicWorker(time.Hour, func() {
+		atomic.AddInt32(&runs, 1)
+	})
+	w.start()
+	defer w.stop()
+	w.notify()
+	assert.Eventually(func() bool {
+		return atomic.LoadInt32(&runs) == 1
+	}, time.Second, time.Millisecond)
+}
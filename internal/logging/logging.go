@@ -0,0 +1,33 @@
+package logging
+
+import (
+	"log"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var level = zap.NewAtomicLevelAt(zap.DebugLevel)
+
+// GetLogger creates a named logger whose level can be changed at runtime using SetLevel.
+func GetLogger(name string) *zap.Logger {
+	cfg := zap.NewProductionConfig()
+	cfg.Level = level
+
+	logger, err := cfg.Build()
+	if err != nil {
+		log.Fatalln("Failed to get zap.Logger "+name, err)
+	}
+
+	return logger.With(zap.String("logger", name))
+}
+
+// SetLevel changes the log level of all loggers created by GetLogger.
+func SetLevel(l zapcore.Level) {
+	level.SetLevel(l)
+}
+
+// Level returns the current log level.
+func Level() zapcore.Level {
+	return level.Level()
+}
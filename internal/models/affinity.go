@@ -0,0 +1,55 @@
+package models
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// AffinityBinding binds an affinity key, such as a room or user id, to an instance of an application until it expires.
+type AffinityBinding struct {
+	Application string    `json:"application"`
+	Key         string    `json:"key"`
+	ServiceID   string    `json:"serviceId"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// Expired checks if the binding has expired.
+func (b AffinityBinding) Expired(now time.Time) bool {
+	return !now.Before(b.ExpiresAt)
+}
+
+// AffinityRequest request to bind a key, to a specific instance if ServiceID is set.
+type AffinityRequest struct {
+	ServiceID  string `json:"serviceId,omitempty"`
+	TTLSeconds int    `json:"ttlSeconds,omitempty"`
+}
+
+// Affinity binding along with the instance it is bound to. Rebound is set if
+// the key was moved from an instance that is no longer available.
+type Affinity struct {
+	Binding AffinityBinding `json:"binding"`
+	Service Service         `json:"service"`
+	Rebound bool            `json:"rebound"`
+}
+
+// PickByHash picks the instance for a key using rendezvous hashing, so that a key keeps mapping to
+// the same instance as long as it is a candidate and only keys of removed instances move.
+func PickByHash(key string, candidates []Service) (Service, bool) {
+	var picked Service
+	var highest uint64
+	found := false
+	for _, svc := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(svc.ID))
+		score := h.Sum64()
+		if !found || score > highest {
+			picked, highest, found = svc, score, true
+		}
+	}
+
+	return picked, found
+}
@@ -0,0 +1,162 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// AlertCondition kind of application health threshold an alert rule checks.
+type AlertCondition string
+
+// Alert conditions. Threshold is a number of instances for HealthyBelow, a percentage of the
+// instances for UnhealthyAbove and a number of seconds for NoHeartbeat.
+const (
+	AlertHealthyBelow   AlertCondition = "healthy-below"
+	AlertUnhealthyAbove AlertCondition = "unhealthy-above"
+	AlertNoHeartbeat    AlertCondition = "no-heartbeat"
+)
+
+// Valid checks if the condition is a known condition.
+func (c AlertCondition) Valid() bool {
+	return c == AlertHealthyBelow || c == AlertUnhealthyAbove || c == AlertNoHeartbeat
+}
+
+// AlertRule threshold on the health of an application. The alert fires once the
+// condition has held for ForSeconds.
+type AlertRule struct {
+	ID          string         `json:"id"`
+	Name        string         `json:"name"`
+	Application string         `json:"application"`
+	Condition   AlertCondition `json:"condition"`
+	Threshold   float64        `json:"threshold"`
+	ForSeconds  int            `json:"forSeconds"`
+	CreatedAt   time.Time      `json:"createdAt"`
+}
+
+// Measure computes the value the condition of the rule is checked against from the instances
+// of its application and reports if the condition holds. Instances past the instance TTL of the
+// policy count as unhealthy.
+func (r AlertRule) Measure(services []Service, policy RegistrationPolicy, now time.Time) (float64, bool) {
+	switch r.Condition {
+	case AlertHealthyBelow:
+		healthy := 0
+		for _, svc := range services {
+			if policy.Available(svc, now) {
+				healthy++
+			}
+		}
+		return float64(healthy), float64(healthy) < r.Threshold
+	case AlertUnhealthyAbove:
+		if len(services) == 0 {
+			return 0, false
+		}
+		unhealthy := 0
+		for _, svc := range services {
+			if !policy.Available(svc, now) {
+				unhealthy++
+			}
+		}
+		percent := 100 * float64(unhealthy) / float64(len(services))
+		return percent, percent > r.Threshold
+	default:
+		var latest time.Time
+		for _, svc := range services {
+			if svc.HeartbeatAt.After(latest) {
+				latest = svc.HeartbeatAt
+			}
+		}
+		if latest.IsZero() {
+			return math.Inf(1), true
+		}
+		silence := now.Sub(latest).Seconds()
+		return silence, silence > r.Threshold
+	}
+}
+
+// Describe summarizes a measured value of the rule for notifications.
+func (r AlertRule) Describe(value float64) string {
+	switch r.Condition {
+	case AlertHealthyBelow:
+		return fmt.Sprintf("%s has %.0f healthy instances, expected at least %.0f", r.Application, value, r.Threshold)
+	case AlertUnhealthyAbove:
+		return fmt.Sprintf("%.0f%% of the instances of %s are unhealthy, expected at most %.0f%%", value, r.Application, r.Threshold)
+	default:
+		if math.IsInf(value, 1) {
+			return fmt.Sprintf("no instance of %s has sent a heartbeat", r.Application)
+		}
+		return fmt.Sprintf("no instance of %s has sent a heartbeat for %.0fs, expected within %.0fs", r.Application, value, r.Threshold)
+	}
+}
+
+// AlertState state of an alert rule.
+type AlertState string
+
+// Alert states. A rule whose condition holds is pending until it has held for the
+// duration of the rule and the alert fires. Fired alerts are resolved once the
+// condition no longer holds.
+const (
+	AlertInactive AlertState = "INACTIVE"
+	AlertPending  AlertState = "PENDING"
+	AlertFiring   AlertState = "FIRING"
+	AlertResolved AlertState = "RESOLVED"
+)
+
+// Valid checks if the state is a known alert state.
+func (s AlertState) Valid() bool {
+	return s == AlertInactive || s == AlertPending || s == AlertFiring || s == AlertResolved
+}
+
+// Alert latest evaluation of an alert rule. Value is not set when it is unbounded,
+// e.g. when no instance has ever sent a heartbeat.
+type Alert struct {
+	Rule        AlertRule  `json:"rule"`
+	State       AlertState `json:"state"`
+	Value       *float64   `json:"value,omitempty"`
+	Summary     string     `json:"summary"`
+	ActiveSince *time.Time `json:"activeSince,omitempty"`
+	FiredAt     *time.Time `json:"firedAt,omitempty"`
+	ResolvedAt  *time.Time `json:"resolvedAt,omitempty"`
+	EvaluatedAt time.Time  `json:"evaluatedAt"`
+}
+
+// Evaluate advances the alert given whether the condition of its rule holds at now.
+// Returns true if the alert fired or was resolved.
+func (a *Alert) Evaluate(value float64, holds bool, now time.Time) bool {
+	a.EvaluatedAt = now
+	a.Summary = a.Rule.Describe(value)
+	a.Value = nil
+	if !math.IsInf(value, 0) {
+		a.Value = &value
+	}
+
+	if !holds {
+		a.ActiveSince = nil
+		switch a.State {
+		case AlertFiring:
+			a.State = AlertResolved
+			a.ResolvedAt = &now
+			return true
+		case AlertPending:
+			a.State = AlertInactive
+		}
+		return false
+	}
+
+	if a.ActiveSince == nil {
+		a.ActiveSince = &now
+	}
+	if a.State == AlertFiring {
+		return false
+	}
+
+	if now.Sub(*a.ActiveSince) < time.Duration(a.Rule.ForSeconds)*time.Second {
+		a.State = AlertPending
+		return false
+	}
+
+	a.State = AlertFiring
+	a.FiredAt = &now
+	a.ResolvedAt = nil
+	return true
+}
@@ -0,0 +1,54 @@
+package models
+
+import "time"
+
+// Capacity number of sessions an instance can host and is currently hosting, as reported by the
+// instance. ReservedSessions counts slots reserved by the registry that have not been released.
+type Capacity struct {
+	MaxSessions      int       `json:"maxSessions"`
+	ActiveSessions   int       `json:"activeSessions"`
+	ReservedSessions int       `json:"reservedSessions"`
+	UpdatedAt        time.Time `json:"updatedAt,omitempty"`
+}
+
+// Load number of active and reserved sessions.
+func (c Capacity) Load() int {
+	return c.ActiveSessions + c.ReservedSessions
+}
+
+// Available checks if the instance has room for another session.
+func (c Capacity) Available() bool {
+	return c.Load() < c.MaxSessions
+}
+
+// Utilization share of the capacity in use.
+func (c Capacity) Utilization() float64 {
+	if c.MaxSessions <= 0 {
+		return 1
+	}
+
+	return float64(c.Load()) / float64(c.MaxSessions)
+}
+
+// Reservation session slot reserved on an instance until it is released or expires.
+type Reservation struct {
+	ID          string    `json:"id"`
+	Application string    `json:"application"`
+	ServiceID   string    `json:"serviceId"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// AllocationRequest request to reserve a session slot on an instance of an application matching
+// the filter. RouteKey is used to pick the subset of instances if the application has routing rules.
+type AllocationRequest struct {
+	TTLSeconds int    `json:"ttlSeconds,omitempty"`
+	RouteKey   string `json:"routeKey,omitempty"`
+	ServiceFilter
+}
+
+// Allocation reserved slot along with the instance hosting it.
+type Allocation struct {
+	Reservation Reservation `json:"reservation"`
+	Service     Service     `json:"service"`
+}
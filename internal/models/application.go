@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+
+	"github.com/rtcheap/dto"
+)
+
+// Application declared application in the catalog along with the defaults applied to its instances.
+// ProxyEnabled allows requests to the application through the reverse proxy.
+type Application struct {
+	Name                string         `json:"name"`
+	Description         string         `json:"description,omitempty"`
+	Team                string         `json:"team,omitempty"`
+	Contact             string         `json:"contact,omitempty"`
+	MinHealthyInstances int            `json:"minHealthyInstances"`
+	InstanceTTLSeconds  int64          `json:"instanceTtlSeconds,omitempty"`
+	ConflictPolicy      ConflictPolicy `json:"conflictPolicy,omitempty"`
+	ProxyEnabled        bool           `json:"proxyEnabled"`
+	CreatedAt           time.Time      `json:"createdAt,omitempty"`
+	UpdatedAt           time.Time      `json:"updatedAt,omitempty"`
+}
+
+// ApplicationSummary application along with the number of registered instances by status.
+// Applications with registered instances that are not declared in the catalog are included
+// with Declared set to false.
+type ApplicationSummary struct {
+	Application
+	Declared     bool                      `json:"declared"`
+	Instances    map[dto.ServiceStatus]int `json:"instances"`
+	BelowMinimum bool                      `json:"belowMinimum"`
+}
+
+// NewApplicationSummary creates a summary of an application from its instance counts.
+func NewApplicationSummary(app Application, declared bool, instances map[dto.ServiceStatus]int) ApplicationSummary {
+	if instances == nil {
+		instances = make(map[dto.ServiceStatus]int)
+	}
+
+	return ApplicationSummary{
+		Application:  app,
+		Declared:     declared,
+		Instances:    instances,
+		BelowMinimum: instances[dto.StatusHealty] < app.MinHealthyInstances,
+	}
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Audit outcomes.
+const (
+	OutcomeSuccess = "SUCCESS"
+	OutcomeFailure = "FAILURE"
+)
+
+// AuditEntry record of a mutating operation performed against the registry.
+type AuditEntry struct {
+	ID          string          `json:"id,omitempty"`
+	ActorID     string          `json:"actorId,omitempty"`
+	ActorRoles  []string        `json:"actorRoles,omitempty"`
+	SourceIP    string          `json:"sourceIp,omitempty"`
+	TraceID     string          `json:"traceId,omitempty"`
+	Action      string          `json:"action,omitempty"`
+	Application string          `json:"application,omitempty"`
+	ServiceID   string          `json:"serviceId,omitempty"`
+	Before      json.RawMessage `json:"before,omitempty"`
+	After       json.RawMessage `json:"after,omitempty"`
+	Outcome     string          `json:"outcome,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt,omitempty"`
+}
+
+// AuditFilter criteria for querying the audit log, empty values match all entries.
+type AuditFilter struct {
+	ActorID     string
+	Application string
+	ServiceID   string
+	From        time.Time
+	To          time.Time
+	Limit       int
+}
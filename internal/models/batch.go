@@ -0,0 +1,24 @@
+package models
+
+import "github.com/rtcheap/dto"
+
+// BatchResult outcome of a single item in a batch operation.
+type BatchResult struct {
+	Index   int      `json:"index"`
+	Status  int      `json:"status"`
+	Service *Service `json:"service,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// BatchResponse outcome of a batch operation, failed items do not prevent the other items from being applied.
+type BatchResponse struct {
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []BatchResult `json:"results"`
+}
+
+// ApplicationStatusUpdate request to set the status of the instances of an application matching the filter.
+type ApplicationStatusUpdate struct {
+	Status dto.ServiceStatus `json:"status"`
+	ServiceFilter
+}
@@ -0,0 +1,216 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Consul health check statuses.
+const (
+	ConsulPassing  = "passing"
+	ConsulCritical = "critical"
+)
+
+// ConsulCatalogService instance in the shape of the Consul catalog API.
+type ConsulCatalogService struct {
+	ID              string            `json:"ID"`
+	Node            string            `json:"Node"`
+	Address         string            `json:"Address"`
+	Datacenter      string            `json:"Datacenter"`
+	TaggedAddresses map[string]string `json:"TaggedAddresses"`
+	NodeMeta        map[string]string `json:"NodeMeta"`
+	ServiceID       string            `json:"ServiceID"`
+	ServiceName     string            `json:"ServiceName"`
+	ServiceTags     []string          `json:"ServiceTags"`
+	ServiceAddress  string            `json:"ServiceAddress"`
+	ServicePort     int               `json:"ServicePort"`
+	ServiceMeta     map[string]string `json:"ServiceMeta"`
+	ServiceWeights  ConsulWeights     `json:"ServiceWeights"`
+	CreateIndex     uint64            `json:"CreateIndex"`
+	ModifyIndex     uint64            `json:"ModifyIndex"`
+}
+
+// ConsulWeights weights of an instance when passing or warning.
+type ConsulWeights struct {
+	Passing int `json:"Passing"`
+	Warning int `json:"Warning"`
+}
+
+// ConsulServiceEntry instance along with its node and health checks in the shape of the Consul health API.
+type ConsulServiceEntry struct {
+	Node    ConsulNode          `json:"Node"`
+	Service ConsulAgentService  `json:"Service"`
+	Checks  []ConsulHealthCheck `json:"Checks"`
+}
+
+// ConsulNode node an instance runs on, the location of the instance.
+type ConsulNode struct {
+	ID              string            `json:"ID"`
+	Node            string            `json:"Node"`
+	Address         string            `json:"Address"`
+	Datacenter      string            `json:"Datacenter"`
+	TaggedAddresses map[string]string `json:"TaggedAddresses"`
+	Meta            map[string]string `json:"Meta"`
+	CreateIndex     uint64            `json:"CreateIndex"`
+	ModifyIndex     uint64            `json:"ModifyIndex"`
+}
+
+// ConsulAgentService instance as registered with a Consul agent.
+type ConsulAgentService struct {
+	ID          string            `json:"ID"`
+	Service     string            `json:"Service"`
+	Tags        []string          `json:"Tags"`
+	Address     string            `json:"Address"`
+	Port        int               `json:"Port"`
+	Meta        map[string]string `json:"Meta"`
+	Weights     ConsulWeights     `json:"Weights"`
+	CreateIndex uint64            `json:"CreateIndex"`
+	ModifyIndex uint64            `json:"ModifyIndex"`
+}
+
+// ConsulHealthCheck health of an instance, passing if the instance is healthy and not ejected as an outlier.
+type ConsulHealthCheck struct {
+	Node        string   `json:"Node"`
+	CheckID     string   `json:"CheckID"`
+	Name        string   `json:"Name"`
+	Status      string   `json:"Status"`
+	Output      string   `json:"Output"`
+	ServiceID   string   `json:"ServiceID"`
+	ServiceName string   `json:"ServiceName"`
+	ServiceTags []string `json:"ServiceTags"`
+	CreateIndex uint64   `json:"CreateIndex"`
+	ModifyIndex uint64   `json:"ModifyIndex"`
+}
+
+// ConsulTags maps the labels of a service to Consul tags formatted as name=value, sorted by name.
+func ConsulTags(svc Service) []string {
+	tags := make([]string, 0, len(svc.Labels))
+	for name, value := range svc.Labels {
+		tags = append(tags, name+"="+value)
+	}
+
+	sort.Strings(tags)
+	return tags
+}
+
+// HasConsulTags checks if the service has every given tag.
+func HasConsulTags(svc Service, tags []string) bool {
+	for _, tag := range tags {
+		name := tag
+		value := ""
+		if i := strings.Index(tag, "="); i >= 0 {
+			name, value = tag[:i], tag[i+1:]
+		}
+
+		actual, ok := svc.Labels[name]
+		if !ok || actual != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// NewConsulCatalogService maps a service to the Consul catalog shape. The location of the
+// service is used as its node and the region, if any, as its datacenter.
+func NewConsulCatalogService(svc Service, datacenter string, index uint64) ConsulCatalogService {
+	node := newConsulNode(svc, datacenter, index)
+	return ConsulCatalogService{
+		ID:              node.ID,
+		Node:            node.Node,
+		Address:         node.Address,
+		Datacenter:      node.Datacenter,
+		TaggedAddresses: node.TaggedAddresses,
+		NodeMeta:        node.Meta,
+		ServiceID:       svc.ID,
+		ServiceName:     svc.Application,
+		ServiceTags:     ConsulTags(svc),
+		ServiceAddress:  svc.Location,
+		ServicePort:     svc.Port,
+		ServiceMeta:     consulMeta(svc),
+		ServiceWeights:  consulWeights(svc),
+		CreateIndex:     index,
+		ModifyIndex:     index,
+	}
+}
+
+// NewConsulServiceEntry maps a service to the Consul health shape with a single check for the service,
+// which is critical if the service is expired according to the registration policy of its application.
+func NewConsulServiceEntry(svc Service, policy RegistrationPolicy, now time.Time, datacenter string, index uint64) ConsulServiceEntry {
+	status, output := ConsulPassing, "instance is healthy"
+	if svc.EjectedUntil != nil {
+		status, output = ConsulCritical, "instance is ejected as an outlier"
+	} else if !svc.Healthy() {
+		status, output = ConsulCritical, "instance is "+string(svc.Status)
+	} else if policy.Expired(svc, now) {
+		status, output = ConsulCritical, "instance has not sent a heartbeat within the instance TTL"
+	}
+
+	tags := ConsulTags(svc)
+	return ConsulServiceEntry{
+		Node: newConsulNode(svc, datacenter, index),
+		Service: ConsulAgentService{
+			ID:          svc.ID,
+			Service:     svc.Application,
+			Tags:        tags,
+			Address:     svc.Location,
+			Port:        svc.Port,
+			Meta:        consulMeta(svc),
+			Weights:     consulWeights(svc),
+			CreateIndex: index,
+			ModifyIndex: index,
+		},
+		Checks: []ConsulHealthCheck{
+			{
+				Node:        svc.Location,
+				CheckID:     "service:" + svc.ID,
+				Name:        "Service '" + svc.Application + "' check",
+				Status:      status,
+				Output:      output,
+				ServiceID:   svc.ID,
+				ServiceName: svc.Application,
+				ServiceTags: tags,
+				CreateIndex: index,
+				ModifyIndex: index,
+			},
+		},
+	}
+}
+
+func newConsulNode(svc Service, datacenter string, index uint64) ConsulNode {
+	if svc.Region != "" {
+		datacenter = svc.Region
+	}
+
+	meta := map[string]string{}
+	if svc.Zone != "" {
+		meta["zone"] = svc.Zone
+	}
+
+	return ConsulNode{
+		Node:            svc.Location,
+		Address:         svc.Location,
+		Datacenter:      datacenter,
+		TaggedAddresses: map[string]string{"lan": svc.Location},
+		Meta:            meta,
+		CreateIndex:     index,
+		ModifyIndex:     index,
+	}
+}
+
+func consulMeta(svc Service) map[string]string {
+	meta := make(map[string]string, len(svc.Labels))
+	for name, value := range svc.Labels {
+		meta[name] = value
+	}
+
+	return meta
+}
+
+func consulWeights(svc Service) ConsulWeights {
+	return ConsulWeights{
+		Passing: effectiveWeight(svc),
+		Warning: 1,
+	}
+}
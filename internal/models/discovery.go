@@ -0,0 +1,84 @@
+package models
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// MetricsPortName name of the port instances expose metrics on.
+const MetricsPortName = "metrics"
+
+// Meta labels attached to Prometheus targets, available during relabeling.
+const (
+	PrometheusLabelPrefix      = "__meta_registry_"
+	PrometheusApplicationLabel = PrometheusLabelPrefix + "application"
+	PrometheusStatusLabel      = PrometheusLabelPrefix + "status"
+	PrometheusServiceIDLabel   = PrometheusLabelPrefix + "service_id"
+	PrometheusRegionLabel      = PrometheusLabelPrefix + "region"
+	PrometheusZoneLabel        = PrometheusLabelPrefix + "zone"
+	PrometheusPortNameLabel    = PrometheusLabelPrefix + "port_name"
+	PrometheusInstanceLabel    = PrometheusLabelPrefix + "label_"
+)
+
+// PrometheusTargetGroup group of targets sharing labels in the Prometheus http_sd_config format.
+type PrometheusTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// NewPrometheusTargetGroups creates the target groups for the given services, which are expected
+// to be ordered by application. The http_sd_config format only has labels per group and every
+// instance has its own service ID label, so each instance is its own group with a single target
+// rather than one group per application. The groups of an application follow each other. An
+// instance declaring a metrics port is scraped on it, other instances on their port.
+func NewPrometheusTargetGroups(services []Service) []PrometheusTargetGroup {
+	groups := make([]PrometheusTargetGroup, 0, len(services))
+	for _, svc := range services {
+		labels := map[string]string{
+			PrometheusApplicationLabel: svc.Application,
+			PrometheusStatusLabel:      string(svc.Status),
+			PrometheusServiceIDLabel:   svc.ID,
+		}
+		if svc.Region != "" {
+			labels[PrometheusRegionLabel] = svc.Region
+		}
+		if svc.Zone != "" {
+			labels[PrometheusZoneLabel] = svc.Zone
+		}
+		for name, value := range svc.Labels {
+			labels[PrometheusInstanceLabel+PrometheusLabelName(name)] = value
+		}
+
+		port := svc.Port
+		metrics, ok := svc.FindPort(MetricsPortName, "")
+		if ok {
+			port = metrics.Port
+			labels[PrometheusPortNameLabel] = metrics.Name
+		}
+
+		groups = append(groups, PrometheusTargetGroup{
+			Targets: []string{net.JoinHostPort(svc.Location, strconv.Itoa(port))},
+			Labels:  labels,
+		})
+	}
+
+	return groups
+}
+
+// PrometheusLabelName converts a label name to a valid Prometheus label name by
+// replacing unsupported characters with underscores, e.g. app.kubernetes.io/name
+// becomes app_kubernetes_io_name.
+func PrometheusLabelName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		valid := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9')
+		if valid {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rtcheap/dto"
+)
+
+// SourceDocker value of the source label of instances registered from Docker containers.
+const SourceDocker = "docker"
+
+// Labels of the Docker containers registered by the docker agent. The application label opts a
+// container in and the port label selects the exposed port to register, the lowest if not set.
+const (
+	DockerApplicationLabel = "service-registry.application"
+	DockerPortLabel        = "service-registry.port"
+)
+
+// Labels of instances registered from Docker containers.
+const (
+	DockerContainerLabel = "docker.container"
+	DockerImageLabel     = "docker.image"
+)
+
+// Docker health statuses of containers with a health check.
+const (
+	DockerHealthy   = "healthy"
+	DockerUnhealthy = "unhealthy"
+	DockerStarting  = "starting"
+)
+
+// DockerContainer container as inspected through the Docker engine API, only the fields used by the agent.
+type DockerContainer struct {
+	ID     string `json:"Id"`
+	Name   string `json:"Name"`
+	Config struct {
+		Image        string              `json:"Image"`
+		Labels       map[string]string   `json:"Labels"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+	} `json:"Config"`
+	State struct {
+		Running bool `json:"Running"`
+		Health  *struct {
+			Status string `json:"Status"`
+		} `json:"Health,omitempty"`
+	} `json:"State"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// DockerEvent event from the event stream of the Docker engine API.
+type DockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// DockerServiceID derives the id of the instance registered for a container from its short id.
+func DockerServiceID(containerID string) string {
+	if len(containerID) > 12 {
+		containerID = containerID[:12]
+	}
+
+	return "docker-" + containerID
+}
+
+// NewDockerService maps a container to an instance of the application in its application label,
+// located at its IP address on the network, or its first network if empty. Containers with a
+// health check are healthy once Docker reports them healthy.
+func NewDockerService(container DockerContainer, network string) (Service, error) {
+	application := container.Config.Labels[DockerApplicationLabel]
+	if application == "" {
+		return Service{}, fmt.Errorf("container %s has no %s label", container.ID, DockerApplicationLabel)
+	}
+
+	address := dockerAddress(container, network)
+	if address == "" {
+		return Service{}, fmt.Errorf("container %s has no IP address on network %q", container.ID, network)
+	}
+
+	ports, err := dockerPorts(container)
+	if err != nil {
+		return Service{}, err
+	}
+
+	status := dto.StatusHealty
+	if container.State.Health != nil && container.State.Health.Status != DockerHealthy {
+		status = dto.StatusUnhealthy
+	}
+
+	return Service{
+		Service: dto.Service{
+			ID:          DockerServiceID(container.ID),
+			Application: application,
+			Location:    address,
+			Port:        ports[0].Port,
+			Status:      status,
+		},
+		Labels: map[string]string{
+			SourceLabel:          SourceDocker,
+			DockerContainerLabel: strings.TrimPrefix(container.Name, "/"),
+			DockerImageLabel:     container.Config.Image,
+		},
+		Ports: ports,
+	}, nil
+}
+
+func dockerAddress(container DockerContainer, network string) string {
+	networks := container.NetworkSettings.Networks
+	if network != "" {
+		return networks[network].IPAddress
+	}
+
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if networks[name].IPAddress != "" {
+			return networks[name].IPAddress
+		}
+	}
+
+	return ""
+}
+
+// dockerPorts maps the exposed ports of a container, formatted like 8080/tcp, to named ports
+// with the port to register first.
+func dockerPorts(container DockerContainer) ([]ServicePort, error) {
+	ports := make([]ServicePort, 0, len(container.Config.ExposedPorts))
+	for exposed := range container.Config.ExposedPorts {
+		parts := strings.SplitN(exposed, "/", 2)
+		port, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("container %s exposes invalid port %s", container.ID, exposed)
+		}
+
+		protocol := ProtocolTCP
+		if len(parts) == 2 && parts[1] == "udp" {
+			protocol = ProtocolUDP
+		} else if len(parts) == 2 && parts[1] != "tcp" {
+			continue
+		}
+
+		ports = append(ports, ServicePort{Name: fmt.Sprintf("port-%d", port), Port: port, Protocol: protocol})
+	}
+	sortPorts(ports)
+
+	value, ok := container.Config.Labels[DockerPortLabel]
+	if !ok {
+		if len(ports) == 0 {
+			return nil, fmt.Errorf("container %s exposes no ports and has no %s label", container.ID, DockerPortLabel)
+		}
+		return ports, nil
+	}
+
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("container %s has invalid %s label %q", container.ID, DockerPortLabel, value)
+	}
+
+	selected := ServicePort{Name: fmt.Sprintf("port-%d", port), Port: port, Protocol: ProtocolTCP}
+	others := make([]ServicePort, 0, len(ports))
+	for _, p := range ports {
+		if p.Name == selected.Name {
+			selected = p
+		} else {
+			others = append(others, p)
+		}
+	}
+
+	return append([]ServicePort{selected}, others...), nil
+}
@@ -0,0 +1,356 @@
+package models
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rtcheap/dto"
+)
+
+// EurekaStatus status of an instance in the Eureka API.
+type EurekaStatus string
+
+// Eureka instance statuses.
+const (
+	EurekaUp           EurekaStatus = "UP"
+	EurekaDown         EurekaStatus = "DOWN"
+	EurekaStarting     EurekaStatus = "STARTING"
+	EurekaOutOfService EurekaStatus = "OUT_OF_SERVICE"
+	EurekaUnknown      EurekaStatus = "UNKNOWN"
+)
+
+// Valid checks if the status is a Eureka instance status.
+func (s EurekaStatus) Valid() bool {
+	switch s {
+	case EurekaUp, EurekaDown, EurekaStarting, EurekaOutOfService, EurekaUnknown:
+		return true
+	default:
+		return false
+	}
+}
+
+// ServiceStatus maps the status to the status of a service, only UP is healthy.
+func (s EurekaStatus) ServiceStatus() dto.ServiceStatus {
+	if s == EurekaUp {
+		return dto.StatusHealty
+	}
+
+	return dto.StatusUnhealthy
+}
+
+// Eureka delta action types, telling clients how to apply a changed instance.
+const (
+	EurekaAdded    = "ADDED"
+	EurekaModified = "MODIFIED"
+	EurekaDeleted  = "DELETED"
+)
+
+// Eureka port names, registered as named ports of the service.
+const (
+	EurekaPortName       = "http"
+	EurekaSecurePortName = "https"
+)
+
+// Eureka lease defaults, reported to clients as the registry applies its own instance TTL.
+const (
+	EurekaRenewalIntervalSecs = 30
+	EurekaLeaseDurationSecs   = 90
+)
+
+const eurekaDataCenterClass = "com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo"
+
+// EurekaApplications every application in the shape of the Eureka apps API, or the
+// applications with recently changed instances in a delta.
+type EurekaApplications struct {
+	XMLName      xml.Name            `json:"-" xml:"applications"`
+	VersionDelta string              `json:"versions__delta" xml:"versions__delta"`
+	HashCode     string              `json:"apps__hashcode" xml:"apps__hashcode"`
+	Applications []EurekaApplication `json:"application" xml:"application"`
+}
+
+// EurekaApplication application and its instances in the shape of the Eureka apps API.
+type EurekaApplication struct {
+	XMLName   xml.Name         `json:"-" xml:"application"`
+	Name      string           `json:"name" xml:"name"`
+	Instances []EurekaInstance `json:"instance" xml:"instance"`
+}
+
+// EurekaInstance instance in the shape of the Eureka apps API, as registered by Eureka clients.
+type EurekaInstance struct {
+	XMLName                       xml.Name             `json:"-" xml:"instance"`
+	InstanceID                    string               `json:"instanceId,omitempty" xml:"instanceId,omitempty"`
+	HostName                      string               `json:"hostName" xml:"hostName"`
+	App                           string               `json:"app" xml:"app"`
+	IPAddr                        string               `json:"ipAddr" xml:"ipAddr"`
+	Status                        EurekaStatus         `json:"status" xml:"status"`
+	OverriddenStatus              EurekaStatus         `json:"overriddenStatus,omitempty" xml:"overriddenstatus,omitempty"`
+	Port                          EurekaPort           `json:"port" xml:"port"`
+	SecurePort                    EurekaPort           `json:"securePort" xml:"securePort"`
+	CountryID                     int                  `json:"countryId" xml:"countryId"`
+	DataCenterInfo                EurekaDataCenterInfo `json:"dataCenterInfo" xml:"dataCenterInfo"`
+	LeaseInfo                     *EurekaLeaseInfo     `json:"leaseInfo,omitempty" xml:"leaseInfo,omitempty"`
+	Metadata                      EurekaMetadata       `json:"metadata" xml:"metadata"`
+	HomePageURL                   string               `json:"homePageUrl,omitempty" xml:"homePageUrl,omitempty"`
+	VIPAddress                    string               `json:"vipAddress,omitempty" xml:"vipAddress,omitempty"`
+	SecureVIPAddress              string               `json:"secureVipAddress,omitempty" xml:"secureVipAddress,omitempty"`
+	IsCoordinatingDiscoveryServer string               `json:"isCoordinatingDiscoveryServer,omitempty" xml:"isCoordinatingDiscoveryServer,omitempty"`
+	LastUpdatedTimestamp          int64                `json:"lastUpdatedTimestamp,string,omitempty" xml:"lastUpdatedTimestamp,omitempty"`
+	LastDirtyTimestamp            int64                `json:"lastDirtyTimestamp,string,omitempty" xml:"lastDirtyTimestamp,omitempty"`
+	ActionType                    string               `json:"actionType,omitempty" xml:"actionType,omitempty"`
+}
+
+// EurekaPort port of an instance, which Eureka clients enable or disable.
+type EurekaPort struct {
+	Port    int    `json:"$" xml:",chardata"`
+	Enabled string `json:"@enabled" xml:"enabled,attr"`
+}
+
+// On checks if the port is enabled.
+func (p EurekaPort) On() bool {
+	return p.Port > 0 && p.Enabled == "true"
+}
+
+// EurekaDataCenterInfo data center an instance runs in.
+type EurekaDataCenterInfo struct {
+	Class string `json:"@class" xml:"class,attr"`
+	Name  string `json:"name" xml:"name"`
+}
+
+// EurekaLeaseInfo lease of an instance, timestamps are in milliseconds since the epoch.
+type EurekaLeaseInfo struct {
+	RenewalIntervalInSecs int   `json:"renewalIntervalInSecs" xml:"renewalIntervalInSecs"`
+	DurationInSecs        int   `json:"durationInSecs" xml:"durationInSecs"`
+	RegistrationTimestamp int64 `json:"registrationTimestamp" xml:"registrationTimestamp"`
+	LastRenewalTimestamp  int64 `json:"lastRenewalTimestamp" xml:"lastRenewalTimestamp"`
+	EvictionTimestamp     int64 `json:"evictionTimestamp" xml:"evictionTimestamp"`
+	ServiceUpTimestamp    int64 `json:"serviceUpTimestamp" xml:"serviceUpTimestamp"`
+}
+
+// EurekaMetadata metadata of an instance, encoded in XML as one element per entry.
+type EurekaMetadata map[string]string
+
+// MarshalXML encodes the metadata as <metadata><name>value</name></metadata>, sorted by name.
+func (m EurekaMetadata) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	err := e.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = e.EncodeElement(m[name], xml.StartElement{Name: xml.Name{Local: name}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return e.EncodeToken(start.End())
+}
+
+// UnmarshalXML decodes metadata encoded as one element per entry.
+func (m *EurekaMetadata) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	metadata := EurekaMetadata{}
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			var value string
+			err = d.DecodeElement(&value, &t)
+			if err != nil {
+				return err
+			}
+			metadata[t.Name.Local] = value
+		case xml.EndElement:
+			*m = metadata
+			return nil
+		}
+	}
+}
+
+// EurekaAppName formats an application name the way Eureka clients expect, in upper case.
+func EurekaAppName(application string) string {
+	return strings.ToUpper(application)
+}
+
+// EurekaApplicationName maps the name of a Eureka app to the name of the application, in lower case.
+func EurekaApplicationName(app string) string {
+	return strings.ToLower(app)
+}
+
+// Service maps an instance registered by a Eureka client to a service of the application. The
+// instance id is used as the service id, the host name as its location, the metadata as its
+// labels and the enabled ports as the named ports http and https.
+func (i EurekaInstance) Service(application string) (Service, error) {
+	id := i.InstanceID
+	if id == "" {
+		id = i.HostName
+	}
+	location := i.HostName
+	if location == "" {
+		location = i.IPAddr
+	}
+
+	switch {
+	case id == "":
+		return Service{}, fmt.Errorf("instanceId or hostName is required")
+	case location == "":
+		return Service{}, fmt.Errorf("hostName or ipAddr is required")
+	case i.Status != "" && !i.Status.Valid():
+		return Service{}, fmt.Errorf("invalid status %s", i.Status)
+	case i.App != "" && EurekaApplicationName(i.App) != application:
+		return Service{}, fmt.Errorf("app %s does not match application %s", i.App, application)
+	case !i.Port.On() && !i.SecurePort.On():
+		return Service{}, fmt.Errorf("an enabled port or securePort is required")
+	}
+
+	ports := make([]ServicePort, 0, 2)
+	if i.Port.On() {
+		ports = append(ports, ServicePort{Name: EurekaPortName, Port: i.Port.Port, Protocol: ProtocolHTTP})
+	}
+	if i.SecurePort.On() {
+		ports = append(ports, ServicePort{Name: EurekaSecurePortName, Port: i.SecurePort.Port, Protocol: ProtocolHTTPS})
+	}
+
+	status := i.Status
+	if status == "" {
+		status = EurekaUp
+	}
+
+	labels := make(map[string]string, len(i.Metadata))
+	for name, value := range i.Metadata {
+		labels[name] = value
+	}
+
+	return Service{
+		Service: dto.Service{
+			ID:          id,
+			Application: application,
+			Location:    location,
+			Status:      status.ServiceStatus(),
+		},
+		Labels: labels,
+		Ports:  ports,
+	}, nil
+}
+
+// NewEurekaInstance maps a service to the shape of the Eureka apps API. The status is UP if the
+// service is healthy and not ejected as an outlier and DOWN otherwise, unless overridden.
+func NewEurekaInstance(svc Service, override EurekaStatus) EurekaInstance {
+	status := EurekaDown
+	if svc.Healthy() {
+		status = EurekaUp
+	}
+	if override != "" {
+		status = override
+	} else {
+		override = EurekaUnknown
+	}
+
+	port := EurekaPort{Port: svc.Port, Enabled: "true"}
+	securePort := EurekaPort{Port: 443, Enabled: "false"}
+	if p, ok := svc.FindPort("", ProtocolHTTP); ok {
+		port = EurekaPort{Port: p.Port, Enabled: "true"}
+	} else if len(svc.Ports) > 0 {
+		port.Enabled = "false"
+	}
+	if p, ok := svc.FindPort("", ProtocolHTTPS); ok {
+		securePort = EurekaPort{Port: p.Port, Enabled: "true"}
+	}
+
+	homePage := fmt.Sprintf("http://%s:%d/", svc.Location, port.Port)
+	if !port.On() {
+		homePage = fmt.Sprintf("https://%s:%d/", svc.Location, securePort.Port)
+	}
+
+	metadata := make(EurekaMetadata, len(svc.Labels))
+	for name, value := range svc.Labels {
+		metadata[name] = value
+	}
+
+	heartbeat := svc.HeartbeatAt.UnixNano() / 1e6
+	if svc.HeartbeatAt.IsZero() {
+		heartbeat = 0
+	}
+
+	return EurekaInstance{
+		InstanceID:       svc.ID,
+		HostName:         svc.Location,
+		App:              EurekaAppName(svc.Application),
+		IPAddr:           svc.Location,
+		Status:           status,
+		OverriddenStatus: override,
+		Port:             port,
+		SecurePort:       securePort,
+		CountryID:        1,
+		DataCenterInfo:   EurekaDataCenterInfo{Class: eurekaDataCenterClass, Name: "MyOwn"},
+		LeaseInfo: &EurekaLeaseInfo{
+			RenewalIntervalInSecs: EurekaRenewalIntervalSecs,
+			DurationInSecs:        EurekaLeaseDurationSecs,
+			LastRenewalTimestamp:  heartbeat,
+		},
+		Metadata:                      metadata,
+		HomePageURL:                   homePage,
+		VIPAddress:                    svc.Application,
+		SecureVIPAddress:              svc.Application,
+		IsCoordinatingDiscoveryServer: "false",
+		LastUpdatedTimestamp:          heartbeat,
+		LastDirtyTimestamp:            heartbeat,
+	}
+}
+
+// NewEurekaApplications groups instances by application, ordered by name. The hash code
+// counts the instances by status the way Eureka clients do to reconcile delta fetches.
+func NewEurekaApplications(instances []EurekaInstance, version uint64, hashCode string) EurekaApplications {
+	apps := make([]EurekaApplication, 0)
+	index := make(map[string]int)
+	for _, instance := range instances {
+		i, ok := index[instance.App]
+		if !ok {
+			i = len(apps)
+			index[instance.App] = i
+			apps = append(apps, EurekaApplication{Name: instance.App, Instances: make([]EurekaInstance, 0)})
+		}
+		apps[i].Instances = append(apps[i].Instances, instance)
+	}
+
+	sort.SliceStable(apps, func(i, j int) bool {
+		return apps[i].Name < apps[j].Name
+	})
+
+	return EurekaApplications{
+		VersionDelta: fmt.Sprintf("%d", version),
+		HashCode:     hashCode,
+		Applications: apps,
+	}
+}
+
+// EurekaHashCode computes the reconcile hash code of instances, e.g. DOWN_1_UP_2_.
+func EurekaHashCode(instances []EurekaInstance) string {
+	counts := make(map[EurekaStatus]int)
+	for _, instance := range instances {
+		counts[instance.Status]++
+	}
+
+	statuses := make([]string, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, string(status))
+	}
+	sort.Strings(statuses)
+
+	var hash strings.Builder
+	for _, status := range statuses {
+		fmt.Fprintf(&hash, "%s_%d_", status, counts[EurekaStatus(status)])
+	}
+
+	return hash.String()
+}
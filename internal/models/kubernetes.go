@@ -0,0 +1,169 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rtcheap/dto"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+// SourceLabel label naming the system an instance is mirrored from, set on instances the
+// registry keeps in sync with another system rather than registered by the instances themselves.
+const SourceLabel = "registry.source"
+
+// SourceKubernetes value of the source label of instances mirrored from Kubernetes.
+const SourceKubernetes = "kubernetes"
+
+// KubernetesApplicationAnnotation annotation of the Kubernetes services mirrored into the
+// registry, its value is the name of the application or empty to use the name of the service.
+const KubernetesApplicationAnnotation = "service-registry/application"
+
+// Labels of instances mirrored from Kubernetes.
+const (
+	KubernetesClusterLabel   = "kubernetes.cluster"
+	KubernetesNamespaceLabel = "kubernetes.namespace"
+	KubernetesServiceLabel   = "kubernetes.service"
+	KubernetesPodLabel       = "kubernetes.pod"
+	KubernetesNodeLabel      = "kubernetes.node"
+)
+
+// KubernetesApplication returns the application an annotated Kubernetes service is mirrored as.
+func KubernetesApplication(svc corev1.Service) (string, bool) {
+	application, ok := svc.Annotations[KubernetesApplicationAnnotation]
+	if !ok {
+		return "", false
+	}
+	if application == "" {
+		application = svc.Name
+	}
+
+	return application, true
+}
+
+// NewKubernetesServices maps the endpoints of a Kubernetes service to instances of the application,
+// one per address with the ports of every slice listing the address. An endpoint is healthy if it
+// is ready. Instance ids are derived from the cluster, namespace, service and address so that
+// they stay the same between syncs.
+func NewKubernetesServices(cluster, application string, svc corev1.Service, slices []discoveryv1.EndpointSlice) []Service {
+	services := make([]Service, 0)
+	index := make(map[string]int)
+	for _, slice := range slices {
+		ports := kubernetesPorts(slice.Ports)
+		if len(ports) == 0 {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			if len(endpoint.Addresses) == 0 {
+				continue
+			}
+
+			address := endpoint.Addresses[0]
+			id := kubernetesInstanceID(cluster, svc.Namespace, svc.Name, address)
+			if i, ok := index[id]; ok {
+				services[i].Ports = mergePorts(services[i].Ports, ports)
+				services[i].Port = services[i].Ports[0].Port
+				continue
+			}
+
+			status := dto.StatusHealty
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				status = dto.StatusUnhealthy
+			}
+
+			labels := map[string]string{
+				SourceLabel:              SourceKubernetes,
+				KubernetesClusterLabel:   cluster,
+				KubernetesNamespaceLabel: svc.Namespace,
+				KubernetesServiceLabel:   svc.Name,
+			}
+			if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" {
+				labels[KubernetesPodLabel] = endpoint.TargetRef.Name
+			}
+			if endpoint.NodeName != nil {
+				labels[KubernetesNodeLabel] = *endpoint.NodeName
+			}
+
+			zone := ""
+			if endpoint.Zone != nil {
+				zone = *endpoint.Zone
+			}
+
+			index[id] = len(services)
+			services = append(services, Service{
+				Service: dto.Service{
+					ID:          id,
+					Application: application,
+					Location:    address,
+					Port:        ports[0].Port,
+					Status:      status,
+				},
+				Zone:   zone,
+				Labels: labels,
+				Ports:  ports,
+			})
+		}
+	}
+
+	return services
+}
+
+// kubernetesPorts maps the ports of a slice, named after the port or its number if unnamed and
+// ordered like the ports of registered services. SCTP ports are left out.
+func kubernetesPorts(slicePorts []discoveryv1.EndpointPort) []ServicePort {
+	ports := make([]ServicePort, 0, len(slicePorts))
+	for _, p := range slicePorts {
+		if p.Port == nil || (p.Protocol != nil && *p.Protocol == corev1.ProtocolSCTP) {
+			continue
+		}
+
+		protocol := ProtocolTCP
+		if p.Protocol != nil && *p.Protocol == corev1.ProtocolUDP {
+			protocol = ProtocolUDP
+		}
+		if p.AppProtocol != nil && Protocol(strings.ToLower(*p.AppProtocol)).Valid() {
+			protocol = Protocol(strings.ToLower(*p.AppProtocol))
+		}
+
+		name := fmt.Sprintf("port-%d", *p.Port)
+		if p.Name != nil && *p.Name != "" {
+			name = *p.Name
+		}
+
+		ports = append(ports, ServicePort{Name: name, Port: int(*p.Port), Protocol: protocol})
+	}
+
+	sortPorts(ports)
+	return ports
+}
+
+func mergePorts(ports, other []ServicePort) []ServicePort {
+	merged := append([]ServicePort{}, ports...)
+	for _, port := range other {
+		if _, ok := (Service{Ports: merged}).FindPort(port.Name, ""); !ok {
+			merged = append(merged, port)
+		}
+	}
+
+	sortPorts(merged)
+	return merged
+}
+
+func sortPorts(ports []ServicePort) {
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Port != ports[j].Port {
+			return ports[i].Port < ports[j].Port
+		}
+		return ports[i].Name < ports[j].Name
+	})
+}
+
+func kubernetesInstanceID(cluster, namespace, name, address string) string {
+	sum := sha1.Sum([]byte(strings.Join([]string{cluster, namespace, name, address}, "/")))
+	return "k8s-" + hex.EncodeToString(sum[:12])
+}
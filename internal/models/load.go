@@ -0,0 +1,152 @@
+package models
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// DefaultLoadReportTTL how long load reports count as fresh unless configured otherwise.
+const DefaultLoadReportTTL = 30 * time.Second
+
+// Bounds of the weights computed from reported load.
+const (
+	MinWeight = 1
+	MaxWeight = 100
+)
+
+// LoadMetric reported value used to rank instances by load.
+type LoadMetric string
+
+// Load metrics.
+const (
+	LoadCPU         LoadMetric = "cpu"
+	LoadConnections LoadMetric = "connections"
+	LoadGauge       LoadMetric = "gauge"
+)
+
+// Valid checks if the metric is a known metric.
+func (m LoadMetric) Valid() bool {
+	return m == LoadCPU || m == LoadConnections || m == LoadGauge
+}
+
+// LoadReport lightweight load metrics pushed by an instance. CPU is the share of CPU
+// in use between 0 and 1, Gauge an application defined value where lower is less loaded.
+type LoadReport struct {
+	CPU               float64   `json:"cpu"`
+	ActiveConnections int       `json:"activeConnections"`
+	Gauge             float64   `json:"gauge"`
+	ReportedAt        time.Time `json:"reportedAt,omitempty"`
+}
+
+// Value returns the reported value of a metric.
+func (r LoadReport) Value(metric LoadMetric) float64 {
+	switch metric {
+	case LoadConnections:
+		return float64(r.ActiveConnections)
+	case LoadGauge:
+		return r.Gauge
+	default:
+		return r.CPU
+	}
+}
+
+// LoadOrder how services are ranked by their reported load.
+type LoadOrder struct {
+	Metric           LoadMetric
+	LeastLoadedFirst bool
+}
+
+// Apply sets the weight of each service from its reported load, between MinWeight for the
+// most and MaxWeight for the least loaded. CPU is used as is while connections and gauges are
+// relative to the most loaded service. Services without a load report get the mean weight of
+// those with reports, so that they neither attract nor starve traffic.
+// If LeastLoadedFirst is set services are sorted by load, services without reports last.
+func (o LoadOrder) Apply(services []Service) {
+	metric := o.Metric
+	if metric == "" {
+		metric = LoadCPU
+	}
+
+	highest := 0.0
+	for _, svc := range services {
+		if svc.Load != nil {
+			highest = math.Max(highest, svc.Load.Value(metric))
+		}
+	}
+
+	scores := make(map[string]float64, len(services))
+	total, reported := 0, 0
+	for i, svc := range services {
+		if svc.Load == nil {
+			continue
+		}
+
+		score := svc.Load.Value(metric)
+		if metric != LoadCPU {
+			score = 0
+			if highest > 0 {
+				score = svc.Load.Value(metric) / highest
+			}
+		}
+		score = math.Min(math.Max(score, 0), 1)
+		scores[svc.ID] = score
+
+		services[i].Weight = MinWeight + int(math.Round(float64(MaxWeight-MinWeight)*(1-score)))
+		total += services[i].Weight
+		reported++
+	}
+
+	fallback := MaxWeight
+	if reported > 0 {
+		fallback = int(math.Round(float64(total) / float64(reported)))
+	}
+	for i, svc := range services {
+		if svc.Load == nil {
+			services[i].Weight = fallback
+		}
+	}
+
+	if !o.LeastLoadedFirst {
+		return
+	}
+
+	sort.SliceStable(services, func(i, j int) bool {
+		a, aReported := scores[services[i].ID]
+		b, bReported := scores[services[j].ID]
+		if aReported != bReported {
+			return aReported
+		}
+
+		return a < b
+	})
+}
+
+// ShuffleByWeight orders services randomly, each position picked among the remaining services
+// with a chance proportional to their weight. Services without a weight count as MinWeight.
+func ShuffleByWeight(services []Service) {
+	for i := 0; i < len(services)-1; i++ {
+		total := 0
+		for _, svc := range services[i:] {
+			total += effectiveWeight(svc)
+		}
+
+		pick := rand.Intn(total)
+		for j := i; j < len(services); j++ {
+			pick -= effectiveWeight(services[j])
+			if pick < 0 {
+				services[i], services[j] = services[j], services[i]
+				break
+			}
+		}
+	}
+}
+
+func effectiveWeight(svc Service) int {
+	if svc.Weight < MinWeight {
+		return MinWeight
+	}
+
+	return svc.Weight
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"sort"
+
+	"github.com/rtcheap/dto"
+)
+
+// Locality tiers of an instance relative to a caller, lower is closer.
+const (
+	sameZone = iota
+	sameRegion
+	remote
+)
+
+// Locality zone and region of a caller, used to prefer the instances closest to it.
+// FailoverThreshold is the number of healthy instances in the local zone required to
+// only return local instances. With a zero threshold services are only ordered.
+type Locality struct {
+	Zone              string
+	Region            string
+	FailoverThreshold int
+}
+
+func (l Locality) empty() bool {
+	return l.Zone == "" && l.Region == ""
+}
+
+// tier ranks a service by how close it is to the caller. A caller that only knows
+// its region treats every instance in the region as local.
+func (l Locality) tier(svc Service) int {
+	if l.Region != "" && svc.Region != "" && l.Region != svc.Region {
+		return remote
+	}
+	if l.Zone == "" || l.Zone == svc.Zone {
+		return sameZone
+	}
+	if l.Region != "" && l.Region == svc.Region {
+		return sameRegion
+	}
+
+	return remote
+}
+
+// Select keeps only local services if at least FailoverThreshold of them are healthy,
+// otherwise all services are kept so that callers fail over to other zones.
+func (l Locality) Select(services []Service) []Service {
+	if l.empty() || l.FailoverThreshold <= 0 {
+		return services
+	}
+
+	local := make([]Service, 0, len(services))
+	healthy := 0
+	for _, svc := range services {
+		if l.tier(svc) != sameZone {
+			continue
+		}
+
+		local = append(local, svc)
+		if svc.Status == dto.StatusHealty {
+			healthy++
+		}
+	}
+
+	if healthy < l.FailoverThreshold {
+		return services
+	}
+	return local
+}
+
+// Sort orders services same zone first, then same region and then other regions,
+// keeping the existing order within each tier.
+func (l Locality) Sort(services []Service) {
+	if l.empty() {
+		return
+	}
+
+	sort.SliceStable(services, func(i, j int) bool {
+		return l.tier(services[i]) < l.tier(services[j])
+	})
+}
@@ -0,0 +1,94 @@
+package models
+
+import "time"
+
+// OutlierPolicy settings for ejecting instances that callers report as failing.
+// Instances are ejected when more than ErrorThreshold of at least MinRequests calls
+// reported within Window failed. Ejections last BaseEjectionTime, doubling for each
+// consecutive ejection up to MaxEjectionTime. At most MaxEjectionPercent of the
+// instances of an application are ejected at the same time.
+type OutlierPolicy struct {
+	Window             time.Duration
+	ErrorThreshold     float64
+	MinRequests        int
+	BaseEjectionTime   time.Duration
+	MaxEjectionTime    time.Duration
+	MaxEjectionPercent int
+}
+
+// DefaultOutlierPolicy returns the outlier policy used unless configured otherwise.
+func DefaultOutlierPolicy() OutlierPolicy {
+	return OutlierPolicy{
+		Window:             time.Minute,
+		ErrorThreshold:     0.5,
+		MinRequests:        10,
+		BaseEjectionTime:   30 * time.Second,
+		MaxEjectionTime:    5 * time.Minute,
+		MaxEjectionPercent: 50,
+	}
+}
+
+// Enabled checks if instances may be ejected under the policy.
+func (p OutlierPolicy) Enabled() bool {
+	return p.Window > 0 && p.ErrorThreshold > 0 && p.MaxEjectionPercent > 0
+}
+
+// EjectionTime returns how long the n:th consecutive ejection of an instance lasts.
+func (p OutlierPolicy) EjectionTime(n int) time.Duration {
+	ejection := p.BaseEjectionTime
+	for i := 1; i < n && ejection < p.MaxEjectionTime; i++ {
+		ejection *= 2
+	}
+	if ejection > p.MaxEjectionTime {
+		return p.MaxEjectionTime
+	}
+
+	return ejection
+}
+
+// MaxEjected returns how many of the given number of instances may be ejected at once. Applications
+// with more than one instance may always eject one, even if their share of the instances is above
+// MaxEjectionPercent, while the only instance of an application is never ejected.
+func (p OutlierPolicy) MaxEjected(instances int) int {
+	max := instances * p.MaxEjectionPercent / 100
+	if max == 0 && p.MaxEjectionPercent > 0 && instances > 1 {
+		return 1
+	}
+
+	return max
+}
+
+// CallReport outcome of calls made by a consumer to an instance.
+type CallReport struct {
+	ServiceID string `json:"serviceId,omitempty"`
+	Successes int    `json:"successes"`
+	Failures  int    `json:"failures"`
+}
+
+// Total returns the number of reported calls.
+func (r CallReport) Total() int {
+	return r.Successes + r.Failures
+}
+
+// ErrorRatio returns the share of failed calls, 0 if no calls were reported.
+func (r CallReport) ErrorRatio() float64 {
+	if r.Total() == 0 {
+		return 0
+	}
+
+	return float64(r.Failures) / float64(r.Total())
+}
+
+// OutlierStatus calls reported against an instance within the window and its ejection state.
+type OutlierStatus struct {
+	ServiceID    string     `json:"serviceId"`
+	Calls        CallReport `json:"calls"`
+	ErrorRatio   float64    `json:"errorRatio"`
+	Ejections    int        `json:"ejections"`
+	EjectedUntil *time.Time `json:"ejectedUntil,omitempty"`
+}
+
+// Ejected checks if the instance is ejected at the given time.
+func (s OutlierStatus) Ejected(now time.Time) bool {
+	return s.EjectedUntil != nil && now.Before(*s.EjectedUntil)
+}
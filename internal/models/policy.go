@@ -0,0 +1,77 @@
+package models
+
+import (
+	"time"
+
+	"github.com/rtcheap/dto"
+)
+
+// ConflictPolicy decides what happens when a registration collides with another
+// service registered on the same location and port.
+type ConflictPolicy string
+
+// Conflict policies.
+const (
+	ConflictReject            ConflictPolicy = "reject"
+	ConflictTakeover          ConflictPolicy = "takeover"
+	ConflictTakeoverUnhealthy ConflictPolicy = "takeover-if-unhealthy"
+)
+
+// Valid checks if the policy is a known policy.
+func (p ConflictPolicy) Valid() bool {
+	return p == ConflictReject || p == ConflictTakeover || p == ConflictTakeoverUnhealthy
+}
+
+// RegistrationPolicy rules applied when registering services.
+type RegistrationPolicy struct {
+	ConflictPolicy      ConflictPolicy
+	ApplicationPolicies map[string]ConflictPolicy
+	InstanceTTL         time.Duration
+	// LoadReportTTL how long load reports are used, DefaultLoadReportTTL if not set.
+	LoadReportTTL time.Duration
+	// RequireDeclaredApplications refuses registrations of applications missing from the catalog.
+	RequireDeclaredApplications bool
+}
+
+// WithApplication applies the defaults declared for an application in the catalog. Conflict
+// policies configured for the application in ApplicationPolicies still take precedence.
+func (p RegistrationPolicy) WithApplication(app Application) RegistrationPolicy {
+	if app.ConflictPolicy != "" {
+		p.ConflictPolicy = app.ConflictPolicy
+	}
+	if app.InstanceTTLSeconds > 0 {
+		p.InstanceTTL = time.Duration(app.InstanceTTLSeconds) * time.Second
+	}
+
+	return p
+}
+
+// ConflictPolicyFor returns the conflict policy of an application, falling back to the default policy.
+func (p RegistrationPolicy) ConflictPolicyFor(application string) ConflictPolicy {
+	policy, ok := p.ApplicationPolicies[application]
+	if ok {
+		return policy
+	}
+
+	return p.ConflictPolicy
+}
+
+// Expired checks if a service has not sent a heartbeat within the instance TTL.
+func (p RegistrationPolicy) Expired(svc Service, now time.Time) bool {
+	return p.InstanceTTL > 0 && now.Sub(svc.HeartbeatAt) > p.InstanceTTL
+}
+
+// LoadFresh checks if a load report is recent enough to be used.
+func (p RegistrationPolicy) LoadFresh(report LoadReport, now time.Time) bool {
+	ttl := p.LoadReportTTL
+	if ttl <= 0 {
+		ttl = DefaultLoadReportTTL
+	}
+
+	return now.Sub(report.ReportedAt) <= ttl
+}
+
+// Available checks if a service is healthy and has not expired.
+func (p RegistrationPolicy) Available(svc Service, now time.Time) bool {
+	return svc.Status == dto.StatusHealty && !p.Expired(svc, now)
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/rtcheap/dto"
+)
+
+// RenderData registry contents config templates are rendered from. Applications are ordered by
+// name and their instances by location and port, so unchanged membership renders the same output.
+type RenderData struct {
+	Applications []RenderApplication
+}
+
+// RenderApplication application along with its registered instances.
+type RenderApplication struct {
+	Name      string
+	Instances []Service
+}
+
+// Healthy lists the instances that are healthy and not ejected as outliers.
+func (a RenderApplication) Healthy() []Service {
+	healthy := make([]Service, 0, len(a.Instances))
+	for _, svc := range a.Instances {
+		if svc.Healthy() {
+			healthy = append(healthy, svc)
+		}
+	}
+
+	return healthy
+}
+
+// NewRenderData groups services ordered by application into the data templates are rendered from.
+func NewRenderData(services []Service) RenderData {
+	data := RenderData{
+		Applications: make([]RenderApplication, 0),
+	}
+	for _, svc := range services {
+		last := len(data.Applications) - 1
+		if last < 0 || data.Applications[last].Name != svc.Application {
+			data.Applications = append(data.Applications, RenderApplication{Name: svc.Application})
+			last++
+		}
+		data.Applications[last].Instances = append(data.Applications[last].Instances, svc)
+	}
+
+	return data
+}
+
+// Address formats the location and port of the service as host:port.
+func (s Service) Address() string {
+	return net.JoinHostPort(s.Location, strconv.Itoa(s.Port))
+}
+
+// Healthy checks if the service is healthy and not ejected as an outlier.
+func (s Service) Healthy() bool {
+	return s.Status == dto.StatusHealty && s.EjectedUntil == nil
+}
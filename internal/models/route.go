@@ -0,0 +1,139 @@
+package models
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// TotalRouteWeight sum of the weights of the subsets of routing rules, weights are percentages.
+const TotalRouteWeight = 100
+
+// RouteSubset instances selected by labels, receiving a share of the traffic given by Weight.
+// A subset without labels selects every instance.
+type RouteSubset struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Weight int               `json:"weight"`
+}
+
+// RouteMatch sends requests with a header, or the route key if Header is empty,
+// equal to Value to a subset regardless of the weights.
+type RouteMatch struct {
+	Header string `json:"header,omitempty"`
+	Value  string `json:"value"`
+	Subset string `json:"subset"`
+}
+
+// RoutingRules split the traffic of an application between subsets of its instances.
+type RoutingRules struct {
+	Application string        `json:"application"`
+	Subsets     []RouteSubset `json:"subsets"`
+	Matches     []RouteMatch  `json:"matches,omitempty"`
+	Revision    int64         `json:"revision"`
+	UpdatedAt   time.Time     `json:"updatedAt"`
+}
+
+// RouteRequest attributes of a request used to pick a subset. Requests with
+// the same key are routed to the same subset while the weights are unchanged.
+type RouteRequest struct {
+	Key     string
+	Headers http.Header
+}
+
+// Validate checks that subsets are named uniquely, that their weights add up to
+// TotalRouteWeight and that matches refer to defined subsets.
+func (r RoutingRules) Validate() error {
+	if len(r.Subsets) == 0 {
+		return fmt.Errorf("at least one subset is required")
+	}
+
+	total := 0
+	names := make(map[string]bool, len(r.Subsets))
+	for _, subset := range r.Subsets {
+		if subset.Name == "" {
+			return fmt.Errorf("subset name is required")
+		}
+		if names[subset.Name] {
+			return fmt.Errorf("duplicate subset %s", subset.Name)
+		}
+		if subset.Weight < 0 {
+			return fmt.Errorf("weight of subset %s must not be negative, got %d", subset.Name, subset.Weight)
+		}
+		names[subset.Name] = true
+		total += subset.Weight
+	}
+	if total != TotalRouteWeight {
+		return fmt.Errorf("subset weights must add up to %d, got %d", TotalRouteWeight, total)
+	}
+
+	for _, match := range r.Matches {
+		if !names[match.Subset] {
+			return fmt.Errorf("match on %q refers to unknown subset %s", match.Value, match.Subset)
+		}
+	}
+
+	return nil
+}
+
+// WithWeights returns the rules with the weights of the given subsets replaced.
+func (r RoutingRules) WithWeights(weights map[string]int) (RoutingRules, error) {
+	subsets := make([]RouteSubset, len(r.Subsets))
+	found := 0
+	for i, subset := range r.Subsets {
+		weight, ok := weights[subset.Name]
+		if ok {
+			subset.Weight = weight
+			found++
+		}
+		subsets[i] = subset
+	}
+	if found != len(weights) {
+		return RoutingRules{}, fmt.Errorf("weights refer to unknown subsets")
+	}
+
+	r.Subsets = subsets
+	return r, nil
+}
+
+// Pick selects the subset for a request. Matches are checked in order, otherwise the subset is
+// picked by weight using a hash of the route key, or at random if the request has no key.
+func (r RoutingRules) Pick(req RouteRequest) (RouteSubset, bool) {
+	for _, match := range r.Matches {
+		value := req.Key
+		if match.Header != "" {
+			value = req.Headers.Get(match.Header)
+		}
+		if value != "" && value == match.Value {
+			return r.subset(match.Subset)
+		}
+	}
+
+	bucket := rand.Intn(TotalRouteWeight)
+	if req.Key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(req.Key))
+		bucket = int(h.Sum32() % TotalRouteWeight)
+	}
+
+	for _, subset := range r.Subsets {
+		if bucket < subset.Weight {
+			return subset, true
+		}
+		bucket -= subset.Weight
+	}
+
+	return RouteSubset{}, false
+}
+
+func (r RoutingRules) subset(name string) (RouteSubset, bool) {
+	for _, subset := range r.Subsets {
+		if subset.Name == name {
+			return subset, true
+		}
+	}
+
+	return RouteSubset{}, false
+}
@@ -0,0 +1,132 @@
+package models
+
+import (
+	"time"
+
+	"github.com/rtcheap/dto"
+)
+
+// Protocol spoken on a service port.
+type Protocol string
+
+// Supported protocols.
+const (
+	ProtocolHTTP  Protocol = "http"
+	ProtocolHTTPS Protocol = "https"
+	ProtocolGRPC  Protocol = "grpc"
+	ProtocolUDP   Protocol = "udp"
+	ProtocolTCP   Protocol = "tcp"
+	ProtocolWS    Protocol = "ws"
+)
+
+// Valid checks if the protocol is a supported protocol.
+func (p Protocol) Valid() bool {
+	switch p {
+	case ProtocolHTTP, ProtocolHTTPS, ProtocolGRPC, ProtocolUDP, ProtocolTCP, ProtocolWS:
+		return true
+	default:
+		return false
+	}
+}
+
+// ServicePort named port exposed by a service. If EndPort is set the port
+// is a range from Port to EndPort inclusive, e.g. for RTP.
+type ServicePort struct {
+	Name     string   `json:"name"`
+	Port     int      `json:"port"`
+	EndPort  int      `json:"endPort,omitempty"`
+	Protocol Protocol `json:"protocol"`
+}
+
+// Service registered application instance along with the metadata managed by the registry.
+// Port is kept populated for clients unaware of named ports.
+type Service struct {
+	dto.Service
+	Version     int64             `json:"version,omitempty"`
+	Epoch       int64             `json:"epoch,omitempty"`
+	HeartbeatAt time.Time         `json:"heartbeatAt"`
+	Region      string            `json:"region,omitempty"`
+	Zone        string            `json:"zone,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Ports       []ServicePort     `json:"ports,omitempty"`
+	Capacity    *Capacity         `json:"capacity,omitempty"`
+	// Load and Weight are derived from the latest fresh load report, they are not persisted.
+	Load   *LoadReport `json:"load,omitempty"`
+	Weight int         `json:"weight,omitempty"`
+	// EjectedUntil is set while the instance is ejected as an outlier, it is not persisted.
+	EjectedUntil *time.Time `json:"ejectedUntil,omitempty"`
+}
+
+// FindPort looks up a named port matching the name and protocol, empty values match any port.
+func (s Service) FindPort(name string, protocol Protocol) (ServicePort, bool) {
+	for _, port := range s.Ports {
+		if (name == "" || port.Name == name) && (protocol == "" || port.Protocol == protocol) {
+			return port, true
+		}
+	}
+
+	return ServicePort{}, false
+}
+
+// ServiceQuery selects and orders the instances of an application.
+type ServiceQuery struct {
+	OnlyHealthy bool
+	Filter      ServiceFilter
+	Order       LoadOrder
+	Locality    Locality
+}
+
+// ServiceFilter selects services by location, labels and ports, empty fields match any service.
+type ServiceFilter struct {
+	Location string            `json:"location,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	PortName string            `json:"portName,omitempty"`
+	Protocol Protocol          `json:"protocol,omitempty"`
+}
+
+// Matches checks if a service is selected by the filter.
+func (f ServiceFilter) Matches(svc Service) bool {
+	if f.Location != "" && f.Location != svc.Location {
+		return false
+	}
+
+	for name, value := range f.Labels {
+		if svc.Labels[name] != value {
+			return false
+		}
+	}
+
+	if f.PortName != "" || f.Protocol != "" {
+		_, ok := svc.FindPort(f.PortName, f.Protocol)
+		return ok
+	}
+
+	return true
+}
+
+// WithLabels returns the filter additionally requiring the given labels.
+func (f ServiceFilter) WithLabels(labels map[string]string) ServiceFilter {
+	merged := make(map[string]string, len(f.Labels)+len(labels))
+	for name, value := range f.Labels {
+		merged[name] = value
+	}
+	for name, value := range labels {
+		merged[name] = value
+	}
+
+	f.Labels = merged
+	return f
+}
+
+// SelectPort points the port of the service at the named port selected by the filter, if any.
+func (f ServiceFilter) SelectPort(svc Service) Service {
+	if f.PortName == "" && f.Protocol == "" {
+		return svc
+	}
+
+	port, ok := svc.FindPort(f.PortName, f.Protocol)
+	if ok {
+		svc.Port = port.Port
+	}
+	return svc
+}
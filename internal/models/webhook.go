@@ -0,0 +1,162 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// EventType kind of change to a registered instance or an alert.
+type EventType string
+
+// Event types.
+const (
+	EventServiceRegistered    EventType = "service.registered"
+	EventServiceStatusChanged EventType = "service.status-changed"
+	EventServiceDeregistered  EventType = "service.deregistered"
+	EventAlertFiring          EventType = "alert.firing"
+	EventAlertResolved        EventType = "alert.resolved"
+)
+
+// Valid checks if the event type is a known event type.
+func (t EventType) Valid() bool {
+	return t == EventServiceRegistered || t == EventServiceStatusChanged || t == EventServiceDeregistered ||
+		t == EventAlertFiring || t == EventAlertResolved
+}
+
+// Event change to a registered instance or an alert of an application.
+// Either Service or Alert is set depending on the type.
+type Event struct {
+	ID          string    `json:"id"`
+	Type        EventType `json:"type"`
+	Application string    `json:"application"`
+	Service     *Service  `json:"service,omitempty"`
+	Alert       *Alert    `json:"alert,omitempty"`
+	OccurredAt  time.Time `json:"occurredAt"`
+}
+
+// Webhook subscription delivering events to a URL. Empty Applications or EventTypes match every
+// application or event type. Payloads are signed with the secret, which is only returned on creation.
+type Webhook struct {
+	ID           string      `json:"id"`
+	URL          string      `json:"url"`
+	Secret       string      `json:"secret,omitempty"`
+	Applications []string    `json:"applications,omitempty"`
+	EventTypes   []EventType `json:"eventTypes,omitempty"`
+	CreatedAt    time.Time   `json:"createdAt"`
+}
+
+// Matches checks if an event should be delivered to the webhook.
+func (w Webhook) Matches(event Event) bool {
+	return (len(w.Applications) == 0 || containsString(w.Applications, event.Application)) &&
+		(len(w.EventTypes) == 0 || containsEventType(w.EventTypes, event.Type))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsEventType(types []EventType, eventType EventType) bool {
+	for _, t := range types {
+		if t == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DeliveryStatus state of a webhook delivery.
+type DeliveryStatus string
+
+// Delivery statuses.
+const (
+	DeliveryPending   DeliveryStatus = "PENDING"
+	DeliveryDelivered DeliveryStatus = "DELIVERED"
+	DeliveryDead      DeliveryStatus = "DEAD"
+)
+
+// Valid checks if the status is a known delivery status.
+func (s DeliveryStatus) Valid() bool {
+	return s == DeliveryPending || s == DeliveryDelivered || s == DeliveryDead
+}
+
+// WebhookDelivery queued delivery of an event to a webhook. ResponseStatus and LastError
+// describe the outcome of the latest attempt.
+type WebhookDelivery struct {
+	ID             string         `json:"id"`
+	WebhookID      string         `json:"webhookId"`
+	EventID        string         `json:"eventId"`
+	EventType      EventType      `json:"eventType"`
+	Payload        string         `json:"payload"`
+	Status         DeliveryStatus `json:"status"`
+	Attempts       int            `json:"attempts"`
+	NextAttemptAt  time.Time      `json:"nextAttemptAt"`
+	ResponseStatus int            `json:"responseStatus,omitempty"`
+	LastError      string         `json:"lastError,omitempty"`
+	CreatedAt      time.Time      `json:"createdAt"`
+	UpdatedAt      time.Time      `json:"updatedAt"`
+}
+
+// DeliveryPolicy how webhook deliveries are attempted. Failed attempts are retried after
+// RetryBackoff, doubling for each attempt up to MaxRetryBackoff, until MaxAttempts attempts
+// have failed and the delivery is dead-lettered.
+type DeliveryPolicy struct {
+	MaxAttempts     int
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	Timeout         time.Duration
+	BatchSize       int
+}
+
+// DefaultDeliveryPolicy returns the delivery policy used unless configured otherwise.
+func DefaultDeliveryPolicy() DeliveryPolicy {
+	return DeliveryPolicy{
+		MaxAttempts:     8,
+		RetryBackoff:    time.Second,
+		MaxRetryBackoff: 5 * time.Minute,
+		Timeout:         5 * time.Second,
+		BatchSize:       100,
+	}
+}
+
+// Backoff returns how long to wait before retrying a delivery that has failed the given number of attempts.
+func (p DeliveryPolicy) Backoff(attempts int) time.Duration {
+	backoff := p.RetryBackoff
+	for i := 1; i < attempts && backoff < p.MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxRetryBackoff {
+		return p.MaxRetryBackoff
+	}
+
+	return backoff
+}
+
+// Lease returns how long a claimed delivery is reserved for the dispatcher that claimed it, long
+// enough to attempt it and record the outcome before other dispatchers may attempt it again.
+func (p DeliveryPolicy) Lease() time.Duration {
+	return 2 * p.Timeout
+}
+
+// Headers set on webhook deliveries.
+const (
+	WebhookEventHeader     = "X-Registry-Event"
+	WebhookDeliveryHeader  = "X-Registry-Delivery"
+	WebhookSignatureHeader = "X-Registry-Signature"
+)
+
+// SignWebhookPayload returns the signature of a payload sent in the WebhookSignatureHeader,
+// the hex encoded HMAC-SHA256 of the payload keyed with the webhook secret.
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
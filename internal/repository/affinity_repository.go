@@ -0,0 +1,229 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/CzarSimon/httputil/dbutil"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+// AffinityRepository storage interface for affinity bindings.
+type AffinityRepository interface {
+	// Find looks up the binding of a key, returns sql.ErrNoRows if the key is not bound.
+	Find(ctx context.Context, application, key string) (models.AffinityBinding, error)
+	FindByService(ctx context.Context, serviceID string) ([]models.AffinityBinding, error)
+	// Save binds a key, replacing any existing binding of the key.
+	Save(ctx context.Context, binding models.AffinityBinding) (models.AffinityBinding, error)
+	// Delete removes the binding of a key, returns sql.ErrNoRows if the key is not bound.
+	Delete(ctx context.Context, application, key string) error
+	// DeleteExpired removes bindings that expired before now.
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// NewAffinityRepository creates an affinity repository using the default implementation.
+func NewAffinityRepository(db *sql.DB) AffinityRepository {
+	return &affinityRepo{
+		db: db,
+	}
+}
+
+type affinityRepo struct {
+	db *sql.DB
+}
+
+const findAffinityBindingQuery = `
+	SELECT
+		application,
+		affinity_key,
+		service_id,
+		expires_at,
+		created_at,
+		updated_at
+	FROM affinity_binding
+	WHERE
+		application = ?
+		AND affinity_key = ?`
+
+func (r *affinityRepo) Find(ctx context.Context, application, key string) (models.AffinityBinding, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "affinityRepo.Find")
+	defer span.Finish()
+
+	binding, err := scanAffinityBinding(r.db.QueryRowContext(ctx, findAffinityBindingQuery, application, key))
+	if err != nil && err != sql.ErrNoRows {
+		err = fmt.Errorf("failed to query database. %w", err)
+		recordError(span, err)
+		return models.AffinityBinding{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return binding, err
+}
+
+const findAffinityBindingsByServiceQuery = `
+	SELECT
+		application,
+		affinity_key,
+		service_id,
+		expires_at,
+		created_at,
+		updated_at
+	FROM affinity_binding
+	WHERE
+		service_id = ?
+	ORDER BY affinity_key`
+
+func (r *affinityRepo) FindByService(ctx context.Context, serviceID string) ([]models.AffinityBinding, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "affinityRepo.FindByService")
+	defer span.Finish()
+
+	rows, err := r.db.QueryContext(ctx, findAffinityBindingsByServiceQuery, serviceID)
+	if err != nil {
+		err = fmt.Errorf("failed to query database. %w", err)
+		recordError(span, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	bindings := make([]models.AffinityBinding, 0)
+	for rows.Next() {
+		binding, err := scanAffinityBinding(rows)
+		if err != nil {
+			err = fmt.Errorf("failed to scan row. %w", err)
+			recordError(span, err)
+			return nil, err
+		}
+
+		bindings = append(bindings, binding)
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return bindings, nil
+}
+
+const insertAffinityBindingQuery = `
+	INSERT INTO affinity_binding(
+		application,
+		affinity_key,
+		service_id,
+		expires_at,
+		created_at,
+		updated_at
+	) VALUES (?, ?, ?, ?, ?, ?)`
+
+const updateAffinityBindingQuery = `
+	UPDATE affinity_binding SET
+		service_id = ?,
+		expires_at = ?,
+		updated_at = ?
+	WHERE
+		application = ?
+		AND affinity_key = ?`
+
+func (r *affinityRepo) Save(ctx context.Context, binding models.AffinityBinding) (models.AffinityBinding, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "affinityRepo.Save")
+	defer span.Finish()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.AffinityBinding{}, err
+	}
+
+	binding.ExpiresAt = binding.ExpiresAt.UTC()
+	binding.UpdatedAt = time.Now().UTC()
+	existing, err := scanAffinityBinding(tx.QueryRowContext(ctx, findAffinityBindingQuery, binding.Application, binding.Key))
+	if err == sql.ErrNoRows {
+		binding.CreatedAt = binding.UpdatedAt
+		_, err = tx.ExecContext(ctx, insertAffinityBindingQuery, binding.Application, binding.Key, binding.ServiceID, binding.ExpiresAt, binding.CreatedAt, binding.UpdatedAt)
+	} else if err == nil {
+		binding.CreatedAt = existing.CreatedAt
+		_, err = tx.ExecContext(ctx, updateAffinityBindingQuery, binding.ServiceID, binding.ExpiresAt, binding.UpdatedAt, binding.Application, binding.Key)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to save affinity binding(application=%s, key=%s). %w", binding.Application, binding.Key, err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.AffinityBinding{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return binding, tx.Commit()
+}
+
+const deleteAffinityBindingQuery = `
+	DELETE FROM affinity_binding
+	WHERE
+		application = ?
+		AND affinity_key = ?`
+
+func (r *affinityRepo) Delete(ctx context.Context, application, key string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "affinityRepo.Delete")
+	defer span.Finish()
+
+	res, err := r.db.ExecContext(ctx, deleteAffinityBindingQuery, application, key)
+	if err != nil {
+		err = fmt.Errorf("failed to delete affinity binding(application=%s, key=%s). %w", application, key, err)
+		recordError(span, err)
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("failed to check affected rows. %w", err)
+		recordError(span, err)
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return nil
+}
+
+const deleteExpiredAffinityBindingsQuery = `
+	DELETE FROM affinity_binding
+	WHERE
+		expires_at <= ?`
+
+func (r *affinityRepo) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "affinityRepo.DeleteExpired")
+	defer span.Finish()
+
+	res, err := r.db.ExecContext(ctx, deleteExpiredAffinityBindingsQuery, now.UTC())
+	if err != nil {
+		err = fmt.Errorf("failed to delete expired affinity bindings. %w", err)
+		recordError(span, err)
+		return 0, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("failed to check affected rows. %w", err)
+		recordError(span, err)
+		return 0, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return int(affected), nil
+}
+
+func scanAffinityBinding(row scanner) (models.AffinityBinding, error) {
+	binding := models.AffinityBinding{}
+	err := row.Scan(
+		&binding.Application,
+		&binding.Key,
+		&binding.ServiceID,
+		&binding.ExpiresAt,
+		&binding.CreatedAt,
+		&binding.UpdatedAt,
+	)
+	return binding, err
+}
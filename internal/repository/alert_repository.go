@@ -0,0 +1,355 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/CzarSimon/httputil/dbutil"
+	"github.com/CzarSimon/httputil/id"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+// AlertRepository storage interface for alert rules and the state of their alerts.
+type AlertRepository interface {
+	CreateRule(ctx context.Context, rule models.AlertRule) (models.AlertRule, error)
+	// FindRule looks up a rule, returns sql.ErrNoRows if it does not exist.
+	FindRule(ctx context.Context, id string) (models.AlertRule, error)
+	// DeleteRule removes a rule and the state of its alert, returns sql.ErrNoRows if it does not exist.
+	DeleteRule(ctx context.Context, id string) error
+	// FindAlerts lists the alert of every rule, rules never evaluated are inactive.
+	FindAlerts(ctx context.Context) ([]models.Alert, error)
+	// SaveAlert saves the alert if it is still in the previous state, returns false if
+	// another evaluator moved it first.
+	SaveAlert(ctx context.Context, alert models.Alert, previous models.AlertState) (bool, error)
+}
+
+// NewAlertRepository creates an alert repository using the default implementation.
+func NewAlertRepository(db *sql.DB) AlertRepository {
+	return &alertRepo{
+		db: db,
+	}
+}
+
+type alertRepo struct {
+	db *sql.DB
+}
+
+const insertAlertRuleQuery = `
+	INSERT INTO alert_rule(
+		id,
+		name,
+		application,
+		condition_type,
+		threshold,
+		for_seconds,
+		created_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+func (r *alertRepo) CreateRule(ctx context.Context, rule models.AlertRule) (models.AlertRule, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "alertRepo.CreateRule")
+	defer span.Finish()
+
+	rule.ID = id.New()
+	rule.CreatedAt = time.Now().UTC()
+	_, err := r.db.ExecContext(ctx, insertAlertRuleQuery, rule.ID, rule.Name, rule.Application, rule.Condition, rule.Threshold, rule.ForSeconds, rule.CreatedAt)
+	if err != nil {
+		err = fmt.Errorf("failed to insert alert rule(name=%s). %w", rule.Name, err)
+		recordError(span, err)
+		return models.AlertRule{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return rule, nil
+}
+
+const findAlertRuleQuery = `
+	SELECT
+		id,
+		name,
+		application,
+		condition_type,
+		threshold,
+		for_seconds,
+		created_at
+	FROM alert_rule
+	WHERE
+		id = ?`
+
+func (r *alertRepo) FindRule(ctx context.Context, id string) (models.AlertRule, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "alertRepo.FindRule")
+	defer span.Finish()
+
+	rule := models.AlertRule{}
+	err := r.db.QueryRowContext(ctx, findAlertRuleQuery, id).Scan(
+		&rule.ID,
+		&rule.Name,
+		&rule.Application,
+		&rule.Condition,
+		&rule.Threshold,
+		&rule.ForSeconds,
+		&rule.CreatedAt,
+	)
+	if err != nil && err != sql.ErrNoRows {
+		err = fmt.Errorf("failed to query database. %w", err)
+		recordError(span, err)
+		return models.AlertRule{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return rule, err
+}
+
+const deleteAlertRuleQuery = `DELETE FROM alert_rule WHERE id = ?`
+
+const deleteAlertStateQuery = `DELETE FROM alert_state WHERE rule_id = ?`
+
+func (r *alertRepo) DeleteRule(ctx context.Context, id string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "alertRepo.DeleteRule")
+	defer span.Finish()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, deleteAlertRuleQuery, id)
+	if err != nil {
+		err = fmt.Errorf("failed to delete alert rule(id=%s). %w", id, err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("failed to check affected rows. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return err
+	}
+	if affected == 0 {
+		dbutil.Rollback(tx)
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.ExecContext(ctx, deleteAlertStateQuery, id)
+	if err != nil {
+		err = fmt.Errorf("failed to delete state of alert rule(id=%s). %w", id, err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return tx.Commit()
+}
+
+const findAlertsQuery = `
+	SELECT
+		r.id,
+		r.name,
+		r.application,
+		r.condition_type,
+		r.threshold,
+		r.for_seconds,
+		r.created_at,
+		s.state,
+		s.value,
+		s.summary,
+		s.active_since,
+		s.fired_at,
+		s.resolved_at,
+		s.evaluated_at
+	FROM alert_rule r
+	LEFT JOIN alert_state s ON s.rule_id = r.id
+	ORDER BY r.application, r.name, r.id`
+
+func (r *alertRepo) FindAlerts(ctx context.Context) ([]models.Alert, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "alertRepo.FindAlerts")
+	defer span.Finish()
+
+	rows, err := r.db.QueryContext(ctx, findAlertsQuery)
+	if err != nil {
+		err = fmt.Errorf("failed to query database. %w", err)
+		recordError(span, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := make([]models.Alert, 0)
+	for rows.Next() {
+		alert, err := scanAlert(rows)
+		if err != nil {
+			err = fmt.Errorf("failed to scan row. %w", err)
+			recordError(span, err)
+			return nil, err
+		}
+
+		alerts = append(alerts, alert)
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return alerts, nil
+}
+
+const countAlertStateQuery = `SELECT COUNT(*) FROM alert_state WHERE rule_id = ?`
+
+const insertAlertStateQuery = `
+	INSERT INTO alert_state(
+		state,
+		value,
+		summary,
+		active_since,
+		fired_at,
+		resolved_at,
+		evaluated_at,
+		rule_id
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+const updateAlertStateQuery = `
+	UPDATE alert_state SET
+		state = ?,
+		value = ?,
+		summary = ?,
+		active_since = ?,
+		fired_at = ?,
+		resolved_at = ?,
+		evaluated_at = ?
+	WHERE
+		rule_id = ?
+		AND state = ?`
+
+func (r *alertRepo) SaveAlert(ctx context.Context, alert models.Alert, previous models.AlertState) (bool, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "alertRepo.SaveAlert")
+	defer span.Finish()
+
+	args := []interface{}{alert.State, nullFloat(alert.Value), alert.Summary, nullTime(alert.ActiveSince),
+		nullTime(alert.FiredAt), nullTime(alert.ResolvedAt), alert.EvaluatedAt.UTC(), alert.Rule.ID}
+	res, err := r.db.ExecContext(ctx, updateAlertStateQuery, append(args, previous)...)
+	if err != nil {
+		err = fmt.Errorf("failed to update alert of rule(id=%s). %w", alert.Rule.ID, err)
+		recordError(span, err)
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("failed to check affected rows. %w", err)
+		recordError(span, err)
+		return false, err
+	}
+	if affected == 1 {
+		span.LogFields(tracelog.Bool("success", true))
+		return true, nil
+	}
+
+	// The alert has either been moved by another evaluator or never been saved.
+	saved, err := r.alertSaved(ctx, alert.Rule.ID)
+	if err != nil {
+		recordError(span, err)
+		return false, err
+	}
+	if saved {
+		span.LogFields(tracelog.Bool("success", true))
+		return false, nil
+	}
+
+	_, err = r.db.ExecContext(ctx, insertAlertStateQuery, args...)
+	if err != nil {
+		// Another evaluator saving the alert first violates the primary key.
+		saved, checkErr := r.alertSaved(ctx, alert.Rule.ID)
+		if checkErr == nil && saved {
+			span.LogFields(tracelog.Bool("success", true))
+			return false, nil
+		}
+
+		err = fmt.Errorf("failed to insert alert of rule(id=%s). %w", alert.Rule.ID, err)
+		recordError(span, err)
+		return false, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return true, nil
+}
+
+// alertSaved checks if the alert of a rule has been saved.
+func (r *alertRepo) alertSaved(ctx context.Context, ruleID string) (bool, error) {
+	var count int
+	err := r.db.QueryRowContext(ctx, countAlertStateQuery, ruleID).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to query alert of rule(id=%s). %w", ruleID, err)
+	}
+
+	return count > 0, nil
+}
+
+func scanAlert(row scanner) (models.Alert, error) {
+	alert := models.Alert{}
+	var state, summary sql.NullString
+	var value sql.NullFloat64
+	var activeSince, firedAt, resolvedAt, evaluatedAt sql.NullTime
+	err := row.Scan(
+		&alert.Rule.ID,
+		&alert.Rule.Name,
+		&alert.Rule.Application,
+		&alert.Rule.Condition,
+		&alert.Rule.Threshold,
+		&alert.Rule.ForSeconds,
+		&alert.Rule.CreatedAt,
+		&state,
+		&value,
+		&summary,
+		&activeSince,
+		&firedAt,
+		&resolvedAt,
+		&evaluatedAt,
+	)
+	if err != nil {
+		return models.Alert{}, err
+	}
+
+	alert.State = models.AlertInactive
+	if state.Valid {
+		alert.State = models.AlertState(state.String)
+	}
+	if value.Valid {
+		alert.Value = &value.Float64
+	}
+	alert.Summary = summary.String
+	alert.ActiveSince = timePointer(activeSince)
+	alert.FiredAt = timePointer(firedAt)
+	alert.ResolvedAt = timePointer(resolvedAt)
+	alert.EvaluatedAt = evaluatedAt.Time
+	return alert, nil
+}
+
+func nullFloat(f *float64) sql.NullFloat64 {
+	if f == nil {
+		return sql.NullFloat64{}
+	}
+
+	return sql.NullFloat64{Float64: *f, Valid: true}
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+
+	return nullableTime(*t)
+}
+
+func timePointer(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+
+	return &t.Time
+}
@@ -0,0 +1,450 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/CzarSimon/httputil/dbutil"
+	"github.com/CzarSimon/httputil/id"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+// ErrNoCapacity returned when no eligible instance has remaining capacity.
+var ErrNoCapacity = errors.New("no instance with remaining capacity")
+
+// AllocationRepository storage interface for instance capacity and session reservations.
+type AllocationRepository interface {
+	// SetCapacity records the capacity reported by the instance holding the given epoch.
+	SetCapacity(ctx context.Context, id string, epoch int64, capacity models.Capacity) (models.Capacity, error)
+	// Allocate reserves a session slot on the least utilized eligible instance of an application
+	// with remaining capacity, returns ErrNoCapacity if there is none.
+	Allocate(ctx context.Context, application string, eligible func(models.Service) bool, expiresAt time.Time) (models.Allocation, error)
+	// Release frees a reserved slot, returns sql.ErrNoRows if the reservation does not exist.
+	Release(ctx context.Context, id string) (models.Reservation, error)
+	// ReclaimExpired frees the slots of reservations that expired before now.
+	ReclaimExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// NewAllocationRepository creates an allocation repository using the default implementation.
+func NewAllocationRepository(db *sql.DB) AllocationRepository {
+	return &allocationRepo{
+		db: db,
+	}
+}
+
+type allocationRepo struct {
+	db *sql.DB
+}
+
+const updateCapacityQuery = `
+	UPDATE service_capacity SET
+		max_sessions = ?,
+		active_sessions = ?,
+		updated_at = ?
+	WHERE
+		service_id = ?`
+
+const insertCapacityQuery = `
+	INSERT INTO service_capacity(
+		service_id,
+		max_sessions,
+		active_sessions,
+		reserved_sessions,
+		updated_at
+	) VALUES (?, ?, ?, 0, ?)`
+
+func (r *allocationRepo) SetCapacity(ctx context.Context, id string, epoch int64, capacity models.Capacity) (models.Capacity, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "allocationRepo.SetCapacity")
+	defer span.Finish()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Capacity{}, err
+	}
+
+	state, err := findServiceState(ctx, tx, id)
+	if err == sql.ErrNoRows {
+		dbutil.Rollback(tx)
+		return models.Capacity{}, err
+	} else if err != nil {
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Capacity{}, err
+	}
+	if epoch != state.epoch {
+		err = fmt.Errorf("service(id=%s) is at epoch %d, got %d. %w", id, state.epoch, epoch, ErrEpochMismatch)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Capacity{}, err
+	}
+
+	existing, err := findCapacity(ctx, tx, id)
+	if err != nil {
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Capacity{}, err
+	}
+
+	capacity.UpdatedAt = time.Now().UTC()
+	if existing == nil {
+		capacity.ReservedSessions = 0
+		_, err = tx.ExecContext(ctx, insertCapacityQuery, id, capacity.MaxSessions, capacity.ActiveSessions, capacity.UpdatedAt)
+	} else {
+		capacity.ReservedSessions = existing.ReservedSessions
+		_, err = tx.ExecContext(ctx, updateCapacityQuery, capacity.MaxSessions, capacity.ActiveSessions, capacity.UpdatedAt, id)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to store capacity of service(id=%s). %w", id, err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Capacity{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return capacity, tx.Commit()
+}
+
+const reserveSlotQuery = `
+	UPDATE service_capacity SET
+		reserved_sessions = reserved_sessions + 1
+	WHERE
+		service_id = ?
+		AND active_sessions + reserved_sessions < max_sessions`
+
+const insertReservationQuery = `
+	INSERT INTO reservation(
+		id,
+		application,
+		service_id,
+		expires_at,
+		created_at
+	) VALUES (?, ?, ?, ?, ?)`
+
+const findExpiredApplicationReservationsQuery = `
+	SELECT
+		id,
+		service_id
+	FROM reservation
+	WHERE
+		application = ?
+		AND expires_at <= ?`
+
+func (r *allocationRepo) Allocate(ctx context.Context, application string, eligible func(models.Service) bool, expiresAt time.Time) (models.Allocation, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "allocationRepo.Allocate")
+	defer span.Finish()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Allocation{}, err
+	}
+
+	now := time.Now().UTC()
+	_, err = reclaimReservations(ctx, tx, findExpiredApplicationReservationsQuery, application, now)
+	if err != nil {
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Allocation{}, err
+	}
+
+	services, err := findByApplication(ctx, tx, application)
+	if err != nil {
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Allocation{}, err
+	}
+
+	candidates := make([]models.Service, 0, len(services))
+	for _, svc := range services {
+		if svc.Capacity != nil && svc.Capacity.Available() && eligible(svc) {
+			candidates = append(candidates, svc)
+		}
+	}
+	sortByUtilization(candidates)
+
+	for _, svc := range candidates {
+		res, err := tx.ExecContext(ctx, reserveSlotQuery, svc.ID)
+		if err != nil {
+			err = fmt.Errorf("failed to reserve slot on service(id=%s). %w", svc.ID, err)
+			recordError(span, err)
+			dbutil.Rollback(tx)
+			return models.Allocation{}, err
+		}
+		if expectOneRow(res) != nil {
+			continue
+		}
+
+		reservation := models.Reservation{
+			ID:          id.New(),
+			Application: application,
+			ServiceID:   svc.ID,
+			ExpiresAt:   expiresAt.UTC(),
+			CreatedAt:   now,
+		}
+		_, err = tx.ExecContext(ctx, insertReservationQuery, reservation.ID, reservation.Application, reservation.ServiceID, reservation.ExpiresAt, reservation.CreatedAt)
+		if err != nil {
+			err = fmt.Errorf("failed to insert reservation. %w", err)
+			recordError(span, err)
+			dbutil.Rollback(tx)
+			return models.Allocation{}, err
+		}
+
+		svc.Capacity.ReservedSessions++
+		span.LogFields(tracelog.Bool("success", true))
+		return models.Allocation{Reservation: reservation, Service: svc}, tx.Commit()
+	}
+
+	dbutil.Rollback(tx)
+	span.LogFields(tracelog.Bool("success", true))
+	return models.Allocation{}, ErrNoCapacity
+}
+
+const findReservationQuery = `
+	SELECT
+		id,
+		application,
+		service_id,
+		expires_at,
+		created_at
+	FROM reservation
+	WHERE
+		id = ?`
+
+func (r *allocationRepo) Release(ctx context.Context, id string) (models.Reservation, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "allocationRepo.Release")
+	defer span.Finish()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Reservation{}, err
+	}
+
+	var reservation models.Reservation
+	err = tx.QueryRowContext(ctx, findReservationQuery, id).Scan(
+		&reservation.ID,
+		&reservation.Application,
+		&reservation.ServiceID,
+		&reservation.ExpiresAt,
+		&reservation.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		dbutil.Rollback(tx)
+		return models.Reservation{}, err
+	} else if err != nil {
+		err = fmt.Errorf("failed to query reservation(id=%s). %w", id, err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Reservation{}, err
+	}
+
+	err = freeSlot(ctx, tx, reservation.ID, reservation.ServiceID)
+	if err == sql.ErrNoRows {
+		dbutil.Rollback(tx)
+		return models.Reservation{}, err
+	} else if err != nil {
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Reservation{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return reservation, tx.Commit()
+}
+
+const findExpiredReservationsQuery = `
+	SELECT
+		id,
+		service_id
+	FROM reservation
+	WHERE
+		expires_at <= ?`
+
+func (r *allocationRepo) ReclaimExpired(ctx context.Context, now time.Time) (int, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "allocationRepo.ReclaimExpired")
+	defer span.Finish()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return 0, err
+	}
+
+	reclaimed, err := reclaimReservations(ctx, tx, findExpiredReservationsQuery, now.UTC())
+	if err != nil {
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return 0, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return reclaimed, tx.Commit()
+}
+
+// reclaimReservations frees the slots of the reservations selected by the query,
+// which must select the reservation id and service id.
+func reclaimReservations(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (int, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query expired reservations. %w", err)
+	}
+	defer rows.Close()
+
+	type expired struct {
+		id        string
+		serviceID string
+	}
+	reservations := make([]expired, 0)
+	for rows.Next() {
+		var e expired
+		err = rows.Scan(&e.id, &e.serviceID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to scan reservation row. %w", err)
+		}
+		reservations = append(reservations, e)
+	}
+	rows.Close()
+
+	reclaimed := 0
+	for _, e := range reservations {
+		err = freeSlot(ctx, tx, e.id, e.serviceID)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		reclaimed++
+	}
+
+	return reclaimed, nil
+}
+
+const deleteReservationQuery = `
+	DELETE FROM reservation
+	WHERE
+		id = ?`
+
+const freeSlotQuery = `
+	UPDATE service_capacity SET
+		reserved_sessions = reserved_sessions - 1
+	WHERE
+		service_id = ?
+		AND reserved_sessions > 0`
+
+// freeSlot deletes a reservation and frees its slot. The slot is only freed if the reservation
+// was still present so that concurrent reclaims do not free the same slot twice.
+func freeSlot(ctx context.Context, tx *sql.Tx, reservationID, serviceID string) error {
+	res, err := tx.ExecContext(ctx, deleteReservationQuery, reservationID)
+	if err != nil {
+		return fmt.Errorf("failed to delete reservation(id=%s). %w", reservationID, err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check affected rows. %w", err)
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.ExecContext(ctx, freeSlotQuery, serviceID)
+	if err != nil {
+		return fmt.Errorf("failed to free slot on service(id=%s). %w", serviceID, err)
+	}
+
+	return nil
+}
+
+const findCapacityQuery = `
+	SELECT
+		max_sessions,
+		active_sessions,
+		reserved_sessions,
+		updated_at
+	FROM service_capacity
+	WHERE
+		service_id = ?`
+
+// findCapacity finds the reported capacity of a service, returns nil if none has been reported.
+func findCapacity(ctx context.Context, q queryer, id string) (*models.Capacity, error) {
+	rows, err := q.QueryContext(ctx, findCapacityQuery, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query capacity of service(id=%s). %w", id, err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	var c models.Capacity
+	err = rows.Scan(&c.MaxSessions, &c.ActiveSessions, &c.ReservedSessions, &c.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan capacity row. %w", err)
+	}
+
+	return &c, nil
+}
+
+const findCapacitiesQuery = `
+	SELECT
+		service_id,
+		max_sessions,
+		active_sessions,
+		reserved_sessions,
+		updated_at
+	FROM service_capacity
+	WHERE
+		service_id IN (%s)`
+
+// findCapacities loads the reported capacity of the services with the given ids, leaving it nil if none has been reported.
+func findCapacities(ctx context.Context, q queryer, services map[string]*models.Service, ids []interface{}) error {
+	rows, err := q.QueryContext(ctx, inQuery(findCapacitiesQuery, len(ids)), ids...)
+	if err != nil {
+		return fmt.Errorf("failed to query capacity of services. %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var c models.Capacity
+		err = rows.Scan(&id, &c.MaxSessions, &c.ActiveSessions, &c.ReservedSessions, &c.UpdatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to scan capacity row. %w", err)
+		}
+
+		services[id].Capacity = &c
+	}
+
+	return rows.Err()
+}
+
+// sortByUtilization orders services by the share of their capacity in use, breaking ties
+// by the number of sessions and then id so that allocations are deterministic.
+func sortByUtilization(services []models.Service) {
+	sort.Slice(services, func(i, j int) bool {
+		a, b := services[i].Capacity, services[j].Capacity
+		if a.Utilization() != b.Utilization() {
+			return a.Utilization() < b.Utilization()
+		} else if a.Load() != b.Load() {
+			return a.Load() < b.Load()
+		}
+
+		return services[i].ID < services[j].ID
+	})
+}
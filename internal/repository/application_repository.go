@@ -0,0 +1,266 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/CzarSimon/httputil/dbutil"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+// ErrApplicationExists returned when creating an application that is already declared.
+var ErrApplicationExists = errors.New("application already exists")
+
+// ApplicationRepository storage interface for the application catalog.
+type ApplicationRepository interface {
+	// Create declares an application, returns ErrApplicationExists if it is already declared.
+	Create(ctx context.Context, app models.Application) (models.Application, error)
+	// Update replaces the declaration of an application, returns sql.ErrNoRows if it is not declared.
+	Update(ctx context.Context, app models.Application) (models.Application, error)
+	Find(ctx context.Context, name string) (models.Application, error)
+	FindAll(ctx context.Context) ([]models.Application, error)
+	// Delete removes the declaration of an application, returns sql.ErrNoRows if it is not declared.
+	Delete(ctx context.Context, name string) error
+}
+
+// NewApplicationRepository creates an application repository using the default implementation.
+func NewApplicationRepository(db *sql.DB) ApplicationRepository {
+	return &applicationRepo{
+		db: db,
+	}
+}
+
+type applicationRepo struct {
+	db *sql.DB
+}
+
+const insertApplicationQuery = `
+	INSERT INTO application(
+		name,
+		description,
+		team,
+		contact,
+		min_healthy_instances,
+		instance_ttl_seconds,
+		conflict_policy,
+		proxy_enabled,
+		created_at,
+		updated_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+func (r *applicationRepo) Create(ctx context.Context, app models.Application) (models.Application, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "applicationRepo.Create")
+	defer span.Finish()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Application{}, err
+	}
+
+	_, err = scanApplication(tx.QueryRowContext(ctx, findApplicationQuery, app.Name))
+	if err == nil {
+		err = fmt.Errorf("application(name=%s) is already declared. %w", app.Name, ErrApplicationExists)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Application{}, err
+	} else if err != sql.ErrNoRows {
+		err = fmt.Errorf("failed to query for application(name=%s). %w", app.Name, err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Application{}, err
+	}
+
+	app.CreatedAt = time.Now().UTC()
+	app.UpdatedAt = app.CreatedAt
+	_, err = tx.ExecContext(ctx, insertApplicationQuery, app.Name, nullableString(app.Description), app.Team, app.Contact, app.MinHealthyInstances, app.InstanceTTLSeconds, app.ConflictPolicy, app.ProxyEnabled, app.CreatedAt, app.UpdatedAt)
+	if err != nil {
+		err = fmt.Errorf("failed to insert application(name=%s). %w", app.Name, err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Application{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return app, tx.Commit()
+}
+
+const updateApplicationQuery = `
+	UPDATE application SET
+		description = ?,
+		team = ?,
+		contact = ?,
+		min_healthy_instances = ?,
+		instance_ttl_seconds = ?,
+		conflict_policy = ?,
+		proxy_enabled = ?,
+		updated_at = ?
+	WHERE
+		name = ?`
+
+func (r *applicationRepo) Update(ctx context.Context, app models.Application) (models.Application, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "applicationRepo.Update")
+	defer span.Finish()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Application{}, err
+	}
+
+	existing, err := scanApplication(tx.QueryRowContext(ctx, findApplicationQuery, app.Name))
+	if err == sql.ErrNoRows {
+		dbutil.Rollback(tx)
+		return models.Application{}, err
+	} else if err != nil {
+		err = fmt.Errorf("failed to query for application(name=%s). %w", app.Name, err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Application{}, err
+	}
+
+	app.CreatedAt = existing.CreatedAt
+	app.UpdatedAt = time.Now().UTC()
+	_, err = tx.ExecContext(ctx, updateApplicationQuery, nullableString(app.Description), app.Team, app.Contact, app.MinHealthyInstances, app.InstanceTTLSeconds, app.ConflictPolicy, app.ProxyEnabled, app.UpdatedAt, app.Name)
+	if err != nil {
+		err = fmt.Errorf("failed to update application(name=%s). %w", app.Name, err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Application{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return app, tx.Commit()
+}
+
+const findApplicationQuery = `
+	SELECT
+		name,
+		description,
+		team,
+		contact,
+		min_healthy_instances,
+		instance_ttl_seconds,
+		conflict_policy,
+		proxy_enabled,
+		created_at,
+		updated_at
+	FROM application
+	WHERE
+		name = ?`
+
+func (r *applicationRepo) Find(ctx context.Context, name string) (models.Application, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "applicationRepo.Find")
+	defer span.Finish()
+
+	app, err := scanApplication(r.db.QueryRowContext(ctx, findApplicationQuery, name))
+	if err != nil && err != sql.ErrNoRows {
+		err = fmt.Errorf("failed to query database. %w", err)
+		recordError(span, err)
+		return models.Application{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return app, err
+}
+
+const findAllApplicationsQuery = `
+	SELECT
+		name,
+		description,
+		team,
+		contact,
+		min_healthy_instances,
+		instance_ttl_seconds,
+		conflict_policy,
+		proxy_enabled,
+		created_at,
+		updated_at
+	FROM application
+	ORDER BY name`
+
+func (r *applicationRepo) FindAll(ctx context.Context) ([]models.Application, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "applicationRepo.FindAll")
+	defer span.Finish()
+
+	rows, err := r.db.QueryContext(ctx, findAllApplicationsQuery)
+	if err != nil {
+		err = fmt.Errorf("failed to query database. %w", err)
+		recordError(span, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	apps := make([]models.Application, 0)
+	for rows.Next() {
+		app, err := scanApplication(rows)
+		if err != nil {
+			err = fmt.Errorf("failed to scan row. %w", err)
+			recordError(span, err)
+			return nil, err
+		}
+
+		apps = append(apps, app)
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return apps, nil
+}
+
+const deleteApplicationQuery = `
+	DELETE FROM application
+	WHERE
+		name = ?`
+
+func (r *applicationRepo) Delete(ctx context.Context, name string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "applicationRepo.Delete")
+	defer span.Finish()
+
+	res, err := r.db.ExecContext(ctx, deleteApplicationQuery, name)
+	if err != nil {
+		err = fmt.Errorf("failed to delete application(name=%s). %w", name, err)
+		recordError(span, err)
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("failed to check affected rows. %w", err)
+		recordError(span, err)
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return nil
+}
+
+func scanApplication(row scanner) (models.Application, error) {
+	app := models.Application{}
+	var description sql.NullString
+	err := row.Scan(
+		&app.Name,
+		&description,
+		&app.Team,
+		&app.Contact,
+		&app.MinHealthyInstances,
+		&app.InstanceTTLSeconds,
+		&app.ConflictPolicy,
+		&app.ProxyEnabled,
+		&app.CreatedAt,
+		&app.UpdatedAt,
+	)
+	app.Description = description.String
+	return app, err
+}
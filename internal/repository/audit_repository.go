@@ -0,0 +1,174 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+const roleDelimiter = ";"
+
+// AuditRepository storage interface for the audit log.
+type AuditRepository interface {
+	Save(ctx context.Context, entry models.AuditEntry) error
+	Find(ctx context.Context, filter models.AuditFilter) ([]models.AuditEntry, error)
+}
+
+// NewAuditRepository creates an audit repository using the default implementation.
+func NewAuditRepository(db *sql.DB) AuditRepository {
+	return &auditRepo{
+		db: db,
+	}
+}
+
+type auditRepo struct {
+	db *sql.DB
+}
+
+const insertAuditEntryQuery = `
+	INSERT INTO audit_log(
+		id,
+		actor_id,
+		actor_roles,
+		source_ip,
+		trace_id,
+		action,
+		application,
+		service_id,
+		before_state,
+		after_state,
+		outcome,
+		error,
+		created_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+func (r *auditRepo) Save(ctx context.Context, e models.AuditEntry) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "auditRepo.Save")
+	defer span.Finish()
+
+	_, err := r.db.ExecContext(
+		ctx,
+		insertAuditEntryQuery,
+		e.ID,
+		e.ActorID,
+		strings.Join(e.ActorRoles, roleDelimiter),
+		e.SourceIP,
+		e.TraceID,
+		e.Action,
+		e.Application,
+		e.ServiceID,
+		nullableString(string(e.Before)),
+		nullableString(string(e.After)),
+		e.Outcome,
+		nullableString(e.Error),
+		e.CreatedAt.UTC(),
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to insert audit entry(action=%s). %w", e.Action, err)
+		recordError(span, err)
+		return err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return nil
+}
+
+const findAuditEntriesQuery = `
+	SELECT
+		id,
+		actor_id,
+		actor_roles,
+		source_ip,
+		trace_id,
+		action,
+		application,
+		service_id,
+		before_state,
+		after_state,
+		outcome,
+		error,
+		created_at
+	FROM audit_log`
+
+func (r *auditRepo) Find(ctx context.Context, filter models.AuditFilter) ([]models.AuditEntry, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "auditRepo.Find")
+	defer span.Finish()
+
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	addCondition := func(condition string, arg interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+
+	if filter.ActorID != "" {
+		addCondition("actor_id = ?", filter.ActorID)
+	}
+	if filter.Application != "" {
+		addCondition("application = ?", filter.Application)
+	}
+	if filter.ServiceID != "" {
+		addCondition("service_id = ?", filter.ServiceID)
+	}
+	if !filter.From.IsZero() {
+		addCondition("created_at >= ?", filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		addCondition("created_at < ?", filter.To.UTC())
+	}
+
+	query := findAuditEntriesQuery
+	if len(conditions) > 0 {
+		query += "\n\tWHERE " + strings.Join(conditions, " AND ")
+	}
+	query += "\n\tORDER BY created_at DESC LIMIT ?"
+	args = append(args, filter.Limit)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		err = fmt.Errorf("failed to query database. %w", err)
+		recordError(span, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]models.AuditEntry, 0)
+	for rows.Next() {
+		var e models.AuditEntry
+		var roles string
+		var before, after, errMsg sql.NullString
+		err = rows.Scan(&e.ID, &e.ActorID, &roles, &e.SourceIP, &e.TraceID, &e.Action, &e.Application, &e.ServiceID, &before, &after, &e.Outcome, &errMsg, &e.CreatedAt)
+		if err != nil {
+			err = fmt.Errorf("failed to scan row. %w", err)
+			recordError(span, err)
+			return nil, err
+		}
+
+		if roles != "" {
+			e.ActorRoles = strings.Split(roles, roleDelimiter)
+		}
+		if before.Valid {
+			e.Before = []byte(before.String)
+		}
+		if after.Valid {
+			e.After = []byte(after.String)
+		}
+		e.Error = errMsg.String
+		entries = append(entries, e)
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return entries, nil
+}
+
+func nullableString(s string) sql.NullString {
+	return sql.NullString{
+		String: s,
+		Valid:  s != "",
+	}
+}
@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+)
+
+// CatalogRepository storage interface for the index of changes to the catalog shared by every replica.
+type CatalogRepository interface {
+	FindIndex(ctx context.Context) (uint64, error)
+	AdvanceIndex(ctx context.Context) error
+}
+
+// NewCatalogRepository creates a catalog repository using the default implementation.
+func NewCatalogRepository(db *sql.DB) CatalogRepository {
+	return &catalogRepo{
+		db: db,
+	}
+}
+
+type catalogRepo struct {
+	db *sql.DB
+}
+
+const findCatalogIndexQuery = `SELECT value FROM catalog_index WHERE id = 1`
+
+func (r *catalogRepo) FindIndex(ctx context.Context) (uint64, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "catalogRepo.FindIndex")
+	defer span.Finish()
+
+	var index uint64
+	err := r.db.QueryRowContext(ctx, findCatalogIndexQuery).Scan(&index)
+	if err != nil {
+		err = fmt.Errorf("failed to query catalog index. %w", err)
+		recordError(span, err)
+		return 0, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return index, nil
+}
+
+const advanceCatalogIndexQuery = `UPDATE catalog_index SET value = value + 1 WHERE id = 1`
+
+func (r *catalogRepo) AdvanceIndex(ctx context.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "catalogRepo.AdvanceIndex")
+	defer span.Finish()
+
+	_, err := r.db.ExecContext(ctx, advanceCatalogIndexQuery)
+	if err != nil {
+		err = fmt.Errorf("failed to advance catalog index. %w", err)
+		recordError(span, err)
+		return err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return nil
+}
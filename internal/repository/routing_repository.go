@@ -0,0 +1,275 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/CzarSimon/httputil/dbutil"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+// ErrNoPreviousRoutes returned when rolling back routing rules that have not been replaced.
+var ErrNoPreviousRoutes = errors.New("no previous routing rules to roll back to")
+
+// RoutingRepository storage interface for routing rules.
+type RoutingRepository interface {
+	// Find looks up the routing rules of an application, returns sql.ErrNoRows if there are none.
+	Find(ctx context.Context, application string) (models.RoutingRules, error)
+	// Save replaces the routing rules of an application, keeping the replaced rules for Rollback.
+	Save(ctx context.Context, rules models.RoutingRules) (models.RoutingRules, error)
+	// Rollback restores the rules replaced by the last change, returns sql.ErrNoRows if the application
+	// has no routing rules and ErrNoPreviousRoutes if the rules have not been replaced.
+	Rollback(ctx context.Context, application string) (models.RoutingRules, error)
+	// Delete removes the routing rules of an application, returns sql.ErrNoRows if there are none.
+	Delete(ctx context.Context, application string) error
+}
+
+// NewRoutingRepository creates a routing repository using the default implementation.
+func NewRoutingRepository(db *sql.DB) RoutingRepository {
+	return &routingRepo{
+		db: db,
+	}
+}
+
+type routingRepo struct {
+	db *sql.DB
+}
+
+// routeSpec stored form of routing rules.
+type routeSpec struct {
+	Subsets []models.RouteSubset `json:"subsets"`
+	Matches []models.RouteMatch  `json:"matches,omitempty"`
+}
+
+// storedRoutes routing rules row.
+type storedRoutes struct {
+	application string
+	revision    int64
+	rules       string
+	previous    sql.NullString
+	updatedAt   time.Time
+}
+
+func (s storedRoutes) toRules() (models.RoutingRules, error) {
+	var spec routeSpec
+	err := json.Unmarshal([]byte(s.rules), &spec)
+	if err != nil {
+		return models.RoutingRules{}, fmt.Errorf("failed to parse routing rules of application(name=%s). %w", s.application, err)
+	}
+
+	return models.RoutingRules{
+		Application: s.application,
+		Subsets:     spec.Subsets,
+		Matches:     spec.Matches,
+		Revision:    s.revision,
+		UpdatedAt:   s.updatedAt,
+	}, nil
+}
+
+const findRoutingRulesQuery = `
+	SELECT
+		application,
+		revision,
+		rules,
+		previous_rules,
+		updated_at
+	FROM routing_rule
+	WHERE
+		application = ?`
+
+func (r *routingRepo) Find(ctx context.Context, application string) (models.RoutingRules, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "routingRepo.Find")
+	defer span.Finish()
+
+	stored, err := findRoutes(ctx, r.db, application)
+	if err == sql.ErrNoRows {
+		span.LogFields(tracelog.Bool("success", true))
+		return models.RoutingRules{}, err
+	} else if err != nil {
+		err = fmt.Errorf("failed to query database. %w", err)
+		recordError(span, err)
+		return models.RoutingRules{}, err
+	}
+
+	rules, err := stored.toRules()
+	if err != nil {
+		recordError(span, err)
+		return models.RoutingRules{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return rules, nil
+}
+
+const insertRoutingRulesQuery = `
+	INSERT INTO routing_rule(
+		application,
+		revision,
+		rules,
+		previous_rules,
+		updated_at
+	) VALUES (?, ?, ?, NULL, ?)`
+
+const updateRoutingRulesQuery = `
+	UPDATE routing_rule SET
+		revision = ?,
+		rules = ?,
+		previous_rules = ?,
+		updated_at = ?
+	WHERE
+		application = ?
+		AND revision = ?`
+
+func (r *routingRepo) Save(ctx context.Context, rules models.RoutingRules) (models.RoutingRules, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "routingRepo.Save")
+	defer span.Finish()
+
+	spec, err := json.Marshal(routeSpec{Subsets: rules.Subsets, Matches: rules.Matches})
+	if err != nil {
+		err = fmt.Errorf("failed to serialize routing rules. %w", err)
+		recordError(span, err)
+		return models.RoutingRules{}, err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.RoutingRules{}, err
+	}
+
+	rules.UpdatedAt = time.Now().UTC()
+	current, err := findRoutes(ctx, tx, rules.Application)
+	if err == sql.ErrNoRows {
+		rules.Revision = 1
+		_, err = tx.ExecContext(ctx, insertRoutingRulesQuery, rules.Application, rules.Revision, string(spec), rules.UpdatedAt)
+	} else if err == nil {
+		rules.Revision = current.revision + 1
+		err = updateRoutes(ctx, tx, rules, string(spec), current.rules, current.revision)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to save routing rules of application(name=%s). %w", rules.Application, err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.RoutingRules{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return rules, tx.Commit()
+}
+
+func (r *routingRepo) Rollback(ctx context.Context, application string) (models.RoutingRules, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "routingRepo.Rollback")
+	defer span.Finish()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.RoutingRules{}, err
+	}
+
+	current, err := findRoutes(ctx, tx, application)
+	if err == sql.ErrNoRows {
+		dbutil.Rollback(tx)
+		return models.RoutingRules{}, err
+	} else if err != nil {
+		err = fmt.Errorf("failed to query routing rules of application(name=%s). %w", application, err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.RoutingRules{}, err
+	}
+	if !current.previous.Valid {
+		dbutil.Rollback(tx)
+		return models.RoutingRules{}, ErrNoPreviousRoutes
+	}
+
+	restored := storedRoutes{
+		application: application,
+		revision:    current.revision + 1,
+		rules:       current.previous.String,
+		updatedAt:   time.Now().UTC(),
+	}
+	rules, err := restored.toRules()
+	if err != nil {
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.RoutingRules{}, err
+	}
+
+	err = updateRoutes(ctx, tx, rules, restored.rules, current.rules, current.revision)
+	if err != nil {
+		err = fmt.Errorf("failed to roll back routing rules of application(name=%s). %w", application, err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.RoutingRules{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return rules, tx.Commit()
+}
+
+const deleteRoutingRulesQuery = `
+	DELETE FROM routing_rule
+	WHERE
+		application = ?`
+
+func (r *routingRepo) Delete(ctx context.Context, application string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "routingRepo.Delete")
+	defer span.Finish()
+
+	res, err := r.db.ExecContext(ctx, deleteRoutingRulesQuery, application)
+	if err != nil {
+		err = fmt.Errorf("failed to delete routing rules of application(name=%s). %w", application, err)
+		recordError(span, err)
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("failed to check affected rows. %w", err)
+		recordError(span, err)
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return nil
+}
+
+// updateRoutes replaces the rules at the given revision, keeping the replaced rules as the previous rules.
+func updateRoutes(ctx context.Context, tx *sql.Tx, rules models.RoutingRules, spec, replaced string, revision int64) error {
+	res, err := tx.ExecContext(ctx, updateRoutingRulesQuery, rules.Revision, spec, replaced, rules.UpdatedAt, rules.Application, revision)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(res)
+}
+
+func findRoutes(ctx context.Context, q rowQueryer, application string) (storedRoutes, error) {
+	var s storedRoutes
+	err := q.QueryRowContext(ctx, findRoutingRulesQuery, application).Scan(
+		&s.application,
+		&s.revision,
+		&s.rules,
+		&s.previous,
+		&s.updatedAt,
+	)
+	return s, err
+}
+
+// rowQueryer runs single row queries against either the database or a transaction.
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
@@ -3,20 +3,68 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/CzarSimon/httputil/dbutil"
+	"github.com/CzarSimon/httputil/id"
 	"github.com/opentracing/opentracing-go"
 	tracelog "github.com/opentracing/opentracing-go/log"
 	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/models"
 )
 
+// Repository errors.
+var (
+	// ErrVersionConflict returned when a write expected a different version than the stored one.
+	ErrVersionConflict = errors.New("stored version does not match expected version")
+	// ErrEpochMismatch returned when a write carries another epoch than the current registration.
+	ErrEpochMismatch = errors.New("epoch does not match the current registration")
+	// ErrRegistrationConflict returned when a registration is not allowed to take over the location and port of another service.
+	ErrRegistrationConflict = errors.New("location and port is held by another service")
+)
+
+// ConflictResolver decides if a registration may take over the location and port held by an
+// existing service with another id. Returning an error rejects the registration.
+type ConflictResolver func(existing, incoming models.Service) error
+
+// TakeOver conflict resolver that always lets the incoming registration replace the existing service.
+func TakeOver(existing, incoming models.Service) error {
+	return nil
+}
+
 // ServiceRepository storage interface for service metadata.
 type ServiceRepository interface {
-	Save(ctx context.Context, svc dto.Service) (dto.Service, error)
-	Find(ctx context.Context, id string) (dto.Service, error)
-	FindByApplication(ctx context.Context, application string) ([]dto.Service, error)
+	// Save registers a service, inserting it or updating the existing registration
+	// and starting a new epoch. If svc.Version is set the update is only performed
+	// if it matches the stored version. A service with another id holding the same
+	// location and port is passed to resolve and removed if it allows the take over, the
+	// removed service is returned as replaced and has an empty id if nothing was taken over.
+	// Without an id the registration updates the service holding the location and port.
+	Save(ctx context.Context, svc models.Service, resolve ConflictResolver) (saved, replaced models.Service, err error)
+	// SaveAll registers services in a single transaction like Save, a failed registration
+	// is reported at its index in the returned errors without affecting the others.
+	SaveAll(ctx context.Context, services []models.Service, resolve ConflictResolver) (saved, replaced []models.Service, errs []error, err error)
+	// Update changes an existing registration without starting a new epoch, the write is
+	// rejected if svc.Epoch is not the current epoch or svc.Version is not the stored version.
+	Update(ctx context.Context, svc models.Service) (models.Service, error)
+	// UpdateStatuses sets the status of the services of an application matching the filter in a
+	// single transaction, without epoch fencing. Failures are reported at the index of the service.
+	UpdateStatuses(ctx context.Context, application string, filter models.ServiceFilter, status dto.ServiceStatus) ([]models.Service, []error, error)
+	// Heartbeat records that the instance holding the given epoch is alive.
+	Heartbeat(ctx context.Context, id string, epoch int64) error
+	Find(ctx context.Context, id string) (models.Service, error)
+	FindByApplication(ctx context.Context, application string) ([]models.Service, error)
+	// FindAll lists every registered service ordered by application.
+	FindAll(ctx context.Context) ([]models.Service, error)
+	FindByLocation(ctx context.Context, location string, port int) (models.Service, error)
+	// CountByApplication counts the registered services of each application by status.
+	CountByApplication(ctx context.Context) (map[string]map[dto.ServiceStatus]int, error)
+	// Delete removes a service, if version is non zero the service is
+	// only removed if it matches the stored version.
+	Delete(ctx context.Context, id string, version int64) error
 }
 
 // NewServiceRepository creates a service repository using the default implementation.
@@ -30,7 +78,7 @@ type serviceRepo struct {
 	db *sql.DB
 }
 
-func (r *serviceRepo) Save(ctx context.Context, svc dto.Service) (dto.Service, error) {
+func (r *serviceRepo) Save(ctx context.Context, svc models.Service, resolve ConflictResolver) (models.Service, models.Service, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "serviceRepo.Save")
 	defer span.Finish()
 
@@ -39,81 +87,409 @@ func (r *serviceRepo) Save(ctx context.Context, svc dto.Service) (dto.Service, e
 		err = fmt.Errorf("failed to create transaction. %w", err)
 		recordError(span, err)
 		dbutil.Rollback(tx)
-		return dto.Service{}, err
+		return models.Service{}, models.Service{}, err
 	}
 
-	existingID, err := findExistingServiceID(ctx, tx, svc)
+	svc, replaced, err := saveService(ctx, tx, svc, resolve)
+	if err != nil {
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Service{}, models.Service{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return svc, replaced, tx.Commit()
+}
+
+func (r *serviceRepo) SaveAll(ctx context.Context, services []models.Service, resolve ConflictResolver) ([]models.Service, []models.Service, []error, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "serviceRepo.SaveAll")
+	defer span.Finish()
+
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		err = fmt.Errorf("failed to query for existing service. %w", err)
+		err = fmt.Errorf("failed to create transaction. %w", err)
 		recordError(span, err)
 		dbutil.Rollback(tx)
-		return dto.Service{}, err
+		return nil, nil, nil, err
 	}
-	if existingID != "" {
-		svc.ID = existingID
-		err = updateService(ctx, tx, svc)
+
+	saved := make([]models.Service, len(services))
+	replaced := make([]models.Service, len(services))
+	errs := make([]error, len(services))
+	for i, svc := range services {
+		errs[i], err = withSavepoint(ctx, tx, func() (itemErr error) {
+			saved[i], replaced[i], itemErr = saveService(ctx, tx, svc, resolve)
+			return itemErr
+		})
 		if err != nil {
 			recordError(span, err)
 			dbutil.Rollback(tx)
-			return dto.Service{}, err
+			return nil, nil, nil, err
 		}
-		return svc, tx.Commit()
 	}
 
-	err = insertNewService(ctx, tx, svc)
+	span.LogFields(tracelog.Bool("success", true))
+	return saved, replaced, errs, tx.Commit()
+}
+
+// saveService registers a service within a transaction, see ServiceRepository.Save.
+func saveService(ctx context.Context, tx *sql.Tx, svc models.Service, resolve ConflictResolver) (models.Service, models.Service, error) {
+	holder, err := findLocationHolder(ctx, tx, svc.Location, svc.Port)
+	if err != nil {
+		return models.Service{}, models.Service{}, err
+	}
+
+	replaced := models.Service{}
+	if svc.ID == "" {
+		svc.ID = holder.ID
+	} else if holder.ID != "" && holder.ID != svc.ID {
+		replaced, err = takeOverLocation(ctx, tx, holder, svc, resolve)
+		if err != nil {
+			return models.Service{}, models.Service{}, err
+		}
+	}
+
+	state, err := findServiceState(ctx, tx, svc.ID)
+	if err == nil {
+		svc, err = reregisterService(ctx, tx, svc, state)
+	} else if err == sql.ErrNoRows && svc.Version != 0 {
+		err = ErrVersionConflict
+	} else if err == sql.ErrNoRows {
+		svc, err = insertNewService(ctx, tx, svc)
+	}
 	if err != nil {
+		return models.Service{}, models.Service{}, err
+	}
+
+	err = replaceLabels(ctx, tx, svc.ID, svc.Labels)
+	if err != nil {
+		return models.Service{}, models.Service{}, err
+	}
+
+	err = replacePorts(ctx, tx, svc.ID, svc.Ports)
+	if err != nil {
+		return models.Service{}, models.Service{}, err
+	}
+
+	err = replaceLocality(ctx, tx, svc)
+	if err != nil {
+		return models.Service{}, models.Service{}, err
+	}
+
+	return svc, replaced, nil
+}
+
+func (r *serviceRepo) Update(ctx context.Context, svc models.Service) (models.Service, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "serviceRepo.Update")
+	defer span.Finish()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Service{}, err
+	}
+
+	state, err := findServiceState(ctx, tx, svc.ID)
+	if err != nil {
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Service{}, err
+	}
+	if svc.Epoch != state.epoch {
+		err = fmt.Errorf("service(id=%s) is at epoch %d, got %d. %w", svc.ID, state.epoch, svc.Epoch, ErrEpochMismatch)
 		recordError(span, err)
 		dbutil.Rollback(tx)
-		return dto.Service{}, err
+		return models.Service{}, err
+	}
+
+	svc, err = updateService(ctx, tx, svc, state)
+	if err != nil {
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return models.Service{}, err
 	}
 
 	span.LogFields(tracelog.Bool("success", true))
 	return svc, tx.Commit()
 }
 
+func (r *serviceRepo) UpdateStatuses(ctx context.Context, application string, filter models.ServiceFilter, status dto.ServiceStatus) ([]models.Service, []error, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "serviceRepo.UpdateStatuses")
+	defer span.Finish()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return nil, nil, err
+	}
+
+	services, err := findByApplication(ctx, tx, application)
+	if err != nil {
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return nil, nil, err
+	}
+
+	updated := make([]models.Service, 0, len(services))
+	errs := make([]error, 0, len(services))
+	for _, svc := range services {
+		if !filter.Matches(svc) {
+			continue
+		}
+
+		state := serviceState{version: svc.Version, epoch: svc.Epoch}
+		change := svc
+		change.Status = status
+		itemErr, err := withSavepoint(ctx, tx, func() (itemErr error) {
+			change, itemErr = updateService(ctx, tx, change, state)
+			return itemErr
+		})
+		if err != nil {
+			recordError(span, err)
+			dbutil.Rollback(tx)
+			return nil, nil, err
+		}
+		if itemErr != nil {
+			change = svc
+		}
+
+		updated = append(updated, change)
+		errs = append(errs, itemErr)
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return updated, errs, tx.Commit()
+}
+
+const heartbeatQuery = `
+	UPDATE service SET
+		heartbeat_at = ?
+	WHERE
+		id = ?
+		AND epoch = ?`
+
+func (r *serviceRepo) Heartbeat(ctx context.Context, id string, epoch int64) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "serviceRepo.Heartbeat")
+	defer span.Finish()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return err
+	}
+
+	state, err := findServiceState(ctx, tx, id)
+	if err != nil {
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return err
+	}
+	if epoch != state.epoch {
+		err = fmt.Errorf("service(id=%s) is at epoch %d, got %d. %w", id, state.epoch, epoch, ErrEpochMismatch)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, heartbeatQuery, time.Now().UTC(), id, epoch)
+	if err != nil {
+		err = fmt.Errorf("failed to record heartbeat for service(id=%s). %w", id, err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return tx.Commit()
+}
+
 const findQuery = `
-	SELECT 
-		id, 
-		application, 
-		location, 
-		port, 
-		status 
+	SELECT
+		id,
+		application,
+		location,
+		port,
+		status,
+		version,
+		epoch,
+		heartbeat_at
 	FROM service
-	WHERE 
+	WHERE
 		id = ?`
 
-func (r *serviceRepo) Find(ctx context.Context, id string) (dto.Service, error) {
+func (r *serviceRepo) Find(ctx context.Context, id string) (models.Service, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "serviceRepo.Find")
 	defer span.Finish()
 
-	s := dto.Service{}
-	err := r.db.QueryRowContext(ctx, findQuery, id).Scan(&s.ID, &s.Application, &s.Location, &s.Port, &s.Status)
-	if err != nil && err != sql.ErrNoRows {
+	s, err := scanService(r.db.QueryRowContext(ctx, findQuery, id))
+	if err == sql.ErrNoRows {
+		span.LogFields(tracelog.Bool("success", true))
+		return models.Service{}, err
+	} else if err != nil {
 		err = fmt.Errorf("failed to query database. %w", err)
 		recordError(span, err)
-		return dto.Service{}, err
+		return models.Service{}, err
+	}
+
+	err = loadServiceDetails(ctx, r.db, &s)
+	if err != nil {
+		recordError(span, err)
+		return models.Service{}, err
 	}
 
 	span.LogFields(tracelog.Bool("success", true))
-	return s, err
+	return s, nil
 }
 
 const findByApplicationQuery = `
-	SELECT 
-		id, 
-		application, 
-		location, 
-		port, 
-		status 
+	SELECT
+		id,
+		application,
+		location,
+		port,
+		status,
+		version,
+		epoch,
+		heartbeat_at
 	FROM service
-	WHERE 
+	WHERE
 		application = ?`
 
-func (r *serviceRepo) FindByApplication(ctx context.Context, application string) ([]dto.Service, error) {
+func (r *serviceRepo) FindByApplication(ctx context.Context, application string) ([]models.Service, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "serviceRepo.FindByApplication")
 	defer span.Finish()
 
-	rows, err := r.db.QueryContext(ctx, findByApplicationQuery, application)
+	services, err := findByApplication(ctx, r.db, application)
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return services, nil
+}
+
+const findAllServicesQuery = `
+	SELECT
+		id,
+		application,
+		location,
+		port,
+		status,
+		version,
+		epoch,
+		heartbeat_at
+	FROM service
+	ORDER BY application, location, port`
+
+func (r *serviceRepo) FindAll(ctx context.Context) ([]models.Service, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "serviceRepo.FindAll")
+	defer span.Finish()
+
+	services, err := findServices(ctx, r.db, findAllServicesQuery)
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return services, nil
+}
+
+func findByApplication(ctx context.Context, q queryer, application string) ([]models.Service, error) {
+	return findServices(ctx, q, findByApplicationQuery, application)
+}
+
+func findServices(ctx context.Context, q queryer, query string, args ...interface{}) ([]models.Service, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database. %w", err)
+	}
+	defer rows.Close()
+
+	services := make([]models.Service, 0)
+	for rows.Next() {
+		s, err := scanService(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row. %w", err)
+		}
+
+		services = append(services, s)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate over rows. %w", err)
+	}
+	rows.Close()
+
+	err = loadDetails(ctx, q, services)
+	if err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+const findByLocationQuery = `
+	SELECT
+		id,
+		application,
+		location,
+		port,
+		status,
+		version,
+		epoch,
+		heartbeat_at
+	FROM service
+	WHERE
+		location = ?
+		AND port = ?`
+
+func (r *serviceRepo) FindByLocation(ctx context.Context, location string, port int) (models.Service, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "serviceRepo.FindByLocation")
+	defer span.Finish()
+
+	s, err := scanService(r.db.QueryRowContext(ctx, findByLocationQuery, location, port))
+	if err == sql.ErrNoRows {
+		span.LogFields(tracelog.Bool("success", true))
+		return models.Service{}, err
+	} else if err != nil {
+		err = fmt.Errorf("failed to query database. %w", err)
+		recordError(span, err)
+		return models.Service{}, err
+	}
+
+	err = loadServiceDetails(ctx, r.db, &s)
+	if err != nil {
+		recordError(span, err)
+		return models.Service{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return s, nil
+}
+
+const countByApplicationQuery = `
+	SELECT
+		application,
+		status,
+		COUNT(*)
+	FROM service
+	GROUP BY
+		application,
+		status`
+
+func (r *serviceRepo) CountByApplication(ctx context.Context) (map[string]map[dto.ServiceStatus]int, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "serviceRepo.CountByApplication")
+	defer span.Finish()
+
+	rows, err := r.db.QueryContext(ctx, countByApplicationQuery)
 	if err != nil {
 		err = fmt.Errorf("failed to query database. %w", err)
 		recordError(span, err)
@@ -121,59 +497,202 @@ func (r *serviceRepo) FindByApplication(ctx context.Context, application string)
 	}
 	defer rows.Close()
 
-	services := make([]dto.Service, 0)
+	counts := make(map[string]map[dto.ServiceStatus]int)
 	for rows.Next() {
-		s := dto.Service{}
-		err = rows.Scan(&s.ID, &s.Application, &s.Location, &s.Port, &s.Status)
+		var application string
+		var status dto.ServiceStatus
+		var count int
+		err = rows.Scan(&application, &status, &count)
 		if err != nil {
 			err = fmt.Errorf("failed to scan row. %w", err)
 			recordError(span, err)
 			return nil, err
 		}
 
-		services = append(services, s)
+		if counts[application] == nil {
+			counts[application] = make(map[dto.ServiceStatus]int)
+		}
+		counts[application][status] = count
 	}
 
 	span.LogFields(tracelog.Bool("success", true))
-	return services, nil
+	return counts, nil
 }
 
-const findExistingIDQuery = `
-	SELECT 
-		id 
-	FROM service 
-	WHERE 
-		id = ? 
-		OR (
-			location = ? 
-			AND port = ?
-		)`
+const findServiceStateQuery = `
+	SELECT
+		version,
+		epoch
+	FROM service
+	WHERE
+		id = ?`
+
+// serviceState the stored version and epoch of a service.
+type serviceState struct {
+	version int64
+	epoch   int64
+}
+
+func findServiceState(ctx context.Context, tx *sql.Tx, id string) (serviceState, error) {
+	var state serviceState
+	err := tx.QueryRowContext(ctx, findServiceStateQuery, id).Scan(&state.version, &state.epoch)
+	if err != nil && err != sql.ErrNoRows {
+		return serviceState{}, fmt.Errorf("failed to query state of service(id=%s). %w", id, err)
+	}
 
-func findExistingServiceID(ctx context.Context, tx *sql.Tx, svc dto.Service) (string, error) {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "repository.findExistingServiceID")
+	return state, err
+}
+
+const deleteServiceQuery = `
+	DELETE FROM service
+	WHERE
+		id = ?
+		AND version = ?`
+
+func (r *serviceRepo) Delete(ctx context.Context, id string, version int64) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "serviceRepo.Delete")
 	defer span.Finish()
 
-	var existingID string
-	err := tx.QueryRowContext(ctx, findExistingIDQuery, svc.ID, svc.Location, svc.Port).Scan(&existingID)
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return err
+	}
+
+	state, err := findServiceState(ctx, tx, id)
 	if err == sql.ErrNoRows {
-		return "", nil
+		dbutil.Rollback(tx)
+		return err
 	} else if err != nil {
-		err = fmt.Errorf("failed to query for existing service(id=%s). %w", svc.ID, err)
 		recordError(span, err)
-		return "", err
+		dbutil.Rollback(tx)
+		return err
+	}
+	if version == 0 {
+		version = state.version
+	}
+
+	err = deleteService(ctx, tx, id, version)
+	if err != nil {
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return tx.Commit()
+}
+
+// deleteService removes a service at the given version along with its labels, ports, locality, capacity and reservations.
+func deleteService(ctx context.Context, tx *sql.Tx, id string, version int64) error {
+	res, err := tx.ExecContext(ctx, deleteServiceQuery, id, version)
+	if err != nil {
+		return fmt.Errorf("failed to delete service(id=%s). %w", id, err)
+	}
+
+	err = expectOneRow(res)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, deleteLabelsQuery, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete labels of service(id=%s). %w", id, err)
+	}
+
+	_, err = tx.ExecContext(ctx, deletePortsQuery, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete ports of service(id=%s). %w", id, err)
+	}
+
+	_, err = tx.ExecContext(ctx, deleteLocalityQuery, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete locality of service(id=%s). %w", id, err)
+	}
+
+	_, err = tx.ExecContext(ctx, deleteCapacityQuery, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete capacity of service(id=%s). %w", id, err)
+	}
+
+	_, err = tx.ExecContext(ctx, deleteServiceReservationsQuery, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete reservations on service(id=%s). %w", id, err)
+	}
+
+	return nil
+}
+
+const deleteCapacityQuery = `
+	DELETE FROM service_capacity
+	WHERE
+		service_id = ?`
+
+const deleteServiceReservationsQuery = `
+	DELETE FROM reservation
+	WHERE
+		service_id = ?`
+
+// findLocationHolder finds the service registered on a location and port,
+// returns an empty service if the location and port is free.
+func findLocationHolder(ctx context.Context, tx *sql.Tx, location string, port int) (models.Service, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "repository.findLocationHolder")
+	defer span.Finish()
+
+	s, err := scanService(tx.QueryRowContext(ctx, findByLocationQuery, location, port))
+	if err == sql.ErrNoRows {
+		span.LogFields(tracelog.Bool("success", true))
+		return models.Service{}, nil
+	} else if err != nil {
+		err = fmt.Errorf("failed to query for service on %s:%d. %w", location, port, err)
+		recordError(span, err)
+		return models.Service{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return s, nil
+}
+
+// takeOverLocation removes the service holding the location and port of the incoming
+// registration if the conflict resolver allows it, returning the removed service.
+func takeOverLocation(ctx context.Context, tx *sql.Tx, holder, svc models.Service, resolve ConflictResolver) (models.Service, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "repository.takeOverLocation")
+	defer span.Finish()
+
+	err := resolve(holder, svc)
+	if err != nil {
+		recordError(span, err)
+		return models.Service{}, err
+	}
+
+	err = loadServiceDetails(ctx, tx, &holder)
+	if err != nil {
+		recordError(span, err)
+		return models.Service{}, err
+	}
+
+	err = deleteService(ctx, tx, holder.ID, holder.Version)
+	if err != nil {
+		recordError(span, err)
+		return models.Service{}, err
 	}
 
 	span.LogFields(tracelog.Bool("success", true))
-	return existingID, nil
+	return holder, nil
 }
 
 const insertServiceQuery = `
 	INSERT INTO service(
-		id, 
-		application, 
-		location, 
-		port, 
+		id,
+		application,
+		location,
+		port,
 		status,
+		version,
+		epoch,
+		heartbeat_at,
 		created_at,
 		updated_at
 	) VALUES (
@@ -183,23 +702,32 @@ const insertServiceQuery = `
 		?,
 		?,
 		?,
+		?,
+		?,
+		?,
 		?
 	)`
 
-func insertNewService(ctx context.Context, tx *sql.Tx, svc dto.Service) error {
+func insertNewService(ctx context.Context, tx *sql.Tx, svc models.Service) (models.Service, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "repository.insertNewService")
 	defer span.Finish()
 
 	now := time.Now().UTC()
-	_, err := tx.ExecContext(ctx, insertServiceQuery, svc.ID, svc.Application, svc.Location, svc.Port, svc.Status, now, now)
+	if svc.ID == "" {
+		svc.ID = id.New()
+	}
+	svc.Version = 1
+	svc.Epoch = 1
+	svc.HeartbeatAt = now
+	_, err := tx.ExecContext(ctx, insertServiceQuery, svc.ID, svc.Application, svc.Location, svc.Port, svc.Status, svc.Version, svc.Epoch, svc.HeartbeatAt, now, now)
 	if err != nil {
 		err = fmt.Errorf("failed to insert new service. %w", err)
 		recordError(span, err)
-		return err
+		return models.Service{}, err
 	}
 
 	span.LogFields(tracelog.Bool("success", true))
-	return nil
+	return svc, nil
 }
 
 const updateServiceQuery = `
@@ -208,26 +736,379 @@ const updateServiceQuery = `
 		location = ?,
 		port = ?,
 		status = ?,
+		version = ?,
+		epoch = ?,
+		heartbeat_at = ?,
 		updated_at = ?
 	WHERE
-		id = ?`
+		id = ?
+		AND version = ?`
 
-func updateService(ctx context.Context, tx *sql.Tx, svc dto.Service) error {
+// reregisterService updates an existing registration, starting a new epoch.
+func reregisterService(ctx context.Context, tx *sql.Tx, svc models.Service, state serviceState) (models.Service, error) {
+	svc.Epoch = state.epoch + 1
+	svc.HeartbeatAt = time.Now().UTC()
+	return updateService(ctx, tx, svc, state)
+}
+
+// updateService updates a service and increments its version. The update is performed
+// as a compare-and-set against svc.Version, or the currently stored version if not set.
+func updateService(ctx context.Context, tx *sql.Tx, svc models.Service, state serviceState) (models.Service, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "repository.updateService")
 	defer span.Finish()
 
+	expectedVersion := svc.Version
+	if expectedVersion == 0 {
+		expectedVersion = state.version
+	}
+
 	now := time.Now().UTC()
-	_, err := tx.ExecContext(ctx, updateServiceQuery, svc.Application, svc.Location, svc.Port, svc.Status, now, svc.ID)
+	svc.Version = expectedVersion + 1
+	res, err := tx.ExecContext(ctx, updateServiceQuery, svc.Application, svc.Location, svc.Port, svc.Status, svc.Version, svc.Epoch, nullableTime(svc.HeartbeatAt), now, svc.ID, expectedVersion)
 	if err != nil {
 		err = fmt.Errorf("failed to update service(id=%s). %w", svc.ID, err)
 		recordError(span, err)
-		return err
+		return models.Service{}, err
+	}
+
+	err = expectOneRow(res)
+	if err != nil {
+		recordError(span, err)
+		return models.Service{}, err
 	}
 
 	span.LogFields(tracelog.Bool("success", true))
+	return svc, nil
+}
+
+// loadServiceDetails loads the labels, named ports, locality and capacity of a service.
+func loadServiceDetails(ctx context.Context, q queryer, svc *models.Service) error {
+	services := []models.Service{*svc}
+	err := loadDetails(ctx, q, services)
+	*svc = services[0]
+	return err
+}
+
+// detailsBatchSize max number of services whose details are loaded by a single query per
+// table, keeping the number of placeholders below the limits of the database drivers.
+const detailsBatchSize = 500
+
+// loadDetails loads the labels, ports, locality and capacity of services, querying each
+// table once per batch of services instead of once per service.
+func loadDetails(ctx context.Context, q queryer, services []models.Service) error {
+	for start := 0; start < len(services); start += detailsBatchSize {
+		end := start + detailsBatchSize
+		if end > len(services) {
+			end = len(services)
+		}
+
+		err := loadDetailsBatch(ctx, q, services[start:end])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func loadDetailsBatch(ctx context.Context, q queryer, services []models.Service) error {
+	byID := make(map[string]*models.Service, len(services))
+	ids := make([]interface{}, len(services))
+	for i := range services {
+		byID[services[i].ID] = &services[i]
+		ids[i] = services[i].ID
+	}
+
+	err := findLabels(ctx, q, byID, ids)
+	if err != nil {
+		return err
+	}
+
+	err = findPorts(ctx, q, byID, ids)
+	if err != nil {
+		return err
+	}
+
+	err = findLocalities(ctx, q, byID, ids)
+	if err != nil {
+		return err
+	}
+
+	return findCapacities(ctx, q, byID, ids)
+}
+
+// inQuery expands the %s of a query to n placeholders of an IN clause.
+func inQuery(query string, n int) string {
+	return fmt.Sprintf(query, strings.TrimSuffix(strings.Repeat("?, ", n), ", "))
+}
+
+const findLabelsQuery = `
+	SELECT
+		service_id,
+		name,
+		value
+	FROM service_label
+	WHERE
+		service_id IN (%s)`
+
+// findLabels loads the labels of the services with the given ids.
+func findLabels(ctx context.Context, q queryer, services map[string]*models.Service, ids []interface{}) error {
+	rows, err := q.QueryContext(ctx, inQuery(findLabelsQuery, len(ids)), ids...)
+	if err != nil {
+		return fmt.Errorf("failed to query labels of services. %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, name, value string
+		err = rows.Scan(&id, &name, &value)
+		if err != nil {
+			return fmt.Errorf("failed to scan label row. %w", err)
+		}
+
+		svc := services[id]
+		if svc.Labels == nil {
+			svc.Labels = make(map[string]string)
+		}
+		svc.Labels[name] = value
+	}
+
+	return rows.Err()
+}
+
+const deleteLabelsQuery = `
+	DELETE FROM service_label
+	WHERE
+		service_id = ?`
+
+const insertLabelQuery = `
+	INSERT INTO service_label(
+		service_id,
+		name,
+		value
+	) VALUES (
+		?,
+		?,
+		?
+	)`
+
+// replaceLabels sets the labels of a service, removing any labels not present.
+func replaceLabels(ctx context.Context, tx *sql.Tx, id string, labels map[string]string) error {
+	_, err := tx.ExecContext(ctx, deleteLabelsQuery, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete labels of service(id=%s). %w", id, err)
+	}
+
+	for name, value := range labels {
+		_, err = tx.ExecContext(ctx, insertLabelQuery, id, name, value)
+		if err != nil {
+			return fmt.Errorf("failed to insert label %s of service(id=%s). %w", name, id, err)
+		}
+	}
+
+	return nil
+}
+
+const findPortsQuery = `
+	SELECT
+		service_id,
+		name,
+		port,
+		end_port,
+		protocol
+	FROM service_port
+	WHERE
+		service_id IN (%s)
+	ORDER BY service_id, port, name`
+
+// findPorts loads the named ports of the services with the given ids.
+func findPorts(ctx context.Context, q queryer, services map[string]*models.Service, ids []interface{}) error {
+	rows, err := q.QueryContext(ctx, inQuery(findPortsQuery, len(ids)), ids...)
+	if err != nil {
+		return fmt.Errorf("failed to query ports of services. %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var p models.ServicePort
+		err = rows.Scan(&id, &p.Name, &p.Port, &p.EndPort, &p.Protocol)
+		if err != nil {
+			return fmt.Errorf("failed to scan port row. %w", err)
+		}
+
+		svc := services[id]
+		svc.Ports = append(svc.Ports, p)
+	}
+
+	return rows.Err()
+}
+
+const deletePortsQuery = `
+	DELETE FROM service_port
+	WHERE
+		service_id = ?`
+
+const insertPortQuery = `
+	INSERT INTO service_port(
+		service_id,
+		name,
+		port,
+		end_port,
+		protocol
+	) VALUES (
+		?,
+		?,
+		?,
+		?,
+		?
+	)`
+
+// replacePorts sets the named ports of a service, removing any ports not present.
+func replacePorts(ctx context.Context, tx *sql.Tx, id string, ports []models.ServicePort) error {
+	_, err := tx.ExecContext(ctx, deletePortsQuery, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete ports of service(id=%s). %w", id, err)
+	}
+
+	for _, p := range ports {
+		_, err = tx.ExecContext(ctx, insertPortQuery, id, p.Name, p.Port, p.EndPort, p.Protocol)
+		if err != nil {
+			return fmt.Errorf("failed to insert port %s of service(id=%s). %w", p.Name, id, err)
+		}
+	}
+
+	return nil
+}
+
+const findLocalitiesQuery = `
+	SELECT
+		service_id,
+		region,
+		zone
+	FROM service_locality
+	WHERE
+		service_id IN (%s)`
+
+// findLocalities loads the region and zone of the services with the given ids, leaving them empty if not set.
+func findLocalities(ctx context.Context, q queryer, services map[string]*models.Service, ids []interface{}) error {
+	rows, err := q.QueryContext(ctx, inQuery(findLocalitiesQuery, len(ids)), ids...)
+	if err != nil {
+		return fmt.Errorf("failed to query locality of services. %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, region, zone string
+		err = rows.Scan(&id, &region, &zone)
+		if err != nil {
+			return fmt.Errorf("failed to scan locality row. %w", err)
+		}
+
+		svc := services[id]
+		svc.Region = region
+		svc.Zone = zone
+	}
+
+	return rows.Err()
+}
+
+const deleteLocalityQuery = `
+	DELETE FROM service_locality
+	WHERE
+		service_id = ?`
+
+const insertLocalityQuery = `
+	INSERT INTO service_locality(
+		service_id,
+		region,
+		zone
+	) VALUES (
+		?,
+		?,
+		?
+	)`
+
+// replaceLocality sets the region and zone of a service, removing them if neither is set.
+func replaceLocality(ctx context.Context, tx *sql.Tx, svc models.Service) error {
+	_, err := tx.ExecContext(ctx, deleteLocalityQuery, svc.ID)
+	if err != nil {
+		return fmt.Errorf("failed to delete locality of service(id=%s). %w", svc.ID, err)
+	}
+
+	if svc.Region == "" && svc.Zone == "" {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, insertLocalityQuery, svc.ID, svc.Region, svc.Zone)
+	if err != nil {
+		return fmt.Errorf("failed to insert locality of service(id=%s). %w", svc.ID, err)
+	}
+
 	return nil
 }
 
+// withSavepoint runs fn within a savepoint, undoing only the changes made by fn if it fails.
+// The error returned by fn is returned as itemErr, err is set if the savepoint itself failed.
+func withSavepoint(ctx context.Context, tx *sql.Tx, fn func() error) (itemErr error, err error) {
+	_, err = tx.ExecContext(ctx, "SAVEPOINT batch_item")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create savepoint. %w", err)
+	}
+
+	itemErr = fn()
+	if itemErr != nil {
+		_, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch_item")
+		if err != nil {
+			return nil, fmt.Errorf("failed to roll back to savepoint. %w", err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT batch_item")
+	if err != nil {
+		return nil, fmt.Errorf("failed to release savepoint. %w", err)
+	}
+
+	return itemErr, nil
+}
+
+// expectOneRow checks that a compare-and-set statement affected a row.
+func expectOneRow(res sql.Result) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check affected rows. %w", err)
+	}
+	if affected == 0 {
+		return ErrVersionConflict
+	}
+
+	return nil
+}
+
+// queryer runs queries against either the database or a transaction.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanService(row scanner) (models.Service, error) {
+	s := models.Service{}
+	var heartbeatAt sql.NullTime
+	err := row.Scan(&s.ID, &s.Application, &s.Location, &s.Port, &s.Status, &s.Version, &s.Epoch, &heartbeatAt)
+	s.HeartbeatAt = heartbeatAt.Time
+	return s, err
+}
+
+func nullableTime(t time.Time) sql.NullTime {
+	return sql.NullTime{
+		Time:  t.UTC(),
+		Valid: !t.IsZero(),
+	}
+}
+
 func recordError(span opentracing.Span, err error) {
 	span.LogFields(
 		tracelog.Bool("success", false),
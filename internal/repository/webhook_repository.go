@@ -0,0 +1,451 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/CzarSimon/httputil/dbutil"
+	"github.com/CzarSimon/httputil/id"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+// WebhookRepository storage interface for webhook subscriptions and their delivery queue.
+type WebhookRepository interface {
+	Create(ctx context.Context, webhook models.Webhook) (models.Webhook, error)
+	// Find looks up a webhook, returns sql.ErrNoRows if it does not exist.
+	Find(ctx context.Context, id string) (models.Webhook, error)
+	FindAll(ctx context.Context) ([]models.Webhook, error)
+	// Delete removes a webhook and its deliveries, returns sql.ErrNoRows if it does not exist.
+	Delete(ctx context.Context, id string) error
+	// Enqueue adds deliveries to the queue.
+	Enqueue(ctx context.Context, deliveries []models.WebhookDelivery) error
+	// FindDue lists pending deliveries due for an attempt at now, the longest overdue first.
+	FindDue(ctx context.Context, now time.Time, limit int) ([]models.WebhookDelivery, error)
+	// Claim reserves a delivery that is still due at now for an attempt by moving its next attempt
+	// to until, returns false if it was claimed by another dispatcher first. Claimed deliveries
+	// that are not updated before until are due again.
+	Claim(ctx context.Context, id string, now, until time.Time) (bool, error)
+	// FindDelivery looks up a delivery, returns sql.ErrNoRows if it does not exist.
+	FindDelivery(ctx context.Context, id string) (models.WebhookDelivery, error)
+	// FindDeliveries lists the deliveries of a webhook, newest first. An empty status matches any status.
+	FindDeliveries(ctx context.Context, webhookID string, status models.DeliveryStatus, limit int) ([]models.WebhookDelivery, error)
+	UpdateDelivery(ctx context.Context, delivery models.WebhookDelivery) (models.WebhookDelivery, error)
+}
+
+// NewWebhookRepository creates a webhook repository using the default implementation.
+func NewWebhookRepository(db *sql.DB) WebhookRepository {
+	return &webhookRepo{
+		db: db,
+	}
+}
+
+type webhookRepo struct {
+	db *sql.DB
+}
+
+const insertWebhookQuery = `
+	INSERT INTO webhook(
+		id,
+		url,
+		secret,
+		applications,
+		event_types,
+		created_at
+	) VALUES (?, ?, ?, ?, ?, ?)`
+
+func (r *webhookRepo) Create(ctx context.Context, webhook models.Webhook) (models.Webhook, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "webhookRepo.Create")
+	defer span.Finish()
+
+	applications, err := json.Marshal(webhook.Applications)
+	if err != nil {
+		err = fmt.Errorf("failed to encode applications. %w", err)
+		recordError(span, err)
+		return models.Webhook{}, err
+	}
+
+	eventTypes, err := json.Marshal(webhook.EventTypes)
+	if err != nil {
+		err = fmt.Errorf("failed to encode event types. %w", err)
+		recordError(span, err)
+		return models.Webhook{}, err
+	}
+
+	webhook.ID = id.New()
+	webhook.CreatedAt = time.Now().UTC()
+	_, err = r.db.ExecContext(ctx, insertWebhookQuery, webhook.ID, webhook.URL, webhook.Secret, string(applications), string(eventTypes), webhook.CreatedAt)
+	if err != nil {
+		err = fmt.Errorf("failed to insert webhook(url=%s). %w", webhook.URL, err)
+		recordError(span, err)
+		return models.Webhook{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return webhook, nil
+}
+
+const findWebhookQuery = `
+	SELECT
+		id,
+		url,
+		secret,
+		applications,
+		event_types,
+		created_at
+	FROM webhook
+	WHERE
+		id = ?`
+
+func (r *webhookRepo) Find(ctx context.Context, id string) (models.Webhook, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "webhookRepo.Find")
+	defer span.Finish()
+
+	webhook, err := scanWebhook(r.db.QueryRowContext(ctx, findWebhookQuery, id))
+	if err != nil && err != sql.ErrNoRows {
+		err = fmt.Errorf("failed to query database. %w", err)
+		recordError(span, err)
+		return models.Webhook{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return webhook, err
+}
+
+const findWebhooksQuery = `
+	SELECT
+		id,
+		url,
+		secret,
+		applications,
+		event_types,
+		created_at
+	FROM webhook
+	ORDER BY created_at, id`
+
+func (r *webhookRepo) FindAll(ctx context.Context) ([]models.Webhook, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "webhookRepo.FindAll")
+	defer span.Finish()
+
+	rows, err := r.db.QueryContext(ctx, findWebhooksQuery)
+	if err != nil {
+		err = fmt.Errorf("failed to query database. %w", err)
+		recordError(span, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := make([]models.Webhook, 0)
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			err = fmt.Errorf("failed to scan row. %w", err)
+			recordError(span, err)
+			return nil, err
+		}
+
+		webhooks = append(webhooks, webhook)
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return webhooks, nil
+}
+
+const deleteWebhookQuery = `DELETE FROM webhook WHERE id = ?`
+
+const deleteWebhookDeliveriesQuery = `DELETE FROM webhook_delivery WHERE webhook_id = ?`
+
+func (r *webhookRepo) Delete(ctx context.Context, id string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "webhookRepo.Delete")
+	defer span.Finish()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, deleteWebhookQuery, id)
+	if err != nil {
+		err = fmt.Errorf("failed to delete webhook(id=%s). %w", id, err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("failed to check affected rows. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return err
+	}
+	if affected == 0 {
+		dbutil.Rollback(tx)
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.ExecContext(ctx, deleteWebhookDeliveriesQuery, id)
+	if err != nil {
+		err = fmt.Errorf("failed to delete deliveries of webhook(id=%s). %w", id, err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return tx.Commit()
+}
+
+const insertWebhookDeliveryQuery = `
+	INSERT INTO webhook_delivery(
+		id,
+		webhook_id,
+		event_id,
+		event_type,
+		payload,
+		status,
+		attempts,
+		next_attempt_at,
+		response_status,
+		last_error,
+		created_at,
+		updated_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+func (r *webhookRepo) Enqueue(ctx context.Context, deliveries []models.WebhookDelivery) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "webhookRepo.Enqueue")
+	defer span.Finish()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to create transaction. %w", err)
+		recordError(span, err)
+		dbutil.Rollback(tx)
+		return err
+	}
+
+	for _, d := range deliveries {
+		_, err = tx.ExecContext(ctx, insertWebhookDeliveryQuery, d.ID, d.WebhookID, d.EventID, d.EventType, d.Payload, d.Status,
+			d.Attempts, d.NextAttemptAt.UTC(), d.ResponseStatus, d.LastError, d.CreatedAt.UTC(), d.UpdatedAt.UTC())
+		if err != nil {
+			err = fmt.Errorf("failed to insert webhook delivery(id=%s). %w", d.ID, err)
+			recordError(span, err)
+			dbutil.Rollback(tx)
+			return err
+		}
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return tx.Commit()
+}
+
+const selectWebhookDeliveryQuery = `
+	SELECT
+		id,
+		webhook_id,
+		event_id,
+		event_type,
+		payload,
+		status,
+		attempts,
+		next_attempt_at,
+		response_status,
+		last_error,
+		created_at,
+		updated_at
+	FROM webhook_delivery`
+
+const findDueWebhookDeliveriesQuery = selectWebhookDeliveryQuery + `
+	WHERE
+		status = ?
+		AND next_attempt_at <= ?
+	ORDER BY next_attempt_at, id
+	LIMIT ?`
+
+func (r *webhookRepo) FindDue(ctx context.Context, now time.Time, limit int) ([]models.WebhookDelivery, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "webhookRepo.FindDue")
+	defer span.Finish()
+
+	deliveries, err := r.queryDeliveries(ctx, findDueWebhookDeliveriesQuery, models.DeliveryPending, now.UTC(), limit)
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return deliveries, nil
+}
+
+const claimWebhookDeliveryQuery = `
+	UPDATE webhook_delivery SET
+		next_attempt_at = ?,
+		updated_at = ?
+	WHERE
+		id = ?
+		AND status = ?
+		AND next_attempt_at <= ?`
+
+func (r *webhookRepo) Claim(ctx context.Context, id string, now, until time.Time) (bool, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "webhookRepo.Claim")
+	defer span.Finish()
+
+	res, err := r.db.ExecContext(ctx, claimWebhookDeliveryQuery, until.UTC(), now.UTC(), id, models.DeliveryPending, now.UTC())
+	if err != nil {
+		err = fmt.Errorf("failed to claim webhook delivery(id=%s). %w", id, err)
+		recordError(span, err)
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		err = fmt.Errorf("failed to check affected rows. %w", err)
+		recordError(span, err)
+		return false, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return affected == 1, nil
+}
+
+const findWebhookDeliveryQuery = selectWebhookDeliveryQuery + `
+	WHERE
+		id = ?`
+
+func (r *webhookRepo) FindDelivery(ctx context.Context, id string) (models.WebhookDelivery, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "webhookRepo.FindDelivery")
+	defer span.Finish()
+
+	delivery, err := scanWebhookDelivery(r.db.QueryRowContext(ctx, findWebhookDeliveryQuery, id))
+	if err != nil && err != sql.ErrNoRows {
+		err = fmt.Errorf("failed to query database. %w", err)
+		recordError(span, err)
+		return models.WebhookDelivery{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return delivery, err
+}
+
+const findWebhookDeliveriesQuery = selectWebhookDeliveryQuery + `
+	WHERE
+		webhook_id = ?
+		AND (? = '' OR status = ?)
+	ORDER BY created_at DESC, id
+	LIMIT ?`
+
+func (r *webhookRepo) FindDeliveries(ctx context.Context, webhookID string, status models.DeliveryStatus, limit int) ([]models.WebhookDelivery, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "webhookRepo.FindDeliveries")
+	defer span.Finish()
+
+	deliveries, err := r.queryDeliveries(ctx, findWebhookDeliveriesQuery, webhookID, status, status, limit)
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return deliveries, nil
+}
+
+func (r *webhookRepo) queryDeliveries(ctx context.Context, query string, args ...interface{}) ([]models.WebhookDelivery, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database. %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]models.WebhookDelivery, 0)
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row. %w", err)
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+const updateWebhookDeliveryQuery = `
+	UPDATE webhook_delivery SET
+		status = ?,
+		attempts = ?,
+		next_attempt_at = ?,
+		response_status = ?,
+		last_error = ?,
+		updated_at = ?
+	WHERE
+		id = ?`
+
+func (r *webhookRepo) UpdateDelivery(ctx context.Context, delivery models.WebhookDelivery) (models.WebhookDelivery, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "webhookRepo.UpdateDelivery")
+	defer span.Finish()
+
+	delivery.NextAttemptAt = delivery.NextAttemptAt.UTC()
+	delivery.UpdatedAt = time.Now().UTC()
+	_, err := r.db.ExecContext(ctx, updateWebhookDeliveryQuery, delivery.Status, delivery.Attempts, delivery.NextAttemptAt,
+		delivery.ResponseStatus, delivery.LastError, delivery.UpdatedAt, delivery.ID)
+	if err != nil {
+		err = fmt.Errorf("failed to update webhook delivery(id=%s). %w", delivery.ID, err)
+		recordError(span, err)
+		return models.WebhookDelivery{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return delivery, nil
+}
+
+func scanWebhook(row scanner) (models.Webhook, error) {
+	webhook := models.Webhook{}
+	var applications, eventTypes string
+	err := row.Scan(
+		&webhook.ID,
+		&webhook.URL,
+		&webhook.Secret,
+		&applications,
+		&eventTypes,
+		&webhook.CreatedAt,
+	)
+	if err != nil {
+		return models.Webhook{}, err
+	}
+
+	err = json.Unmarshal([]byte(applications), &webhook.Applications)
+	if err != nil {
+		return models.Webhook{}, fmt.Errorf("failed to decode applications of webhook(id=%s). %w", webhook.ID, err)
+	}
+
+	err = json.Unmarshal([]byte(eventTypes), &webhook.EventTypes)
+	if err != nil {
+		return models.Webhook{}, fmt.Errorf("failed to decode event types of webhook(id=%s). %w", webhook.ID, err)
+	}
+
+	return webhook, nil
+}
+
+func scanWebhookDelivery(row scanner) (models.WebhookDelivery, error) {
+	delivery := models.WebhookDelivery{}
+	err := row.Scan(
+		&delivery.ID,
+		&delivery.WebhookID,
+		&delivery.EventID,
+		&delivery.EventType,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.ResponseStatus,
+		&delivery.LastError,
+		&delivery.CreatedAt,
+		&delivery.UpdatedAt,
+	)
+	return delivery, err
+}
@@ -0,0 +1,295 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+	"go.uber.org/zap"
+)
+
+// Limits of how long a key can be bound to an instance.
+const (
+	DefaultAffinityTTL = 10 * time.Minute
+	MaxAffinityTTL     = 24 * time.Hour
+)
+
+// AffinityService binds affinity keys to instances so that clients reconnect to the same instance.
+type AffinityService struct {
+	repo     repository.AffinityRepository
+	registry *RegistryService
+}
+
+// NewAffinityService sets up and creates a new affinity service. Bindings of instances
+// that are drained or deregistered in the registry are migrated to other instances.
+func NewAffinityService(repo repository.AffinityRepository, registry *RegistryService) *AffinityService {
+	s := &AffinityService{
+		repo:     repo,
+		registry: registry,
+	}
+	registry.OnUnavailable(s.migrate)
+	return s
+}
+
+// Bind binds a key to the requested instance or, if none is requested, to the instance it is
+// currently bound to if still available and otherwise to one picked by consistent hashing.
+// The binding expires after the requested TTL.
+func (s *AffinityService) Bind(ctx context.Context, application, key string, req models.AffinityRequest) (models.Affinity, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AffinityService.Bind")
+	defer span.Finish()
+
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if ttl == 0 {
+		ttl = DefaultAffinityTTL
+	}
+	if ttl < 0 || ttl > MaxAffinityTTL {
+		err := httputil.BadRequestError(fmt.Errorf("ttlSeconds must be between 1 and %.0f, got %d", MaxAffinityTTL.Seconds(), req.TTLSeconds))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Affinity{}, err
+	}
+
+	candidates, err := s.availableInstances(ctx, application, "")
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Affinity{}, err
+	}
+
+	now := time.Now()
+	current, err := s.repo.Find(ctx, application, key)
+	if err != nil && err != sql.ErrNoRows {
+		err = httputil.InternalServerError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Affinity{}, err
+	}
+	bound := err == nil && !current.Expired(now)
+
+	svc, err := s.target(application, key, req, candidates, current, bound)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Affinity{}, err
+	}
+
+	binding, err := s.repo.Save(ctx, models.AffinityBinding{
+		Application: application,
+		Key:         key,
+		ServiceID:   svc.ID,
+		ExpiresAt:   now.Add(ttl),
+	})
+	if err != nil {
+		err = httputil.InternalServerError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Affinity{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return models.Affinity{
+		Binding: binding,
+		Service: svc,
+		Rebound: bound && current.ServiceID != svc.ID,
+	}, nil
+}
+
+// Lookup returns the instance a key is bound to. If the instance is no longer available
+// the key is rebound to another instance picked by consistent hashing, keeping its expiry.
+func (s *AffinityService) Lookup(ctx context.Context, application, key string) (models.Affinity, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AffinityService.Lookup")
+	defer span.Finish()
+
+	binding, err := s.repo.Find(ctx, application, key)
+	if err == nil && binding.Expired(time.Now()) {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		err = httputil.NotFoundError(fmt.Errorf("key %s is not bound to an instance of application(name=%s)", key, application))
+	} else if err != nil {
+		err = httputil.InternalServerError(err)
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Affinity{}, err
+	}
+
+	candidates, err := s.availableInstances(ctx, application, "")
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Affinity{}, err
+	}
+
+	svc, ok := findInstance(candidates, binding.ServiceID)
+	if ok {
+		span.LogFields(tracelog.Bool("success", true))
+		return models.Affinity{Binding: binding, Service: svc}, nil
+	}
+
+	svc, ok = models.PickByHash(key, candidates)
+	if !ok {
+		err = noInstanceError(application)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Affinity{}, err
+	}
+
+	binding.ServiceID = svc.ID
+	binding, err = s.repo.Save(ctx, binding)
+	if err != nil {
+		err = httputil.InternalServerError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Affinity{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return models.Affinity{Binding: binding, Service: svc, Rebound: true}, nil
+}
+
+// Unbind removes the binding of a key.
+func (s *AffinityService) Unbind(ctx context.Context, application, key string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AffinityService.Unbind")
+	defer span.Finish()
+
+	err := s.repo.Delete(ctx, application, key)
+	if err == sql.ErrNoRows {
+		err = httputil.NotFoundError(fmt.Errorf("key %s is not bound to an instance of application(name=%s)", key, application))
+	} else if err != nil {
+		err = httputil.InternalServerError(err)
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return nil
+}
+
+// DeleteExpired removes expired bindings.
+func (s *AffinityService) DeleteExpired(ctx context.Context) (int, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AffinityService.DeleteExpired")
+	defer span.Finish()
+
+	deleted, err := s.repo.DeleteExpired(ctx, time.Now())
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return 0, err
+	}
+
+	if deleted > 0 {
+		log.Info("deleted expired affinity bindings", zap.Int("count", deleted))
+	}
+	span.LogFields(tracelog.Bool("success", true))
+	return deleted, nil
+}
+
+// migrate moves the bindings of an instance that is no longer available to the remaining instances
+// of its application. Bindings are kept as is if there are no other instances to move them to.
+func (s *AffinityService) migrate(ctx context.Context, svc models.Service) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AffinityService.migrate")
+	defer span.Finish()
+
+	bindings, err := s.repo.FindByService(ctx, svc.ID)
+	if err != nil {
+		log.Error("failed to find affinity bindings to migrate", zap.String("serviceId", svc.ID), zap.Error(err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return
+	}
+	if len(bindings) == 0 {
+		span.LogFields(tracelog.Bool("success", true))
+		return
+	}
+
+	candidates, err := s.availableInstances(ctx, svc.Application, svc.ID)
+	if err != nil {
+		log.Error("failed to find instances to migrate affinity bindings to", zap.String("serviceId", svc.ID), zap.Error(err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return
+	}
+
+	now := time.Now()
+	migrated := 0
+	for _, binding := range bindings {
+		target, ok := models.PickByHash(binding.Key, candidates)
+		if !ok || binding.Expired(now) {
+			continue
+		}
+
+		binding.ServiceID = target.ID
+		_, err = s.repo.Save(ctx, binding)
+		if err != nil {
+			log.Error("failed to migrate affinity binding", zap.Any("binding", binding), zap.Error(err))
+			continue
+		}
+		migrated++
+	}
+
+	log.Info("migrated affinity bindings",
+		zap.String("serviceId", svc.ID),
+		zap.Int("bindings", len(bindings)),
+		zap.Int("migrated", migrated))
+	span.LogFields(tracelog.Bool("success", true))
+}
+
+// target returns the requested instance if set. Otherwise the key is kept on its current
+// instance if it is still available or an instance is picked by consistent hashing.
+func (s *AffinityService) target(application, key string, req models.AffinityRequest, candidates []models.Service, current models.AffinityBinding, bound bool) (models.Service, error) {
+	if req.ServiceID != "" {
+		svc, ok := findInstance(candidates, req.ServiceID)
+		if !ok {
+			return models.Service{}, UnprocessableEntityError(fmt.Errorf("service(id=%s) is not an available instance of application(name=%s)", req.ServiceID, application))
+		}
+		return svc, nil
+	}
+
+	if bound {
+		svc, ok := findInstance(candidates, current.ServiceID)
+		if ok {
+			return svc, nil
+		}
+	}
+
+	svc, ok := models.PickByHash(key, candidates)
+	if !ok {
+		return models.Service{}, noInstanceError(application)
+	}
+	return svc, nil
+}
+
+// availableInstances looks up the healthy and unexpired instances of an application, except the excluded instance.
+func (s *AffinityService) availableInstances(ctx context.Context, application, exclude string) ([]models.Service, error) {
+	policy, err := s.registry.ApplicationPolicy(ctx, application)
+	if err != nil {
+		return nil, err
+	}
+
+	services, err := s.registry.FindApplicationServices(ctx, application, models.ServiceQuery{OnlyHealthy: true})
+	if err != nil {
+		return nil, httputil.InternalServerError(err)
+	}
+
+	now := time.Now()
+	available := make([]models.Service, 0, len(services))
+	for _, svc := range services {
+		if svc.ID != exclude && policy.Available(svc, now) {
+			available = append(available, svc)
+		}
+	}
+
+	return available, nil
+}
+
+func findInstance(services []models.Service, id string) (models.Service, bool) {
+	for _, svc := range services {
+		if svc.ID == id {
+			return svc, true
+		}
+	}
+
+	return models.Service{}, false
+}
+
+func noInstanceError(application string) error {
+	return httputil.ServiceUnavailableError(fmt.Errorf("no available instance of application(name=%s)", application))
+}
@@ -0,0 +1,261 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+	"go.uber.org/zap"
+)
+
+// Notifier is notified when an alert fires or is resolved.
+type Notifier interface {
+	Notify(ctx context.Context, alert models.Alert) error
+}
+
+// LogNotifier notifies by writing alerts to the log.
+type LogNotifier struct{}
+
+// Notify logs firing alerts as warnings and resolved alerts as info.
+func (LogNotifier) Notify(ctx context.Context, alert models.Alert) error {
+	fields := []zap.Field{
+		zap.String("ruleId", alert.Rule.ID),
+		zap.String("rule", alert.Rule.Name),
+		zap.String("application", alert.Rule.Application),
+		zap.String("summary", alert.Summary),
+	}
+	if alert.State == models.AlertResolved {
+		log.Info("alert resolved", fields...)
+	} else {
+		log.Warn("alert firing", fields...)
+	}
+
+	return nil
+}
+
+// AlertService manages alert rules on the health of applications and evaluates them.
+type AlertService struct {
+	repo      repository.AlertRepository
+	registry  *RegistryService
+	notifiers []Notifier
+}
+
+// NewAlertService sets up and creates a new alert service notifying the given notifiers.
+func NewAlertService(repo repository.AlertRepository, registry *RegistryService, notifiers ...Notifier) *AlertService {
+	return &AlertService{
+		repo:      repo,
+		registry:  registry,
+		notifiers: notifiers,
+	}
+}
+
+// CreateRule adds an alert rule, evaluated from the next evaluation on.
+func (s *AlertService) CreateRule(ctx context.Context, rule models.AlertRule) (models.AlertRule, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AlertService.CreateRule")
+	defer span.Finish()
+
+	err := validateAlertRule(rule)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.AlertRule{}, err
+	}
+
+	created, err := s.repo.CreateRule(ctx, rule)
+	if err != nil {
+		err = httputil.InternalServerError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.AlertRule{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return created, nil
+}
+
+func validateAlertRule(rule models.AlertRule) error {
+	problems := make([]string, 0)
+	if rule.Name == "" {
+		problems = append(problems, "name is required")
+	}
+	if rule.Application == "" {
+		problems = append(problems, "application is required")
+	}
+	if !rule.Condition.Valid() {
+		problems = append(problems, fmt.Sprintf("condition must be one of %s, %s or %s, got %q",
+			models.AlertHealthyBelow, models.AlertUnhealthyAbove, models.AlertNoHeartbeat, rule.Condition))
+	}
+	if rule.Threshold < 0 || (rule.Condition == models.AlertUnhealthyAbove && rule.Threshold > 100) {
+		problems = append(problems, fmt.Sprintf("threshold must not be negative or above 100 percent, got %v", rule.Threshold))
+	}
+	if rule.ForSeconds < 0 {
+		problems = append(problems, fmt.Sprintf("forSeconds must not be negative, got %d", rule.ForSeconds))
+	}
+
+	if len(problems) > 0 {
+		return httputil.BadRequestError(fmt.Errorf("invalid alert rule: %s", strings.Join(problems, "; ")))
+	}
+
+	return nil
+}
+
+// FindRule looks up an alert rule.
+func (s *AlertService) FindRule(ctx context.Context, id string) (models.AlertRule, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AlertService.FindRule")
+	defer span.Finish()
+
+	rule, err := s.repo.FindRule(ctx, id)
+	if err == sql.ErrNoRows {
+		err = httputil.NotFoundError(fmt.Errorf("alert rule(id=%s) does not exist", id))
+	} else if err != nil {
+		err = httputil.InternalServerError(err)
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.AlertRule{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return rule, nil
+}
+
+// DeleteRule removes an alert rule along with its alert.
+func (s *AlertService) DeleteRule(ctx context.Context, id string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AlertService.DeleteRule")
+	defer span.Finish()
+
+	err := s.repo.DeleteRule(ctx, id)
+	if err == sql.ErrNoRows {
+		err = httputil.NotFoundError(fmt.Errorf("alert rule(id=%s) does not exist", id))
+	} else if err != nil {
+		err = httputil.InternalServerError(err)
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return nil
+}
+
+// FindAlerts lists the alerts of every rule, optionally only those of an application or in a state.
+func (s *AlertService) FindAlerts(ctx context.Context, application string, state models.AlertState) ([]models.Alert, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AlertService.FindAlerts")
+	defer span.Finish()
+
+	if state != "" && !state.Valid() {
+		err := httputil.BadRequestError(fmt.Errorf("invalid alert state %s", state))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return nil, err
+	}
+
+	alerts, err := s.repo.FindAlerts(ctx)
+	if err != nil {
+		err = httputil.InternalServerError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return nil, err
+	}
+
+	matching := make([]models.Alert, 0, len(alerts))
+	for _, alert := range alerts {
+		if (application == "" || alert.Rule.Application == application) && (state == "" || alert.State == state) {
+			matching = append(matching, alert)
+		}
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return matching, nil
+}
+
+// Evaluate checks every rule against the current instances of its application, saves the alerts
+// whose state changed and notifies the notifiers of alerts that fired or were resolved. The
+// value of alerts that did not change is only returned, not saved, to avoid a write per rule
+// every evaluation. Alerts are only saved if still in the state they were evaluated from, so
+// that when several replicas evaluate the rules only the first to move an alert notifies.
+// Notifier failures are logged and do not stop the evaluation.
+func (s *AlertService) Evaluate(ctx context.Context) ([]models.Alert, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AlertService.Evaluate")
+	defer span.Finish()
+
+	alerts, err := s.repo.FindAlerts(ctx)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	instances := make(map[string][]models.Service)
+	policies := make(map[string]models.RegistrationPolicy)
+	for i, alert := range alerts {
+		application := alert.Rule.Application
+		services, ok := instances[application]
+		if !ok {
+			services, err = s.registry.FindApplicationServices(ctx, application, models.ServiceQuery{})
+			if err == nil {
+				policies[application], err = s.registry.ApplicationPolicy(ctx, application)
+			}
+			if err != nil {
+				span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+				return nil, err
+			}
+			instances[application] = services
+		}
+
+		before := alert
+		value, holds := alert.Rule.Measure(services, policies[application], now)
+		changed := alert.Evaluate(value, holds, now)
+		if !changed && !alertMoved(before, alert) {
+			alerts[i] = alert
+			continue
+		}
+
+		saved, err := s.repo.SaveAlert(ctx, alert, before.State)
+		if err != nil {
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			return nil, err
+		}
+		if !saved {
+			log.Debug("alert moved by another evaluator", zap.String("ruleId", alert.Rule.ID))
+			continue
+		}
+
+		alerts[i] = alert
+		if changed {
+			s.notify(ctx, alert)
+		}
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return alerts, nil
+}
+
+// alertMoved checks if an evaluation moved an alert to another state or changed when its condition
+// started to hold, or if the alert is evaluated for the first time.
+func alertMoved(before, after models.Alert) bool {
+	if before.EvaluatedAt.IsZero() || before.State != after.State {
+		return true
+	}
+	if before.ActiveSince == nil || after.ActiveSince == nil {
+		return before.ActiveSince != after.ActiveSince
+	}
+
+	return !before.ActiveSince.Equal(*after.ActiveSince)
+}
+
+func (s *AlertService) notify(ctx context.Context, alert models.Alert) {
+	for _, notifier := range s.notifiers {
+		err := notifier.Notify(ctx, alert)
+		if err != nil {
+			log.Error("failed to notify alert",
+				zap.String("ruleId", alert.Rule.ID),
+				zap.String("state", string(alert.State)),
+				zap.Error(err))
+		}
+	}
+}
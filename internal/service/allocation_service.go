@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+	"go.uber.org/zap"
+)
+
+// Limits of how long a session slot can be reserved.
+const (
+	DefaultReservationTTL = time.Minute
+	MaxReservationTTL     = time.Hour
+)
+
+// AllocationService tracks instance capacity and reserves session slots on instances.
+type AllocationService struct {
+	repo     repository.AllocationRepository
+	registry *RegistryService
+}
+
+// NewAllocationService sets up and creates a new allocation service.
+func NewAllocationService(repo repository.AllocationRepository, registry *RegistryService) *AllocationService {
+	return &AllocationService{
+		repo:     repo,
+		registry: registry,
+	}
+}
+
+// SetCapacity records the capacity reported by the instance holding epoch.
+func (s *AllocationService) SetCapacity(ctx context.Context, id string, epoch int64, capacity models.Capacity) (models.Capacity, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AllocationService.SetCapacity")
+	defer span.Finish()
+
+	if epoch == 0 {
+		err := httputil.PreconditionRequiredError(fmt.Errorf("epoch is required to report the capacity of service(id=%s)", id))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Capacity{}, err
+	}
+	if capacity.MaxSessions < 0 || capacity.ActiveSessions < 0 {
+		err := httputil.BadRequestError(fmt.Errorf("maxSessions and activeSessions must not be negative, got %d and %d", capacity.MaxSessions, capacity.ActiveSessions))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Capacity{}, err
+	}
+
+	saved, err := s.repo.SetCapacity(ctx, id, epoch, capacity)
+	if err == sql.ErrNoRows {
+		err = httputil.NotFoundError(err)
+	} else if errors.Is(err, repository.ErrEpochMismatch) {
+		err = httputil.ConflictError(err)
+	} else if err != nil {
+		err = fmt.Errorf("failed to record capacity of service(id=%s). %w", id, err)
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Capacity{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return saved, nil
+}
+
+// Allocate reserves a session slot on the least utilized available instance of an application
+// with remaining capacity. The slot is held until it is released or the reservation expires.
+func (s *AllocationService) Allocate(ctx context.Context, application string, req models.AllocationRequest) (models.Allocation, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AllocationService.Allocate")
+	defer span.Finish()
+
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if ttl == 0 {
+		ttl = DefaultReservationTTL
+	}
+	if ttl < 0 || ttl > MaxReservationTTL {
+		err := httputil.BadRequestError(fmt.Errorf("ttlSeconds must be between 1 and %.0f, got %d", MaxReservationTTL.Seconds(), req.TTLSeconds))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Allocation{}, err
+	}
+
+	policy, err := s.registry.ApplicationPolicy(ctx, application)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Allocation{}, err
+	}
+
+	now := time.Now()
+	eligible := func(svc models.Service) bool {
+		return policy.Available(svc, now) && req.ServiceFilter.Matches(svc)
+	}
+
+	allocation, err := s.repo.Allocate(ctx, application, eligible, now.Add(ttl))
+	if err == repository.ErrNoCapacity {
+		err = httputil.ServiceUnavailableError(fmt.Errorf("failed to allocate session on application(name=%s). %w", application, err))
+	} else if err != nil {
+		err = httputil.InternalServerError(err)
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Allocation{}, err
+	}
+
+	allocation.Service = req.ServiceFilter.SelectPort(allocation.Service)
+	log.Debug("allocated session", zap.Any("reservation", allocation.Reservation))
+	span.LogFields(tracelog.Bool("success", true))
+	return allocation, nil
+}
+
+// Release frees a reserved session slot.
+func (s *AllocationService) Release(ctx context.Context, id string) (models.Reservation, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AllocationService.Release")
+	defer span.Finish()
+
+	reservation, err := s.repo.Release(ctx, id)
+	if err == sql.ErrNoRows {
+		err = httputil.NotFoundError(fmt.Errorf("reservation(id=%s) does not exist or has been reclaimed", id))
+	} else if err != nil {
+		err = httputil.InternalServerError(err)
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Reservation{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return reservation, nil
+}
+
+// ReclaimExpired frees the slots of expired reservations.
+func (s *AllocationService) ReclaimExpired(ctx context.Context) (int, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AllocationService.ReclaimExpired")
+	defer span.Finish()
+
+	reclaimed, err := s.repo.ReclaimExpired(ctx, time.Now())
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return 0, err
+	}
+
+	if reclaimed > 0 {
+		log.Info("reclaimed expired reservations", zap.Int("count", reclaimed))
+	}
+	span.LogFields(tracelog.Bool("success", true))
+	return reclaimed, nil
+}
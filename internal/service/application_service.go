@@ -0,0 +1,206 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+)
+
+// ApplicationService manages the application catalog.
+type ApplicationService struct {
+	repo     repository.ApplicationRepository
+	services repository.ServiceRepository
+}
+
+// NewApplicationService sets up and creates a new application service.
+func NewApplicationService(repo repository.ApplicationRepository, services repository.ServiceRepository) *ApplicationService {
+	return &ApplicationService{
+		repo:     repo,
+		services: services,
+	}
+}
+
+// Create declares a new application.
+func (s *ApplicationService) Create(ctx context.Context, app models.Application) (models.Application, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationService.Create")
+	defer span.Finish()
+
+	err := validateApplication(app)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Application{}, err
+	}
+
+	created, err := s.repo.Create(ctx, app)
+	if errors.Is(err, repository.ErrApplicationExists) {
+		err = httputil.ConflictError(err)
+	} else if err != nil {
+		err = httputil.InternalServerError(err)
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Application{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return created, nil
+}
+
+// Update replaces the declaration of an application.
+func (s *ApplicationService) Update(ctx context.Context, app models.Application) (models.Application, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationService.Update")
+	defer span.Finish()
+
+	err := validateApplication(app)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Application{}, err
+	}
+
+	updated, err := s.repo.Update(ctx, app)
+	if err == sql.ErrNoRows {
+		err = httputil.NotFoundError(fmt.Errorf("application(name=%s) is not declared", app.Name))
+	} else if err != nil {
+		err = httputil.InternalServerError(err)
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Application{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return updated, nil
+}
+
+// Find looks up a declared application, returns a 404 error if it is not declared.
+func (s *ApplicationService) Find(ctx context.Context, name string) (models.Application, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationService.Find")
+	defer span.Finish()
+
+	app, err := s.repo.Find(ctx, name)
+	if err == sql.ErrNoRows {
+		err = httputil.NotFoundError(fmt.Errorf("application(name=%s) is not declared", name))
+	} else if err != nil {
+		err = httputil.InternalServerError(err)
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Application{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return app, nil
+}
+
+// Summarize looks up an application along with its instance counts. Applications that are
+// not declared are still summarized if they have registered instances.
+func (s *ApplicationService) Summarize(ctx context.Context, name string) (models.ApplicationSummary, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationService.Summarize")
+	defer span.Finish()
+
+	summaries, err := s.FindAll(ctx)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.ApplicationSummary{}, err
+	}
+
+	for _, summary := range summaries {
+		if summary.Name == name {
+			span.LogFields(tracelog.Bool("success", true))
+			return summary, nil
+		}
+	}
+
+	err = httputil.NotFoundError(fmt.Errorf("application(name=%s) is neither declared nor registered", name))
+	span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+	return models.ApplicationSummary{}, err
+}
+
+// FindAll lists declared applications and applications with registered instances, ordered by name.
+func (s *ApplicationService) FindAll(ctx context.Context) ([]models.ApplicationSummary, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationService.FindAll")
+	defer span.Finish()
+
+	apps, err := s.repo.FindAll(ctx)
+	if err != nil {
+		err = httputil.InternalServerError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return nil, err
+	}
+
+	counts, err := s.services.CountByApplication(ctx)
+	if err != nil {
+		err = httputil.InternalServerError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return nil, err
+	}
+
+	summaries := make([]models.ApplicationSummary, 0, len(apps)+len(counts))
+	for _, app := range apps {
+		summaries = append(summaries, models.NewApplicationSummary(app, true, counts[app.Name]))
+		delete(counts, app.Name)
+	}
+	for name, instances := range counts {
+		summaries = append(summaries, models.NewApplicationSummary(models.Application{Name: name}, false, instances))
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+
+	span.LogFields(tracelog.Bool("success", true))
+	return summaries, nil
+}
+
+// Delete removes the declaration of an application, registered instances are kept.
+func (s *ApplicationService) Delete(ctx context.Context, name string) (models.Application, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationService.Delete")
+	defer span.Finish()
+
+	app, err := s.Find(ctx, name)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Application{}, err
+	}
+
+	err = s.repo.Delete(ctx, name)
+	if err == sql.ErrNoRows {
+		err = httputil.NotFoundError(fmt.Errorf("application(name=%s) is not declared", name))
+	} else if err != nil {
+		err = httputil.InternalServerError(err)
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Application{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return app, nil
+}
+
+func validateApplication(app models.Application) error {
+	var err error
+	if app.Name == "" {
+		err = errors.New("name is required")
+	} else if app.MinHealthyInstances < 0 {
+		err = fmt.Errorf("minHealthyInstances must not be negative, got %d", app.MinHealthyInstances)
+	} else if app.InstanceTTLSeconds < 0 {
+		err = fmt.Errorf("instanceTtlSeconds must not be negative, got %d", app.InstanceTTLSeconds)
+	} else if app.ConflictPolicy != "" && !app.ConflictPolicy.Valid() {
+		err = fmt.Errorf("invalid conflictPolicy %s", app.ConflictPolicy)
+	}
+
+	if err != nil {
+		return httputil.BadRequestError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/CzarSimon/httputil/id"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+	"go.uber.org/zap"
+)
+
+// AuditService records and queries the audit log.
+type AuditService struct {
+	repo repository.AuditRepository
+}
+
+// NewAuditService sets up and creates a new audit service.
+func NewAuditService(repo repository.AuditRepository) *AuditService {
+	return &AuditService{
+		repo: repo,
+	}
+}
+
+// Record stores an audit entry. Failures are logged rather than returned since
+// the audited operation has already been carried out.
+func (s *AuditService) Record(ctx context.Context, entry models.AuditEntry) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AuditService.Record")
+	defer span.Finish()
+
+	entry.ID = id.New()
+	entry.CreatedAt = time.Now().UTC()
+
+	err := s.repo.Save(ctx, entry)
+	if err != nil {
+		log.Error("failed to record audit entry", zap.Any("entry", entry), zap.Error(err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+}
+
+// Find looks up audit entries matching a filter, newest first.
+func (s *AuditService) Find(ctx context.Context, filter models.AuditFilter) ([]models.AuditEntry, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "AuditService.Find")
+	defer span.Finish()
+
+	entries, err := s.repo.Find(ctx, filter)
+	if err != nil {
+		err = httputil.InternalServerError(fmt.Errorf("failed to query audit log. %w", err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return nil, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return entries, nil
+}
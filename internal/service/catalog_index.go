@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+	"go.uber.org/zap"
+)
+
+// CatalogIndex counts the changes made to registered instances so that clients can block
+// until the catalog changes, like the blocking queries of the Consul API. The index is stored
+// in the database so that every replica hands out the same index. It is advanced by the events
+// of the registry and by instances expiring, changes made through other replicas wake waiting
+// clients once noticed by Refresh.
+type CatalogIndex struct {
+	repo      repository.CatalogRepository
+	registry  *RegistryService
+	mu        sync.Mutex
+	index     uint64
+	changed   chan struct{}
+	checkedAt time.Time
+}
+
+// NewCatalogIndex creates a catalog index advanced by the events of the registry.
+func NewCatalogIndex(repo repository.CatalogRepository, registry *RegistryService) *CatalogIndex {
+	i := &CatalogIndex{
+		repo:      repo,
+		registry:  registry,
+		changed:   make(chan struct{}),
+		checkedAt: time.Now(),
+	}
+	registry.OnEvent(func(ctx context.Context, event models.Event) error {
+		err := i.advance(ctx)
+		if err != nil {
+			log.Error("failed to advance catalog index", zap.String("eventId", event.ID), zap.Error(err))
+		}
+		return nil
+	})
+
+	return i
+}
+
+func (i *CatalogIndex) advance(ctx context.Context) error {
+	err := i.repo.AdvanceIndex(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = i.Current(ctx)
+	return err
+}
+
+// Current returns the current index, waking waiting clients if it has changed.
+func (i *CatalogIndex) Current(ctx context.Context) (uint64, error) {
+	index, err := i.repo.FindIndex(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if index != i.index {
+		i.index = index
+		close(i.changed)
+		i.changed = make(chan struct{})
+	}
+
+	return index, nil
+}
+
+// Refresh wakes waiting clients if the index has been advanced by another replica.
+func (i *CatalogIndex) Refresh(ctx context.Context) error {
+	_, err := i.Current(ctx)
+	return err
+}
+
+// AdvanceExpired advances the index if an instance has passed the instance TTL of its
+// application since the last check, as expiring changes the health of the instance
+// without an event.
+func (i *CatalogIndex) AdvanceExpired(ctx context.Context) error {
+	now := time.Now()
+	services, err := i.registry.FindAll(ctx, models.ServiceFilter{})
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	checkedAt := i.checkedAt
+	i.mu.Unlock()
+
+	policies := make(map[string]models.RegistrationPolicy)
+	expired := false
+	for _, svc := range services {
+		policy, ok := policies[svc.Application]
+		if !ok {
+			policy, err = i.registry.ApplicationPolicy(ctx, svc.Application)
+			if err != nil {
+				return err
+			}
+			policies[svc.Application] = policy
+		}
+
+		if policy.Expired(svc, now) && !policy.Expired(svc, checkedAt) {
+			expired = true
+			break
+		}
+	}
+
+	i.mu.Lock()
+	i.checkedAt = now
+	i.mu.Unlock()
+
+	if !expired {
+		return nil
+	}
+
+	return i.advance(ctx)
+}
+
+// Wait blocks until the index is greater than after, the timeout has passed or ctx is done
+// and returns the current index.
+func (i *CatalogIndex) Wait(ctx context.Context, after uint64, timeout time.Duration) (uint64, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		i.mu.Lock()
+		changed := i.changed
+		i.mu.Unlock()
+
+		index, err := i.Current(ctx)
+		if err != nil || index > after {
+			return index, err
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return index, nil
+		case <-ctx.Done():
+			return index, nil
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package service
+
+import (
+	"net/http"
+
+	"github.com/CzarSimon/httputil"
+)
+
+// PreconditionFailedError creates a 412 - Precondition Failed error.
+func PreconditionFailedError(err error) *httputil.Error {
+	return httputil.NewError(http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed, err)
+}
+
+// UnprocessableEntityError creates a 422 - Unprocessable Entity error.
+func UnprocessableEntityError(err error) *httputil.Error {
+	return httputil.NewError(http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity, err)
+}
@@ -0,0 +1,355 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+// eurekaDeltaRetention how long changed instances are served in deltas, as in Eureka.
+const eurekaDeltaRetention = 3 * time.Minute
+
+// maxEurekaInstanceID longest instance id that fits the id of a service.
+const maxEurekaInstanceID = 50
+
+type eurekaChange struct {
+	action  string
+	service models.Service
+	at      time.Time
+}
+
+// EurekaService serves the registry to Eureka clients. Status overrides and the recent changes
+// served in deltas are kept in memory, so after a restart overrides are lost and clients
+// reconcile through a full fetch.
+type EurekaService struct {
+	registry  *RegistryService
+	mu        sync.Mutex
+	overrides map[string]models.EurekaStatus
+	changes   []eurekaChange
+	version   uint64
+}
+
+// NewEurekaService creates a Eureka service recording the changes made to registered instances.
+func NewEurekaService(registry *RegistryService) *EurekaService {
+	s := &EurekaService{
+		registry:  registry,
+		overrides: make(map[string]models.EurekaStatus),
+		changes:   make([]eurekaChange, 0),
+	}
+	registry.OnEvent(s.record)
+
+	return s
+}
+
+func (s *EurekaService) record(ctx context.Context, event models.Event) error {
+	action := models.EurekaModified
+	switch event.Type {
+	case models.EventServiceRegistered:
+		action = models.EurekaAdded
+	case models.EventServiceDeregistered:
+		action = models.EurekaDeleted
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if action == models.EurekaDeleted {
+		delete(s.overrides, event.Service.ID)
+	}
+	s.addChange(action, *event.Service)
+	return nil
+}
+
+// addChange records a changed instance, the caller must hold the lock.
+func (s *EurekaService) addChange(action string, svc models.Service) {
+	now := time.Now()
+	kept := s.changes[:0]
+	for _, change := range s.changes {
+		if now.Sub(change.at) < eurekaDeltaRetention {
+			kept = append(kept, change)
+		}
+	}
+
+	s.changes = append(kept, eurekaChange{action: action, service: svc, at: now})
+	s.version++
+}
+
+func (s *EurekaService) override(id string) models.EurekaStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.overrides[id]
+}
+
+// Register registers an instance of the app. An instance with an overridden status is registered with that status.
+func (s *EurekaService) Register(ctx context.Context, app string, instance models.EurekaInstance) (models.Service, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "EurekaService.Register")
+	defer span.Finish()
+
+	svc, err := instance.Service(models.EurekaApplicationName(app))
+	if err == nil && len(svc.ID) > maxEurekaInstanceID {
+		err = fmt.Errorf("instance id must be at most %d characters, got %s", maxEurekaInstanceID, svc.ID)
+	}
+	if err != nil {
+		err = httputil.BadRequestError(fmt.Errorf("invalid instance: %w", err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
+	}
+
+	if override := s.override(svc.ID); override != "" {
+		svc.Status = override.ServiceStatus()
+	}
+
+	saved, err := s.registry.Register(ctx, svc)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return saved, nil
+}
+
+// Renew records a heartbeat from an instance of the app.
+func (s *EurekaService) Renew(ctx context.Context, app, id string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "EurekaService.Renew")
+	defer span.Finish()
+
+	svc, err := s.find(ctx, app, id)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return err
+	}
+
+	err = s.registry.Heartbeat(ctx, id, svc.Epoch)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return nil
+}
+
+// Cancel deregisters an instance of the app.
+func (s *EurekaService) Cancel(ctx context.Context, app, id string) (models.Service, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "EurekaService.Cancel")
+	defer span.Finish()
+
+	_, err := s.find(ctx, app, id)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
+	}
+
+	svc, err := s.registry.Deregister(ctx, id, 0)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return svc, nil
+}
+
+// OverrideStatus overrides the status of an instance of the app, e.g. to take it OUT_OF_SERVICE.
+// The override takes precedence over the status the instance registers with until it is removed.
+func (s *EurekaService) OverrideStatus(ctx context.Context, app, id string, status models.EurekaStatus) (models.Service, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "EurekaService.OverrideStatus")
+	defer span.Finish()
+
+	if !status.Valid() {
+		err := httputil.BadRequestError(fmt.Errorf("invalid status %s", status))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
+	}
+
+	saved, err := s.setStatus(ctx, app, id, status, status)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return saved, nil
+}
+
+// RemoveStatusOverride removes the overridden status of an instance of the app and sets its
+// status to the given status, if any.
+func (s *EurekaService) RemoveStatusOverride(ctx context.Context, app, id string, status models.EurekaStatus) (models.Service, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "EurekaService.RemoveStatusOverride")
+	defer span.Finish()
+
+	if status != "" && !status.Valid() {
+		err := httputil.BadRequestError(fmt.Errorf("invalid status %s", status))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
+	}
+
+	saved, err := s.setStatus(ctx, app, id, status, "")
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return saved, nil
+}
+
+// setStatus replaces the override of an instance and sets its status, if given. The change is
+// recorded for deltas even if the status of the service stays the same.
+func (s *EurekaService) setStatus(ctx context.Context, app, id string, status, override models.EurekaStatus) (models.Service, error) {
+	svc, err := s.find(ctx, app, id)
+	if err != nil {
+		return models.Service{}, err
+	}
+
+	s.mu.Lock()
+	if override == "" {
+		delete(s.overrides, id)
+	} else {
+		s.overrides[id] = override
+	}
+	s.mu.Unlock()
+
+	saved := svc
+	if status != "" && status.ServiceStatus() != svc.Status {
+		saved, err = s.registry.SetStatus(ctx, id, status.ServiceStatus(), svc.Epoch, 0)
+		if err != nil {
+			return models.Service{}, err
+		}
+	} else {
+		s.mu.Lock()
+		s.addChange(models.EurekaModified, saved)
+		s.mu.Unlock()
+	}
+
+	return saved, nil
+}
+
+// find looks up an instance of the app.
+func (s *EurekaService) find(ctx context.Context, app, id string) (models.Service, error) {
+	svc, err := s.registry.Find(ctx, id)
+	if err == nil && svc.Application != models.EurekaApplicationName(app) {
+		err = httputil.NotFoundError(fmt.Errorf("service(id=%s) is not an instance of %s", id, app))
+	}
+
+	return svc, err
+}
+
+// Applications lists the instances of every application.
+func (s *EurekaService) Applications(ctx context.Context) (models.EurekaApplications, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "EurekaService.Applications")
+	defer span.Finish()
+
+	instances, err := s.instances(ctx)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.EurekaApplications{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return models.NewEurekaApplications(instances, s.currentVersion(), models.EurekaHashCode(instances)), nil
+}
+
+// Delta lists the instances changed within the last three minutes, along with the hash
+// code of every instance which clients compare with their own after applying the delta.
+func (s *EurekaService) Delta(ctx context.Context) (models.EurekaApplications, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "EurekaService.Delta")
+	defer span.Finish()
+
+	instances, err := s.instances(ctx)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.EurekaApplications{}, err
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	latest := make(map[string]int)
+	changed := make([]models.EurekaInstance, 0)
+	for _, change := range s.changes {
+		if now.Sub(change.at) >= eurekaDeltaRetention {
+			continue
+		}
+
+		instance := models.NewEurekaInstance(change.service, s.overrides[change.service.ID])
+		instance.ActionType = change.action
+		if i, ok := latest[instance.InstanceID]; ok {
+			changed[i] = instance
+			continue
+		}
+		latest[instance.InstanceID] = len(changed)
+		changed = append(changed, instance)
+	}
+	version := s.version
+	s.mu.Unlock()
+
+	span.LogFields(tracelog.Bool("success", true))
+	return models.NewEurekaApplications(changed, version, models.EurekaHashCode(instances)), nil
+}
+
+// Application lists the instances of an application.
+func (s *EurekaService) Application(ctx context.Context, app string) (models.EurekaApplication, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "EurekaService.Application")
+	defer span.Finish()
+
+	services, err := s.registry.FindApplicationServices(ctx, models.EurekaApplicationName(app), models.ServiceQuery{})
+	if err == nil && len(services) == 0 {
+		err = httputil.NotFoundError(fmt.Errorf("application %s has no instances", app))
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.EurekaApplication{}, err
+	}
+
+	apps := models.NewEurekaApplications(s.toInstances(services), 0, "")
+	span.LogFields(tracelog.Bool("success", true))
+	return apps.Applications[0], nil
+}
+
+// Instance looks up an instance of an application.
+func (s *EurekaService) Instance(ctx context.Context, app, id string) (models.EurekaInstance, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "EurekaService.Instance")
+	defer span.Finish()
+
+	svc, err := s.find(ctx, app, id)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.EurekaInstance{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return models.NewEurekaInstance(svc, s.override(id)), nil
+}
+
+func (s *EurekaService) instances(ctx context.Context) ([]models.EurekaInstance, error) {
+	services, err := s.registry.FindAll(ctx, models.ServiceFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.toInstances(services), nil
+}
+
+func (s *EurekaService) toInstances(services []models.Service) []models.EurekaInstance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	instances := make([]models.EurekaInstance, 0, len(services))
+	for _, svc := range services {
+		instances = append(instances, models.NewEurekaInstance(svc, s.overrides[svc.ID]))
+	}
+
+	return instances
+}
+
+func (s *EurekaService) currentVersion() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+	"go.uber.org/zap"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+)
+
+// KubernetesSync mirrors the endpoints of annotated Kubernetes services into the registry.
+type KubernetesSync struct {
+	services  corelisters.ServiceLister
+	slices    discoverylisters.EndpointSliceLister
+	registry  *RegistryService
+	namespace string
+	cluster   string
+}
+
+// NewKubernetesSync creates a sync of the services in the namespace, or every namespace if
+// empty, of the named cluster. Services and endpoint slices are read from informer caches,
+// which must have synced before the first sync or every mirrored instance is deregistered.
+// Only instances mirrored from the same cluster and namespace are removed, so several
+// clusters can be mirrored into the same registry.
+func NewKubernetesSync(services corelisters.ServiceLister, slices discoverylisters.EndpointSliceLister, registry *RegistryService, namespace, cluster string) *KubernetesSync {
+	return &KubernetesSync{
+		services:  services,
+		slices:    slices,
+		registry:  registry,
+		namespace: namespace,
+		cluster:   cluster,
+	}
+}
+
+// Sync registers the current endpoints of annotated services, records heartbeats for endpoints
+// that have not changed and deregisters instances whose endpoints have disappeared. Failures
+// to sync an instance are logged and do not stop the sync of the other instances.
+func (s *KubernetesSync) Sync(ctx context.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "KubernetesSync.Sync")
+	defer span.Finish()
+
+	desired, err := s.findEndpoints()
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return err
+	}
+
+	filter := models.ServiceFilter{Labels: map[string]string{
+		models.SourceLabel:            models.SourceKubernetes,
+		models.KubernetesClusterLabel: s.cluster,
+	}}
+	if s.namespace != "" {
+		filter.Labels[models.KubernetesNamespaceLabel] = s.namespace
+	}
+	mirrored, err := s.registry.FindAll(ctx, filter)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return err
+	}
+
+	existing := make(map[string]models.Service, len(mirrored))
+	for _, svc := range mirrored {
+		existing[svc.ID] = svc
+	}
+
+	failed := 0
+	for _, svc := range desired {
+		current, ok := existing[svc.ID]
+		delete(existing, svc.ID)
+		if ok && sameRegistration(current, svc) {
+			err = s.registry.Heartbeat(ctx, svc.ID, current.Epoch)
+		} else {
+			_, err = s.registry.Register(ctx, svc)
+		}
+		if err != nil {
+			failed++
+			log.Error("failed to sync kubernetes endpoint", zap.String("serviceId", svc.ID), zap.String("application", svc.Application), zap.Error(err))
+		}
+	}
+
+	for id, svc := range existing {
+		_, err = s.registry.Deregister(ctx, id, 0)
+		if err != nil {
+			failed++
+			log.Error("failed to deregister removed kubernetes endpoint", zap.String("serviceId", id), zap.String("application", svc.Application), zap.Error(err))
+		}
+	}
+
+	if failed > 0 {
+		err = fmt.Errorf("failed to sync %d kubernetes endpoints", failed)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return nil
+}
+
+// findEndpoints lists the endpoints of every annotated service as instances.
+func (s *KubernetesSync) findEndpoints() ([]models.Service, error) {
+	services, err := s.services.Services(s.namespace).List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list kubernetes services. %w", err)
+	}
+
+	endpoints := make([]models.Service, 0)
+	for _, svc := range services {
+		application, ok := models.KubernetesApplication(*svc)
+		if !ok {
+			continue
+		}
+
+		selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: svc.Name})
+		cached, err := s.slices.EndpointSlices(svc.Namespace).List(selector)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list endpoint slices of kubernetes service %s/%s. %w", svc.Namespace, svc.Name, err)
+		}
+
+		slices := make([]discoveryv1.EndpointSlice, 0, len(cached))
+		for _, slice := range cached {
+			slices = append(slices, *slice)
+		}
+		endpoints = append(endpoints, models.NewKubernetesServices(s.cluster, application, *svc, slices)...)
+	}
+
+	return endpoints, nil
+}
+
+// sameRegistration checks if registering svc would leave the registered instance unchanged.
+func sameRegistration(registered, svc models.Service) bool {
+	return registered.Application == svc.Application &&
+		registered.Location == svc.Location &&
+		registered.Port == svc.Port &&
+		registered.Status == svc.Status &&
+		registered.Zone == svc.Zone &&
+		reflect.DeepEqual(registered.Labels, svc.Labels) &&
+		reflect.DeepEqual(registered.Ports, svc.Ports)
+}
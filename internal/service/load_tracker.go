@@ -0,0 +1,59 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+// loadPruneInterval how often reports that are no longer fresh are dropped.
+const loadPruneInterval = time.Minute
+
+// loadTracker keeps the latest load report of each instance in memory.
+type loadTracker struct {
+	mu         sync.RWMutex
+	reports    map[string]models.LoadReport
+	lastPruned time.Time
+}
+
+func newLoadTracker() *loadTracker {
+	return &loadTracker{
+		reports:    make(map[string]models.LoadReport),
+		lastPruned: time.Now(),
+	}
+}
+
+// record stores the report of an instance, dropping reports of other instances that are no longer
+// fresh at most once per loadPruneInterval so that removed instances do not accumulate.
+func (t *loadTracker) record(id string, report models.LoadReport, fresh func(models.LoadReport) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.reports[id] = report
+	if report.ReportedAt.Sub(t.lastPruned) < loadPruneInterval {
+		return
+	}
+
+	for other, r := range t.reports {
+		if !fresh(r) {
+			delete(t.reports, other)
+		}
+	}
+	t.lastPruned = report.ReportedAt
+}
+
+func (t *loadTracker) find(id string) (models.LoadReport, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	report, ok := t.reports[id]
+	return report, ok
+}
+
+func (t *loadTracker) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.reports, id)
+}
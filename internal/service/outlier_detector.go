@@ -0,0 +1,204 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rtcheap/service-registry/internal/models"
+	"go.uber.org/zap"
+)
+
+// outlierBuckets number of buckets the sliding window of reported calls is split into.
+const outlierBuckets = 10
+
+// outlierPruneInterval how often instances without recent reports or ejections are dropped.
+const outlierPruneInterval = time.Minute
+
+type callBucket struct {
+	start time.Time
+	calls models.CallReport
+}
+
+type outlierState struct {
+	application  string
+	buckets      []callBucket
+	ejections    int
+	ejectedUntil time.Time
+}
+
+// slide drops the buckets that are no longer within the window.
+func (s *outlierState) slide(window time.Duration, now time.Time) {
+	i := 0
+	for i < len(s.buckets) && now.Sub(s.buckets[i].start) >= window {
+		i++
+	}
+	s.buckets = s.buckets[i:]
+}
+
+func (s *outlierState) add(calls models.CallReport, window time.Duration, now time.Time) {
+	last := len(s.buckets) - 1
+	if last >= 0 && now.Sub(s.buckets[last].start) < window/outlierBuckets {
+		s.buckets[last].calls.Successes += calls.Successes
+		s.buckets[last].calls.Failures += calls.Failures
+		return
+	}
+
+	s.buckets = append(s.buckets, callBucket{start: now, calls: calls})
+}
+
+func (s *outlierState) calls() models.CallReport {
+	var total models.CallReport
+	for _, bucket := range s.buckets {
+		total.Successes += bucket.calls.Successes
+		total.Failures += bucket.calls.Failures
+	}
+
+	return total
+}
+
+func (s *outlierState) ejected(now time.Time) bool {
+	return now.Before(s.ejectedUntil)
+}
+
+func (s *outlierState) status(id string, now time.Time) models.OutlierStatus {
+	calls := s.calls()
+	status := models.OutlierStatus{
+		ServiceID:  id,
+		Calls:      calls,
+		ErrorRatio: calls.ErrorRatio(),
+		Ejections:  s.ejections,
+	}
+	if s.ejected(now) {
+		until := s.ejectedUntil
+		status.EjectedUntil = &until
+	}
+
+	return status
+}
+
+// outlierDetector aggregates the calls reported against instances in memory and
+// ejects the instances failing too many of them.
+type outlierDetector struct {
+	mu         sync.Mutex
+	states     map[string]*outlierState
+	lastPruned time.Time
+}
+
+func newOutlierDetector() *outlierDetector {
+	return &outlierDetector{
+		states:     make(map[string]*outlierState),
+		lastPruned: time.Now(),
+	}
+}
+
+// record adds calls reported against an instance of an application with the given number of
+// instances and ejects the instance if its error ratio within the window exceeds the threshold,
+// unless that would eject more instances of the application than the policy allows.
+// Consecutive ejections back off exponentially, the count is reset once an instance has
+// stayed in rotation for the max ejection time.
+func (d *outlierDetector) record(id, application string, instances int, calls models.CallReport, policy models.OutlierPolicy, now time.Time) models.OutlierStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.prune(policy, now)
+	state, ok := d.states[id]
+	if !ok {
+		state = &outlierState{application: application}
+		d.states[id] = state
+	}
+
+	state.slide(policy.Window, now)
+	state.add(calls, policy.Window, now)
+	if !policy.Enabled() || state.ejected(now) {
+		return state.status(id, now)
+	}
+
+	if state.ejections > 0 && now.Sub(state.ejectedUntil) >= policy.MaxEjectionTime {
+		state.ejections = 0
+	}
+
+	total := state.calls()
+	if total.Total() < policy.MinRequests || total.ErrorRatio() <= policy.ErrorThreshold {
+		return state.status(id, now)
+	}
+
+	ejected := d.ejectedInstances(application, now)
+	if ejected >= policy.MaxEjected(instances) {
+		log.Info("outlier not ejected, max ejection percent reached",
+			zap.String("serviceId", id),
+			zap.String("application", application),
+			zap.Int("ejected", ejected))
+		return state.status(id, now)
+	}
+
+	state.ejections++
+	state.ejectedUntil = now.Add(policy.EjectionTime(state.ejections))
+	state.buckets = nil
+	log.Info("ejected outlier",
+		zap.String("serviceId", id),
+		zap.String("application", application),
+		zap.Float64("errorRatio", total.ErrorRatio()),
+		zap.Time("ejectedUntil", state.ejectedUntil))
+
+	return state.status(id, now)
+}
+
+func (d *outlierDetector) ejectedInstances(application string, now time.Time) int {
+	count := 0
+	for _, state := range d.states {
+		if state.application == application && state.ejected(now) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// prune drops instances without calls in the window whose ejection count has been reset,
+// at most once per outlierPruneInterval so that removed instances do not accumulate.
+func (d *outlierDetector) prune(policy models.OutlierPolicy, now time.Time) {
+	if now.Sub(d.lastPruned) < outlierPruneInterval {
+		return
+	}
+
+	for id, state := range d.states {
+		state.slide(policy.Window, now)
+		if len(state.buckets) == 0 && now.Sub(state.ejectedUntil) >= policy.MaxEjectionTime {
+			delete(d.states, id)
+		}
+	}
+	d.lastPruned = now
+}
+
+// ejectedUntil returns when the ejection of an instance ends, if it is ejected.
+func (d *outlierDetector) ejectedUntil(id string, now time.Time) (time.Time, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.states[id]
+	if !ok || !state.ejected(now) {
+		return time.Time{}, false
+	}
+
+	return state.ejectedUntil, true
+}
+
+func (d *outlierDetector) find(id string, window time.Duration, now time.Time) models.OutlierStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.states[id]
+	if !ok {
+		return models.OutlierStatus{ServiceID: id}
+	}
+
+	state.slide(window, now)
+	return state.status(id, now)
+}
+
+func (d *outlierDetector) remove(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.states, id)
+}
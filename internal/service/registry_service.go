@@ -3,49 +3,179 @@ package service
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/CzarSimon/httputil"
 	"github.com/CzarSimon/httputil/id"
-	"github.com/CzarSimon/httputil/logger"
 	"github.com/opentracing/opentracing-go"
 	tracelog "github.com/opentracing/opentracing-go/log"
 	"github.com/rtcheap/dto"
+	"github.com/rtcheap/service-registry/internal/logging"
+	"github.com/rtcheap/service-registry/internal/models"
 	"github.com/rtcheap/service-registry/internal/repository"
 	"go.uber.org/zap"
 )
 
-var log = logger.GetDefaultLogger("service-registry/service")
+var log = logging.GetLogger("service-registry/service")
+
+// maxPort highest valid port number.
+const maxPort = 65535
+
+// maxWriteAttempts number of times an unconditional update is retried on concurrent modification.
+const maxWriteAttempts = 3
+
+// UnavailableListener is notified after an instance is drained (marked unhealthy) or deregistered.
+type UnavailableListener func(ctx context.Context, svc models.Service)
+
+// EventListener is notified after an instance is registered, changes status or is deregistered.
+// A returned error fails the call that made the change, which has already been saved.
+type EventListener func(ctx context.Context, event models.Event) error
 
 // RegistryService service registry.
 type RegistryService struct {
-	repo repository.ServiceRepository
+	repo      repository.ServiceRepository
+	apps      repository.ApplicationRepository
+	loads     *loadTracker
+	outliers  *outlierDetector
+	mu        sync.RWMutex
+	policy    models.RegistrationPolicy
+	detection models.OutlierPolicy
+	listeners []UnavailableListener
+	observers []EventListener
 }
 
 // NewRegistryService sets up and creates a new service repository.
-func NewRegistryService(repo repository.ServiceRepository) *RegistryService {
+// Conflicting registrations take over by default.
+func NewRegistryService(repo repository.ServiceRepository, apps repository.ApplicationRepository) *RegistryService {
 	return &RegistryService{
-		repo: repo,
+		repo:     repo,
+		apps:     apps,
+		loads:    newLoadTracker(),
+		outliers: newOutlierDetector(),
+		policy: models.RegistrationPolicy{
+			ConflictPolicy: models.ConflictTakeover,
+		},
+		detection: models.DefaultOutlierPolicy(),
+	}
+}
+
+// SetPolicy replaces the registration policy.
+func (s *RegistryService) SetPolicy(policy models.RegistrationPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = policy
+}
+
+// Policy returns the current registration policy.
+func (s *RegistryService) Policy() models.RegistrationPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.policy
+}
+
+// SetOutlierPolicy replaces the policy for ejecting instances callers report as failing.
+func (s *RegistryService) SetOutlierPolicy(policy models.OutlierPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.detection = policy
+}
+
+// OutlierPolicy returns the current outlier policy.
+func (s *RegistryService) OutlierPolicy() models.OutlierPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.detection
+}
+
+// OnUnavailable adds a listener notified after an instance is drained or deregistered.
+func (s *RegistryService) OnUnavailable(listener UnavailableListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+func (s *RegistryService) notifyUnavailable(ctx context.Context, svc models.Service) {
+	s.mu.RLock()
+	listeners := s.listeners
+	s.mu.RUnlock()
+
+	for _, listener := range listeners {
+		listener(ctx, svc)
 	}
 }
 
-// Register saves information about a service.
-func (s *RegistryService) Register(ctx context.Context, svc dto.Service) (dto.Service, error) {
+// OnEvent adds a listener notified of changes to registered instances.
+func (s *RegistryService) OnEvent(listener EventListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observers = append(s.observers, listener)
+}
+
+// publish notifies every observer of an event, returning the first error of an observer.
+func (s *RegistryService) publish(ctx context.Context, eventType models.EventType, svc models.Service) error {
+	s.mu.RLock()
+	observers := s.observers
+	s.mu.RUnlock()
+
+	event := models.Event{
+		ID:          id.New(),
+		Type:        eventType,
+		Application: svc.Application,
+		Service:     &svc,
+		OccurredAt:  time.Now().UTC(),
+	}
+
+	var firstErr error
+	for _, observer := range observers {
+		err := observer(ctx, event)
+		if err != nil && firstErr == nil {
+			firstErr = httputil.InternalServerError(fmt.Errorf("failed to publish event(id=%s, type=%s) of service(id=%s). %w", event.ID, eventType, svc.ID, err))
+		}
+	}
+
+	return firstErr
+}
+
+// Register saves information about a service. A registration without an id reuses the id of the
+// service on the same location and port, otherwise the conflict policy of the application
+// decides if the registration may replace a service with another id on the location and port.
+func (s *RegistryService) Register(ctx context.Context, svc models.Service) (models.Service, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "RegistryService.Register")
 	defer span.Finish()
 
-	if svc.ID == "" {
-		svc.ID = id.New()
+	svc, err := prepareRegistration(svc)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
 	}
-	if svc.Status == "" {
-		svc.Status = dto.StatusHealty
+
+	policy, err := s.registrationPolicy(ctx, svc.Application)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
 	}
 
-	saved, err := s.repo.Save(ctx, svc)
+	policies := map[string]models.RegistrationPolicy{svc.Application: policy}
+	saved, replaced, err := s.repo.Save(ctx, svc, conflictResolver(policies))
 	if err != nil {
-		err = httputil.InternalServerError(err)
+		err = registrationError(err)
 		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
-		return dto.Service{}, err
+		return models.Service{}, err
+	}
+
+	if replaced.ID != "" {
+		err = s.deregistered(ctx, replaced)
+	}
+	if err == nil {
+		err = s.publish(ctx, models.EventServiceRegistered, saved)
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
 	}
 
 	log.Debug("registered service", zap.Any("service", saved))
@@ -53,8 +183,204 @@ func (s *RegistryService) Register(ctx context.Context, svc dto.Service) (dto.Se
 	return saved, nil
 }
 
+// RegisterAll registers services in a single transaction, reporting the outcome of each registration.
+// A failed registration does not prevent the other services from being registered.
+func (s *RegistryService) RegisterAll(ctx context.Context, services []models.Service) ([]models.BatchResult, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RegistryService.RegisterAll")
+	defer span.Finish()
+
+	results := make([]models.BatchResult, len(services))
+	policies := make(map[string]models.RegistrationPolicy)
+	refused := make(map[string]error)
+	indexes := make([]int, 0, len(services))
+	prepared := make([]models.Service, 0, len(services))
+	for i, svc := range services {
+		svc, err := prepareRegistration(svc)
+		if err != nil {
+			results[i] = batchResult(i, models.Service{}, err)
+			continue
+		}
+
+		_, seen := policies[svc.Application]
+		if !seen && refused[svc.Application] == nil {
+			policy, err := s.registrationPolicy(ctx, svc.Application)
+			var httpErr *httputil.Error
+			if errors.As(err, &httpErr) && httpErr.Status < http.StatusInternalServerError {
+				refused[svc.Application] = err
+			} else if err != nil {
+				span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+				return nil, err
+			} else {
+				policies[svc.Application] = policy
+			}
+		}
+
+		if refused[svc.Application] != nil {
+			results[i] = batchResult(i, models.Service{}, refused[svc.Application])
+			continue
+		}
+
+		indexes = append(indexes, i)
+		prepared = append(prepared, svc)
+	}
+
+	saved, replaced, errs, err := s.repo.SaveAll(ctx, prepared, conflictResolver(policies))
+	if err != nil {
+		err = httputil.InternalServerError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return nil, err
+	}
+
+	for j, svc := range saved {
+		i := indexes[j]
+		if errs[j] != nil {
+			results[i] = batchResult(i, svc, registrationError(errs[j]))
+			continue
+		}
+
+		var err error
+		if replaced[j].ID != "" {
+			err = s.deregistered(ctx, replaced[j])
+		}
+		if err == nil {
+			err = s.publish(ctx, models.EventServiceRegistered, svc)
+		}
+		results[i] = batchResult(i, svc, err)
+	}
+
+	log.Debug("registered services", zap.Int("count", len(services)))
+	span.LogFields(tracelog.Bool("success", true))
+	return results, nil
+}
+
+// SetApplicationStatus sets the status of every instance of an application matching the filter
+// in a single transaction. Unlike SetStatus the update is not fenced by the epoch of the instances.
+func (s *RegistryService) SetApplicationStatus(ctx context.Context, application string, update models.ApplicationStatusUpdate) ([]models.BatchResult, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RegistryService.SetApplicationStatus")
+	defer span.Finish()
+
+	if update.Status != dto.StatusHealty && update.Status != dto.StatusUnhealthy {
+		err := httputil.BadRequestError(fmt.Errorf("invalid status %s", update.Status))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return nil, err
+	}
+
+	updated, errs, err := s.repo.UpdateStatuses(ctx, application, update.ServiceFilter, update.Status)
+	if err != nil {
+		err = httputil.InternalServerError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return nil, err
+	}
+
+	results := make([]models.BatchResult, len(updated))
+	for i, svc := range updated {
+		var err error
+		if errs[i] != nil {
+			err = httputil.InternalServerError(errs[i])
+		}
+		if err == nil {
+			err = s.publish(ctx, models.EventServiceStatusChanged, svc)
+		}
+		results[i] = batchResult(i, svc, err)
+		if errs[i] != nil {
+			continue
+		}
+
+		if svc.Status != dto.StatusHealty {
+			s.notifyUnavailable(ctx, svc)
+		}
+	}
+
+	log.Info("set application status",
+		zap.String("application", application),
+		zap.String("status", string(update.Status)),
+		zap.Int("count", len(results)))
+	span.LogFields(tracelog.Bool("success", true))
+	return results, nil
+}
+
+// prepareRegistration resets the registry managed fields of a registration, applies defaults
+// and validates the named ports. Port defaults to the first named port if not set.
+func prepareRegistration(svc models.Service) (models.Service, error) {
+	svc.Version = 0
+	if svc.Status == "" {
+		svc.Status = dto.StatusHealty
+	}
+
+	err := validatePorts(svc.Ports)
+	if err != nil {
+		return models.Service{}, httputil.BadRequestError(err)
+	}
+
+	if svc.Port == 0 && len(svc.Ports) > 0 {
+		svc.Port = svc.Ports[0].Port
+	}
+
+	return svc, nil
+}
+
+func validatePorts(ports []models.ServicePort) error {
+	names := make(map[string]bool, len(ports))
+	for _, p := range ports {
+		if p.Name == "" {
+			return errors.New("port name is required")
+		} else if names[p.Name] {
+			return fmt.Errorf("duplicate port name %s", p.Name)
+		} else if !p.Protocol.Valid() {
+			return fmt.Errorf("invalid protocol %s for port %s", p.Protocol, p.Name)
+		} else if p.Port < 1 || p.Port > maxPort {
+			return fmt.Errorf("port %s must be between 1 and %d, got %d", p.Name, maxPort, p.Port)
+		} else if p.EndPort != 0 && (p.EndPort <= p.Port || p.EndPort > maxPort) {
+			return fmt.Errorf("end of port range %s must be between %d and %d, got %d", p.Name, p.Port+1, maxPort, p.EndPort)
+		}
+
+		names[p.Name] = true
+	}
+
+	return nil
+}
+
+func registrationError(err error) error {
+	if err == nil {
+		return nil
+	} else if errors.Is(err, repository.ErrRegistrationConflict) {
+		return httputil.ConflictError(err)
+	}
+
+	return httputil.InternalServerError(err)
+}
+
+// batchResult creates the result of a batch item from the outcome of the operation.
+// The cause of an error is only exposed for client errors.
+func batchResult(index int, svc models.Service, err error) models.BatchResult {
+	if err == nil {
+		return models.BatchResult{
+			Index:   index,
+			Status:  http.StatusOK,
+			Service: &svc,
+		}
+	}
+
+	result := models.BatchResult{
+		Index:  index,
+		Status: http.StatusInternalServerError,
+		Error:  http.StatusText(http.StatusInternalServerError),
+	}
+
+	var httpErr *httputil.Error
+	if errors.As(err, &httpErr) {
+		result.Status = httpErr.Status
+		result.Error = httpErr.Message
+		if httpErr.Status < http.StatusInternalServerError && httpErr.Err != nil {
+			result.Error = httpErr.Err.Error()
+		}
+	}
+
+	return result
+}
+
 // Find looks up and and returns service with the given id.
-func (s *RegistryService) Find(ctx context.Context, id string) (dto.Service, error) {
+func (s *RegistryService) Find(ctx context.Context, id string) (models.Service, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "RegistryService.Find")
 	defer span.Finish()
 
@@ -65,31 +391,98 @@ func (s *RegistryService) Find(ctx context.Context, id string) (dto.Service, err
 		if notFound {
 			err = httputil.NotFoundError(err)
 		}
-		return dto.Service{}, err
+		return models.Service{}, err
 	}
 
 	span.LogFields(tracelog.Bool("success", true))
 	return svc, nil
 }
 
-// SetStatus records the status of a given service.
-func (s *RegistryService) SetStatus(ctx context.Context, id string, status dto.ServiceStatus) error {
+// SetStatus records the status of a given service reported by the instance holding epoch.
+// If expectedVersion is non zero the status is only changed if the service is still at that version.
+// Listeners of unavailable instances are only notified when the status moves away from healthy.
+func (s *RegistryService) SetStatus(ctx context.Context, id string, status dto.ServiceStatus, epoch, expectedVersion int64) (models.Service, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "RegistryService.SetStatus")
 	defer span.Finish()
 
-	svc, err := s.repo.Find(ctx, id)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			err = httputil.PreconditionRequiredError(err)
+	if epoch == 0 {
+		err := httputil.PreconditionRequiredError(fmt.Errorf("epoch is required to update the status of service(id=%s)", id))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		svc, err := s.repo.Find(ctx, id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				err = httputil.PreconditionRequiredError(err)
+			}
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			return models.Service{}, err
+		}
+
+		err = checkVersion(svc, expectedVersion)
+		if err != nil {
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			return models.Service{}, err
+		}
+
+		previous := svc.Status
+		svc.Status = status
+		svc.Epoch = epoch
+		saved, err := s.repo.Update(ctx, svc)
+		if errors.Is(err, repository.ErrEpochMismatch) {
+			err = httputil.ConflictError(err)
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			return models.Service{}, err
+		} else if err == repository.ErrVersionConflict && expectedVersion == 0 && attempt < maxWriteAttempts {
+			continue
+		} else if err == repository.ErrVersionConflict {
+			err = PreconditionFailedError(err)
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			return models.Service{}, err
+		} else if err != nil {
+			err := fmt.Errorf("failed to save status update for service(id=%s). %w", id, err)
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			return models.Service{}, err
 		}
+
+		if previous == dto.StatusHealty && saved.Status != dto.StatusHealty {
+			s.notifyUnavailable(ctx, saved)
+		}
+		if saved.Status != previous {
+			err = s.publish(ctx, models.EventServiceStatusChanged, saved)
+		}
+		if err != nil {
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			return models.Service{}, err
+		}
+
+		span.LogFields(tracelog.Bool("success", true))
+		return saved, nil
+	}
+}
+
+// Heartbeat records that the instance holding epoch is alive.
+func (s *RegistryService) Heartbeat(ctx context.Context, id string, epoch int64) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RegistryService.Heartbeat")
+	defer span.Finish()
+
+	if epoch == 0 {
+		err := httputil.PreconditionRequiredError(fmt.Errorf("epoch is required for heartbeats from service(id=%s)", id))
 		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
 		return err
 	}
 
-	svc.Status = status
-	_, err = s.repo.Save(ctx, svc)
+	err := s.repo.Heartbeat(ctx, id, epoch)
+	if err == sql.ErrNoRows {
+		err = httputil.NotFoundError(err)
+	} else if errors.Is(err, repository.ErrEpochMismatch) {
+		err = httputil.ConflictError(err)
+	} else if err != nil {
+		err = fmt.Errorf("failed to record heartbeat for service(id=%s). %w", id, err)
+	}
 	if err != nil {
-		err := fmt.Errorf("failed to save status update for service(id=%s). %w", id, err)
 		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
 		return err
 	}
@@ -98,8 +491,181 @@ func (s *RegistryService) SetStatus(ctx context.Context, id string, status dto.S
 	return nil
 }
 
-// FindApplicationServices looks up all serices for an application.
-func (s *RegistryService) FindApplicationServices(ctx context.Context, application string, onlyHealthy bool) ([]dto.Service, error) {
+// ReportLoad records the load reported by the instance holding epoch. Reports are kept in
+// memory and used to rank instances until they are older than the load report TTL.
+func (s *RegistryService) ReportLoad(ctx context.Context, id string, epoch int64, report models.LoadReport) (models.LoadReport, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RegistryService.ReportLoad")
+	defer span.Finish()
+
+	if epoch == 0 {
+		err := httputil.PreconditionRequiredError(fmt.Errorf("epoch is required for load reports from service(id=%s)", id))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.LoadReport{}, err
+	}
+
+	if report.CPU < 0 || report.CPU > 1 || report.ActiveConnections < 0 || report.Gauge < 0 {
+		err := httputil.BadRequestError(fmt.Errorf("cpu must be between 0 and 1, activeConnections and gauge must not be negative. got %+v", report))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.LoadReport{}, err
+	}
+
+	svc, err := s.Find(ctx, id)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.LoadReport{}, err
+	}
+
+	if svc.Epoch != epoch {
+		err = httputil.ConflictError(fmt.Errorf("%w. service(id=%s) is at epoch %d", repository.ErrEpochMismatch, id, svc.Epoch))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.LoadReport{}, err
+	}
+
+	policy := s.Policy()
+	report.ReportedAt = time.Now().UTC()
+	s.loads.record(id, report, func(r models.LoadReport) bool {
+		return policy.LoadFresh(r, report.ReportedAt)
+	})
+
+	span.LogFields(tracelog.Bool("success", true))
+	return report, nil
+}
+
+// ReportCalls records the outcome of calls made to an instance. Instances failing too many of
+// the calls reported within the outlier window are temporarily left out of healthy results.
+func (s *RegistryService) ReportCalls(ctx context.Context, report models.CallReport) (models.OutlierStatus, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RegistryService.ReportCalls")
+	defer span.Finish()
+
+	if report.Successes < 0 || report.Failures < 0 || report.Total() == 0 {
+		err := httputil.BadRequestError(fmt.Errorf("successes and failures must not be negative and at least one call must be reported. got %+v", report))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.OutlierStatus{}, err
+	}
+
+	svc, err := s.Find(ctx, report.ServiceID)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.OutlierStatus{}, err
+	}
+
+	instances, err := s.repo.FindByApplication(ctx, svc.Application)
+	if err != nil {
+		err = fmt.Errorf("failed to query database for application=%s. %w", svc.Application, err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.OutlierStatus{}, err
+	}
+
+	report.ServiceID = ""
+	status := s.outliers.record(svc.ID, svc.Application, len(instances), report, s.OutlierPolicy(), time.Now().UTC())
+	span.LogFields(tracelog.Bool("success", true))
+	return status, nil
+}
+
+// FindOutlierStatus returns the calls reported against an instance within the outlier window
+// and whether it is ejected.
+func (s *RegistryService) FindOutlierStatus(ctx context.Context, id string) (models.OutlierStatus, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RegistryService.FindOutlierStatus")
+	defer span.Finish()
+
+	_, err := s.Find(ctx, id)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.OutlierStatus{}, err
+	}
+
+	status := s.outliers.find(id, s.OutlierPolicy().Window, time.Now().UTC())
+	span.LogFields(tracelog.Bool("success", true))
+	return status, nil
+}
+
+// FindExisting looks up the registered service that a registration of svc would replace,
+// matching on id or location and port. Returns an empty service if none exists.
+func (s *RegistryService) FindExisting(ctx context.Context, svc models.Service) (models.Service, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RegistryService.FindExisting")
+	defer span.Finish()
+
+	if svc.ID != "" {
+		existing, err := s.repo.Find(ctx, svc.ID)
+		if err == nil {
+			span.LogFields(tracelog.Bool("success", true))
+			return existing, nil
+		} else if err != sql.ErrNoRows {
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			return models.Service{}, httputil.InternalServerError(err)
+		}
+	}
+
+	existing, err := s.repo.FindByLocation(ctx, svc.Location, svc.Port)
+	if err != nil && err != sql.ErrNoRows {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, httputil.InternalServerError(err)
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return existing, nil
+}
+
+// Deregister removes the service with the given id and returns the removed service.
+// If expectedVersion is non zero the service is only removed if it is still at that version.
+func (s *RegistryService) Deregister(ctx context.Context, id string, expectedVersion int64) (models.Service, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RegistryService.Deregister")
+	defer span.Finish()
+
+	svc, err := s.Find(ctx, id)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
+	}
+
+	err = checkVersion(svc, expectedVersion)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
+	}
+
+	err = s.repo.Delete(ctx, id, expectedVersion)
+	if err == sql.ErrNoRows {
+		err = httputil.NotFoundError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
+	} else if err == repository.ErrVersionConflict {
+		err = PreconditionFailedError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
+	} else if err != nil {
+		err = fmt.Errorf("failed to deregister service(id=%s). %w", id, err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
+	}
+
+	err = s.deregistered(ctx, svc)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Service{}, err
+	}
+
+	log.Debug("deregistered service", zap.Any("service", svc))
+	span.LogFields(tracelog.Bool("success", true))
+	return svc, nil
+}
+
+// deregistered forgets the load and outlier state of a removed service and notifies listeners,
+// whether it was deregistered or taken over by a registration on its location and port.
+func (s *RegistryService) deregistered(ctx context.Context, svc models.Service) error {
+	s.loads.remove(svc.ID)
+	s.outliers.remove(svc.ID)
+	s.notifyUnavailable(ctx, svc)
+	return s.publish(ctx, models.EventServiceDeregistered, svc)
+}
+
+// FindApplicationServices looks up the services of an application matching the query filter. If
+// the filter selects a named port, Port is set to that port for clients unaware of named ports.
+// Fresh load reports are attached to the services, which are weighted and ordered by them.
+// Services close to the caller come first, or are the only ones returned if enough are healthy.
+// Instances ejected as outliers or past the instance TTL of the application are left out of
+// healthy results.
+func (s *RegistryService) FindApplicationServices(ctx context.Context, application string, query models.ServiceQuery) ([]models.Service, error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "RegistryService.FindApplicationServices")
 	defer span.Finish()
 
@@ -110,18 +676,146 @@ func (s *RegistryService) FindApplicationServices(ctx context.Context, applicati
 		return nil, err
 	}
 
-	if !onlyHealthy {
-		span.LogFields(tracelog.Bool("success", true))
-		return services, nil
+	_, policy, err := s.applicationPolicy(ctx, application)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return nil, err
 	}
 
-	healthyServices := make([]dto.Service, 0, len(services))
+	now := time.Now()
+	matching := make([]models.Service, 0, len(services))
 	for _, svc := range services {
-		if svc.Status == dto.StatusHealty {
-			healthyServices = append(healthyServices, svc)
+		if query.OnlyHealthy && !policy.Available(svc, now) {
+			continue
 		}
+		if !query.Filter.Matches(svc) {
+			continue
+		}
+
+		ejectedUntil, ejected := s.outliers.ejectedUntil(svc.ID, now)
+		if ejected && query.OnlyHealthy {
+			continue
+		} else if ejected {
+			svc.EjectedUntil = &ejectedUntil
+		}
+
+		report, ok := s.loads.find(svc.ID)
+		if ok && policy.LoadFresh(report, now) {
+			svc.Load = &report
+		}
+		matching = append(matching, query.Filter.SelectPort(svc))
 	}
 
+	matching = query.Locality.Select(matching)
+	query.Order.Apply(matching)
+	query.Locality.Sort(matching)
+
 	span.LogFields(tracelog.Bool("success", true))
-	return healthyServices, nil
+	return matching, nil
+}
+
+// FindAll looks up the services of every application matching the filter, ordered by application.
+// If the filter selects a named port, Port is set to that port.
+func (s *RegistryService) FindAll(ctx context.Context, filter models.ServiceFilter) ([]models.Service, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RegistryService.FindAll")
+	defer span.Finish()
+
+	services, err := s.repo.FindAll(ctx)
+	if err != nil {
+		err := fmt.Errorf("failed to query database. %w", err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return nil, err
+	}
+
+	now := time.Now()
+	matching := make([]models.Service, 0, len(services))
+	for _, svc := range services {
+		if !filter.Matches(svc) {
+			continue
+		}
+
+		ejectedUntil, ejected := s.outliers.ejectedUntil(svc.ID, now)
+		if ejected {
+			svc.EjectedUntil = &ejectedUntil
+		}
+		matching = append(matching, filter.SelectPort(svc))
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return matching, nil
+}
+
+// ApplicationPolicy returns the registration policy with the defaults declared
+// for the application in the catalog applied, if it is declared.
+func (s *RegistryService) ApplicationPolicy(ctx context.Context, application string) (models.RegistrationPolicy, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RegistryService.ApplicationPolicy")
+	defer span.Finish()
+
+	_, policy, err := s.applicationPolicy(ctx, application)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.RegistrationPolicy{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return policy, nil
+}
+
+// registrationPolicy returns the registration policy of an application with the defaults
+// declared in the catalog applied. Refuses applications missing from the catalog if required.
+func (s *RegistryService) registrationPolicy(ctx context.Context, application string) (models.RegistrationPolicy, error) {
+	declared, policy, err := s.applicationPolicy(ctx, application)
+	if err != nil {
+		return models.RegistrationPolicy{}, err
+	}
+	if !declared && policy.RequireDeclaredApplications {
+		return models.RegistrationPolicy{}, UnprocessableEntityError(fmt.Errorf("application(name=%s) is not declared", application))
+	}
+
+	return policy, nil
+}
+
+func (s *RegistryService) applicationPolicy(ctx context.Context, application string) (bool, models.RegistrationPolicy, error) {
+	policy := s.Policy()
+	app, err := s.apps.Find(ctx, application)
+	if err == sql.ErrNoRows {
+		return false, policy, nil
+	} else if err != nil {
+		return false, models.RegistrationPolicy{}, httputil.InternalServerError(err)
+	}
+
+	return true, policy.WithApplication(app), nil
+}
+
+// conflictResolver applies the conflict policy of the incoming application to a
+// registration colliding with an existing service on the same location and port.
+func conflictResolver(policies map[string]models.RegistrationPolicy) repository.ConflictResolver {
+	return func(existing, incoming models.Service) error {
+		policy := policies[incoming.Application]
+		conflictPolicy := policy.ConflictPolicyFor(incoming.Application)
+
+		takeOver := conflictPolicy == models.ConflictTakeover ||
+			(conflictPolicy == models.ConflictTakeoverUnhealthy && !policy.Available(existing, time.Now()))
+		if !takeOver {
+			return fmt.Errorf("%s:%d is held by service(id=%s), policy=%s. %w", existing.Location, existing.Port, existing.ID, conflictPolicy, repository.ErrRegistrationConflict)
+		}
+
+		log.Info("registration took over location",
+			zap.String("location", existing.Location),
+			zap.Int("port", existing.Port),
+			zap.String("replacedId", existing.ID),
+			zap.String("id", incoming.ID),
+			zap.String("policy", string(conflictPolicy)))
+		return nil
+	}
+}
+
+// checkVersion checks that a service is at the expected version, a zero expectedVersion matches any version.
+func checkVersion(svc models.Service, expectedVersion int64) error {
+	if expectedVersion == 0 || svc.Version == expectedVersion {
+		return nil
+	}
+
+	err := fmt.Errorf("service(id=%s) is at version %d, expected %d. %w", svc.ID, svc.Version, expectedVersion, repository.ErrVersionConflict)
+	return PreconditionFailedError(err)
 }
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+)
+
+// TemplateExtension extension of the template files loaded from the templates directory.
+const TemplateExtension = ".tmpl"
+
+// nginxTemplate renders an upstream per application with healthy instances,
+// as nginx rejects upstreams without servers.
+const nginxTemplate = `# Generated by service-registry, do not edit.
+{{- range .Applications }}{{ $healthy := .Healthy }}{{ if $healthy }}
+
+upstream {{ identifier .Name }} {
+{{- range $healthy }}
+    server {{ .Address }};
+{{- end }}
+}
+{{- end }}{{ end }}
+`
+
+// haproxyTemplate renders a backend per application where instances that are
+// unhealthy or ejected as outliers are disabled.
+const haproxyTemplate = `# Generated by service-registry, do not edit.
+{{- range .Applications }}
+
+backend {{ identifier .Name }}
+    balance roundrobin
+{{- range .Instances }}
+    server {{ .ID }} {{ .Address }} check{{ if not .Healthy }} disabled{{ end }}
+{{- end }}
+{{- end }}
+`
+
+var nonIdentifierChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// templateFuncs functions available to templates in addition to the text/template builtins.
+var templateFuncs = template.FuncMap{
+	// identifier replaces characters not allowed in proxy identifiers with underscores.
+	"identifier": func(name string) string {
+		return nonIdentifierChars.ReplaceAllString(name, "_")
+	},
+}
+
+// RenderService renders config files from the current contents of the registry.
+type RenderService struct {
+	registry  *RegistryService
+	templates map[string]*template.Template
+}
+
+// NewRenderService sets up and creates a new render service with the built-in nginx and haproxy
+// templates and the *.tmpl templates found in dir, if set. A template file named after a built-in
+// template replaces it.
+func NewRenderService(registry *RegistryService, dir string) (*RenderService, error) {
+	s := &RenderService{
+		registry:  registry,
+		templates: make(map[string]*template.Template),
+	}
+
+	builtins := map[string]string{
+		"nginx":   nginxTemplate,
+		"haproxy": haproxyTemplate,
+	}
+	for name, text := range builtins {
+		err := s.addTemplate(name, text)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dir == "" {
+		return s, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+TemplateExtension))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list templates in %s. %w", dir, err)
+	}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read template %s. %w", file, err)
+		}
+
+		err = s.addTemplate(strings.TrimSuffix(filepath.Base(file), TemplateExtension), string(content))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *RenderService) addTemplate(name, text string) error {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return fmt.Errorf("failed to parse template %s. %w", name, err)
+	}
+
+	s.templates[name] = tmpl
+	return nil
+}
+
+// Render renders the named template from the services currently registered.
+func (s *RenderService) Render(ctx context.Context, name string) (string, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RenderService.Render")
+	defer span.Finish()
+
+	tmpl, ok := s.templates[name]
+	if !ok {
+		err := httputil.NotFoundError(fmt.Errorf("template %s does not exist", name))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return "", err
+	}
+
+	services, err := s.registry.FindAll(ctx, models.ServiceFilter{})
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return "", err
+	}
+
+	services, err = s.withoutExpired(ctx, services)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return "", err
+	}
+
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, models.NewRenderData(services))
+	if err != nil {
+		err = httputil.InternalServerError(fmt.Errorf("failed to render template %s. %w", name, err))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return "", err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return out.String(), nil
+}
+
+// withoutExpired leaves out the services that have not sent a heartbeat within
+// the instance TTL of their application, as discovery does.
+func (s *RenderService) withoutExpired(ctx context.Context, services []models.Service) ([]models.Service, error) {
+	policies := make(map[string]models.RegistrationPolicy)
+	now := time.Now()
+	live := make([]models.Service, 0, len(services))
+	for _, svc := range services {
+		policy, ok := policies[svc.Application]
+		if !ok {
+			var err error
+			policy, err = s.registry.ApplicationPolicy(ctx, svc.Application)
+			if err != nil {
+				return nil, err
+			}
+			policies[svc.Application] = policy
+		}
+
+		if !policy.Expired(svc, now) {
+			live = append(live, svc)
+		}
+	}
+
+	return live, nil
+}
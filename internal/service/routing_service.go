@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+	"go.uber.org/zap"
+)
+
+// RoutingService manages the rules splitting the traffic of applications between subsets of their instances.
+type RoutingService struct {
+	repo repository.RoutingRepository
+}
+
+// NewRoutingService sets up and creates a new routing service.
+func NewRoutingService(repo repository.RoutingRepository) *RoutingService {
+	return &RoutingService{
+		repo: repo,
+	}
+}
+
+// Find looks up the routing rules of an application.
+func (s *RoutingService) Find(ctx context.Context, application string) (models.RoutingRules, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RoutingService.Find")
+	defer span.Finish()
+
+	rules, err := s.repo.Find(ctx, application)
+	if err != nil {
+		err = routingError(application, err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.RoutingRules{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return rules, nil
+}
+
+// Save replaces the routing rules of an application.
+func (s *RoutingService) Save(ctx context.Context, rules models.RoutingRules) (models.RoutingRules, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RoutingService.Save")
+	defer span.Finish()
+
+	saved, err := s.save(ctx, rules)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.RoutingRules{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return saved, nil
+}
+
+// ShiftWeights changes the weights of subsets, keeping the rest of the rules, so that traffic
+// can be shifted gradually. Each shift can be undone with Rollback.
+func (s *RoutingService) ShiftWeights(ctx context.Context, application string, weights map[string]int) (models.RoutingRules, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RoutingService.ShiftWeights")
+	defer span.Finish()
+
+	rules, err := s.repo.Find(ctx, application)
+	if err != nil {
+		err = routingError(application, err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.RoutingRules{}, err
+	}
+
+	rules, err = rules.WithWeights(weights)
+	if err != nil {
+		err = httputil.BadRequestError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.RoutingRules{}, err
+	}
+
+	saved, err := s.save(ctx, rules)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.RoutingRules{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return saved, nil
+}
+
+// Rollback restores the routing rules in place before the last change.
+func (s *RoutingService) Rollback(ctx context.Context, application string) (models.RoutingRules, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RoutingService.Rollback")
+	defer span.Finish()
+
+	rules, err := s.repo.Rollback(ctx, application)
+	if err != nil {
+		err = routingError(application, err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.RoutingRules{}, err
+	}
+
+	log.Info("rolled back routing rules", zap.String("application", application), zap.Int64("revision", rules.Revision))
+	span.LogFields(tracelog.Bool("success", true))
+	return rules, nil
+}
+
+// Delete removes the routing rules of an application, sending its traffic to every instance.
+func (s *RoutingService) Delete(ctx context.Context, application string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RoutingService.Delete")
+	defer span.Finish()
+
+	err := s.repo.Delete(ctx, application)
+	if err != nil {
+		err = routingError(application, err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return nil
+}
+
+// Route picks the subset a request to an application is routed to. Returns
+// false if the application has no routing rules.
+func (s *RoutingService) Route(ctx context.Context, application string, req models.RouteRequest) (models.RouteSubset, bool, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "RoutingService.Route")
+	defer span.Finish()
+
+	rules, err := s.repo.Find(ctx, application)
+	if err == sql.ErrNoRows {
+		span.LogFields(tracelog.Bool("success", true))
+		return models.RouteSubset{}, false, nil
+	} else if err != nil {
+		err = httputil.InternalServerError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.RouteSubset{}, false, err
+	}
+
+	subset, ok := rules.Pick(req)
+	span.LogFields(tracelog.Bool("success", true))
+	return subset, ok, nil
+}
+
+func (s *RoutingService) save(ctx context.Context, rules models.RoutingRules) (models.RoutingRules, error) {
+	err := rules.Validate()
+	if err != nil {
+		return models.RoutingRules{}, httputil.BadRequestError(err)
+	}
+
+	saved, err := s.repo.Save(ctx, rules)
+	if err != nil {
+		return models.RoutingRules{}, routingError(rules.Application, err)
+	}
+
+	log.Info("saved routing rules", zap.Any("rules", saved))
+	return saved, nil
+}
+
+func routingError(application string, err error) error {
+	if err == sql.ErrNoRows {
+		return httputil.NotFoundError(fmt.Errorf("application(name=%s) has no routing rules", application))
+	} else if err == repository.ErrNoPreviousRoutes {
+		return httputil.ConflictError(fmt.Errorf("failed to roll back routing rules of application(name=%s). %w", application, err))
+	} else if errors.Is(err, repository.ErrVersionConflict) {
+		return httputil.ConflictError(fmt.Errorf("routing rules of application(name=%s) were changed concurrently. %w", application, err))
+	}
+
+	return httputil.InternalServerError(err)
+}
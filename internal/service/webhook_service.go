@@ -0,0 +1,428 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/CzarSimon/httputil"
+	"github.com/CzarSimon/httputil/id"
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/rtcheap/service-registry/internal/models"
+	"github.com/rtcheap/service-registry/internal/repository"
+	"go.uber.org/zap"
+)
+
+// maxDeliveryErrorLength longest response body or error stored with a failed delivery attempt.
+const maxDeliveryErrorLength = 500
+
+// WebhookService manages webhook subscriptions and delivers registry events to them.
+type WebhookService struct {
+	repo   repository.WebhookRepository
+	policy models.DeliveryPolicy
+	client *http.Client
+}
+
+// NewWebhookService sets up and creates a new webhook service. Events published by
+// the registry are queued for delivery to the webhooks subscribed to them.
+func NewWebhookService(repo repository.WebhookRepository, registry *RegistryService, policy models.DeliveryPolicy) *WebhookService {
+	s := &WebhookService{
+		repo:   repo,
+		policy: policy,
+		client: &http.Client{Timeout: policy.Timeout},
+	}
+	registry.OnEvent(s.queue)
+	return s
+}
+
+// Create subscribes a webhook to events. A secret is generated unless one is given.
+// The secret is only included in the created webhook.
+func (s *WebhookService) Create(ctx context.Context, webhook models.Webhook) (models.Webhook, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "WebhookService.Create")
+	defer span.Finish()
+
+	err := validateWebhook(webhook)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Webhook{}, err
+	}
+
+	if webhook.Secret == "" {
+		webhook.Secret, err = generateSecret()
+		if err != nil {
+			err = httputil.InternalServerError(err)
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			return models.Webhook{}, err
+		}
+	}
+
+	created, err := s.repo.Create(ctx, webhook)
+	if err != nil {
+		err = httputil.InternalServerError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Webhook{}, err
+	}
+
+	log.Info("created webhook", zap.String("id", created.ID), zap.String("url", created.URL))
+	span.LogFields(tracelog.Bool("success", true))
+	return created, nil
+}
+
+func validateWebhook(webhook models.Webhook) error {
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return httputil.BadRequestError(fmt.Errorf("url must be an absolute http or https url, got %q", webhook.URL))
+	}
+
+	for _, eventType := range webhook.EventTypes {
+		if !eventType.Valid() {
+			return httputil.BadRequestError(fmt.Errorf("invalid event type %s", eventType))
+		}
+	}
+
+	return nil
+}
+
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate webhook secret. %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Find looks up a webhook, without its secret.
+func (s *WebhookService) Find(ctx context.Context, id string) (models.Webhook, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "WebhookService.Find")
+	defer span.Finish()
+
+	webhook, err := s.repo.Find(ctx, id)
+	if err == sql.ErrNoRows {
+		err = httputil.NotFoundError(fmt.Errorf("webhook(id=%s) does not exist", id))
+	} else if err != nil {
+		err = httputil.InternalServerError(err)
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.Webhook{}, err
+	}
+
+	webhook.Secret = ""
+	span.LogFields(tracelog.Bool("success", true))
+	return webhook, nil
+}
+
+// FindAll lists the webhooks, without their secrets.
+func (s *WebhookService) FindAll(ctx context.Context) ([]models.Webhook, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "WebhookService.FindAll")
+	defer span.Finish()
+
+	webhooks, err := s.repo.FindAll(ctx)
+	if err != nil {
+		err = httputil.InternalServerError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return nil, err
+	}
+
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return webhooks, nil
+}
+
+// Delete unsubscribes a webhook and drops its queued deliveries.
+func (s *WebhookService) Delete(ctx context.Context, id string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "WebhookService.Delete")
+	defer span.Finish()
+
+	err := s.repo.Delete(ctx, id)
+	if err == sql.ErrNoRows {
+		err = httputil.NotFoundError(fmt.Errorf("webhook(id=%s) does not exist", id))
+	} else if err != nil {
+		err = httputil.InternalServerError(err)
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return err
+	}
+
+	log.Info("deleted webhook", zap.String("id", id))
+	span.LogFields(tracelog.Bool("success", true))
+	return nil
+}
+
+// FindDeliveries lists the latest deliveries of a webhook, optionally only those with the given status.
+func (s *WebhookService) FindDeliveries(ctx context.Context, webhookID string, status models.DeliveryStatus, limit int) ([]models.WebhookDelivery, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "WebhookService.FindDeliveries")
+	defer span.Finish()
+
+	if status != "" && !status.Valid() {
+		err := httputil.BadRequestError(fmt.Errorf("invalid delivery status %s", status))
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return nil, err
+	}
+
+	_, err := s.Find(ctx, webhookID)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return nil, err
+	}
+
+	deliveries, err := s.repo.FindDeliveries(ctx, webhookID, status, limit)
+	if err != nil {
+		err = httputil.InternalServerError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return nil, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return deliveries, nil
+}
+
+// Redeliver queues a dead-lettered delivery for a new round of attempts.
+func (s *WebhookService) Redeliver(ctx context.Context, webhookID, deliveryID string) (models.WebhookDelivery, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "WebhookService.Redeliver")
+	defer span.Finish()
+
+	delivery, err := s.repo.FindDelivery(ctx, deliveryID)
+	if err == sql.ErrNoRows || (err == nil && delivery.WebhookID != webhookID) {
+		err = httputil.NotFoundError(fmt.Errorf("delivery(id=%s) of webhook(id=%s) does not exist", deliveryID, webhookID))
+	} else if err == nil && delivery.Status != models.DeliveryDead {
+		err = httputil.ConflictError(fmt.Errorf("only dead-lettered deliveries can be redelivered, delivery(id=%s) is %s", deliveryID, delivery.Status))
+	} else if err != nil {
+		err = httputil.InternalServerError(err)
+	}
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.WebhookDelivery{}, err
+	}
+
+	delivery.Status = models.DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now()
+	updated, err := s.repo.UpdateDelivery(ctx, delivery)
+	if err != nil {
+		err = httputil.InternalServerError(err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return models.WebhookDelivery{}, err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return updated, nil
+}
+
+// Notify queues an alert that fired or was resolved for delivery to the webhooks subscribed to it.
+func (s *WebhookService) Notify(ctx context.Context, alert models.Alert) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "WebhookService.Notify")
+	defer span.Finish()
+
+	eventType := models.EventAlertFiring
+	if alert.State == models.AlertResolved {
+		eventType = models.EventAlertResolved
+	}
+
+	err := s.queue(ctx, models.Event{
+		ID:          id.New(),
+		Type:        eventType,
+		Application: alert.Rule.Application,
+		Alert:       &alert,
+		OccurredAt:  time.Now().UTC(),
+	})
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return nil
+}
+
+// queue queues an event for delivery to every webhook subscribed to it. Failures are
+// returned to the change that caused the event so that the client can retry it.
+func (s *WebhookService) queue(ctx context.Context, event models.Event) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "WebhookService.queue")
+	defer span.Finish()
+
+	webhooks, err := s.repo.FindAll(ctx)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return err
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		err = fmt.Errorf("failed to encode event(id=%s). %w", event.ID, err)
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return err
+	}
+
+	now := time.Now().UTC()
+	deliveries := make([]models.WebhookDelivery, 0)
+	for _, webhook := range webhooks {
+		if !webhook.Matches(event) {
+			continue
+		}
+
+		deliveries = append(deliveries, models.WebhookDelivery{
+			ID:            id.New(),
+			WebhookID:     webhook.ID,
+			EventID:       event.ID,
+			EventType:     event.Type,
+			Payload:       string(payload),
+			Status:        models.DeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		})
+	}
+	if len(deliveries) == 0 {
+		span.LogFields(tracelog.Bool("success", true))
+		return nil
+	}
+
+	err = s.repo.Enqueue(ctx, deliveries)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return err
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return nil
+}
+
+// Deliver attempts the deliveries that are due and returns how many of them succeeded.
+// Each delivery is claimed before it is attempted so that it is only sent by one of the
+// replicas sharing the database. Failed attempts are retried with exponential back-off
+// until the max attempts are used up, after which the delivery is dead-lettered.
+func (s *WebhookService) Deliver(ctx context.Context) (int, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "WebhookService.Deliver")
+	defer span.Finish()
+
+	due, err := s.repo.FindDue(ctx, time.Now(), s.policy.BatchSize)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return 0, err
+	}
+	if len(due) == 0 {
+		span.LogFields(tracelog.Bool("success", true))
+		return 0, nil
+	}
+
+	webhooks, err := s.repo.FindAll(ctx)
+	if err != nil {
+		span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+		return 0, err
+	}
+
+	byID := make(map[string]models.Webhook, len(webhooks))
+	for _, webhook := range webhooks {
+		byID[webhook.ID] = webhook
+	}
+
+	delivered := 0
+	for _, delivery := range due {
+		webhook, ok := byID[delivery.WebhookID]
+		if !ok {
+			continue
+		}
+
+		now := time.Now()
+		claimed, err := s.repo.Claim(ctx, delivery.ID, now, now.Add(s.policy.Lease()))
+		if err != nil {
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			return delivered, err
+		}
+		if !claimed {
+			continue
+		}
+
+		delivery = s.attempt(ctx, webhook, delivery)
+		_, err = s.repo.UpdateDelivery(ctx, delivery)
+		if err != nil {
+			span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+			return delivered, err
+		}
+		if delivery.Status == models.DeliveryDelivered {
+			delivered++
+		}
+	}
+
+	span.LogFields(tracelog.Bool("success", true))
+	return delivered, nil
+}
+
+func (s *WebhookService) attempt(ctx context.Context, webhook models.Webhook, delivery models.WebhookDelivery) models.WebhookDelivery {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "WebhookService.attempt")
+	defer span.Finish()
+
+	delivery.Attempts++
+	status, err := s.post(ctx, webhook, delivery)
+	delivery.ResponseStatus = status
+	if err == nil {
+		delivery.Status = models.DeliveryDelivered
+		delivery.LastError = ""
+		span.LogFields(tracelog.Bool("success", true))
+		return delivery
+	}
+
+	delivery.LastError = err.Error()
+	if len(delivery.LastError) > maxDeliveryErrorLength {
+		delivery.LastError = delivery.LastError[:maxDeliveryErrorLength]
+	}
+	if delivery.Attempts >= s.policy.MaxAttempts {
+		delivery.Status = models.DeliveryDead
+		log.Warn("dead-lettered webhook delivery",
+			zap.String("webhookId", webhook.ID),
+			zap.String("deliveryId", delivery.ID),
+			zap.Int("attempts", delivery.Attempts),
+			zap.Error(err))
+	} else {
+		delivery.NextAttemptAt = time.Now().Add(s.policy.Backoff(delivery.Attempts))
+	}
+
+	span.LogFields(tracelog.Bool("success", false), tracelog.Error(err))
+	return delivery
+}
+
+// post sends the payload of a delivery to the webhook, signed with its secret.
+// Responses other than 2xx count as failures.
+func (s *WebhookService) post(ctx context.Context, webhook models.Webhook, delivery models.WebhookDelivery) (int, error) {
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request. %w", err)
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(models.WebhookEventHeader, string(delivery.EventType))
+	req.Header.Set(models.WebhookDeliveryHeader, delivery.ID)
+	req.Header.Set(models.WebhookSignatureHeader, models.SignWebhookPayload(webhook.Secret, payload))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res.StatusCode, nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxDeliveryErrorLength))
+	return res.StatusCode, fmt.Errorf("unexpected response status %d: %s", res.StatusCode, body)
+}
@@ -0,0 +1,11 @@
+-- +migrate Up
+CREATE TABLE `routing_rule` (
+  `application` VARCHAR(100) NOT NULL,
+  `revision` BIGINT NOT NULL,
+  `rules` TEXT NOT NULL,
+  `previous_rules` TEXT,
+  `updated_at` DATETIME(6) NOT NULL,
+  PRIMARY KEY (`application`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+-- +migrate Down
+DROP TABLE IF EXISTS `routing_rule`;
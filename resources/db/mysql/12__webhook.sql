@@ -0,0 +1,32 @@
+-- +migrate Up
+CREATE TABLE `webhook` (
+  `id` VARCHAR(50) NOT NULL,
+  `url` VARCHAR(500) NOT NULL,
+  `secret` VARCHAR(200) NOT NULL,
+  `applications` TEXT NOT NULL,
+  `event_types` TEXT NOT NULL,
+  `created_at` DATETIME(6) NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+CREATE TABLE `webhook_delivery` (
+  `id` VARCHAR(50) NOT NULL,
+  `webhook_id` VARCHAR(50) NOT NULL,
+  `event_id` VARCHAR(50) NOT NULL,
+  `event_type` VARCHAR(50) NOT NULL,
+  `payload` TEXT NOT NULL,
+  `status` VARCHAR(20) NOT NULL,
+  `attempts` INT NOT NULL,
+  `next_attempt_at` DATETIME(6) NOT NULL,
+  `response_status` INT NOT NULL,
+  `last_error` TEXT NOT NULL,
+  `created_at` DATETIME(6) NOT NULL,
+  `updated_at` DATETIME(6) NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+CREATE INDEX `idx_webhook_delivery_status` ON `webhook_delivery`(`status`, `next_attempt_at`);
+CREATE INDEX `idx_webhook_delivery_webhook_id` ON `webhook_delivery`(`webhook_id`);
+-- +migrate Down
+DROP INDEX `idx_webhook_delivery_webhook_id` ON `webhook_delivery`;
+DROP INDEX `idx_webhook_delivery_status` ON `webhook_delivery`;
+DROP TABLE IF EXISTS `webhook_delivery`;
+DROP TABLE IF EXISTS `webhook`;
@@ -0,0 +1,27 @@
+-- +migrate Up
+CREATE TABLE `alert_rule` (
+  `id` VARCHAR(50) NOT NULL,
+  `name` VARCHAR(100) NOT NULL,
+  `application` VARCHAR(100) NOT NULL,
+  `condition_type` VARCHAR(50) NOT NULL,
+  `threshold` DOUBLE NOT NULL,
+  `for_seconds` INT NOT NULL,
+  `created_at` DATETIME(6) NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+CREATE INDEX `idx_alert_rule_application` ON `alert_rule`(`application`);
+CREATE TABLE `alert_state` (
+  `rule_id` VARCHAR(50) NOT NULL,
+  `state` VARCHAR(20) NOT NULL,
+  `value` DOUBLE,
+  `summary` TEXT NOT NULL,
+  `active_since` DATETIME(6),
+  `fired_at` DATETIME(6),
+  `resolved_at` DATETIME(6),
+  `evaluated_at` DATETIME(6) NOT NULL,
+  PRIMARY KEY (`rule_id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+-- +migrate Down
+DROP TABLE IF EXISTS `alert_state`;
+DROP INDEX `idx_alert_rule_application` ON `alert_rule`;
+DROP TABLE IF EXISTS `alert_rule`;
@@ -0,0 +1,4 @@
+-- +migrate Up
+ALTER TABLE `application` ADD COLUMN `proxy_enabled` BOOLEAN NOT NULL DEFAULT FALSE;
+-- +migrate Down
+ALTER TABLE `application` DROP COLUMN `proxy_enabled`;
@@ -0,0 +1,4 @@
+-- +migrate Up
+ALTER TABLE `service` ADD COLUMN `version` BIGINT NOT NULL DEFAULT 1;
+-- +migrate Down
+ALTER TABLE `service` DROP COLUMN `version`;
\ No newline at end of file
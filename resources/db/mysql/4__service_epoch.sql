@@ -0,0 +1,6 @@
+-- +migrate Up
+ALTER TABLE `service` ADD COLUMN `epoch` BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE `service` ADD COLUMN `heartbeat_at` DATETIME NULL;
+-- +migrate Down
+ALTER TABLE `service` DROP COLUMN `heartbeat_at`;
+ALTER TABLE `service` DROP COLUMN `epoch`;
\ No newline at end of file
@@ -0,0 +1,10 @@
+-- +migrate Up
+CREATE TABLE `service_label` (
+  `service_id` VARCHAR(50) NOT NULL,
+  `name` VARCHAR(100) NOT NULL,
+  `value` VARCHAR(255) NOT NULL,
+  PRIMARY KEY (`service_id`, `name`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+CREATE INDEX `idx_service_label_name_value` ON `service_label`(`name`, `value`);
+-- +migrate Down
+DROP TABLE IF EXISTS `service_label`;
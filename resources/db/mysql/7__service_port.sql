@@ -0,0 +1,11 @@
+-- +migrate Up
+CREATE TABLE `service_port` (
+  `service_id` VARCHAR(50) NOT NULL,
+  `name` VARCHAR(100) NOT NULL,
+  `port` INTEGER NOT NULL,
+  `end_port` INTEGER NOT NULL DEFAULT 0,
+  `protocol` VARCHAR(20) NOT NULL,
+  PRIMARY KEY (`service_id`, `name`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+-- +migrate Down
+DROP TABLE IF EXISTS `service_port`;
@@ -0,0 +1,14 @@
+-- +migrate Up
+CREATE TABLE `affinity_binding` (
+  `application` VARCHAR(100) NOT NULL,
+  `affinity_key` VARCHAR(200) NOT NULL,
+  `service_id` VARCHAR(50) NOT NULL,
+  `expires_at` DATETIME(6) NOT NULL,
+  `created_at` DATETIME(6) NOT NULL,
+  `updated_at` DATETIME(6) NOT NULL,
+  PRIMARY KEY (`application`, `affinity_key`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+CREATE INDEX `idx_affinity_binding_service_id` ON `affinity_binding`(`service_id`);
+CREATE INDEX `idx_affinity_binding_expires_at` ON `affinity_binding`(`expires_at`);
+-- +migrate Down
+DROP TABLE IF EXISTS `affinity_binding`;
@@ -0,0 +1,9 @@
+-- +migrate Up
+CREATE TABLE `service_locality` (
+  `service_id` VARCHAR(50) NOT NULL,
+  `region` VARCHAR(100) NOT NULL,
+  `zone` VARCHAR(100) NOT NULL,
+  PRIMARY KEY (`service_id`)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS `service_locality`;
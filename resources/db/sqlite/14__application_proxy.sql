@@ -0,0 +1,18 @@
+-- +migrate Up
+ALTER TABLE `application` ADD COLUMN `proxy_enabled` BOOLEAN NOT NULL DEFAULT 0;
+-- +migrate Down
+CREATE TABLE `application_backup` (
+  `name` VARCHAR(100) NOT NULL,
+  `description` TEXT,
+  `team` VARCHAR(100) NOT NULL,
+  `contact` VARCHAR(255) NOT NULL,
+  `min_healthy_instances` INTEGER NOT NULL DEFAULT 0,
+  `instance_ttl_seconds` INTEGER NOT NULL DEFAULT 0,
+  `conflict_policy` VARCHAR(50) NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `updated_at` DATETIME NOT NULL,
+  PRIMARY KEY (`name`)
+);
+INSERT INTO `application_backup` SELECT `name`, `description`, `team`, `contact`, `min_healthy_instances`, `instance_ttl_seconds`, `conflict_policy`, `created_at`, `updated_at` FROM `application`;
+DROP TABLE `application`;
+ALTER TABLE `application_backup` RENAME TO `application`;
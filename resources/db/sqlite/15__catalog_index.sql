@@ -0,0 +1,9 @@
+-- +migrate Up
+CREATE TABLE `catalog_index` (
+  `id` INTEGER NOT NULL,
+  `value` BIGINT NOT NULL,
+  PRIMARY KEY (`id`)
+);
+INSERT INTO `catalog_index`(`id`, `value`) VALUES (1, 1);
+-- +migrate Down
+DROP TABLE IF EXISTS `catalog_index`;
@@ -0,0 +1,27 @@
+-- +migrate Up
+CREATE TABLE `audit_log` (
+  `id` VARCHAR(50) NOT NULL,
+  `actor_id` VARCHAR(100) NOT NULL,
+  `actor_roles` VARCHAR(255) NOT NULL,
+  `source_ip` VARCHAR(50) NOT NULL,
+  `trace_id` VARCHAR(50) NOT NULL,
+  `action` VARCHAR(50) NOT NULL,
+  `application` VARCHAR(100) NOT NULL,
+  `service_id` VARCHAR(50) NOT NULL,
+  `before_state` TEXT,
+  `after_state` TEXT,
+  `outcome` VARCHAR(20) NOT NULL,
+  `error` TEXT,
+  `created_at` DATETIME NOT NULL,
+  PRIMARY KEY (`id`)
+);
+CREATE INDEX `idx_audit_log_created_at` ON `audit_log`(`created_at`);
+CREATE INDEX `idx_audit_log_actor_id` ON `audit_log`(`actor_id`);
+CREATE INDEX `idx_audit_log_application` ON `audit_log`(`application`);
+CREATE INDEX `idx_audit_log_service_id` ON `audit_log`(`service_id`);
+-- +migrate Down
+DROP INDEX IF EXISTS `idx_audit_log_service_id`;
+DROP INDEX IF EXISTS `idx_audit_log_application`;
+DROP INDEX IF EXISTS `idx_audit_log_actor_id`;
+DROP INDEX IF EXISTS `idx_audit_log_created_at`;
+DROP TABLE IF EXISTS `audit_log`;
\ No newline at end of file
@@ -0,0 +1,19 @@
+-- +migrate Up
+ALTER TABLE `service` ADD COLUMN `version` INTEGER NOT NULL DEFAULT 1;
+-- +migrate Down
+CREATE TABLE `service_backup` (
+  `id` VARCHAR(50) NOT NULL,
+  `application` VARCHAR(100) NOT NULL,
+  `location` VARCHAR(100) NOT NULL,
+  `port` INTEGER NOT NULL,
+  `status` VARCHAR(20) NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `updated_at` DATETIME NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE(`location`, `port`)
+);
+INSERT INTO `service_backup` SELECT `id`, `application`, `location`, `port`, `status`, `created_at`, `updated_at` FROM `service`;
+DROP INDEX IF EXISTS `idx_service_application`;
+DROP TABLE `service`;
+ALTER TABLE `service_backup` RENAME TO `service`;
+CREATE INDEX `idx_service_application` ON `service`(`application`);
\ No newline at end of file
@@ -0,0 +1,15 @@
+-- +migrate Up
+CREATE TABLE `application` (
+  `name` VARCHAR(100) NOT NULL,
+  `description` TEXT,
+  `team` VARCHAR(100) NOT NULL,
+  `contact` VARCHAR(255) NOT NULL,
+  `min_healthy_instances` INTEGER NOT NULL DEFAULT 0,
+  `instance_ttl_seconds` INTEGER NOT NULL DEFAULT 0,
+  `conflict_policy` VARCHAR(50) NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  `updated_at` DATETIME NOT NULL,
+  PRIMARY KEY (`name`)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS `application`;
@@ -0,0 +1,22 @@
+-- +migrate Up
+CREATE TABLE `service_capacity` (
+  `service_id` VARCHAR(50) NOT NULL,
+  `max_sessions` INTEGER NOT NULL,
+  `active_sessions` INTEGER NOT NULL,
+  `reserved_sessions` INTEGER NOT NULL DEFAULT 0,
+  `updated_at` DATETIME NOT NULL,
+  PRIMARY KEY (`service_id`)
+);
+CREATE TABLE `reservation` (
+  `id` VARCHAR(50) NOT NULL,
+  `application` VARCHAR(100) NOT NULL,
+  `service_id` VARCHAR(50) NOT NULL,
+  `expires_at` DATETIME NOT NULL,
+  `created_at` DATETIME NOT NULL,
+  PRIMARY KEY (`id`)
+);
+CREATE INDEX `idx_reservation_service_id` ON `reservation`(`service_id`);
+CREATE INDEX `idx_reservation_expires_at` ON `reservation`(`expires_at`);
+-- +migrate Down
+DROP TABLE IF EXISTS `reservation`;
+DROP TABLE IF EXISTS `service_capacity`;